@@ -62,6 +62,9 @@ const (
 	checksDir     = "checks"
 	checkStateDir = "checks/state"
 
+	// Path to save the servers retry join last joined, for retry_join_hints
+	retryJoinHintsDir = "retry_join"
+
 	// Default reasons for node/service maintenance mode
 	defaultNodeMaintReason = "Maintenance mode is enabled for this node, " +
 		"but no reason was provided. This is a default message."
@@ -205,6 +208,15 @@ type Agent struct {
 	// attempts.
 	retryJoinCh chan error
 
+	// retryJoinLANStatus and retryJoinWANStatus track the progress of the
+	// retry join so that it can be reported in the agent's stats.
+	retryJoinLANStatus *retryJoinStatus
+	retryJoinWANStatus *retryJoinStatus
+
+	// retryJoinSettings holds the retry join settings that can be reloaded
+	// while the retry join is running.
+	retryJoinSettings *retryJoinSettings
+
 	// endpoints maps unique RPC endpoint names to common ones
 	// to allow overriding of RPC handlers since the golang
 	// net/rpc server does not allow this.
@@ -260,23 +272,26 @@ func New(c *config.RuntimeConfig) (*Agent, error) {
 	}
 
 	a := &Agent{
-		config:          c,
-		checkReapAfter:  make(map[types.CheckID]time.Duration),
-		checkMonitors:   make(map[types.CheckID]*checks.CheckMonitor),
-		checkTTLs:       make(map[types.CheckID]*checks.CheckTTL),
-		checkHTTPs:      make(map[types.CheckID]*checks.CheckHTTP),
-		checkTCPs:       make(map[types.CheckID]*checks.CheckTCP),
-		checkGRPCs:      make(map[types.CheckID]*checks.CheckGRPC),
-		checkDockers:    make(map[types.CheckID]*checks.CheckDocker),
-		checkAliases:    make(map[types.CheckID]*checks.CheckAlias),
-		eventCh:         make(chan serf.UserEvent, 1024),
-		eventBuf:        make([]*UserEvent, 256),
-		joinLANNotifier: &systemd.Notifier{},
-		reloadCh:        make(chan chan error),
-		retryJoinCh:     make(chan error),
-		shutdownCh:      make(chan struct{}),
-		endpoints:       make(map[string]string),
-		tokens:          new(token.Store),
+		config:             c,
+		checkReapAfter:     make(map[types.CheckID]time.Duration),
+		checkMonitors:      make(map[types.CheckID]*checks.CheckMonitor),
+		checkTTLs:          make(map[types.CheckID]*checks.CheckTTL),
+		checkHTTPs:         make(map[types.CheckID]*checks.CheckHTTP),
+		checkTCPs:          make(map[types.CheckID]*checks.CheckTCP),
+		checkGRPCs:         make(map[types.CheckID]*checks.CheckGRPC),
+		checkDockers:       make(map[types.CheckID]*checks.CheckDocker),
+		checkAliases:       make(map[types.CheckID]*checks.CheckAlias),
+		eventCh:            make(chan serf.UserEvent, 1024),
+		eventBuf:           make([]*UserEvent, 256),
+		joinLANNotifier:    &systemd.Notifier{},
+		reloadCh:           make(chan chan error),
+		retryJoinCh:        make(chan error),
+		retryJoinLANStatus: &retryJoinStatus{},
+		retryJoinWANStatus: &retryJoinStatus{},
+		retryJoinSettings:  newRetryJoinSettings(c),
+		shutdownCh:         make(chan struct{}),
+		endpoints:          make(map[string]string),
+		tokens:             new(token.Store),
 	}
 
 	if err := a.initializeACLs(); err != nil {
@@ -505,8 +520,9 @@ func (a *Agent) Start() error {
 	}
 
 	// start retry join
-	go a.retryJoinLAN()
-	go a.retryJoinWAN()
+	budget := newRetryJoinBudget(a.config.RetryJoinMaxAttemptsTotal)
+	go a.retryJoinLAN(budget)
+	go a.retryJoinWAN(budget)
 
 	return nil
 }
@@ -2839,6 +2855,17 @@ func (a *Agent) Stats() map[string]map[string]string {
 		"version":    a.config.Version,
 		"prerelease": a.config.VersionPrerelease,
 	}
+
+	retryJoin := make(map[string]string)
+	if len(a.config.RetryJoinLAN) > 0 {
+		a.retryJoinLANStatus.snapshot().addStats(retryJoin, "lan")
+	}
+	if len(a.config.RetryJoinWAN) > 0 {
+		a.retryJoinWANStatus.snapshot().addStats(retryJoin, "wan")
+	}
+	if len(retryJoin) > 0 {
+		stats["retry_join"] = retryJoin
+	}
 	return stats
 }
 
@@ -3374,6 +3401,7 @@ func (a *Agent) ReloadConfig(newCfg *config.RuntimeConfig) error {
 	}
 
 	a.loadLimits(newCfg)
+	a.retryJoinSettings.update(newCfg)
 
 	// create the config for the rpc server/client
 	consulCfg, err := a.consulConfig()
@@ -3405,6 +3433,9 @@ func (a *Agent) registerCache() {
 
 	a.cache.RegisterType(cachetype.ConnectCARootName, &cachetype.ConnectCARoot{
 		RPC: a,
+
+		// Roots rarely change, so block for as long as the servers allow.
+		QueryTime: 10 * time.Minute,
 	}, &cache.RegisterOptions{
 		// Maintain a blocking query, retry dropped connections quickly
 		Refresh:        true,
@@ -3413,8 +3444,12 @@ func (a *Agent) registerCache() {
 	})
 
 	a.cache.RegisterType(cachetype.ConnectCALeafName, &cachetype.ConnectCALeaf{
-		RPC:   a,
-		Cache: a.cache,
+		RPC:    a,
+		Cache:  a.cache,
+		Logger: a.logger,
+
+		// Checking tokens costs an RPC per blocked watch, so it's opt-in.
+		TokenCheckInterval: a.config.ConnectLeafTokenCheckInterval,
 	}, &cache.RegisterOptions{
 		// Maintain a blocking query, retry dropped connections quickly
 		Refresh:        true,
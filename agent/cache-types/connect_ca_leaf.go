@@ -1,206 +1,2006 @@
 package cachetype
 
 import (
+	"context"
+	"crypto"
+	"crypto/hmac"
+	"crypto/rand"
 	"crypto/sha256"
+	"crypto/x509/pkix"
 	"errors"
 	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/url"
+	"sort"
+	"strings"
 	"sync"
-	"sync/atomic"
 	"time"
 
+	"github.com/armon/go-metrics"
+	"github.com/hashicorp/consul/acl"
 	"github.com/hashicorp/consul/agent/cache"
 	"github.com/hashicorp/consul/agent/connect"
 	"github.com/hashicorp/consul/agent/structs"
+	"github.com/hashicorp/go-multierror"
+	"github.com/mitchellh/hashstructure"
+	"golang.org/x/time/rate"
 )
 
 // Recommended name for registration.
 const ConnectCALeafName = "connect-ca-leaf"
 
+// minForceExpireDelay is the least time a Fetch waits before renewing a leaf
+// whose forced renewal time passed before it started.
+const minForceExpireDelay = 1 * time.Second
+
+// defaultMaxConcurrentGenerations is the number of leaves that are generated
+// at once if ConnectCALeaf.MaxConcurrentGenerations isn't set.
+const defaultMaxConcurrentGenerations = 64
+
+// errRootsNotPopulated is returned by rootsFromCache when the roots cache
+// entry exists but hasn't been populated by the servers yet. This is
+// transient so callers should wait for a roots update rather than treat it
+// as the CA being absent.
+var errRootsNotPopulated = errors.New("CA roots not yet populated in cache")
+
+// errLeafClosed is returned from Fetch once the ConnectCALeaf has been closed.
+var errLeafClosed = errors.New("connect-ca-leaf: closed")
+
+// errSignBreakerOpen is returned when a leaf needs signing but recent signs
+// have failed enough to open the sign breaker.
+var errSignBreakerOpen = errors.New("connect-ca-leaf: too many recent sign failures, not signing until cooldown ends")
+
+// subscribeFetchTimeout is how long each Fetch made for a Subscribe blocks
+// for a renewal before starting another.
+const subscribeFetchTimeout = 10 * time.Minute
+
+// subscribeMaxRetryWait is the longest a Subscribe waits to retry after
+// failed Fetches.
+const subscribeMaxRetryWait = time.Minute
+
+// errLeafDraining is returned from Fetch when a new leaf is needed but the
+// ConnectCALeaf is draining.
+var errLeafDraining = errors.New("connect-ca-leaf: draining, not signing new leaves")
+
+// clock abstracts the passing of time for Fetch.
+type clock interface {
+	Now() time.Time
+	After(d time.Duration) <-chan time.Time
+}
+
+// realClock is the clock implementation backed by the time package.
+type realClock struct{}
+
+func (realClock) Now() time.Time                         { return time.Now() }
+func (realClock) After(d time.Duration) <-chan time.Time { return time.After(d) }
+
 // ConnectCALeaf supports fetching and generating Connect leaf
 // certificates.
 type ConnectCALeaf struct {
-	caIndex uint64 // Current index for CA roots
+	// caIndexes is the index of the latest CA roots seen for each
+	// datacenter. Indexes from different datacenters' servers aren't
+	// comparable, so each is tracked separately.
+	caIndexLock sync.Mutex
+	caIndexes   map[string]uint64
+
+	issuedCertsLock sync.RWMutex
+	issuedCerts     map[string]*fetchState
+
+	// closeCh is closed when Close is called so that blocking Fetches return.
+	// It's created lazily since the zero value of ConnectCALeaf is usable.
+	// draining is set by Drain and shares the lock.
+	closeLock sync.Mutex
+	closed    bool
+	closeCh   chan struct{}
+	draining  bool
+
+	// activeRoots tracks the active root last seen for each datacenter so
+	// that genuine rotations can be told apart from other roots updates.
+	activeRootsLock sync.Mutex
+	activeRoots     map[string]*activeRootState
+
+	// pokedRoots holds the roots PokeRoots last read from the servers for
+	// each datacenter, which are used in place of older cached roots until
+	// the cache catches up. pokeCh is closed and replaced by each poke that
+	// finds newer roots to wake blocked Fetches.
+	pokeLock   sync.Mutex
+	pokedRoots map[string]*structs.IndexedCARoots
+	pokeCh     chan struct{}
+
+	// generateSlots bounds how many leaves are generated at once. It's
+	// created lazily with MaxConcurrentGenerations slots.
+	generateSlotsLock sync.Mutex
+	generateSlots     chan struct{}
+
+	// signLatency is the exponentially weighted moving average of recent
+	// ConnectCA.Sign RPC latencies, or zero before the first sign.
+	signLatencyLock sync.Mutex
+	signLatency     time.Duration
+
+	// signFailures counts consecutive sign failures for SignBreakerThreshold.
+	// Signs fail fast until signBreakerOpenUntil once it's reached, then a
+	// single trial sign decides whether the breaker closes or opens again.
+	signBreakerLock      sync.Mutex
+	signFailures         int
+	signBreakerOpenUntil time.Time
+	signBreakerTrial     bool
+
+	// clock is used for all Fetch timing so tests can control it. If nil,
+	// the real clock is used.
+	clock clock
+
+	RPC   RPC         // RPC client for remote requests
+	Cache RootsSource // Source of CA root certs, usually the agent's cache
+
+	// Logger is optionally used to log issued certs that are rejected as
+	// suspicious, such as ones for the wrong trust domain.
+	Logger *log.Logger
+
+	// SignLimiter optionally limits how quickly this agent requests new
+	// leaf certs from the servers. If nil, signs are not limited.
+	SignLimiter *rate.Limiter
+
+	// RotationLimiter optionally paces the renewals triggered by a CA
+	// rotation so that an agent with many leaves doesn't renew them all at
+	// once. Each leaf reserves a slot when it sees the rotation and keeps
+	// serving its current cert until that slot comes up. If nil, leaves are
+	// renewed as soon as the rotation is seen.
+	RotationLimiter *rate.Limiter
+
+	// RotationAgeWeighted scales each leaf's RotationLimiter delay by the
+	// share of its cert's lifetime that is left, so that leaves closer to
+	// expiry renew sooner after a CA rotation. This trades some of the
+	// limiter's pacing for renewing the most urgent leaves first.
+	RotationAgeWeighted bool
+
+	// OnNewLeaf is optionally called with each newly signed cert, including
+	// its PrivateKeyPEM, before it is cached. This lets the key be mirrored
+	// to an external store as part of issuing it. The PrivateKeyPEM is empty
+	// if the request supplied its own CSR. If it returns an error the cert is
+	// discarded and the error is returned from Fetch.
+	OnNewLeaf func(req *ConnectCALeafRequest, cert *structs.IssuedCert) error
+
+	// OnRootChange is optionally called with the roots each time the active
+	// root of a datacenter is seen to change, e.g. to mirror it into an
+	// external trust store. It isn't called for the first roots seen or for
+	// updates that keep the same active root. The roots are shared with the
+	// cache and must not be modified.
+	OnRootChange func(datacenter string, roots *structs.IndexedCARoots)
+
+	// FederatedTrustDomains is the set of trust domains other than the local
+	// cluster's that leaves may be requested under using
+	// ConnectCALeafRequest.TrustDomainOverride.
+	FederatedTrustDomains []string
+
+	// TokenCheckInterval, if non-zero, is how often a blocked Fetch checks
+	// that the request's ACL token still exists. This surfaces a revoked
+	// token as a permission denied error promptly rather than only when the
+	// leaf next needs renewing, which may be hours later.
+	TokenCheckInterval time.Duration
+
+	// RootChangeCooldown is the minimum time after a leaf is renewed for a
+	// CA roots change before another roots change renews it again, unless
+	// the new active root was created after the one the leaf was signed
+	// under. Changes seen during the cooldown are batched into one renewal
+	// when it ends. This damps renewal storms from roots that flap between
+	// two active roots. If zero, every roots change renews the leaf.
+	RootChangeCooldown time.Duration
+
+	// MaxConcurrentGenerations bounds how many leaves this agent generates
+	// at once, which protects the node when many leaves rotate together.
+	// Generations beyond it wait for a slot until the Fetch times out. This
+	// is separate from SignLimiter, which paces the requests to the servers.
+	// If zero, defaultMaxConcurrentGenerations is used.
+	MaxConcurrentGenerations int
+
+	// AdaptiveTimeout extends how long a Fetch may spend generating a leaf
+	// beyond its timeout by a multiple of the recent sign latency, up to
+	// doubling it, so that generations aren't abandoned while the servers
+	// are slow. Fetches that don't need to generate still return at their
+	// timeout.
+	AdaptiveTimeout bool
+
+	// MaxKeyAge, if non-zero, is the longest a leaf's private key is used
+	// for. Once it's reached the leaf is renewed with a new key wherever its
+	// cert is in its renewal window, e.g. to rotate keys on a compliance
+	// schedule shorter than the cert lifetime. It doesn't apply to leaves
+	// signed from a supplied CSR, whose keys the caller manages.
+	MaxKeyAge time.Duration
+
+	// MinAcceptableTTL, if non-zero, is the shortest lifetime an issued leaf
+	// may have. Shorter leaves, e.g. from a misconfigured server CA, are
+	// rejected rather than cached, since they'd be renewed almost
+	// continuously and load the servers.
+	MinAcceptableTTL time.Duration
+
+	// SignBreakerThreshold, if non-zero, is the number of consecutive failed
+	// signs after which signing stops for SignBreakerCooldown, so that an
+	// unhealthy cluster isn't loaded further by every leaf retrying. While
+	// it's open, generating fails straight away and the cache keeps serving
+	// the current certs. After the cooldown one sign is tried and the
+	// breaker closes if it succeeds or opens again if not. Permission denied
+	// errors count as the servers answering rather than as failures.
+	SignBreakerThreshold int
+	SignBreakerCooldown  time.Duration
+
+	// LocalSigner, if set, signs leaves with its own development CA rather
+	// than asking the servers, so Connect can be tried out without a
+	// cluster. Its roots are used in place of the cached CA roots. This is
+	// for development and testing only: the leaves aren't trusted by
+	// anything outside this agent.
+	LocalSigner *LocalSigner
+
+	// EmergencyGrace, if non-zero, is how long after a leaf expires Fetch
+	// keeps returning it, marked Expired, while it can't be renewed, e.g.
+	// during a total server outage. It's for workloads where an expired cert
+	// is better than none and is off by default. Permission denied errors
+	// are still returned.
+	EmergencyGrace time.Duration
+
+	// SpiffeIDFormatter optionally builds the SPIFFE ID requested for each
+	// leaf from the Consul one, e.g. to match the path layout a federated
+	// SPIRE deployment expects. If nil, the Consul format
+	// spiffe://<trust domain>/ns/<namespace>/dc/<datacenter>/svc/<service>
+	// is used. The CA signing the leaves must accept the formatted IDs,
+	// which Consul's servers only do for the Consul format.
+	SpiffeIDFormatter func(id *connect.SpiffeIDService) *url.URL
+
+	// DefaultNamespace is the namespace leaves are requested under, for
+	// installations that have renamed the default namespace. It must be a
+	// single path segment. If empty, "default" is used.
+	DefaultNamespace string
+
+	// ServeFutureLeaves serves a renewed leaf straight away even if its
+	// cert isn't valid yet, e.g. because it was signed with a future
+	// NotBefore or by a server whose clock is ahead. By default the
+	// current cert keeps being served until the renewed one is valid.
+	ServeFutureLeaves bool
+
+	// OneShot is for callers such as CLI tools that fetch a leaf once and
+	// exit. Fetch doesn't watch the CA roots and returns as soon as it has
+	// a valid cert, even for a blocking Fetch, so nothing is left running
+	// in the background. Leaves aren't renewed on roots changes.
+	OneShot bool
+}
+
+const (
+	// signLatencyWeight is the weight of each new sample in the sign
+	// latency moving average.
+	signLatencyWeight = 0.2
+
+	// adaptiveTimeoutFactor is the multiple of the sign latency that
+	// AdaptiveTimeout extends the generation timeout by.
+	adaptiveTimeoutFactor = 3
+)
+
+// RootsSource is where ConnectCALeaf gets the CA roots from. A *cache.Cache
+// with ConnectCARoot registered is one, and tools that don't run a cache can
+// supply their own, e.g. one that polls the servers directly.
+//
+// Get is called with ConnectCARootName and a *structs.DCSpecificRequest and
+// returns a *structs.IndexedCARoots, or nil if it has none yet. If the
+// request's MinQueryIndex is set, Get blocks until it has roots with a higher
+// index or MaxQueryTime passes, and then returns the latest roots it has.
+//
+// FetchBatch also calls Get with ConnectCALeafName and a *ConnectCALeafRequest
+// so that batched leaves fill the same cache as other callers, so a
+// *cache.Cache must have the ConnectCALeaf registered too for it.
+type RootsSource interface {
+	Get(t string, r cache.Request) (interface{}, cache.ResultMeta, error)
+}
+
+// activeRootState is the active root last seen for a datacenter.
+type activeRootState struct {
+	// id is the active root's ID and index is that of the roots it was in.
+	id    string
+	index uint64
+
+	// changedAt is when the active root was last seen to change, or zero if
+	// it hasn't changed since it was first seen.
+	changedAt time.Time
+}
+
+// fetchState is the agent-local state kept for each issued leaf.
+type fetchState struct {
+	// cert is the most recently issued cert.
+	cert *structs.IssuedCert
+
+	// forceExpireAfter, if non-zero, is a time before the cert's soft expiry
+	// at which it must be renewed anyway, e.g. because of a CA rotation.
+	forceExpireAfter time.Time
+
+	// rootsIndex is the index of the CA roots the cert was generated under.
+	// Fetches for this leaf wait for roots newer than this rather than the
+	// datacenter's latest index, which other leaves may have advanced past
+	// roots this leaf hasn't been renewed for yet.
+	rootsIndex uint64
+
+	// invalidatedCh is closed when the leaf is invalidated so that blocked
+	// Fetches for it regenerate straight away.
+	invalidatedCh chan struct{}
+
+	// activeRootIndex is the CreateIndex of the active root when the cert
+	// was generated, if the roots said which it was.
+	activeRootIndex uint64
+
+	// rootRenewedAt is when the cert was generated if that was because of a
+	// CA roots change, for RootChangeCooldown.
+	rootRenewedAt time.Time
+
+	// keyCreatedAt is when the cert's private key was generated, for
+	// MaxKeyAge. It's zero if the request supplied its own CSR.
+	keyCreatedAt time.Time
+
+	// req is the request the cert was generated for, without its token, and
+	// signingKeyID is the ID of the key that signed the cert, if it could be
+	// parsed. They're kept for Leaves.
+	req          *ConnectCALeafRequest
+	signingKeyID string
+
+	// next is a renewed leaf whose cert isn't valid yet. It replaces this
+	// state at its switchAt, until which cert is still served.
+	next *fetchState
+}
+
+// switchAt returns when the state's next leaf replaces it: once its cert is
+// valid, or when the current cert expires if that's sooner.
+func (s *fetchState) switchAt() time.Time {
+	at := s.next.cert.ValidAfter
+	if s.cert.ValidBefore.Before(at) {
+		at = s.cert.ValidBefore
+	}
+	return at
+}
+
+// switchLeaf replaces the state of the leaf with the given key with its next
+// leaf if that is due by now, and returns the leaf's state. issuedCertsLock
+// must be held.
+func (c *ConnectCALeaf) switchLeaf(issuedKey string, now time.Time) *fetchState {
+	state := c.issuedCerts[issuedKey]
+	if state != nil && state.next != nil && !now.Before(state.switchAt()) {
+		state = state.next
+		c.issuedCerts[issuedKey] = state
+	}
+	return state
+}
+
+// issuedKey returns the issuedCerts cache key for a given service and token. We
+// use a hash rather than concatenating strings to provide resilience against
+// user input containing our separator - both service name and token ID can be
+// freely manipulated by user so may contain any delimiter we choose. It also
+// has the benefit of not leaking the ACL token to a new place in memory it
+// might get accidentally dumped etc.
+//
+// The two are separated by a NUL, which can't appear in a request's Key, so
+// that no service and token can be split differently to collide.
+func issuedKey(service, token string) string {
+	hash := sha256.New()
+	hash.Write([]byte(service))
+	hash.Write([]byte{0})
+	hash.Write([]byte(token))
+	return fmt.Sprintf("%x", hash.Sum(nil))
+}
+
+// Fetch returns the leaf certificate for the requested service and token,
+// generating one if there's no valid cert yet. A Fetch with a zero MinIndex,
+// or a one-shot Fetch, returns a valid cached cert straight away. Otherwise
+// it blocks until the cert needs renewing, because it's nearing expiry, the
+// CA roots changed or it was invalidated, and then returns a newly generated
+// cert. It also returns early when a renewed leaf it was holding back becomes
+// valid, and with an empty result and no error once opts.Timeout passes. If
+// the type is closed it returns errLeafClosed, and if opts.Context is done
+// while it's blocked it returns the context's error.
+func (c *ConnectCALeaf) Fetch(opts cache.FetchOptions, req cache.Request) (cache.FetchResult, error) {
+	var result cache.FetchResult
+	stopCtx := opts.Context
+	if stopCtx == nil {
+		stopCtx = context.Background()
+	}
+
+	// Get the correct type
+	reqReal, ok := req.(*ConnectCALeafRequest)
+	if !ok {
+		return result, fmt.Errorf(
+			"Internal cache failure: request wrong type: %T", req)
+	}
+
+	closeCh, closed := c.closeState()
+	if closed {
+		return result, errLeafClosed
+	}
+
+	// Get the poke channel before the current cert so that a poke for roots
+	// newer than those it was signed under can't be missed.
+	pokeCh := c.rootsPokedCh()
+
+	// This context watches our overall timeout, which generating may
+	// extend with AdaptiveTimeout. The other goroutines launched in this
+	// function should end all around the same time so they clean themselves
+	// up.
+	ctx, cancel := context.WithTimeout(stopCtx, c.generateTimeout(opts.Timeout))
+	defer cancel()
+	clk := c.getClock()
+	deadline := clk.Now().Add(opts.Timeout)
+
+	// Generate a cache key to lookup/store the cert. We MUST generate a new cert
+	// per token used to ensure revocation by ACL token is robust.
+	issuedKey := issuedKey(reqReal.Key(), reqReal.Token)
+
+	// Get our prior cert (if we had one) and use that to determine our
+	// expiration time. If no cert exists, we expire immediately since we
+	// need to generate.
+	var lastCert *structs.IssuedCert
+	var forceExpireAfter time.Time
+	var rootsIndex uint64
+	var invalidatedCh chan struct{}
+	var activeRootIndex uint64
+	var rootRenewedAt time.Time
+	var switchAt time.Time
+	var switched bool
+	c.issuedCertsLock.Lock()
+	if state := c.issuedCerts[issuedKey]; state != nil {
+		// Switch to a renewed leaf that has become valid since the last
+		// Fetch, which is then returned straight away.
+		if next := c.switchLeaf(issuedKey, clk.Now()); next != state {
+			state, switched = next, true
+		}
+
+		// A renewal time that has already passed means an earlier Fetch
+		// woke for it but didn't replace the leaf, e.g. because generating
+		// failed or timed out. Put it off a little rather than letting each
+		// Fetch renew straight away.
+		if now := clk.Now(); !state.forceExpireAfter.IsZero() && !state.forceExpireAfter.After(now) {
+			state.forceExpireAfter = now.Add(minForceExpireDelay)
+		}
+
+		lastCert = state.cert
+		forceExpireAfter = c.renewBy(state)
+		rootsIndex = state.rootsIndex
+		invalidatedCh = state.invalidatedCh
+		activeRootIndex = state.activeRootIndex
+		rootRenewedAt = state.rootRenewedAt
+		if state.next != nil {
+			switchAt = state.switchAt()
+		}
+	}
+	c.issuedCertsLock.Unlock()
+
+	// Kick off the goroutine that waits for new CA roots. The channel buffer
+	// is so that the goroutine doesn't block forever if we return for other
+	// reasons. The first wait is for roots newer than the ones the current
+	// cert was generated under, so a rotation that happened since is seen
+	// straight away. Once woken, later waits are for roots newer than those
+	// already seen.
+	var newRootCACh chan error
+	var watchIndex uint64
+	watchRoots := func(minIndex uint64) {
+		if c.LocalSigner != nil || c.OneShot {
+			// The local roots never change and one-shot Fetches don't
+			// wait for them to, so leave the channels nil.
+			pokeCh = nil
+			return
+		}
+		watchIndex = minIndex
+		newRootCACh = make(chan error, 1)
+		go c.waitNewRootCA(reqReal.Datacenter, newRootCACh, opts.Timeout, minIndex)
+	}
+	if lastCert != nil && rootsIndex > 0 {
+		watchRoots(rootsIndex)
+	} else {
+		watchRoots(c.loadCAIndex(reqReal.Datacenter))
+	}
+
+	// Work out when we next need to wake up. If there's no valid cert then
+	// that's straight away since we need to generate one.
+	sched := &leafRenewalScheduler{
+		cert:             lastCert,
+		forceExpireAfter: forceExpireAfter,
+		switchAt:         switchAt,
+		deadline:         deadline,
+	}
+	now := clk.Now()
+	wakeAt, reason := sched.next(now)
+
+	// We should not depend on the cache package de-duplicating requests for
+	// the same service/token (which is all we care about keying our local
+	// issued cert cache on) since it might later make sense to partition
+	// clients for other reasons too. So if the request has a 0 MinIndex, and
+	// the cached cert is still valid, then the client is expecting an
+	// immediate response and hasn't already seen the cached cert, return it
+	// now. One-shot Fetches never block on a valid cert, and nor do Fetches
+	// that just switched to a renewed leaf, which the client hasn't seen.
+	if reason != leafWakeNoCert && (opts.MinIndex == 0 || c.OneShot || switched) {
+		result.Value = lastCert
+		result.Index = lastCert.ModifyIndex
+		result.TTLRemaining = lastCert.ValidBefore.Sub(now)
+		return result, nil
+	}
+	wakeCh := clk.After(wakeAt.Sub(now))
+
+	// The anonymous token can't be revoked so there's nothing to check.
+	var tokenCheckCh <-chan time.Time
+	if c.TokenCheckInterval > 0 && reqReal.Token != "" {
+		tokenCheckCh = clk.After(c.TokenCheckInterval)
+	}
+
+	// Block on the events that wake us up. rootChange records whether the
+	// renewal, if any, is because of a roots change.
+	rootChange := false
+WAIT:
+	for {
+		select {
+		case <-closeCh:
+			return result, errLeafClosed
+
+		case <-stopCtx.Done():
+			return result, stopCtx.Err()
+
+		case <-pokeCh:
+			// PokeRoots found newer roots than the cache has given us so
+			// far. Handle them like any other roots change, leaving the
+			// watcher to finish on its own.
+			pokeCh = c.rootsPokedCh()
+			if c.loadCAIndex(reqReal.Datacenter) > watchIndex {
+				newRootCACh = make(chan error, 1)
+				newRootCACh <- nil
+			}
+
+		case err := <-newRootCACh:
+			// A new root CA triggers us to refresh the leaf certificate.
+			// If there was an error while getting the root CA then we return.
+			// Otherwise, we leave the select statement and move to generation.
+			if err != nil {
+				return result, err
+			}
+
+			// If the request pinned a root that is still trusted then this
+			// rotation shouldn't renew the leaf yet. Wait for the next roots
+			// change, which may be the pinned root finally being removed.
+			if lastCert != nil && reqReal.PreferRootID != "" {
+				pinned, err := c.rootPresent(reqReal.Datacenter, reqReal.PreferRootID)
+				if err != nil {
+					return result, err
+				}
+				if pinned {
+					watchRoots(c.loadCAIndex(reqReal.Datacenter))
+					continue
+				}
+			}
+
+			// If rotations are paced, wait for this leaf's turn while
+			// continuing to serve the current cert.
+			var delay time.Duration
+			if lastCert != nil && c.RotationLimiter != nil {
+				delay = c.scheduleRotation(issuedKey, reqReal.MaxCAChangeJitter)
+			}
+			now := clk.Now()
+
+			// Within the cooldown after the last renewal for a roots change,
+			// put this one off until the cooldown ends unless there's a
+			// genuinely new active root.
+			if cooldown := rootRenewedAt.Add(c.RootChangeCooldown).Sub(now); lastCert != nil &&
+				!rootRenewedAt.IsZero() && cooldown > delay {
+				newer, err := c.activeRootNewer(reqReal.Datacenter, activeRootIndex)
+				if err != nil {
+					return result, err
+				}
+				if !newer {
+					delay = cooldown
+				}
+			}
+
+			rootChange = true
+			if wakeAt, reason = sched.rootChanged(now, delay); reason == leafWakeRootChange {
+				break WAIT
+			}
+			wakeCh = clk.After(wakeAt.Sub(now))
+			watchRoots(c.loadCAIndex(reqReal.Datacenter))
+
+		case <-wakeCh:
+			// On a timeout, we just return the empty result and no error.
+			// It isn't an error to timeout, its just the limit of time the
+			// caching system wants us to block for. By returning an empty result
+			// the caching system will ignore.
+			if reason == leafWakeTimeout {
+				return result, nil
+			}
+
+			// A renewed leaf is due to replace the current one. If it's
+			// gone, e.g. because the leaf was invalidated, renew again.
+			if reason == leafWakeSwitch {
+				c.issuedCertsLock.Lock()
+				state := c.switchLeaf(issuedKey, clk.Now())
+				c.issuedCertsLock.Unlock()
+				if state != nil && state.cert.ModifyIndex > lastCert.ModifyIndex {
+					result.Value = state.cert
+					result.Index = state.cert.ModifyIndex
+					result.TTLRemaining = state.cert.ValidBefore.Sub(clk.Now())
+					return result, nil
+				}
+			}
+
+			// Otherwise the existing leaf certificate is expiring soon or
+			// its rotation slot came up, so we generate a new cert with a
+			// healthy overlapping validity period.
+			break WAIT
+
+		case <-invalidatedCh:
+			// The leaf was dropped by Invalidate so replace it now.
+			break WAIT
+
+		case <-tokenCheckCh:
+			revoked, err := c.tokenRevoked(reqReal)
+			if revoked {
+				// Drop the leaf so it isn't served to later Fetches either.
+				c.Invalidate(reqReal)
+				return result, acl.PermissionDeniedError{
+					Cause: fmt.Sprintf("token for service %q was revoked", reqReal.Service),
+				}
+			}
+
+			// Only transient errors are retried at the next check. Others,
+			// like ACLs being disabled or servers without the endpoint, would
+			// fail the same way every time.
+			tokenCheckCh = nil
+			if err == nil || tokenCheckRetryable(err) {
+				tokenCheckCh = clk.After(c.TokenCheckInterval)
+			}
+		}
+	}
+
+	// While draining, don't sign a leaf that is likely to be abandoned. The
+	// caller already has the current cert if it's still valid, so hold on to
+	// it until the Fetch times out like any other blocking query.
+	if c.isDraining() {
+		if lastCert == nil || !lastCert.ValidBefore.After(clk.Now()) {
+			return result, errLeafDraining
+		}
+		select {
+		case <-closeCh:
+			return result, errLeafClosed
+		case <-stopCtx.Done():
+			return result, stopCtx.Err()
+		case <-clk.After(deadline.Sub(clk.Now())):
+			return result, nil
+		}
+	}
+
+	if reqReal.GenerateDeadline > 0 {
+		var cancelGenerate context.CancelFunc
+		ctx, cancelGenerate = context.WithTimeout(ctx, reqReal.GenerateDeadline)
+		defer cancelGenerate()
+	}
+	result, err := c.generateNewLeaf(ctx, reqReal, rootChange && reason != leafWakeSoftExpiry)
+	if lastCert != nil && (err != nil || result.Value == nil) {
+		// The cache keeps serving the current cert.
+		reportOverdue(clk.Now(), reqReal, lastCert)
+	}
+	if err != nil && lastCert != nil && c.withinEmergencyGrace(clk.Now(), lastCert) &&
+		!acl.IsErrPermissionDenied(err) {
+		metrics.IncrCounter([]string{"consul", "connect", "leaf", "emergency_grace"}, 1)
+		expired := *lastCert
+		expired.Expired = true
+		result.Value = &expired
+		result.Index = lastCert.ModifyIndex
+		return result, nil
+	}
+	return result, err
+}
+
+// withinEmergencyGrace returns true if the cert has expired but by less than
+// EmergencyGrace.
+func (c *ConnectCALeaf) withinEmergencyGrace(now time.Time, cert *structs.IssuedCert) bool {
+	return c.EmergencyGrace > 0 && !cert.ValidBefore.After(now) &&
+		now.Before(cert.ValidBefore.Add(c.EmergencyGrace))
+}
+
+// reportOverdue emits metrics if the cert the cache is left serving after a
+// renewal failed is past its soft expiry but not yet expired, so operators
+// can see renewals failing before leaves expire.
+func reportOverdue(now time.Time, req *ConnectCALeafRequest, cert *structs.IssuedCert) {
+	softExpiry, _ := calculateSoftExpiry(now, cert)
+	if !now.After(softExpiry) || !now.Before(cert.ValidBefore) {
+		return
+	}
+	metrics.IncrCounter([]string{"consul", "connect", "leaf", "overdue"}, 1)
+	metrics.SetGaugeWithLabels([]string{"consul", "connect", "leaf", "overdue_seconds"},
+		float32(now.Sub(softExpiry).Seconds()),
+		[]metrics.Label{{Name: "service", Value: req.Service}})
+}
+
+// leafWakeReason is why a Fetch blocked on a leaf wakes up.
+type leafWakeReason int
+
+const (
+	// leafWakeTimeout means the Fetch timed out without needing a renewal.
+	leafWakeTimeout leafWakeReason = iota
+
+	// leafWakeNoCert means there is no valid cert so one must be generated
+	// straight away.
+	leafWakeNoCert
+
+	// leafWakeSoftExpiry means the cert is close enough to expiring that it
+	// should be renewed.
+	leafWakeSoftExpiry
+
+	// leafWakeForceExpiry means the cert must be renewed ahead of its soft
+	// expiry, e.g. when its paced CA rotation slot comes up.
+	leafWakeForceExpiry
+
+	// leafWakeRootChange means the CA roots changed and the cert should be
+	// renewed now.
+	leafWakeRootChange
+
+	// leafWakeSwitch means a renewed cert that wasn't valid yet is due to
+	// replace the current one.
+	leafWakeSwitch
+)
+
+// leafRenewalScheduler works out when a Fetch blocked on a leaf next needs to
+// wake up and why. It only does the timing so it can be tested without RPCs
+// or a cache. Fetch drives it with the clock and the CA root changes it sees.
+type leafRenewalScheduler struct {
+	// cert is the current cert, or nil if there isn't one yet.
+	cert *structs.IssuedCert
+
+	// forceExpireAfter, if non-zero, is a time before the cert's soft expiry
+	// at which it must be renewed anyway.
+	forceExpireAfter time.Time
+
+	// switchAt, if non-zero, is when a renewed cert that isn't valid yet
+	// replaces cert. No renewal is due before then.
+	switchAt time.Time
+
+	// deadline is when the Fetch times out.
+	deadline time.Time
+}
+
+// next returns when to wake up next and why, as of now.
+func (s *leafRenewalScheduler) next(now time.Time) (time.Time, leafWakeReason) {
+	if s.cert == nil {
+		return now, leafWakeNoCert
+	}
+	if !s.switchAt.IsZero() {
+		if s.deadline.Before(s.switchAt) {
+			return s.deadline, leafWakeTimeout
+		}
+		return s.switchAt, leafWakeSwitch
+	}
+	softExpiry, hardRenewTime := calculateSoftExpiry(now, s.cert)
+	if !hardRenewTime.After(now) {
+		return now, leafWakeNoCert
+	}
+
+	at, reason := softExpiry, leafWakeSoftExpiry
+	if !s.forceExpireAfter.IsZero() && s.forceExpireAfter.Before(at) {
+		at, reason = s.forceExpireAfter, leafWakeForceExpiry
+	}
+	if s.deadline.Before(at) {
+		at, reason = s.deadline, leafWakeTimeout
+	}
+	return at, reason
+}
+
+// rootChanged returns when to wake up next and why after seeing the CA roots
+// change at now. If delay is positive the renewal is put off until then, e.g.
+// for the leaf's turn on the RotationLimiter. Otherwise the cert should be
+// renewed straight away.
+func (s *leafRenewalScheduler) rootChanged(now time.Time, delay time.Duration) (time.Time, leafWakeReason) {
+	if delay <= 0 {
+		return now, leafWakeRootChange
+	}
+	if at := now.Add(delay); s.forceExpireAfter.IsZero() || at.Before(s.forceExpireAfter) {
+		s.forceExpireAfter = at
+	}
+	return s.next(now)
+}
+
+// scheduleRotation reserves a slot from the RotationLimiter for renewing the
+// leaf with the given key and records it as the leaf's forceExpireAfter. It
+// returns how long until the leaf should be renewed, which is capped at
+// maxDelay if that is non-zero. If the leaf already has a pending renewal
+// scheduled, that is kept rather than reserving another slot.
+func (c *ConnectCALeaf) scheduleRotation(issuedKey string, maxDelay time.Duration) time.Duration {
+	now := c.getClock().Now()
+
+	c.issuedCertsLock.Lock()
+	defer c.issuedCertsLock.Unlock()
+	state := c.issuedCerts[issuedKey]
+	if state == nil {
+		return 0
+	}
+	if !state.forceExpireAfter.IsZero() {
+		return state.forceExpireAfter.Sub(now)
+	}
+
+	delay := c.RotationLimiter.Reserve().Delay()
+	if c.RotationAgeWeighted && state.cert != nil {
+		delay = ageWeightedDelay(now, state.cert, delay)
+	}
+	if maxDelay > 0 && delay > maxDelay {
+		delay = maxDelay
+	}
+	state.forceExpireAfter = now.Add(delay)
+	return delay
+}
+
+// ageWeightedDelay scales the rotation delay by the share of the cert's
+// lifetime remaining at now, so a cert half way through its lifetime waits
+// half as long. Certs without a known lifetime keep the full delay.
+func ageWeightedDelay(now time.Time, cert *structs.IssuedCert, delay time.Duration) time.Duration {
+	if cert.ValidAfter.IsZero() {
+		return delay
+	}
+	lifetime := cert.ValidBefore.Sub(cert.ValidAfter)
+	remaining := cert.ValidBefore.Sub(now)
+	switch {
+	case lifetime <= 0 || remaining >= lifetime:
+		return delay
+	case remaining <= 0:
+		return 0
+	}
+	return time.Duration(float64(delay) * float64(remaining) / float64(lifetime))
+}
+
+// renewBy returns the time before the cert's soft expiry at which the leaf
+// must be renewed, either for a pending forced renewal or because its key
+// reaches MaxKeyAge, whichever is first. It's zero if there is neither.
+func (c *ConnectCALeaf) renewBy(state *fetchState) time.Time {
+	at := state.forceExpireAfter
+	if c.MaxKeyAge <= 0 || state.keyCreatedAt.IsZero() {
+		return at
+	}
+	if keyExpiry := state.keyCreatedAt.Add(c.MaxKeyAge); at.IsZero() || keyExpiry.Before(at) {
+		at = keyExpiry
+	}
+	return at
+}
+
+// calculateSoftExpiry returns the time at which the given cert should be
+// renewed so that the new cert has a healthy overlapping validity period,
+// and hardRenewTime, from which the cert is no longer served at all and a
+// Fetch renews it before returning. The soft expiry is never after
+// hardRenewTime.
+func calculateSoftExpiry(now time.Time, cert *structs.IssuedCert) (softExpiry, hardRenewTime time.Time) {
+	hardRenewTime = cert.ValidBefore
+
+	// TODO(mitchellh): 1 hour buffer is hardcoded here
+	softExpiry = cert.ValidBefore.Add(-1 * time.Hour)
+
+	// Don't renew a cert before it becomes valid, e.g. one requested with a
+	// future NotBefore that is valid for less than the buffer.
+	if softExpiry.Before(cert.ValidAfter) {
+		softExpiry = cert.ValidAfter
+	}
+	if softExpiry.After(hardRenewTime) {
+		softExpiry = hardRenewTime
+	}
+	return softExpiry, hardRenewTime
+}
+
+// getClock returns the clock to use for Fetch timing.
+func (c *ConnectCALeaf) getClock() clock {
+	if c.clock == nil {
+		return realClock{}
+	}
+	return c.clock
+}
+
+// Close stops the ConnectCALeaf. Any Fetches blocked waiting for a root
+// change or renewal return with an error, as do all further Fetches. Close is
+// safe to call multiple times.
+func (c *ConnectCALeaf) Close() error {
+	c.closeLock.Lock()
+	defer c.closeLock.Unlock()
+	if c.closed {
+		return nil
+	}
+	if c.closeCh == nil {
+		c.closeCh = make(chan struct{})
+	}
+	close(c.closeCh)
+	c.closed = true
+	return nil
+}
+
+// Peek returns the leaf currently cached for the given request, along with
+// when it is next due to be renewed, without blocking or generating one. The
+// renewal time accounts for any pending CA rotation but not for roots
+// changes that no Fetch has seen yet. If no leaf is cached, ok is false.
+func (c *ConnectCALeaf) Peek(req *ConnectCALeafRequest) (cert *structs.IssuedCert, renewAt time.Time, ok bool) {
+	var sched leafRenewalScheduler
+	c.issuedCertsLock.RLock()
+	if state := c.issuedCerts[issuedKey(req.Key(), req.Token)]; state != nil {
+		sched.cert = state.cert
+		sched.forceExpireAfter = c.renewBy(state)
+		if state.next != nil {
+			sched.switchAt = state.switchAt()
+		}
+	}
+	c.issuedCertsLock.RUnlock()
+	if sched.cert == nil {
+		return nil, time.Time{}, false
+	}
+
+	sched.deadline = sched.cert.ValidBefore
+	renewAt, _ = sched.next(c.getClock().Now())
+	return sched.cert, renewAt, true
+}
+
+// The reasons RenewalReason reports for a leaf's next renewal.
+const (
+	// LeafRenewalExpiry means the leaf will be renewed as its cert nears
+	// expiry.
+	LeafRenewalExpiry = "expiry"
+
+	// LeafRenewalRotation means the leaf will be renewed early because of
+	// a CA rotation.
+	LeafRenewalRotation = "rotation"
+
+	// LeafRenewalKeyAge means the leaf will be renewed early because its
+	// key reaches MaxKeyAge.
+	LeafRenewalKeyAge = "key-age"
+)
+
+// RenewalReason returns why the leaf cached for the given request will next
+// be renewed, as one of the LeafRenewal values, e.g. for dashboards that
+// tell rotations apart from routine renewals. Like Peek, it doesn't account
+// for roots changes that no Fetch has seen yet. If no leaf is cached, ok is
+// false.
+func (c *ConnectCALeaf) RenewalReason(req *ConnectCALeafRequest) (reason string, ok bool) {
+	c.issuedCertsLock.RLock()
+	defer c.issuedCertsLock.RUnlock()
+	state := c.issuedCerts[issuedKey(req.Key(), req.Token)]
+	if state == nil {
+		return "", false
+	}
+	_, reason = c.nextRenewal(c.getClock().Now(), state)
+	return reason, true
+}
+
+// nextRenewal returns when the leaf with the given state will next be renewed
+// as of now and why, as one of the LeafRenewal values.
+func (c *ConnectCALeaf) nextRenewal(now time.Time, state *fetchState) (time.Time, string) {
+	sched := leafRenewalScheduler{
+		cert:             state.cert,
+		forceExpireAfter: c.renewBy(state),
+		deadline:         state.cert.ValidBefore,
+	}
+	if state.next != nil {
+		sched.switchAt = state.switchAt()
+	}
+	at, wake := sched.next(now)
+	if wake != leafWakeForceExpiry {
+		return at, LeafRenewalExpiry
+	}
+
+	// Only roots changes set forceExpireAfter, so if it's what sets the
+	// renewal time the renewal is for a rotation.
+	if !state.forceExpireAfter.IsZero() && state.forceExpireAfter.Equal(sched.forceExpireAfter) {
+		return at, LeafRenewalRotation
+	}
+	return at, LeafRenewalKeyAge
+}
+
+// tokenRevoked returns true if the request's ACL token no longer exists.
+func (c *ConnectCALeaf) tokenRevoked(req *ConnectCALeafRequest) (bool, error) {
+	args := structs.ACLTokenGetRequest{
+		Datacenter:   req.Datacenter,
+		TokenID:      req.Token,
+		TokenIDType:  structs.ACLTokenSecret,
+		QueryOptions: structs.QueryOptions{Token: req.Token},
+	}
+	var reply structs.ACLTokenResponse
+	if err := c.RPC.RPC("ACL.TokenRead", &args, &reply); err != nil {
+		return false, err
+	}
+	return reply.Token == nil, nil
+}
+
+// tokenCheckRetryable returns true if a token check failed for a reason that
+// is expected to pass, such as the servers having no leader or a lost
+// connection, so that it's worth checking again later.
+func tokenCheckRetryable(err error) bool {
+	if _, ok := err.(net.Error); ok || err == io.EOF || err == io.ErrUnexpectedEOF {
+		return true
+	}
+	msg := err.Error()
+	for _, transient := range []error{
+		structs.ErrNoLeader,
+		structs.ErrNoServers,
+		structs.ErrNoDCPath,
+		structs.ErrNotReadyForConsistentReads,
+		structs.ErrRPCRateExceeded,
+	} {
+		if strings.Contains(msg, transient.Error()) {
+			return true
+		}
+	}
+	return false
+}
+
+// CachedLeaf describes a leaf held by ConnectCALeaf.
+type CachedLeaf struct {
+	// Request is the request the leaf was generated for. Its Token is
+	// always empty so that listing leaves doesn't expose tokens.
+	Request *ConnectCALeafRequest
+
+	// ValidBefore is when the leaf expires.
+	ValidBefore time.Time
+
+	// SigningKeyID is the ID of the key that signed the leaf, in the same
+	// form as CARoot.SigningKeyID. It's empty if the leaf couldn't be parsed.
+	SigningKeyID string
+}
+
+// Leaves returns the leaves currently held, e.g. for an inventory of the
+// services using Connect on this agent. There is one for each service and
+// token combination that a leaf has been generated for, sorted by service.
+// Expired leaves are included until they're renewed or invalidated.
+func (c *ConnectCALeaf) Leaves() []CachedLeaf {
+	c.issuedCertsLock.RLock()
+	defer c.issuedCertsLock.RUnlock()
+
+	leaves := make([]CachedLeaf, 0, len(c.issuedCerts))
+	for _, state := range c.issuedCerts {
+		leaves = append(leaves, CachedLeaf{
+			Request:      state.request(),
+			ValidBefore:  state.cert.ValidBefore,
+			SigningKeyID: state.signingKeyID,
+		})
+	}
+	sort.Slice(leaves, func(i, j int) bool {
+		return leafRequestLess(leaves[i].Request, leaves[j].Request)
+	})
+	return leaves
+}
+
+// LeafDebugInfo is the renewal schedule of a leaf held by ConnectCALeaf.
+type LeafDebugInfo struct {
+	// Request is the request the leaf was generated for, without its Token.
+	Request *ConnectCALeafRequest
+
+	// SerialNumber, ValidAfter and ValidBefore are those of the cert.
+	SerialNumber string
+	ValidAfter   time.Time
+	ValidBefore  time.Time
+
+	// SigningKeyID is the ID of the key that signed the leaf, or empty if
+	// the leaf couldn't be parsed.
+	SigningKeyID string
+
+	// RenewAt is when the leaf will next be renewed and RenewalReason is
+	// why, as one of the LeafRenewal values.
+	RenewAt       time.Time
+	RenewalReason string
+
+	// ForceExpireAfter is when a pending CA rotation renews the leaf, or
+	// zero if none is pending.
+	ForceExpireAfter time.Time
+
+	// RootsIndex is the index of the CA roots the leaf was generated
+	// under and KeyCreatedAt is when its key was generated, or zero if the
+	// request supplied its own CSR.
+	RootsIndex   uint64
+	KeyCreatedAt time.Time
+}
+
+// DebugDump returns the renewal schedule of every leaf currently held, sorted
+// like Leaves, e.g. for support bundles when diagnosing rotation issues. It
+// can be serialized as JSON and never contains tokens or private keys. Like
+// Peek, it doesn't account for roots changes that no Fetch has seen yet.
+func (c *ConnectCALeaf) DebugDump() []LeafDebugInfo {
+	now := c.getClock().Now()
+	c.issuedCertsLock.RLock()
+	defer c.issuedCertsLock.RUnlock()
+
+	dump := make([]LeafDebugInfo, 0, len(c.issuedCerts))
+	for _, state := range c.issuedCerts {
+		renewAt, reason := c.nextRenewal(now, state)
+		dump = append(dump, LeafDebugInfo{
+			Request:          state.request(),
+			SerialNumber:     state.cert.SerialNumber,
+			ValidAfter:       state.cert.ValidAfter,
+			ValidBefore:      state.cert.ValidBefore,
+			SigningKeyID:     state.signingKeyID,
+			RenewAt:          renewAt,
+			RenewalReason:    reason,
+			ForceExpireAfter: state.forceExpireAfter,
+			RootsIndex:       state.rootsIndex,
+			KeyCreatedAt:     state.keyCreatedAt,
+		})
+	}
+	sort.Slice(dump, func(i, j int) bool {
+		return leafRequestLess(dump[i].Request, dump[j].Request)
+	})
+	return dump
+}
+
+// request returns a copy of the request the state's leaf was generated for,
+// which callers can keep and modify.
+func (s *fetchState) request() *ConnectCALeafRequest {
+	req := *s.req
+	req.AdditionalSpiffeIDs = append([]string(nil), s.req.AdditionalSpiffeIDs...)
+	return &req
+}
+
+// leafRequestLess orders requests by service and then key.
+func leafRequestLess(a, b *ConnectCALeafRequest) bool {
+	if a.Service != b.Service {
+		return a.Service < b.Service
+	}
+	return a.Key() < b.Key()
+}
+
+// Invalidate drops the leaf cached for the given request so that the next
+// Fetch for it generates a new one. Fetches already blocked on the leaf,
+// such as the cache's background refresh, regenerate straight away. It's a
+// no-op if no leaf has been issued for the request.
+func (c *ConnectCALeaf) Invalidate(req *ConnectCALeafRequest) {
+	c.issuedCertsLock.Lock()
+	defer c.issuedCertsLock.Unlock()
+	issuedKey := issuedKey(req.Key(), req.Token)
+	if state := c.issuedCerts[issuedKey]; state != nil {
+		delete(c.issuedCerts, issuedKey)
+		close(state.invalidatedCh)
+	}
+}
+
+// Warm generates leaves for the given requests that don't already have a
+// valid one so that they're cached before their first Fetch, e.g. to avoid
+// a latency spike when many sidecars start at once. The leaves are generated
+// one at a time under SignLimiter until the context is done. A failure for
+// one request doesn't stop the others and the errors are returned together.
+func (c *ConnectCALeaf) Warm(ctx context.Context, reqs []*ConnectCALeafRequest) error {
+	var merr *multierror.Error
+	for _, req := range reqs {
+		if _, closed := c.closeState(); closed {
+			return multierror.Append(merr, errLeafClosed)
+		}
+		if c.isDraining() {
+			return multierror.Append(merr, errLeafDraining)
+		}
+		if ctx.Err() != nil {
+			return multierror.Append(merr, fmt.Errorf("warming leaf certs: %s", ctx.Err()))
+		}
+
+		if cert, _, ok := c.Peek(req); ok && cert.ValidBefore.After(c.getClock().Now()) {
+			continue
+		}
+		result, err := c.generateNewLeaf(ctx, req, false)
+		if err == nil && result.Value == nil {
+			// generateNewLeaf gives up quietly if the context ends while
+			// it waits for the CA.
+			err = fmt.Errorf("timed out waiting for CA roots: %s", ctx.Err())
+		}
+		if err != nil {
+			merr = multierror.Append(merr, fmt.Errorf("service %q: %s", req.Service, err))
+		}
+	}
+	return merr.ErrorOrNil()
+}
+
+// ConnectCALeafBatchRequest is the request for FetchBatch, for a workload
+// that exposes several services and wants all their leaves at once.
+type ConnectCALeafBatchRequest struct {
+	Token      string
+	Datacenter string
+	Services   []string
+}
+
+// FetchBatch returns a valid leaf for each of the services in the request,
+// generating those that aren't already cached. The CA roots are checked once
+// up front so that a batch fails fast if they can't be had, though each
+// generation still reads them from Cache. The leaves are got through Cache as
+// ConnectCALeafName, so that they fill the same cache entries as any other
+// caller, with at most MaxConcurrentGenerations in flight at once. A failure
+// for one service doesn't stop the others and is returned in errs under its
+// name. Each service waits at most timeout for its leaf.
+func (c *ConnectCALeaf) FetchBatch(timeout time.Duration, req *ConnectCALeafBatchRequest) (
+	certs map[string]*structs.IssuedCert, errs map[string]error) {
+	certs = make(map[string]*structs.IssuedCert)
+	errs = make(map[string]error)
+
+	// If the roots can't be had, every service would fail the same way.
+	if _, err := c.rootsFromCache(req.Datacenter); err != nil && !caPending(nil, err) {
+		for _, service := range req.Services {
+			errs[service] = err
+		}
+		return certs, errs
+	}
+
+	var services []string
+	seen := make(map[string]bool)
+	for _, service := range req.Services {
+		if !seen[service] {
+			seen[service] = true
+			services = append(services, service)
+		}
+	}
+
+	workers := c.MaxConcurrentGenerations
+	if workers <= 0 {
+		workers = defaultMaxConcurrentGenerations
+	}
+	if workers > len(services) {
+		workers = len(services)
+	}
+	serviceCh := make(chan string)
+	var lock sync.Mutex
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for service := range serviceCh {
+				raw, _, err := c.Cache.Get(ConnectCALeafName, &ConnectCALeafRequest{
+					Token:        req.Token,
+					Datacenter:   req.Datacenter,
+					Service:      service,
+					MaxQueryTime: timeout,
+				})
+				cert, ok := raw.(*structs.IssuedCert)
+				if err == nil && !ok {
+					err = fmt.Errorf("timed out fetching leaf cert")
+				}
+
+				lock.Lock()
+				if err != nil {
+					errs[service] = err
+				} else {
+					certs[service] = cert
+				}
+				lock.Unlock()
+			}
+		}()
+	}
+	for _, service := range services {
+		serviceCh <- service
+	}
+	close(serviceCh)
+	wg.Wait()
+	return certs, errs
+}
+
+// Subscribe returns a channel that's sent the request's leaf straight away
+// and then each renewed leaf, whether renewed for its age or a CA rotation,
+// for callers that want leaves pushed to them rather than running their own
+// blocking Fetch loop. It's driven by Fetch, so renewals happen as they
+// would for the cache. Failed Fetches are retried with a growing wait and
+// logged if there's a Logger. The channel is closed once the context is
+// done or the ConnectCALeaf is closed. Nothing is fetched while a leaf is
+// waiting to be received, so a slow receiver skips leaves renewed meanwhile.
+func (c *ConnectCALeaf) Subscribe(ctx context.Context, req *ConnectCALeafRequest) (<-chan *structs.IssuedCert, error) {
+	if _, closed := c.closeState(); closed {
+		return nil, errLeafClosed
+	}
+	ch := make(chan *structs.IssuedCert)
+	reqCopy := *req
+	go c.subscribe(ctx, &reqCopy, ch)
+	return ch, nil
+}
+
+// subscribe runs the Fetch loop of a Subscribe, sending each new leaf on ch.
+func (c *ConnectCALeaf) subscribe(ctx context.Context, req *ConnectCALeafRequest, ch chan<- *structs.IssuedCert) {
+	defer close(ch)
+
+	var index uint64
+	failures := 0
+	for {
+		// The Fetch returns early once the context is done, so that it
+		// doesn't go on to renew the leaf for nobody.
+		result, err := c.Fetch(cache.FetchOptions{
+			MinIndex: index,
+			Timeout:  subscribeFetchTimeout,
+			Context:  ctx,
+		}, req)
+		if ctx.Err() != nil || err == errLeafClosed {
+			return
+		}
+		if err != nil {
+			failures++
+			wait := time.Duration(failures) * time.Second
+			if wait > subscribeMaxRetryWait {
+				wait = subscribeMaxRetryWait
+			}
+			if c.Logger != nil {
+				c.Logger.Printf("[WARN] connect: leaf subscription for service %q failed, retrying in %s: %s",
+					req.Service, wait, err)
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case <-c.getClock().After(wait):
+			}
+			continue
+		}
+		failures = 0
+
+		// A Fetch that timed out has no leaf, and one kept on after a
+		// failed renewal has the same index.
+		cert, ok := result.Value.(*structs.IssuedCert)
+		if !ok || cert == nil || result.Index <= index {
+			continue
+		}
+		index = result.Index
+		select {
+		case <-ctx.Done():
+			return
+		case ch <- cert:
+		}
+	}
+}
+
+// Drain stops the ConnectCALeaf from signing new leaves, e.g. while the agent
+// is shutting down. Fetches keep serving leaves that are still valid, but
+// return an error if a new one would be needed. Like Close, it can't be
+// undone.
+func (c *ConnectCALeaf) Drain() {
+	c.closeLock.Lock()
+	defer c.closeLock.Unlock()
+	c.draining = true
+}
+
+// isDraining returns true once Drain has been called.
+func (c *ConnectCALeaf) isDraining() bool {
+	c.closeLock.Lock()
+	defer c.closeLock.Unlock()
+	return c.draining
+}
+
+// closeState returns the channel closed by Close and whether Close has
+// already been called.
+func (c *ConnectCALeaf) closeState() (<-chan struct{}, bool) {
+	c.closeLock.Lock()
+	defer c.closeLock.Unlock()
+	if c.closeCh == nil {
+		c.closeCh = make(chan struct{})
+	}
+	return c.closeCh, c.closed
+}
+
+// generateNewLeaf does the actual work of creating a new private key,
+// generating a CSR and getting it signed by the servers. The result is
+// stored in the issued certs map and returned, unless it isn't valid yet and
+// is held back until it is, in which case the current cert is returned.
+// Generated is only set when the returned cert is the newly signed one. The
+// context bounds how long we'll wait for roots to be populated or on the
+// client-side sign limiter.
+// rootChange is true if the leaf is being renewed because of a roots change.
+func (c *ConnectCALeaf) generateNewLeaf(ctx context.Context,
+	req *ConnectCALeafRequest, rootChange bool) (cache.FetchResult, error) {
+	var result cache.FetchResult
+
+	// Need to lookup RootCAs response to discover trust domain. This should
+	// be a cache hit most of the time, but on a cold cache, or while the
+	// servers are still bootstrapping the CA, we wait for roots with a trust
+	// domain to arrive.
+	roots, err := c.rootsFromCache(req.Datacenter)
+	if caPending(roots, err) {
+		metrics.IncrCounter([]string{"consul", "connect", "leaf", "ca_bootstrap_wait"}, 1)
+		clk := c.getClock()
+		start := clk.Now()
+		measureWait := func() {
+			metrics.AddSample([]string{"consul", "connect", "leaf", "ca_bootstrap_wait_ms"},
+				float32(clk.Now().Sub(start))/float32(time.Millisecond))
+		}
+		for caPending(roots, err) {
+			var timeout time.Duration
+			var timeoutCh <-chan time.Time
+			if deadline, ok := ctx.Deadline(); ok {
+				timeout = deadline.Sub(clk.Now())
+				timeoutCh = clk.After(timeout)
+			}
+			newRootCACh := make(chan error, 1)
+			go c.waitNewRootCA(req.Datacenter, newRootCACh, timeout,
+				c.loadCAIndex(req.Datacenter))
+			select {
+			case <-ctx.Done():
+				// Same as any other timeout, the cache will retry.
+				measureWait()
+				return result, nil
+			case <-timeoutCh:
+				measureWait()
+				return result, nil
+			case err := <-newRootCACh:
+				if err != nil {
+					return result, err
+				}
+			}
+			roots, err = c.rootsFromCache(req.Datacenter)
+		}
+		measureWait()
+	}
+	if err != nil {
+		return result, err
+	}
+
+	trustDomain := roots.TrustDomain
+	if req.TrustDomainOverride != "" && req.TrustDomainOverride != trustDomain {
+		if !c.knownTrustDomain(req.TrustDomainOverride) {
+			return result, fmt.Errorf("unknown trust domain %q", req.TrustDomainOverride)
+		}
+		trustDomain = req.TrustDomainOverride
+	}
+
+	if req.BundleFormat != "" && req.BundleFormat != LeafBundleFormatPKCS12 {
+		return result, fmt.Errorf("unsupported bundle format %q", req.BundleFormat)
+	}
+	if req.BundleFormat != "" && req.CSR != "" {
+		return result, fmt.Errorf("can't bundle the private key of a supplied CSR")
+	}
+	switch req.Usage {
+	case "", LeafUsageClient, LeafUsageServer, LeafUsageBoth:
+	default:
+		return result, fmt.Errorf("unsupported leaf usage %q", req.Usage)
+	}
+
+	namespace, err := c.namespace()
+	if err != nil {
+		return result, err
+	}
+
+	// Build the service ID
+	serviceID := &connect.SpiffeIDService{
+		Host:       trustDomain,
+		Datacenter: req.spiffeDatacenter(),
+		Namespace:  namespace,
+		Service:    req.Service,
+	}
+
+	leafID := c.leafID(serviceID)
+
+	if req.CSR != "" {
+		if err := checkSuppliedCSR(req.CSR, leafID); err != nil {
+			return result, err
+		}
+	}
+
+	// Wait for a generation slot before doing the expensive work.
+	release, err := c.acquireGenerateSlot(ctx)
+	if err != nil {
+		return result, err
+	}
+	defer release()
+
+	// Unless the caller supplied the CSR and holds the key, create a new
+	// private key and a CSR for it.
+	csr := req.CSR
+	var pk crypto.Signer
+	var pkPEM string
+	var keyCreatedAt time.Time
+	if csr == "" {
+		pk, pkPEM, err = connect.GeneratePrivateKey()
+		if err != nil {
+			return result, err
+		}
+		keyCreatedAt = c.getClock().Now()
+
+		extraURIs, err := req.additionalURIs()
+		if err != nil {
+			return result, err
+		}
+		dnsNames, err := req.dnsNames()
+		if err != nil {
+			return result, err
+		}
+		csr, err = connect.CreateCSRWithSANs(leafID, extraURIs, dnsNames, req.subject(), pk)
+		if err != nil {
+			return result, err
+		}
+	}
+
+	// Request signing
+	var reply structs.IssuedCert
+	args := structs.CASignRequest{
+		WriteRequest: structs.WriteRequest{Token: req.Token},
+		Datacenter:   req.signingDatacenter(),
+		CSR:          csr,
+		NotBefore:    req.NotBefore,
+		Usage:        req.usage(),
+		OnBehalfOf:   req.OnBehalfOf,
+	}
+	if c.LocalSigner != nil {
+		err = c.LocalSigner.sign(&args, &reply)
+	} else {
+		err = c.signRemote(ctx, req, &args, &reply)
+	}
+	if err != nil {
+		return result, err
+	}
+
+	// A cert for another trust domain means a misconfigured or compromised
+	// server, so it's never cached.
+	if err := checkLeafTrustDomain(&reply, trustDomain); err != nil {
+		metrics.IncrCounter([]string{"consul", "connect", "leaf", "trust_domain_mismatch"}, 1)
+		if c.Logger != nil {
+			c.Logger.Printf("[ERR] connect: rejected leaf cert for service %q: %s", req.Service, err)
+		}
+		return result, err
+	}
+
+	// Don't cache a cert that would need renewing straight away, e.g.
+	// because of skewed server clocks, since we'd renew it in a tight loop.
+	if err := checkLeafValidity(c.getClock().Now(), &reply); err != nil {
+		return result, err
+	}
+	if err := c.checkLeafTTL(&reply); err != nil {
+		metrics.IncrCounter([]string{"consul", "connect", "leaf", "ttl_too_short"}, 1)
+		if c.Logger != nil {
+			c.Logger.Printf("[ERR] connect: rejected leaf cert for service %q: %s", req.Service, err)
+		}
+		return result, err
+	}
+	reply.PrivateKeyPEM = pkPEM
+
+	if req.BundleFormat == LeafBundleFormatPKCS12 {
+		if reply.PKCS12, err = leafPKCS12(&reply, pk, roots, req.BundlePassword); err != nil {
+			return result, err
+		}
+	}
+
+	if c.OnNewLeaf != nil {
+		if err := c.OnNewLeaf(req, &reply); err != nil {
+			return result, fmt.Errorf("new leaf hook failed: %s", err)
+		}
+	}
+
+	// Lock the issued certs map so we can insert it. We only insert if
+	// we didn't happen to get a newer one. This should never happen since
+	// the Cache should ensure only one Fetch per service, but we sanity
+	// check just in case.
+	c.issuedCertsLock.Lock()
+	defer c.issuedCertsLock.Unlock()
+	issuedKey := issuedKey(req.Key(), req.Token)
+	state := c.issuedCerts[issuedKey]
+	if state == nil || state.cert.ModifyIndex < reply.ModifyIndex {
+		if c.issuedCerts == nil {
+			c.issuedCerts = make(map[string]*fetchState)
+		}
+
+		// If the new cert isn't valid yet, keep serving the current one
+		// until it is. The new leaf shares the current one's invalidatedCh
+		// so that invalidating either wakes the Fetches blocked on it.
+		now := c.getClock().Now()
+		current := state
+		if c.ServeFutureLeaves || current == nil || !reply.ValidAfter.After(now) ||
+			current.cert.ValidAfter.After(now) || !current.cert.ValidBefore.After(now) {
+			current = nil
+		}
+
+		state = &fetchState{
+			cert:          &reply,
+			rootsIndex:    roots.Index,
+			invalidatedCh: make(chan struct{}),
+		}
+		if current != nil {
+			state.invalidatedCh = current.invalidatedCh
+		}
+		if active, _ := structs.CARoots(roots.Roots).Active(); active != nil {
+			state.activeRootIndex = active.CreateIndex
+		}
+		if rootChange {
+			state.rootRenewedAt = c.getClock().Now()
+		}
+		state.keyCreatedAt = keyCreatedAt
+		if cert, err := connect.ParseCert(reply.CertPEM); err == nil {
+			state.signingKeyID = connect.HexString(cert.AuthorityKeyId)
+		}
+		leafReq := *req
+		leafReq.Token = ""
+		leafReq.BundlePassword = ""
+		leafReq.MinQueryIndex = 0
+		leafReq.MaxQueryTime = 0
+		leafReq.AdditionalSpiffeIDs = append([]string(nil), req.AdditionalSpiffeIDs...)
+		state.req = &leafReq
+		if current != nil {
+			current.next = state
+			current.forceExpireAfter = time.Time{}
+			state = current
+		} else {
+			c.issuedCerts[issuedKey] = state
+			result.Generated = true
+		}
+	} else if !state.forceExpireAfter.After(c.getClock().Now()) {
+		// We've just renewed, so a renewal that's due on the newer leaf
+		// that's kept instead shouldn't trigger another straight away.
+		state.forceExpireAfter = time.Time{}
+	}
 
-	issuedCertsLock sync.RWMutex
-	issuedCerts     map[string]*structs.IssuedCert
+	result.Value = state.cert
+	result.Index = state.cert.ModifyIndex
+	result.TTLRemaining = state.cert.ValidBefore.Sub(c.getClock().Now())
+	return result, nil
+}
 
-	RPC   RPC          // RPC client for remote requests
-	Cache *cache.Cache // Cache that has CA root certs via ConnectCARoot
+// namespace returns the namespace to request leaves under.
+func (c *ConnectCALeaf) namespace() (string, error) {
+	ns := c.DefaultNamespace
+	if ns == "" {
+		return "default", nil
+	}
+	if strings.TrimSpace(ns) == "" || strings.ContainsAny(ns, "/?#") {
+		return "", fmt.Errorf("invalid default namespace %q", ns)
+	}
+	return ns, nil
 }
 
-// issuedKey returns the issuedCerts cache key for a given service and token. We
-// use a hash rather than concatenating strings to provide resilience against
-// user input containing our separator - both service name and token ID can be
-// freely manipulated by user so may contain any delimiter we choose. It also
-// has the benefit of not leaking the ACL token to a new place in memory it
-// might get accidentally dumped etc.
-func issuedKey(service, token string) string {
-	hash := sha256.New()
-	hash.Write([]byte(service))
-	hash.Write([]byte(token))
-	return fmt.Sprintf("%x", hash.Sum(nil))
+// leafID returns the SPIFFE ID to request the service's leaf under, which is
+// the Consul one unless there's a SpiffeIDFormatter.
+func (c *ConnectCALeaf) leafID(id *connect.SpiffeIDService) connect.CertURI {
+	if c.SpiffeIDFormatter == nil {
+		return id
+	}
+	return &formattedSpiffeID{SpiffeIDService: id, uri: c.SpiffeIDFormatter(id)}
 }
 
-func (c *ConnectCALeaf) Fetch(opts cache.FetchOptions, req cache.Request) (cache.FetchResult, error) {
-	var result cache.FetchResult
+// formattedSpiffeID is a service's SPIFFE ID with its URI in the layout of a
+// SpiffeIDFormatter. Intentions are still matched on the service.
+type formattedSpiffeID struct {
+	*connect.SpiffeIDService
+	uri *url.URL
+}
 
-	// Get the correct type
-	reqReal, ok := req.(*ConnectCALeafRequest)
-	if !ok {
-		return result, fmt.Errorf(
-			"Internal cache failure: request wrong type: %T", req)
+func (id *formattedSpiffeID) URI() *url.URL {
+	return id.uri
+}
+
+// checkSuppliedCSR returns an error unless the PEM-encoded CSR is validly
+// signed and its first URI SAN is the given service's SPIFFE ID.
+func checkSuppliedCSR(csrPEM string, serviceID connect.CertURI) error {
+	csr, err := connect.ParseCSR(csrPEM)
+	if err != nil {
+		return fmt.Errorf("invalid CSR: %s", err)
 	}
+	if err := csr.CheckSignature(); err != nil {
+		return fmt.Errorf("invalid CSR signature: %s", err)
+	}
+	if want := serviceID.URI().String(); len(csr.URIs) == 0 || csr.URIs[0].String() != want {
+		return fmt.Errorf("CSR must have the SPIFFE ID %q as its first URI SAN", want)
+	}
+	return nil
+}
 
-	// This channel watches our overall timeout. The other goroutines
-	// launched in this function should end all around the same time so
-	// they clean themselves up.
-	timeoutCh := time.After(opts.Timeout)
+// leafPKCS12 returns a PKCS#12 bundle of the issued cert and private key,
+// with the cert's chain up to the active root.
+func leafPKCS12(cert *structs.IssuedCert, pk crypto.Signer,
+	roots *structs.IndexedCARoots, password string) ([]byte, error) {
+	chain := cert.CertPEM
+	if caChain := leafCAChain(roots); caChain != "" {
+		chain += "\n" + caChain
+	}
+	certs, err := connect.ParseCerts(chain)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing issued cert chain: %s", err)
+	}
+	return connect.EncodePKCS12(pk, certs, password)
+}
 
-	// Kick off the goroutine that waits for new CA roots. The channel buffer
-	// is so that the goroutine doesn't block forever if we return for other
-	// reasons.
-	newRootCACh := make(chan error, 1)
-	go c.waitNewRootCA(reqReal.Datacenter, newRootCACh, opts.Timeout)
+// leafCAChain returns the PEM-encoded intermediates and root that leaves are
+// signed under, or empty if there is no active root.
+func leafCAChain(roots *structs.IndexedCARoots) string {
+	active, _ := structs.CARoots(roots.Roots).Active()
+	if active == nil {
+		return ""
+	}
+	var chain []string
+	chain = append(chain, active.IntermediateCerts...)
+	return strings.Join(append(chain, active.RootCert), "\n")
+}
 
-	// Generate a cache key to lookup/store the cert. We MUST generate a new cert
-	// per token used to ensure revocation by ACL token is robust.
-	issuedKey := issuedKey(reqReal.Service, reqReal.Token)
+// caPending returns true if the result of rootsFromCache means the CA isn't
+// available yet, either because the roots haven't been fetched or because
+// the servers haven't bootstrapped the CA.
+func caPending(roots *structs.IndexedCARoots, err error) bool {
+	if err == errRootsNotPopulated {
+		return true
+	}
+	return err == nil && roots.TrustDomain == ""
+}
 
-	// Get our prior cert (if we had one) and use that to determine our
-	// expiration time. If no cert exists, we expire immediately since we
-	// need to generate.
-	c.issuedCertsLock.RLock()
-	lastCert := c.issuedCerts[issuedKey]
-	c.issuedCertsLock.RUnlock()
+// checkLeafValidity returns an error if the cert's validity window is
+// inverted or has already ended at now.
+func checkLeafValidity(now time.Time, cert *structs.IssuedCert) error {
+	if !cert.ValidBefore.After(cert.ValidAfter) {
+		return fmt.Errorf("issued leaf cert has an inverted validity window: "+
+			"valid after %s but before %s", cert.ValidAfter, cert.ValidBefore)
+	}
+	if !cert.ValidBefore.After(now) {
+		return fmt.Errorf("issued leaf cert expired at %s", cert.ValidBefore)
+	}
+	return nil
+}
 
-	var leafExpiryCh <-chan time.Time
-	if lastCert != nil {
-		// Determine how long we wait until triggering. If we've already
-		// expired, we trigger immediately.
-		if expiryDur := lastCert.ValidBefore.Sub(time.Now()); expiryDur > 0 {
-			leafExpiryCh = time.After(expiryDur - 1*time.Hour)
-			// TODO(mitchellh): 1 hour buffer is hardcoded above
-
-			// We should not depend on the cache package de-duplicating requests for
-			// the same service/token (which is all we care about keying our local
-			// issued cert cache on) since it might later make sense to partition
-			// clients for other reasons too. So if the request has a 0 MinIndex, and
-			// the cached cert is still valid, then the client is expecting an
-			// immediate response and hasn't already seen the cached cert, return it
-			// now.
-			if opts.MinIndex == 0 {
-				result.Value = lastCert
-				result.Index = lastCert.ModifyIndex
-				return result, nil
+// checkLeafTTL returns an error if the cert's lifetime is shorter than
+// MinAcceptableTTL.
+func (c *ConnectCALeaf) checkLeafTTL(cert *structs.IssuedCert) error {
+	if c.MinAcceptableTTL <= 0 {
+		return nil
+	}
+	if ttl := cert.ValidBefore.Sub(cert.ValidAfter); ttl < c.MinAcceptableTTL {
+		return fmt.Errorf("issued leaf cert is valid for %s, less than the minimum of %s",
+			ttl, c.MinAcceptableTTL)
+	}
+	return nil
+}
+
+// checkLeafTrustDomain returns an error unless the issued cert's SPIFFE ID
+// is in the expected trust domain. A reply without a cert has nothing to
+// check.
+func checkLeafTrustDomain(cert *structs.IssuedCert, trustDomain string) error {
+	if cert.CertPEM == "" {
+		return nil
+	}
+	parsed, err := connect.ParseCert(cert.CertPEM)
+	if err != nil {
+		return fmt.Errorf("error parsing issued leaf cert: %s", err)
+	}
+	if len(parsed.URIs) == 0 {
+		return fmt.Errorf("issued leaf cert has no SPIFFE ID")
+	}
+	if got := parsed.URIs[0].Host; !strings.EqualFold(got, trustDomain) {
+		return fmt.Errorf("issued leaf cert has trust domain %q, expected %q", got, trustDomain)
+	}
+	return nil
+}
+
+// knownTrustDomain returns true if leaves may be requested under the given
+// federated trust domain.
+func (c *ConnectCALeaf) knownTrustDomain(trustDomain string) bool {
+	for _, td := range c.FederatedTrustDomains {
+		if td == trustDomain {
+			return true
+		}
+	}
+	return false
+}
+
+// signRemote has the servers sign the request with ConnectCA.Sign, waiting
+// on the sign limiter and checking the sign breaker first.
+func (c *ConnectCALeaf) signRemote(ctx context.Context, req *ConnectCALeafRequest,
+	args *structs.CASignRequest, reply *structs.IssuedCert) error {
+	// Wait for our turn if we're limiting how quickly this agent requests
+	// new certs. Time spent here is tracked separately from the RPC itself
+	// so a growing backlog of renewals is visible.
+	if c.SignLimiter != nil {
+		if err := c.waitSignLimiter(ctx); err != nil {
+			return err
+		}
+	}
+
+	if err := c.signBreakerAllow(); err != nil {
+		return err
+	}
+
+	start := time.Now()
+	err := c.RPC.RPC("ConnectCA.Sign", args, reply)
+	metrics.MeasureSince([]string{"consul", "connect", "leaf", "sign_duration_ms"}, start)
+	if err == nil {
+		c.observeSignLatency(time.Since(start))
+	}
+	c.signBreakerRecord(err)
+	if err != nil {
+		// The error loses its type over RPC so match on the message. The
+		// token won't be allowed until its policies change, so return a
+		// typed error that the cache backs off on rather than retrying.
+		if acl.IsErrPermissionDenied(err) {
+			return acl.PermissionDeniedError{
+				Cause: fmt.Sprintf("token can't sign a leaf cert for service %q", req.Service),
 			}
 		}
+		return err
+	}
+	return nil
+}
+
+// waitSignLimiter blocks until the sign limiter allows another request or
+// the context is done.
+func (c *ConnectCALeaf) waitSignLimiter(ctx context.Context) error {
+	defer metrics.MeasureSince([]string{"consul", "connect", "leaf", "sign_limiter_wait_ms"}, time.Now())
+
+	if err := c.SignLimiter.Wait(ctx); err != nil {
+		return fmt.Errorf("timed out waiting for leaf sign rate limit: %s", err)
 	}
+	return nil
+}
 
-	if leafExpiryCh == nil {
-		// If the channel is still nil then it means we need to generate
-		// a cert no matter what: we either don't have an existing one or
-		// it is expired.
-		leafExpiryCh = time.After(0)
+// observeSignLatency adds the latency of a successful sign to the moving
+// average.
+func (c *ConnectCALeaf) observeSignLatency(d time.Duration) {
+	c.signLatencyLock.Lock()
+	defer c.signLatencyLock.Unlock()
+	if c.signLatency == 0 {
+		c.signLatency = d
+		return
 	}
+	c.signLatency += time.Duration(signLatencyWeight * float64(d-c.signLatency))
+}
 
-	// Block on the events that wake us up.
-	select {
-	case <-timeoutCh:
-		// On a timeout, we just return the empty result and no error.
-		// It isn't an error to timeout, its just the limit of time the
-		// caching system wants us to block for. By returning an empty result
-		// the caching system will ignore.
-		return result, nil
+// SignLatency returns the moving average of recent ConnectCA.Sign latencies,
+// or zero if nothing has been signed yet.
+func (c *ConnectCALeaf) SignLatency() time.Duration {
+	c.signLatencyLock.Lock()
+	defer c.signLatencyLock.Unlock()
+	return c.signLatency
+}
 
-	case err := <-newRootCACh:
-		// A new root CA triggers us to refresh the leaf certificate.
-		// If there was an error while getting the root CA then we return.
-		// Otherwise, we leave the select statement and move to generation.
-		if err != nil {
-			return result, err
+// generateTimeout returns how long a Fetch with the given timeout may spend
+// generating a leaf.
+func (c *ConnectCALeaf) generateTimeout(timeout time.Duration) time.Duration {
+	if !c.AdaptiveTimeout {
+		return timeout
+	}
+	extra := adaptiveTimeoutFactor * c.SignLatency()
+	if extra > timeout {
+		extra = timeout
+	}
+	return timeout + extra
+}
+
+// signBreakerAllow returns errSignBreakerOpen if signs are suppressed by the
+// sign breaker. Once the cooldown has passed, it lets a single trial sign
+// through and suppresses the others until it's recorded.
+func (c *ConnectCALeaf) signBreakerAllow() error {
+	if c.SignBreakerThreshold <= 0 {
+		return nil
+	}
+	c.signBreakerLock.Lock()
+	defer c.signBreakerLock.Unlock()
+	if c.signFailures < c.SignBreakerThreshold {
+		return nil
+	}
+	if c.signBreakerTrial || c.getClock().Now().Before(c.signBreakerOpenUntil) {
+		metrics.IncrCounter([]string{"consul", "connect", "leaf", "sign_breaker_rejected"}, 1)
+		return errSignBreakerOpen
+	}
+	c.signBreakerTrial = true
+	return nil
+}
+
+// signBreakerRecord records the result of a sign for the sign breaker,
+// opening it if the failures reach SignBreakerThreshold.
+func (c *ConnectCALeaf) signBreakerRecord(err error) {
+	if c.SignBreakerThreshold <= 0 {
+		return
+	}
+	c.signBreakerLock.Lock()
+	defer c.signBreakerLock.Unlock()
+	c.signBreakerTrial = false
+	if err == nil || acl.IsErrPermissionDenied(err) {
+		c.signFailures = 0
+		return
+	}
+	c.signFailures++
+	if c.signFailures >= c.SignBreakerThreshold {
+		c.signBreakerOpenUntil = c.getClock().Now().Add(c.SignBreakerCooldown)
+	}
+}
+
+// acquireGenerateSlot waits for one of the MaxConcurrentGenerations slots,
+// returning a func that releases it.
+func (c *ConnectCALeaf) acquireGenerateSlot(ctx context.Context) (func(), error) {
+	c.generateSlotsLock.Lock()
+	if c.generateSlots == nil {
+		n := c.MaxConcurrentGenerations
+		if n <= 0 {
+			n = defaultMaxConcurrentGenerations
 		}
+		c.generateSlots = make(chan struct{}, n)
+	}
+	slots := c.generateSlots
+	c.generateSlotsLock.Unlock()
+
+	select {
+	case slots <- struct{}{}:
+		return func() { <-slots }, nil
+	case <-ctx.Done():
+		return nil, fmt.Errorf("timed out waiting to generate leaf cert: %s", ctx.Err())
+	}
+}
 
-	case <-leafExpiryCh:
-		// The existing leaf certificate is expiring soon, so we generate a
-		// new cert with a healthy overlapping validity period (determined
-		// by the above channel).
+// rootsFromCache returns the current CA roots for the datacenter from the
+// cache without blocking on a new index. If the cache entry hasn't been
+// populated yet, errRootsNotPopulated is returned. With a LocalSigner its
+// roots are returned instead, and roots read by PokeRoots are returned
+// while they're newer than the cache's.
+func (c *ConnectCALeaf) rootsFromCache(datacenter string) (*structs.IndexedCARoots, error) {
+	if c.LocalSigner != nil {
+		return c.LocalSigner.Roots(), nil
+	}
+	roots, err := c.cachedRoots(datacenter)
+	var index uint64
+	if err == nil {
+		index = roots.Index
 	}
+	if err == nil || err == errRootsNotPopulated {
+		if poked := c.pokedRootsNewer(datacenter, index); poked != nil {
+			return poked, nil
+		}
+	}
+	return roots, err
+}
 
-	// Need to lookup RootCAs response to discover trust domain. First just lookup
-	// with no blocking info - this should be a cache hit most of the time.
+// cachedRoots returns the CA roots for the datacenter from the cache for
+// rootsFromCache.
+func (c *ConnectCALeaf) cachedRoots(datacenter string) (*structs.IndexedCARoots, error) {
 	rawRoots, _, err := c.Cache.Get(ConnectCARootName, &structs.DCSpecificRequest{
-		Datacenter: reqReal.Datacenter,
+		Datacenter: datacenter,
 	})
 	if err != nil {
-		return result, err
+		return nil, err
+	}
+	if rawRoots == nil {
+		return nil, errRootsNotPopulated
 	}
 	roots, ok := rawRoots.(*structs.IndexedCARoots)
 	if !ok {
-		return result, errors.New("invalid RootCA response type")
+		return nil, errors.New("invalid RootCA response type")
 	}
-	if roots.TrustDomain == "" {
-		return result, errors.New("cluster has no CA bootstrapped yet")
-	}
-
-	// Build the service ID
-	serviceID := &connect.SpiffeIDService{
-		Host:       roots.TrustDomain,
-		Datacenter: reqReal.Datacenter,
-		Namespace:  "default",
-		Service:    reqReal.Service,
+	if roots.Index == 0 {
+		// A zero index means the servers haven't given us a real result yet.
+		return nil, errRootsNotPopulated
 	}
+	return roots, nil
+}
 
-	// Create a new private key
-	pk, pkPEM, err := connect.GeneratePrivateKey()
+// rootPresent returns true if the root with the given ID is still part of
+// the trusted roots for the datacenter, whether or not it is the active one.
+func (c *ConnectCALeaf) rootPresent(datacenter, id string) (bool, error) {
+	roots, err := c.rootsFromCache(datacenter)
 	if err != nil {
-		return result, err
+		return false, err
 	}
-
-	// Create a CSR.
-	csr, err := connect.CreateCSR(serviceID, pk)
-	if err != nil {
-		return result, err
+	for _, root := range roots.Roots {
+		if root.ID == id {
+			return true, nil
+		}
 	}
+	return false, nil
+}
 
-	// Request signing
-	var reply structs.IssuedCert
-	args := structs.CASignRequest{
-		WriteRequest: structs.WriteRequest{Token: reqReal.Token},
-		Datacenter:   reqReal.Datacenter,
-		CSR:          csr,
-	}
-	if err := c.RPC.RPC("ConnectCA.Sign", &args, &reply); err != nil {
-		return result, err
+// activeRootNewer returns true if the datacenter's active root was created
+// after the given index.
+func (c *ConnectCALeaf) activeRootNewer(datacenter string, index uint64) (bool, error) {
+	roots, err := c.rootsFromCache(datacenter)
+	if err != nil {
+		return false, err
 	}
-	reply.PrivateKeyPEM = pkPEM
+	active, _ := structs.CARoots(roots.Roots).Active()
+	return active != nil && active.CreateIndex > index, nil
+}
 
-	// Lock the issued certs map so we can insert it. We only insert if
-	// we didn't happen to get a newer one. This should never happen since
-	// the Cache should ensure only one Fetch per service, but we sanity
-	// check just in case.
-	c.issuedCertsLock.Lock()
-	defer c.issuedCertsLock.Unlock()
-	lastCert = c.issuedCerts[issuedKey]
-	if lastCert == nil || lastCert.ModifyIndex < reply.ModifyIndex {
-		if c.issuedCerts == nil {
-			c.issuedCerts = make(map[string]*structs.IssuedCert)
-		}
+// loadCAIndex returns the index of the latest CA roots seen for the
+// datacenter, or zero if none have been seen.
+func (c *ConnectCALeaf) loadCAIndex(datacenter string) uint64 {
+	c.caIndexLock.Lock()
+	defer c.caIndexLock.Unlock()
+	return c.caIndexes[datacenter]
+}
 
-		c.issuedCerts[issuedKey] = &reply
-		lastCert = &reply
+// advanceCAIndex records index as the latest CA roots index seen for the
+// datacenter if it's newer than the one already recorded.
+func (c *ConnectCALeaf) advanceCAIndex(datacenter string, index uint64) {
+	c.caIndexLock.Lock()
+	defer c.caIndexLock.Unlock()
+	if c.caIndexes == nil {
+		c.caIndexes = make(map[string]uint64)
+	}
+	if index > c.caIndexes[datacenter] {
+		c.caIndexes[datacenter] = index
 	}
-
-	result.Value = lastCert
-	result.Index = lastCert.ModifyIndex
-	return result, nil
 }
 
-// waitNewRootCA blocks until a new root CA is available or the timeout is
-// reached (on timeout ErrTimeout is returned on the channel).
+// waitNewRootCA blocks until roots newer than minIndex are available or the
+// timeout is reached. On a timeout nothing is sent on the channel, since the
+// Fetch that started it wakes for its own timeout.
+// Callers load minIndex with loadCAIndex before starting the goroutine so
+// that a rotation observed by another watcher before this one is scheduled
+// still wakes it.
 func (c *ConnectCALeaf) waitNewRootCA(datacenter string, ch chan<- error,
-	timeout time.Duration) {
+	timeout time.Duration, minIndex uint64) {
 	// We always want to block on at least an initial value. If this isn't
-	minIndex := atomic.LoadUint64(&c.caIndex)
 	if minIndex == 0 {
 		minIndex = 1
 	}
@@ -215,6 +2015,10 @@ func (c *ConnectCALeaf) waitNewRootCA(datacenter string, ch chan<- error,
 		},
 	})
 	if err != nil {
+		// The roots entry may be being reset, e.g. because the servers were
+		// restored from a snapshot, so the next roots can have a lower
+		// index than those seen so far.
+		c.forgetRootsIndex(datacenter)
 		ch <- err
 		return
 	}
@@ -227,29 +2031,156 @@ func (c *ConnectCALeaf) waitNewRootCA(datacenter string, ch chan<- error,
 		return
 	}
 
-	// We do a loop here because there can be multiple waitNewRootCA calls
-	// happening simultaneously. Each Fetch kicks off one call. These are
-	// multiplexed through Cache.Get which should ensure we only ever
-	// actually make a single RPC call. However, there is a race to set
-	// the caIndex field so do a basic CAS loop here.
-	for {
-		// We only set our index if its newer than what is previously set.
-		old := atomic.LoadUint64(&c.caIndex)
-		if old == roots.Index || old > roots.Index {
-			break
-		}
+	// The cache returns the roots it has when the query times out. These
+	// aren't a change, and if treated as one they renew the leaf of a Fetch
+	// that is still waiting, e.g. one with a longer timeout than ours.
+	if roots.Index <= minIndex {
+		return
+	}
 
-		// Set the new index atomically. If the caIndex value changed
-		// in the meantime, retry.
-		if atomic.CompareAndSwapUint64(&c.caIndex, old, roots.Index) {
-			break
-		}
+	// There can be multiple waitNewRootCA calls happening simultaneously,
+	// each Fetch kicks off one call. These are multiplexed through
+	// Cache.Get which should ensure we only ever actually make a single
+	// RPC call, but any of them may be the first to record the new index.
+	c.advanceCAIndex(datacenter, roots.Index)
+
+	// The hook is called outside of observeRoots so that a slow hook
+	// doesn't hold up other waiters.
+	if c.observeRoots(datacenter, roots) && c.OnRootChange != nil {
+		c.OnRootChange(datacenter, roots)
 	}
 
 	// Trigger the channel since we updated.
 	ch <- nil
 }
 
+// observeRoots records the datacenter's active root from the given roots and
+// emits how long ago it last changed. Roots updates that don't change the
+// active root, such as a config change, and stale roots from concurrent
+// waiters are ignored. Since the agent can't know when a root it first saw
+// became active, nothing is emitted until it sees a rotation. It returns
+// true if the roots changed the active root.
+func (c *ConnectCALeaf) observeRoots(datacenter string, roots *structs.IndexedCARoots) bool {
+	now := c.getClock().Now()
+	changed := false
+
+	c.activeRootsLock.Lock()
+	defer c.activeRootsLock.Unlock()
+	if c.activeRoots == nil {
+		c.activeRoots = make(map[string]*activeRootState)
+	}
+	state := c.activeRoots[datacenter]
+	switch {
+	case state == nil:
+		state = &activeRootState{id: roots.ActiveRootID, index: roots.Index}
+		c.activeRoots[datacenter] = state
+
+	case roots.Index > state.index:
+		// The first root after the CA bootstraps isn't a rotation.
+		if state.id != "" && roots.ActiveRootID != "" && roots.ActiveRootID != state.id {
+			state.changedAt = now
+			changed = true
+		}
+		if roots.ActiveRootID != "" {
+			state.id = roots.ActiveRootID
+		}
+		state.index = roots.Index
+	}
+
+	if !state.changedAt.IsZero() {
+		metrics.SetGaugeWithLabels([]string{"consul", "connect", "ca", "last_rotation_age_seconds"},
+			float32(now.Sub(state.changedAt).Seconds()),
+			[]metrics.Label{{Name: "datacenter", Value: datacenter}})
+	}
+	return changed
+}
+
+// PokeRoots reads the datacenter's CA roots from the servers straight away
+// rather than waiting for the cache's blocking query to return, for callers
+// that learn of a CA rotation by other means. If the roots are newer than
+// those seen so far they're used until the cache catches up: OnRootChange
+// is called if the active root changed and blocked Fetches for the
+// datacenter renew their leaves as they would for any roots change. It
+// does nothing with a LocalSigner.
+func (c *ConnectCALeaf) PokeRoots(datacenter string) error {
+	if c.LocalSigner != nil {
+		return nil
+	}
+
+	var roots structs.IndexedCARoots
+	err := c.RPC.RPC("ConnectCA.Roots", &structs.DCSpecificRequest{Datacenter: datacenter}, &roots)
+	if err != nil {
+		return err
+	}
+	if roots.Index <= c.loadCAIndex(datacenter) {
+		return nil
+	}
+
+	c.pokeLock.Lock()
+	if c.pokedRoots == nil {
+		c.pokedRoots = make(map[string]*structs.IndexedCARoots)
+	}
+	c.pokedRoots[datacenter] = &roots
+	c.pokeLock.Unlock()
+
+	c.advanceCAIndex(datacenter, roots.Index)
+	if c.observeRoots(datacenter, &roots) && c.OnRootChange != nil {
+		c.OnRootChange(datacenter, &roots)
+	}
+
+	c.pokeLock.Lock()
+	if c.pokeCh != nil {
+		close(c.pokeCh)
+		c.pokeCh = nil
+	}
+	c.pokeLock.Unlock()
+	return nil
+}
+
+// rootsPokedCh returns a channel that is closed when PokeRoots next finds
+// newer roots.
+func (c *ConnectCALeaf) rootsPokedCh() chan struct{} {
+	c.pokeLock.Lock()
+	defer c.pokeLock.Unlock()
+	if c.pokeCh == nil {
+		c.pokeCh = make(chan struct{})
+	}
+	return c.pokeCh
+}
+
+// pokedRootsNewer returns the roots last read by PokeRoots for the datacenter
+// if they're newer than the given index.
+func (c *ConnectCALeaf) pokedRootsNewer(datacenter string, index uint64) *structs.IndexedCARoots {
+	c.pokeLock.Lock()
+	defer c.pokeLock.Unlock()
+	if roots := c.pokedRoots[datacenter]; roots != nil && roots.Index > index {
+		return roots
+	}
+	return nil
+}
+
+// forgetRootsIndex clears the index of the roots the datacenter's active
+// root was last seen in, keeping the root itself, so that the next roots
+// observed are checked for a rotation whatever their index.
+func (c *ConnectCALeaf) forgetRootsIndex(datacenter string) {
+	c.activeRootsLock.Lock()
+	defer c.activeRootsLock.Unlock()
+	if state := c.activeRoots[datacenter]; state != nil {
+		state.index = 0
+	}
+}
+
+// lastRootChange returns when the datacenter's active root was last seen to
+// change, if it has been.
+func (c *ConnectCALeaf) lastRootChange(datacenter string) (time.Time, bool) {
+	c.activeRootsLock.Lock()
+	defer c.activeRootsLock.Unlock()
+	if state := c.activeRoots[datacenter]; state != nil && !state.changedAt.IsZero() {
+		return state.changedAt, true
+	}
+	return time.Time{}, false
+}
+
 func (c *ConnectCALeaf) SupportsBlocking() bool {
 	return true
 }
@@ -263,13 +2194,276 @@ type ConnectCALeafRequest struct {
 	Datacenter    string
 	Service       string // Service name, not ID
 	MinQueryIndex uint64
+
+	// PreferRootID optionally pins the root the current leaf was issued
+	// under. While a root with this ID is still trusted, a rotation to a
+	// different active root won't cause the leaf to be renewed. Renewal
+	// resumes once the pinned root is removed or the leaf expires.
+	PreferRootID string
+
+	// MaxCAChangeJitter optionally caps how long the RotationLimiter can
+	// delay renewing this leaf after a CA change, so that latency-critical
+	// services rotate sooner than bulk ones. The slot is still reserved so
+	// other leaves keep their pacing. Since requests for the same service
+	// share a leaf, the first request to schedule the renewal decides it.
+	MaxCAChangeJitter time.Duration
+
+	// GenerateDeadline optionally bounds how long a Fetch spends generating
+	// a new leaf, separately from the Fetch timeout that a blocking query
+	// waits on an existing cert for. This lets a latency-sensitive caller
+	// fail a slow first fetch quickly while still using long blocking
+	// queries. It bounds waiting for the CA roots, a generation slot and
+	// the sign limiter, but not a sign RPC that is already in flight.
+	GenerateDeadline time.Duration
+
+	// MaxQueryTime optionally bounds how long a cache Get for the leaf waits
+	// on the fetch for it. A fetch that's cut short carries on in the cache.
+	MaxQueryTime time.Duration
+
+	// TrustDomainOverride optionally requests a leaf under one of the
+	// ConnectCALeaf's FederatedTrustDomains instead of the local cluster's
+	// trust domain.
+	TrustDomainOverride string
+
+	// SubjectOrg and SubjectOU optionally set the Organization and
+	// OrganizationalUnit of the CSR's subject. The servers' CA may or may
+	// not carry them over to the signed cert.
+	SubjectOrg string
+	SubjectOU  string
+
+	// SigningDatacenter optionally routes the sign request to another
+	// datacenter's CA, for topologies where the service's datacenter doesn't
+	// sign its own leaves. The leaf's SPIFFE ID still uses Datacenter. If
+	// empty, Datacenter signs.
+	SigningDatacenter string
+
+	// SpiffeDatacenterAlias optionally replaces Datacenter in the leaf's
+	// SPIFFE ID, e.g. the old name of a renamed datacenter that peers still
+	// validate against. The sign request is still routed by Datacenter or
+	// SigningDatacenter. The servers' CA must accept the alias.
+	SpiffeDatacenterAlias string
+
+	// AdditionalSpiffeIDs optionally adds more SPIFFE ID URIs to the CSR
+	// after the service's own, e.g. the same service under another trust
+	// domain during a trust domain migration. The servers' CA must permit
+	// them for them to be in the signed cert.
+	AdditionalSpiffeIDs []string
+
+	// NotBefore optionally requests a leaf that only becomes valid at the
+	// given time, e.g. so that fleets in a staged rollout overlap cleanly.
+	// It's forwarded to the servers, whose CA may ignore it.
+	NotBefore time.Time
+
+	// SNI optionally sets the DNS name the leaf is intended to be reached by
+	// over TLS SNI, e.g. by gateways that route on it rather than the SPIFFE
+	// URI. It becomes the CSR's first DNS SAN. The servers' CA must permit it
+	// for it to be in the signed cert.
+	SNI string
+
+	// BundleFormat optionally requests the leaf in another format as well as
+	// PEM. Only LeafBundleFormatPKCS12 is supported, which sets the result's
+	// PKCS12 to a bundle of the leaf, its chain and its private key,
+	// encrypted with BundlePassword if set.
+	BundleFormat   string
+	BundlePassword string
+
+	// CSR optionally supplies the PEM-encoded CSR to sign, for callers that
+	// manage their own private keys, e.g. in an HSM. No key is generated so
+	// the result's PrivateKeyPEM is empty. The CSR's first URI SAN must be
+	// the service's SPIFFE ID. Its own SANs and subject are used as is, so
+	// the options above that change the CSR don't apply.
+	CSR string
+
+	// Usage optionally restricts the leaf to clients or servers with one of
+	// the LeafUsage values, for services that only ever play one role. It's
+	// forwarded to the servers, whose CA may ignore it and issue a leaf
+	// usable as both. Empty is the same as LeafUsageBoth.
+	Usage string
+
+	// OnBehalfOf optionally names the identity the leaf is requested for
+	// when Token belongs to someone else, e.g. a control plane that
+	// provisions certs centrally with a delegation token. It's forwarded to
+	// the servers, which decide whether the token may act for it.
+	OnBehalfOf string
+}
+
+// LeafBundleFormatPKCS12 is the BundleFormat for a PKCS#12 (PFX) bundle.
+const LeafBundleFormatPKCS12 = "pkcs12"
+
+// The Usage values of a ConnectCALeafRequest.
+const (
+	LeafUsageClient = "client"
+	LeafUsageServer = "server"
+	LeafUsageBoth   = "both"
+)
+
+// usage returns the requested Usage with the default made explicit as empty
+// so that both forms share a cache entry.
+func (r *ConnectCALeafRequest) usage() string {
+	if r.Usage == LeafUsageBoth {
+		return ""
+	}
+	return r.Usage
+}
+
+// additionalURIs returns the parsed AdditionalSpiffeIDs.
+func (r *ConnectCALeafRequest) additionalURIs() ([]*url.URL, error) {
+	var uris []*url.URL
+	for _, id := range r.AdditionalSpiffeIDs {
+		uri, err := url.Parse(id)
+		if err != nil || uri.Scheme != "spiffe" || uri.Host == "" {
+			return nil, fmt.Errorf("invalid additional SPIFFE ID %q", id)
+		}
+		uris = append(uris, uri)
+	}
+	return uris, nil
+}
+
+// dnsNames returns the DNS SANs for the CSR, starting with the SNI name.
+func (r *ConnectCALeafRequest) dnsNames() ([]string, error) {
+	if r.SNI == "" {
+		return nil, nil
+	}
+	if !validDNSName(r.SNI) {
+		return nil, fmt.Errorf("invalid SNI name %q", r.SNI)
+	}
+	return []string{r.SNI}, nil
+}
+
+// validDNSName returns true if name is a syntactically valid DNS name.
+func validDNSName(name string) bool {
+	if len(name) > 253 {
+		return false
+	}
+	for _, label := range strings.Split(strings.TrimSuffix(name, "."), ".") {
+		if label == "" || len(label) > 63 || label[0] == '-' || label[len(label)-1] == '-' {
+			return false
+		}
+		for _, r := range label {
+			if !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '-') {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// signingDatacenter returns the datacenter to send the sign request to.
+func (r *ConnectCALeafRequest) signingDatacenter() string {
+	if r.SigningDatacenter != "" {
+		return r.SigningDatacenter
+	}
+	return r.Datacenter
+}
+
+// spiffeDatacenter returns the datacenter to put in the leaf's SPIFFE ID.
+func (r *ConnectCALeafRequest) spiffeDatacenter() string {
+	if r.SpiffeDatacenterAlias != "" {
+		return r.SpiffeDatacenterAlias
+	}
+	return r.Datacenter
+}
+
+// subject returns the subject to request in the CSR for this leaf.
+func (r *ConnectCALeafRequest) subject() pkix.Name {
+	var name pkix.Name
+	if r.SubjectOrg != "" {
+		name.Organization = []string{r.SubjectOrg}
+	}
+	if r.SubjectOU != "" {
+		name.OrganizationalUnit = []string{r.SubjectOU}
+	}
+	return name
+}
+
+// bundlePasswordKey keys the HMAC of BundlePassword that goes into request
+// keys, so that cache and issued cert keys, which can end up in logs and debug
+// dumps, don't carry a fast unkeyed hash of the password that could be brute
+// forced. It only needs to be stable for the life of the process.
+var bundlePasswordKey = func() []byte {
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		panic(fmt.Sprintf("connect-ca-leaf: failed to generate bundle password key: %s", err))
+	}
+	return key
+}()
+
+// bundlePasswordMAC returns the keyed hash of password to use in request keys,
+// or "" if there's no password.
+func bundlePasswordMAC(password string) string {
+	if password == "" {
+		return ""
+	}
+	mac := hmac.New(sha256.New, bundlePasswordKey)
+	mac.Write([]byte(password))
+	return fmt.Sprintf("%x", mac.Sum(nil))
+}
+
+// Key returns the key identifying the leaf this request is for within its
+// token. This is the escaped datacenter and service name, so that names
+// containing separators can't alias each other, unless options that change
+// the issued cert are set, in which case they're hashed in too so that
+// differing certs are cached separately.
+func (r *ConnectCALeafRequest) Key() string {
+	base := url.QueryEscape(r.Datacenter) + "/" + url.QueryEscape(r.Service)
+
+	var signingDC string
+	if dc := r.signingDatacenter(); dc != r.Datacenter {
+		signingDC = dc
+	}
+	var spiffeDC string
+	if dc := r.spiffeDatacenter(); dc != r.Datacenter {
+		spiffeDC = dc
+	}
+	if r.TrustDomainOverride == "" && r.SubjectOrg == "" && r.SubjectOU == "" && signingDC == "" && spiffeDC == "" &&
+		len(r.AdditionalSpiffeIDs) == 0 && r.SNI == "" && r.NotBefore.IsZero() && r.BundleFormat == "" &&
+		r.CSR == "" && r.usage() == "" && r.OnBehalfOf == "" {
+		return base
+	}
+
+	// The order of the additional IDs doesn't change the cert.
+	extraIDs := append([]string(nil), r.AdditionalSpiffeIDs...)
+	sort.Strings(extraIDs)
+
+	// Hash the instant rather than the time.Time so the location doesn't
+	// matter.
+	var notBefore int64
+	if !r.NotBefore.IsZero() {
+		notBefore = r.NotBefore.UnixNano()
+	}
+
+	fields := []interface{}{
+		r.Service,
+		r.TrustDomainOverride,
+		r.SubjectOrg,
+		r.SubjectOU,
+		signingDC,
+		extraIDs,
+		r.SNI,
+		notBefore,
+		r.BundleFormat,
+		bundlePasswordMAC(r.BundlePassword),
+		r.CSR,
+		r.usage(),
+		r.OnBehalfOf,
+		spiffeDC,
+	}
+	v, err := hashstructure.Hash(fields, nil)
+	if err != nil {
+		// The key also keys the issued certs, so a blank or shared key would
+		// let unrelated requests share a leaf. Fall back to a slower hash that
+		// still gives each distinct request its own key.
+		return fmt.Sprintf("%s:%x", base, sha256.Sum256([]byte(fmt.Sprintf("%#v", fields))))
+	}
+	return fmt.Sprintf("%s:%d", base, v)
 }
 
 func (r *ConnectCALeafRequest) CacheInfo() cache.RequestInfo {
 	return cache.RequestInfo{
 		Token:      r.Token,
-		Key:        r.Service,
+		Key:        r.Key(),
 		Datacenter: r.Datacenter,
 		MinIndex:   r.MinQueryIndex,
+		Timeout:    r.MaxQueryTime,
 	}
 }
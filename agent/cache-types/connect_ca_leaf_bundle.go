@@ -0,0 +1,116 @@
+package cachetype
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/hashicorp/consul/agent/structs"
+)
+
+// The files WriteLeafFiles writes.
+const (
+	LeafCertFile  = "cert.pem"
+	LeafChainFile = "chain.pem"
+	LeafKeyFile   = "key.pem"
+)
+
+// WriteLeafFiles writes the issued leaf to dir as LeafCertFile, its CA chain
+// from roots as LeafChainFile and its private key as LeafKeyFile, e.g. for an
+// init container to hand to a sidecar. The key is only readable by the
+// owner. Each file is written to a temporary file first, and the files are
+// only renamed into place once all of them are complete, so a failure
+// writing them leaves no partly written file and the existing files as they
+// were. The files are renamed one at a time though, so a failure renaming
+// them can leave some new files next to existing ones from an earlier leaf,
+// and callers should write them again on error. A leaf signed from a
+// supplied CSR has no key, so no key file is written for it and any existing
+// one, which wouldn't match the new cert, is removed.
+func WriteLeafFiles(dir string, cert *structs.IssuedCert, roots *structs.IndexedCARoots) error {
+	return writeLeafFiles(dir, cert, roots, os.Rename)
+}
+
+// writeLeafFiles is WriteLeafFiles, renaming the files into place with rename
+// so that tests can make it fail.
+func writeLeafFiles(dir string, cert *structs.IssuedCert, roots *structs.IndexedCARoots,
+	rename func(oldpath, newpath string) error) error {
+	if cert.CertPEM == "" {
+		return fmt.Errorf("leaf for service %q has no certificate", cert.Service)
+	}
+	chain := leafCAChain(roots)
+	if chain == "" {
+		return fmt.Errorf("no active root for the leaf's chain")
+	}
+
+	files := []leafFile{
+		{LeafCertFile, cert.CertPEM, 0644},
+		{LeafChainFile, chain, 0644},
+	}
+	if cert.PrivateKeyPEM != "" {
+		files = append(files, leafFile{LeafKeyFile, cert.PrivateKeyPEM, 0600})
+	}
+
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+
+	// Write all the temporary files before renaming any of them.
+	var temps []string
+	defer func() {
+		for _, temp := range temps {
+			os.Remove(temp)
+		}
+	}()
+	for _, f := range files {
+		temp, err := writeLeafTemp(dir, f)
+		if err != nil {
+			return err
+		}
+		temps = append(temps, temp)
+	}
+	for i, f := range files {
+		if err := rename(temps[i], filepath.Join(dir, f.name)); err != nil {
+			return err
+		}
+	}
+	if cert.PrivateKeyPEM == "" {
+		err := os.Remove(filepath.Join(dir, LeafKeyFile))
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// leafFile is a file written by WriteLeafFiles.
+type leafFile struct {
+	name     string
+	contents string
+	mode     os.FileMode
+}
+
+// writeLeafTemp writes the file's contents to a new temporary file in dir
+// with the file's mode, syncing it to disk, and returns its path.
+func writeLeafTemp(dir string, f leafFile) (string, error) {
+	fh, err := ioutil.TempFile(dir, "."+f.name+"-")
+	if err != nil {
+		return "", err
+	}
+	temp := fh.Name()
+	err = fh.Chmod(f.mode)
+	if err == nil {
+		_, err = fh.WriteString(f.contents)
+	}
+	if err == nil {
+		err = fh.Sync()
+	}
+	if closeErr := fh.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(temp)
+		return "", err
+	}
+	return temp, nil
+}
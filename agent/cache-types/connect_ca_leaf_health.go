@@ -0,0 +1,121 @@
+package cachetype
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/armon/go-metrics"
+	"github.com/hashicorp/consul/agent/connect"
+	"github.com/hashicorp/consul/agent/structs"
+)
+
+// LeafHealthCheckService is the reserved service name HealthCheck signs its
+// throwaway leaves for. The token used must be allowed to write it.
+const LeafHealthCheckService = "consul-connect-leaf-health"
+
+// The stages of the signing path a HealthCheck can fail at.
+const (
+	// LeafHealthStageRoots means the CA roots couldn't be had, or the
+	// servers haven't bootstrapped the CA yet.
+	LeafHealthStageRoots = "roots"
+
+	// LeafHealthStageSign means the leaf couldn't be generated or signed,
+	// e.g. because the servers are unreachable or the token isn't allowed.
+	LeafHealthStageSign = "sign"
+
+	// LeafHealthStageVerify means a leaf was signed but isn't usable.
+	LeafHealthStageVerify = "verify"
+)
+
+// LeafHealthError is the error returned by a failed HealthCheck.
+type LeafHealthError struct {
+	Stage string // One of the LeafHealthStage constants
+	Err   error
+}
+
+func (e *LeafHealthError) Error() string {
+	return fmt.Sprintf("connect leaf health check failed at %s: %s", e.Stage, e.Err)
+}
+
+// HealthCheck checks that this agent can get leaf certs signed in the given
+// datacenter with the token, e.g. for a readiness probe. It signs a leaf for
+// LeafHealthCheckService with a new key and throws it away: nothing is
+// cached, OnNewLeaf isn't called and the leaves of real services aren't
+// touched. It doesn't wait for the CA roots, so it fails straight away if
+// they aren't available. Signs still go through SignLimiter and the sign
+// breaker, since those are part of the path being checked. A failure
+// returns a *LeafHealthError.
+func (c *ConnectCALeaf) HealthCheck(ctx context.Context, datacenter, token string) error {
+	err := c.healthCheck(ctx, datacenter, token)
+	if err != nil {
+		metrics.IncrCounterWithLabels([]string{"consul", "connect", "leaf", "health_check_failed"}, 1,
+			[]metrics.Label{{Name: "stage", Value: err.Stage}})
+		return err
+	}
+	metrics.IncrCounter([]string{"consul", "connect", "leaf", "health_check_ok"}, 1)
+	return nil
+}
+
+func (c *ConnectCALeaf) healthCheck(ctx context.Context, datacenter, token string) *LeafHealthError {
+	if _, closed := c.closeState(); closed {
+		return &LeafHealthError{Stage: LeafHealthStageSign, Err: errLeafClosed}
+	}
+
+	roots, err := c.rootsFromCache(datacenter)
+	if caPending(roots, err) {
+		return &LeafHealthError{Stage: LeafHealthStageRoots, Err: errRootsNotPopulated}
+	}
+	if err != nil {
+		return &LeafHealthError{Stage: LeafHealthStageRoots, Err: err}
+	}
+
+	req := &ConnectCALeafRequest{
+		Token:      token,
+		Datacenter: datacenter,
+		Service:    LeafHealthCheckService,
+	}
+	namespace, err := c.namespace()
+	if err != nil {
+		return &LeafHealthError{Stage: LeafHealthStageSign, Err: err}
+	}
+	leafID := c.leafID(&connect.SpiffeIDService{
+		Host:       roots.TrustDomain,
+		Datacenter: datacenter,
+		Namespace:  namespace,
+		Service:    LeafHealthCheckService,
+	})
+	pk, _, err := connect.GeneratePrivateKey()
+	if err != nil {
+		return &LeafHealthError{Stage: LeafHealthStageSign, Err: err}
+	}
+	csr, err := connect.CreateCSR(leafID, pk)
+	if err != nil {
+		return &LeafHealthError{Stage: LeafHealthStageSign, Err: err}
+	}
+
+	var reply structs.IssuedCert
+	args := structs.CASignRequest{
+		WriteRequest: structs.WriteRequest{Token: token},
+		Datacenter:   datacenter,
+		CSR:          csr,
+	}
+	if c.LocalSigner != nil {
+		err = c.LocalSigner.sign(&args, &reply)
+	} else {
+		err = c.signRemote(ctx, req, &args, &reply)
+	}
+	if err != nil {
+		return &LeafHealthError{Stage: LeafHealthStageSign, Err: err}
+	}
+
+	if err := checkLeafTrustDomain(&reply, roots.TrustDomain); err != nil {
+		return &LeafHealthError{Stage: LeafHealthStageVerify, Err: err}
+	}
+	if err := checkLeafValidity(c.getClock().Now(), &reply); err != nil {
+		return &LeafHealthError{Stage: LeafHealthStageVerify, Err: err}
+	}
+	if err := c.checkLeafTTL(&reply); err != nil {
+		return &LeafHealthError{Stage: LeafHealthStageVerify, Err: err}
+	}
+	return nil
+}
@@ -0,0 +1,204 @@
+package cachetype
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/consul/agent/connect"
+	"github.com/hashicorp/consul/agent/structs"
+)
+
+// localLeafTTL is how long leaves signed by a LocalSigner are valid for,
+// matching the default leaf TTL of the servers' built-in CA.
+const localLeafTTL = 72 * time.Hour
+
+// LocalSigner signs leaf certs with a CA generated in memory instead of
+// the servers' CA. It's meant for offline development where there is no
+// cluster to sign leaves, and must not be used in production since its CA
+// is unknown to every other agent.
+type LocalSigner struct {
+	key   crypto.Signer
+	cert  *x509.Certificate
+	keyID []byte
+	roots *structs.IndexedCARoots
+
+	// index is the last index used, so that each leaf gets a higher index
+	// and serial number than the one before.
+	lock  sync.Mutex
+	index uint64
+}
+
+// NewLocalSigner returns a LocalSigner with a newly generated CA for the
+// given trust domain, e.g. "11111111-2222-3333-4444-555555555555.consul".
+func NewLocalSigner(trustDomain string) (*LocalSigner, error) {
+	key, _, err := connect.GeneratePrivateKey()
+	if err != nil {
+		return nil, err
+	}
+	keyID, err := connect.KeyId(key.Public())
+	if err != nil {
+		return nil, err
+	}
+
+	id := &url.URL{Scheme: "spiffe", Host: trustDomain}
+	now := time.Now()
+	template := x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "Consul Local CA"},
+		URIs:                  []*url.URL{id},
+		BasicConstraintsValid: true,
+		KeyUsage: x509.KeyUsageCertSign |
+			x509.KeyUsageCRLSign |
+			x509.KeyUsageDigitalSignature,
+		IsCA:           true,
+		NotAfter:       now.Add(10 * 365 * 24 * time.Hour),
+		NotBefore:      now.Add(-1 * time.Minute),
+		AuthorityKeyId: keyID,
+		SubjectKeyId:   keyID,
+	}
+	bs, err := x509.CreateCertificate(rand.Reader, &template, &template, key.Public(), key)
+	if err != nil {
+		return nil, fmt.Errorf("error generating local CA certificate: %s", err)
+	}
+	cert, err := x509.ParseCertificate(bs)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing local CA certificate: %s", err)
+	}
+	certPEM, err := encodeCertPEM(bs)
+	if err != nil {
+		return nil, err
+	}
+	rootID, err := connect.CalculateCertFingerprint(certPEM)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &LocalSigner{key: key, cert: cert, keyID: keyID, index: 1}
+	s.roots = &structs.IndexedCARoots{
+		ActiveRootID: rootID,
+		TrustDomain:  trustDomain,
+		Roots: []*structs.CARoot{{
+			ID:           rootID,
+			Name:         "Consul Local CA",
+			SerialNumber: 1,
+			SigningKeyID: connect.HexString(keyID),
+			NotBefore:    cert.NotBefore,
+			NotAfter:     cert.NotAfter,
+			RootCert:     certPEM,
+			Active:       true,
+			RaftIndex:    structs.RaftIndex{CreateIndex: 1, ModifyIndex: 1},
+		}},
+		QueryMeta: structs.QueryMeta{Index: 1},
+	}
+	return s, nil
+}
+
+// Roots returns the roots holding the local CA. They must not be modified.
+func (s *LocalSigner) Roots() *structs.IndexedCARoots {
+	return s.roots
+}
+
+// sign signs the CSR of the request like ConnectCA.Sign would, filling in
+// reply. The CSR must be for a service ID.
+func (s *LocalSigner) sign(args *structs.CASignRequest, reply *structs.IssuedCert) error {
+	csr, err := connect.ParseCSR(args.CSR)
+	if err != nil {
+		return err
+	}
+	if err := csr.CheckSignature(); err != nil {
+		return fmt.Errorf("invalid CSR signature: %s", err)
+	}
+	if len(csr.URIs) == 0 {
+		return fmt.Errorf("CSR SAN does not contain a SPIFFE ID")
+	}
+	spiffeID, err := connect.ParseCertURI(csr.URIs[0])
+	if err != nil {
+		return err
+	}
+	serviceID, ok := spiffeID.(*connect.SpiffeIDService)
+	if !ok {
+		return fmt.Errorf("SPIFFE ID in CSR must be a service ID")
+	}
+	subjectKeyID, err := connect.KeyId(csr.PublicKey)
+	if err != nil {
+		return err
+	}
+
+	var extKeyUsage []x509.ExtKeyUsage
+	switch args.Usage {
+	case LeafUsageClient:
+		extKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}
+	case LeafUsageServer:
+		extKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth}
+	default:
+		extKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth, x509.ExtKeyUsageServerAuth}
+	}
+
+	s.lock.Lock()
+	s.index++
+	idx := s.index
+	s.lock.Unlock()
+
+	// Same as the servers, the cert is valid from a minute in the past.
+	notBefore := time.Now().Add(-1 * time.Minute)
+	if !args.NotBefore.IsZero() {
+		notBefore = args.NotBefore
+	}
+	template := x509.Certificate{
+		SerialNumber:          new(big.Int).SetUint64(idx),
+		Subject:               csr.Subject,
+		URIs:                  csr.URIs,
+		DNSNames:              csr.DNSNames,
+		BasicConstraintsValid: true,
+		KeyUsage: x509.KeyUsageDataEncipherment |
+			x509.KeyUsageKeyAgreement |
+			x509.KeyUsageDigitalSignature |
+			x509.KeyUsageKeyEncipherment,
+		ExtKeyUsage:    extKeyUsage,
+		NotAfter:       notBefore.Add(localLeafTTL),
+		NotBefore:      notBefore,
+		AuthorityKeyId: s.keyID,
+		SubjectKeyId:   subjectKeyID,
+	}
+	bs, err := x509.CreateCertificate(rand.Reader, &template, s.cert, csr.PublicKey, s.key)
+	if err != nil {
+		return fmt.Errorf("error generating certificate: %s", err)
+	}
+	cert, err := x509.ParseCertificate(bs)
+	if err != nil {
+		return fmt.Errorf("error parsing certificate: %s", err)
+	}
+	certPEM, err := encodeCertPEM(bs)
+	if err != nil {
+		return err
+	}
+
+	*reply = structs.IssuedCert{
+		SerialNumber: connect.HexString(cert.SerialNumber.Bytes()),
+		CertPEM:      certPEM,
+		Service:      serviceID.Service,
+		ServiceURI:   csr.URIs[0].String(),
+		ValidAfter:   cert.NotBefore,
+		ValidBefore:  cert.NotAfter,
+		RaftIndex:    structs.RaftIndex{CreateIndex: idx, ModifyIndex: idx},
+	}
+	return nil
+}
+
+// encodeCertPEM returns the DER encoded cert as PEM.
+func encodeCertPEM(der []byte) (string, error) {
+	var buf bytes.Buffer
+	if err := pem.Encode(&buf, &pem.Block{Type: "CERTIFICATE", Bytes: der}); err != nil {
+		return "", fmt.Errorf("error encoding certificate: %s", err)
+	}
+	return buf.String(), nil
+}
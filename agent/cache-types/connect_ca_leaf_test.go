@@ -1,15 +1,34 @@
 package cachetype
 
 import (
+	"bytes"
+	"context"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io/ioutil"
+	"log"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
 	"sync/atomic"
 	"testing"
 	"time"
 
+	"github.com/armon/go-metrics"
+	"github.com/hashicorp/consul/acl"
 	"github.com/hashicorp/consul/agent/cache"
+	"github.com/hashicorp/consul/agent/connect"
 	"github.com/hashicorp/consul/agent/structs"
+	"github.com/hashicorp/consul/testutil/retry"
+	"github.com/hashicorp/go-multierror"
 	"github.com/stretchr/testify/mock"
 	"github.com/stretchr/testify/require"
+	"golang.org/x/time/rate"
 )
 
 // Test that after an initial signing, new CA roots (new ID) will
@@ -17,7 +36,6 @@ import (
 func TestConnectCALeaf_changingRoots(t *testing.T) {
 	t.Parallel()
 
-	require := require.New(t)
 	rpc := TestRPC(t)
 	defer rpc.AssertExpectations(t)
 
@@ -51,9 +69,10 @@ func TestConnectCALeaf_changingRoots(t *testing.T) {
 	case <-time.After(100 * time.Millisecond):
 		t.Fatal("shouldn't block waiting for fetch")
 	case result := <-fetchCh:
-		require.Equal(cache.FetchResult{
-			Value: resp,
-			Index: 1,
+		requireFetchResult(t, cache.FetchResult{
+			Value:     resp,
+			Index:     1,
+			Generated: true,
 		}, result)
 	}
 
@@ -76,9 +95,10 @@ func TestConnectCALeaf_changingRoots(t *testing.T) {
 	case <-time.After(100 * time.Millisecond):
 		t.Fatal("shouldn't block waiting for fetch")
 	case result := <-fetchCh:
-		require.Equal(cache.FetchResult{
-			Value: resp,
-			Index: 2,
+		requireFetchResult(t, cache.FetchResult{
+			Value:     resp,
+			Index:     2,
+			Generated: true,
 		}, result)
 	}
 
@@ -91,12 +111,242 @@ func TestConnectCALeaf_changingRoots(t *testing.T) {
 	}
 }
 
+// Test that a leaf signed by a root the agent's roots don't include yet,
+// e.g. because the servers rotated before the roots update propagated, isn't
+// renewed again straight away. Renewal waits for the roots to change.
+func TestConnectCALeaf_signingRootNotYetInRoots(t *testing.T) {
+	t.Parallel()
+
+	rpc := TestRPC(t)
+	defer rpc.AssertExpectations(t)
+
+	typ, rootsCh := testCALeafType(t, rpc)
+	defer close(rootsCh)
+	rootsCh <- structs.IndexedCARoots{
+		ActiveRootID: "A",
+		TrustDomain:  connect.TestClusterID + ".consul",
+		Roots:        structs.CARoots{{ID: "A", Active: true}},
+		QueryMeta:    structs.QueryMeta{Index: 1},
+	}
+
+	// The servers have already rotated to root B, which signs the leaf
+	rootB := connect.TestCA(t, nil)
+	leafPEM, _ := connect.TestLeaf(t, "web", rootB)
+	var signs uint64
+	rpc.On("RPC", "ConnectCA.Sign", mock.Anything, mock.Anything).Return(nil).
+		Run(func(args mock.Arguments) {
+			reply := args.Get(2).(*structs.IssuedCert)
+			reply.CertPEM = leafPEM
+			reply.ValidBefore = time.Now().Add(12 * time.Hour)
+			reply.CreateIndex = atomic.AddUint64(&signs, 1)
+			reply.ModifyIndex = reply.CreateIndex
+		})
+
+	req := &ConnectCALeafRequest{Datacenter: "dc1", Service: "web"}
+	result, err := typ.Fetch(cache.FetchOptions{Timeout: 10 * time.Second}, req)
+	require.NoError(t, err)
+	require.Equal(t, uint64(1), result.Index)
+
+	// The next Fetch blocks rather than renewing even though root B isn't
+	// known yet
+	fetchCh := TestFetchCh(t, typ, cache.FetchOptions{MinIndex: 1, Timeout: 10 * time.Second}, req)
+	select {
+	case result := <-fetchCh:
+		t.Fatalf("should not return: %#v", result)
+	case <-time.After(200 * time.Millisecond):
+	}
+	require.Equal(t, uint64(1), atomic.LoadUint64(&signs))
+}
+
+// Test that a leaf pinned to a root isn't renewed by a rotation while the
+// pinned root is still trusted, and is renewed once it is removed.
+func TestConnectCALeaf_preferRootID(t *testing.T) {
+	t.Parallel()
+
+	rpc := TestRPC(t)
+	defer rpc.AssertExpectations(t)
+
+	typ, rootsCh := testCALeafType(t, rpc)
+	defer close(rootsCh)
+	rootsCh <- structs.IndexedCARoots{
+		ActiveRootID: "1",
+		TrustDomain:  "fake-trust-domain.consul",
+		Roots:        structs.CARoots{{ID: "1", Active: true}},
+		QueryMeta:    structs.QueryMeta{Index: 1},
+	}
+
+	// Instrument ConnectCA.Sign to return signed cert
+	var resp *structs.IssuedCert
+	var idx uint64
+	rpc.On("RPC", "ConnectCA.Sign", mock.Anything, mock.Anything).Return(nil).
+		Run(func(args mock.Arguments) {
+			reply := args.Get(2).(*structs.IssuedCert)
+			reply.ValidBefore = time.Now().Add(12 * time.Hour)
+			reply.CreateIndex = atomic.AddUint64(&idx, 1)
+			reply.ModifyIndex = reply.CreateIndex
+			resp = reply
+		})
+
+	// We'll reuse the fetch options and request
+	opts := cache.FetchOptions{MinIndex: 0, Timeout: 10 * time.Second}
+	req := &ConnectCALeafRequest{Datacenter: "dc1", Service: "web", PreferRootID: "1"}
+
+	// First fetch should return immediately
+	fetchCh := TestFetchCh(t, typ, opts, req)
+	select {
+	case <-time.After(100 * time.Millisecond):
+		t.Fatal("shouldn't block waiting for fetch")
+	case result := <-fetchCh:
+		requireFetchResult(t, cache.FetchResult{
+			Value:     resp,
+			Index:     1,
+			Generated: true,
+		}, result)
+	}
+
+	// Second fetch should block with set index
+	opts.MinIndex = 1
+	fetchCh = TestFetchCh(t, typ, opts, req)
+	select {
+	case result := <-fetchCh:
+		t.Fatalf("should not return: %#v", result)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	// Rotate to a new active root while the pinned one is still present,
+	// which should not trigger the sign req.
+	rootsCh <- structs.IndexedCARoots{
+		ActiveRootID: "2",
+		TrustDomain:  "fake-trust-domain.consul",
+		Roots:        structs.CARoots{{ID: "1"}, {ID: "2", Active: true}},
+		QueryMeta:    structs.QueryMeta{Index: 2},
+	}
+	select {
+	case result := <-fetchCh:
+		t.Fatalf("should not return: %#v", result)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	// Removing the pinned root should trigger the sign req.
+	rootsCh <- structs.IndexedCARoots{
+		ActiveRootID: "2",
+		TrustDomain:  "fake-trust-domain.consul",
+		Roots:        structs.CARoots{{ID: "2", Active: true}},
+		QueryMeta:    structs.QueryMeta{Index: 3},
+	}
+	select {
+	case <-time.After(100 * time.Millisecond):
+		t.Fatal("shouldn't block waiting for fetch")
+	case result := <-fetchCh:
+		requireFetchResult(t, cache.FetchResult{
+			Value:     resp,
+			Index:     2,
+			Generated: true,
+		}, result)
+	}
+}
+
+// Test that when the roots rotate twice in quick succession, a leaf that was
+// renewed for the first rotation is renewed again for the second even if
+// another leaf saw the second rotation first.
+func TestConnectCALeaf_rapidRotations(t *testing.T) {
+	t.Parallel()
+
+	require := require.New(t)
+	rpc := TestRPC(t)
+	defer rpc.AssertExpectations(t)
+
+	typ, rootsCh := testCALeafType(t, rpc)
+	defer close(rootsCh)
+	rootsCh <- structs.IndexedCARoots{
+		ActiveRootID: "A",
+		TrustDomain:  "fake-trust-domain.consul",
+		QueryMeta:    structs.QueryMeta{Index: 1},
+	}
+
+	// Instrument ConnectCA.Sign to record the active root each service's
+	// latest cert was signed under
+	var signedLock sync.Mutex
+	signedUnder := make(map[string]string)
+	var idx uint64
+	rpc.On("RPC", "ConnectCA.Sign", mock.Anything, mock.Anything).Return(nil).
+		Run(func(args mock.Arguments) {
+			csr, err := connect.ParseCSR(args.Get(1).(*structs.CASignRequest).CSR)
+			require.NoError(err)
+			uri, err := connect.ParseCertURI(csr.URIs[0])
+			require.NoError(err)
+			roots, err := typ.rootsFromCache("dc1")
+			require.NoError(err)
+			signedLock.Lock()
+			signedUnder[uri.(*connect.SpiffeIDService).Service] = roots.ActiveRootID
+			signedLock.Unlock()
+
+			reply := args.Get(2).(*structs.IssuedCert)
+			reply.ValidBefore = time.Now().Add(12 * time.Hour)
+			reply.CreateIndex = atomic.AddUint64(&idx, 1)
+			reply.ModifyIndex = reply.CreateIndex
+		})
+	signedAt := func(service string) string {
+		signedLock.Lock()
+		defer signedLock.Unlock()
+		return signedUnder[service]
+	}
+
+	fetch := func(service string, minIndex uint64) <-chan interface{} {
+		return TestFetchCh(t, typ, cache.FetchOptions{
+			MinIndex: minIndex,
+			Timeout:  10 * time.Second,
+		}, &ConnectCALeafRequest{Datacenter: "dc1", Service: service})
+	}
+	waitIndex := func(ch <-chan interface{}) uint64 {
+		t.Helper()
+		select {
+		case <-time.After(2 * time.Second):
+			t.Fatal("shouldn't block waiting for fetch")
+		case result := <-ch:
+			require.IsType(cache.FetchResult{}, result)
+			return result.(cache.FetchResult).Index
+		}
+		return 0
+	}
+
+	// Issue web under A
+	webIndex := waitIndex(fetch("web", 0))
+
+	// Rotate to B and web is renewed under it
+	webCh := fetch("web", webIndex)
+	time.Sleep(100 * time.Millisecond)
+	rootsCh <- structs.IndexedCARoots{
+		ActiveRootID: "B",
+		TrustDomain:  "fake-trust-domain.consul",
+		QueryMeta:    structs.QueryMeta{Index: 2},
+	}
+	webIndex = waitIndex(webCh)
+	require.Equal("B", signedAt("web"))
+
+	// Issue api under B too
+	apiIndex := waitIndex(fetch("api", 0))
+	require.Equal("B", signedAt("api"))
+
+	// Rotate straight on to C, which api sees first
+	rootsCh <- structs.IndexedCARoots{
+		ActiveRootID: "C",
+		TrustDomain:  "fake-trust-domain.consul",
+		QueryMeta:    structs.QueryMeta{Index: 3},
+	}
+	waitIndex(fetch("api", apiIndex))
+	require.Equal("C", signedAt("api"))
+
+	// web must not be left on B
+	waitIndex(fetch("web", webIndex))
+	require.Equal("C", signedAt("web"))
+}
+
 // Test that after an initial signing, an expiringLeaf will trigger a
 // blocking query to resign.
 func TestConnectCALeaf_expiringLeaf(t *testing.T) {
 	t.Parallel()
 
-	require := require.New(t)
 	rpc := TestRPC(t)
 	defer rpc.AssertExpectations(t)
 
@@ -117,10 +367,10 @@ func TestConnectCALeaf_expiringLeaf(t *testing.T) {
 			reply.CreateIndex = atomic.AddUint64(&idx, 1)
 			reply.ModifyIndex = reply.CreateIndex
 
-			// This sets the validity to 0 on the first call, and
-			// 12 hours+ on subsequent calls. This means that our first
-			// cert expires immediately.
-			reply.ValidBefore = time.Now().Add((12 * time.Hour) *
+			// This sets the validity to 1 hour on the first call, and
+			// 13 hours+ on subsequent calls. This means that our first
+			// cert is already due for renewal.
+			reply.ValidBefore = time.Now().Add(time.Hour + (12*time.Hour)*
 				time.Duration(reply.CreateIndex-1))
 
 			resp = reply
@@ -136,22 +386,25 @@ func TestConnectCALeaf_expiringLeaf(t *testing.T) {
 	case <-time.After(100 * time.Millisecond):
 		t.Fatal("shouldn't block waiting for fetch")
 	case result := <-fetchCh:
-		require.Equal(cache.FetchResult{
-			Value: resp,
-			Index: 1,
+		requireFetchResult(t, cache.FetchResult{
+			Value:     resp,
+			Index:     1,
+			Generated: true,
 		}, result)
 	}
 
 	// Second fetch should return immediately despite there being
-	// no updated CA roots, because we issued an expired cert.
+	// no updated CA roots, because we issued a cert that is expiring.
+	opts.MinIndex = 1
 	fetchCh = TestFetchCh(t, typ, opts, req)
 	select {
 	case <-time.After(100 * time.Millisecond):
 		t.Fatal("shouldn't block waiting for fetch")
 	case result := <-fetchCh:
-		require.Equal(cache.FetchResult{
-			Value: resp,
-			Index: 2,
+		requireFetchResult(t, cache.FetchResult{
+			Value:     resp,
+			Index:     2,
+			Generated: true,
 		}, result)
 	}
 
@@ -216,9 +469,10 @@ func TestConnectCALeaf_multipleClientsDifferentTokens(t *testing.T) {
 	case <-time.After(100 * time.Millisecond):
 		t.Fatal("shouldn't block waiting for fetch")
 	case result := <-fetchCh:
-		require.Equal(cache.FetchResult{
-			Value: resp,
-			Index: 1,
+		requireFetchResult(t, cache.FetchResult{
+			Value:     resp,
+			Index:     1,
+			Generated: true,
 		}, result)
 		certA = result.(cache.FetchResult).Value.(*structs.IssuedCert)
 	}
@@ -229,9 +483,10 @@ func TestConnectCALeaf_multipleClientsDifferentTokens(t *testing.T) {
 	case <-time.After(100 * time.Millisecond):
 		t.Fatal("shouldn't block waiting for fetch")
 	case result := <-fetchCh:
-		require.Equal(cache.FetchResult{
-			Value: resp,
-			Index: 2,
+		requireFetchResult(t, cache.FetchResult{
+			Value:     resp,
+			Index:     2,
+			Generated: true,
 		}, result)
 		// Different tokens should result in different certs. Note that we don't
 		// actually generate and sign real certs in this test with our mock RPC but
@@ -277,7 +532,6 @@ func TestConnectCALeaf_multipleClientsDifferentTokens(t *testing.T) {
 func TestConnectCALeaf_multipleClientsSameToken(t *testing.T) {
 	t.Parallel()
 
-	require := require.New(t)
 	rpc := TestRPC(t)
 	defer rpc.AssertExpectations(t)
 
@@ -312,9 +566,10 @@ func TestConnectCALeaf_multipleClientsSameToken(t *testing.T) {
 	case <-time.After(100 * time.Millisecond):
 		t.Fatal("shouldn't block waiting for fetch")
 	case result := <-fetchCh:
-		require.Equal(cache.FetchResult{
-			Value: resp,
-			Index: 1,
+		requireFetchResult(t, cache.FetchResult{
+			Value:     resp,
+			Index:     1,
+			Generated: true,
 		}, result)
 	}
 
@@ -324,7 +579,7 @@ func TestConnectCALeaf_multipleClientsSameToken(t *testing.T) {
 	case <-time.After(100 * time.Millisecond):
 		t.Fatal("shouldn't block waiting for fetch")
 	case result := <-fetchCh:
-		require.Equal(cache.FetchResult{
+		requireFetchResult(t, cache.FetchResult{
 			Value: resp,
 			Index: 1, // Same result as last fetch
 		}, result)
@@ -348,46 +603,4518 @@ func TestConnectCALeaf_multipleClientsSameToken(t *testing.T) {
 	}
 }
 
-// testCALeafType returns a *ConnectCALeaf that is pre-configured to
-// use the given RPC implementation for "ConnectCA.Sign" operations.
-func testCALeafType(t *testing.T, rpc RPC) (*ConnectCALeaf, chan structs.IndexedCARoots) {
-	// This creates an RPC implementation that will block until the
-	// value is sent on the channel. This lets us control when the
-	// next values show up.
-	rootsCh := make(chan structs.IndexedCARoots, 10)
-	rootsRPC := &testGatedRootsRPC{ValueCh: rootsCh}
+// Test that results report whether the cert was freshly signed or served
+// from the certs already issued.
+func TestConnectCALeaf_generated(t *testing.T) {
+	t.Parallel()
 
-	// Create a cache
-	c := cache.TestCache(t)
-	c.RegisterType(ConnectCARootName, &ConnectCARoot{RPC: rootsRPC}, &cache.RegisterOptions{
-		// Disable refresh so that the gated channel controls the
-		// request directly. Otherwise, we get background refreshes and
-		// it screws up the ordering of the channel reads of the
-		// testGatedRootsRPC implementation.
-		Refresh: false,
-	})
+	require := require.New(t)
+	rpc := TestRPC(t)
+	defer rpc.AssertExpectations(t)
 
-	// Create the leaf type
-	return &ConnectCALeaf{RPC: rpc, Cache: c}, rootsCh
+	typ, rootsCh := testCALeafType(t, rpc)
+	defer close(rootsCh)
+	rootsCh <- structs.IndexedCARoots{
+		ActiveRootID: "1",
+		TrustDomain:  "fake-trust-domain.consul",
+		QueryMeta:    structs.QueryMeta{Index: 1},
+	}
+
+	rpc.On("RPC", "ConnectCA.Sign", mock.Anything, mock.Anything).Return(nil).
+		Run(func(args mock.Arguments) {
+			reply := args.Get(2).(*structs.IssuedCert)
+			reply.ValidBefore = time.Now().Add(12 * time.Hour)
+			reply.CreateIndex = 1
+			reply.ModifyIndex = 1
+		}).Once()
+
+	opts := cache.FetchOptions{MinIndex: 0, Timeout: 10 * time.Second}
+	req := &ConnectCALeafRequest{Datacenter: "dc1", Service: "web"}
+
+	// The first fetch has to sign a cert
+	result, err := typ.Fetch(opts, req)
+	require.NoError(err)
+	require.True(result.Generated)
+	require.Equal(uint64(1), result.Index)
+
+	// The cert is still valid so the next one is served as is
+	result, err = typ.Fetch(opts, req)
+	require.NoError(err)
+	require.False(result.Generated)
+	require.Equal(uint64(1), result.Index)
 }
 
-// testGatedRootsRPC will send each subsequent value on the channel as the
-// RPC response, blocking if it is waiting for a value on the channel. This
-// can be used to control when background fetches are returned and what they
-// return.
-//
-// This should be used with Refresh = false for the registration options so
-// automatic refreshes don't mess up the channel read ordering.
-type testGatedRootsRPC struct {
-	ValueCh chan structs.IndexedCARoots
+// Test that freshness info supplied by the server is kept with the cached
+// leaf, and left empty when the server doesn't supply any.
+func TestConnectCALeaf_freshness(t *testing.T) {
+	t.Parallel()
+
+	require := require.New(t)
+	rpc := TestRPC(t)
+	defer rpc.AssertExpectations(t)
+
+	typ, rootsCh := testCALeafType(t, rpc)
+	defer close(rootsCh)
+	rootsCh <- structs.IndexedCARoots{
+		ActiveRootID: "1",
+		TrustDomain:  "fake-trust-domain.consul",
+		QueryMeta:    structs.QueryMeta{Index: 1},
+	}
+
+	// The first sign is for web and supplies freshness info, the second
+	// for db doesn't
+	issuedAt := time.Now().Add(-time.Minute).UTC().Round(time.Second)
+	rpc.On("RPC", "ConnectCA.Sign", mock.Anything, mock.Anything).Return(nil).
+		Run(func(args mock.Arguments) {
+			reply := args.Get(2).(*structs.IssuedCert)
+			reply.ValidBefore = time.Now().Add(12 * time.Hour)
+			reply.CreateIndex = 1
+			reply.ModifyIndex = 1
+			reply.IssuedAt = issuedAt
+			reply.FreshnessToken = "fresh-token"
+		}).Once()
+	rpc.On("RPC", "ConnectCA.Sign", mock.Anything, mock.Anything).Return(nil).
+		Run(func(args mock.Arguments) {
+			reply := args.Get(2).(*structs.IssuedCert)
+			reply.ValidBefore = time.Now().Add(12 * time.Hour)
+			reply.CreateIndex = 2
+			reply.ModifyIndex = 2
+		}).Once()
+
+	opts := cache.FetchOptions{MinIndex: 0, Timeout: 10 * time.Second}
+
+	// Populated by the server: round-trips through the cached value too
+	req := &ConnectCALeafRequest{Datacenter: "dc1", Service: "web"}
+	for i := 0; i < 2; i++ {
+		result, err := typ.Fetch(opts, req)
+		require.NoError(err)
+		v := result.Value.(*structs.IssuedCert)
+		require.Equal(issuedAt, v.IssuedAt)
+		require.Equal("fresh-token", v.FreshnessToken)
+	}
+
+	// Not provided by the server: stays empty
+	result, err := typ.Fetch(opts, &ConnectCALeafRequest{Datacenter: "dc1", Service: "db"})
+	require.NoError(err)
+	v := result.Value.(*structs.IssuedCert)
+	require.True(v.IssuedAt.IsZero())
+	require.Empty(v.FreshnessToken)
 }
 
-func (r *testGatedRootsRPC) RPC(method string, args interface{}, reply interface{}) error {
-	if method != "ConnectCA.Roots" {
-		return fmt.Errorf("invalid RPC method: %s", method)
+// Test that once draining, leaves that are still valid keep being served but
+// no new ones are signed.
+func TestConnectCALeaf_drain(t *testing.T) {
+	t.Parallel()
+
+	require := require.New(t)
+	rpc := TestRPC(t)
+	defer rpc.AssertExpectations(t)
+
+	typ, rootsCh := testCALeafType(t, rpc)
+	defer close(rootsCh)
+	rootsCh <- structs.IndexedCARoots{
+		ActiveRootID: "1",
+		TrustDomain:  "fake-trust-domain.consul",
+		QueryMeta:    structs.QueryMeta{Index: 1},
 	}
 
-	replyReal := reply.(*structs.IndexedCARoots)
-	*replyReal = <-r.ValueCh
-	return nil
+	var signs uint64
+	rpc.On("RPC", "ConnectCA.Sign", mock.Anything, mock.Anything).Return(nil).
+		Run(func(args mock.Arguments) {
+			reply := args.Get(2).(*structs.IssuedCert)
+			reply.ValidBefore = time.Now().Add(12 * time.Hour)
+			reply.CreateIndex = atomic.AddUint64(&signs, 1)
+			reply.ModifyIndex = reply.CreateIndex
+		})
+
+	opts := cache.FetchOptions{MinIndex: 0, Timeout: 10 * time.Second}
+	req := &ConnectCALeafRequest{Datacenter: "dc1", Service: "web"}
+	_, err := typ.Fetch(opts, req)
+	require.NoError(err)
+
+	// A blocked Fetch that would renew for a rotation after draining starts
+	// keeps the current leaf instead
+	fetchCh := TestFetchCh(t, typ, cache.FetchOptions{MinIndex: 1, Timeout: 500 * time.Millisecond}, req)
+	time.Sleep(50 * time.Millisecond)
+	typ.Drain()
+	rootsCh <- structs.IndexedCARoots{
+		ActiveRootID: "2",
+		TrustDomain:  "fake-trust-domain.consul",
+		QueryMeta:    structs.QueryMeta{Index: 2},
+	}
+	select {
+	case result := <-fetchCh:
+		require.Equal(cache.FetchResult{}, result)
+	case <-time.After(2 * time.Second):
+		t.Fatal("Fetch didn't time out")
+	}
+
+	// The valid leaf is still served
+	result, err := typ.Fetch(opts, req)
+	require.NoError(err)
+	require.Equal(uint64(1), result.Index)
+
+	// A leaf that would have to be signed isn't
+	_, err = typ.Fetch(opts, &ConnectCALeafRequest{Datacenter: "dc1", Service: "db"})
+	require.Equal(errLeafDraining, err)
+	require.Equal(uint64(1), atomic.LoadUint64(&signs))
+}
+
+// Test that Peek returns the cached leaf and its renewal time without ever
+// signing one.
+func TestConnectCALeaf_peek(t *testing.T) {
+	t.Parallel()
+
+	require := require.New(t)
+	rpc := TestRPC(t)
+	defer rpc.AssertExpectations(t)
+
+	typ, rootsCh := testCALeafType(t, rpc)
+	defer close(rootsCh)
+	rootsCh <- structs.IndexedCARoots{
+		ActiveRootID: "1",
+		TrustDomain:  "fake-trust-domain.consul",
+		QueryMeta:    structs.QueryMeta{Index: 1},
+	}
+
+	var signs uint64
+	rpc.On("RPC", "ConnectCA.Sign", mock.Anything, mock.Anything).Return(nil).
+		Run(func(args mock.Arguments) {
+			reply := args.Get(2).(*structs.IssuedCert)
+			reply.ValidBefore = time.Now().Add(12 * time.Hour)
+			reply.CreateIndex = atomic.AddUint64(&signs, 1)
+			reply.ModifyIndex = reply.CreateIndex
+		})
+
+	req := &ConnectCALeafRequest{Datacenter: "dc1", Service: "web"}
+
+	// Nothing is cached yet and peeking doesn't sign
+	cert, _, ok := typ.Peek(req)
+	require.False(ok)
+	require.Nil(cert)
+	require.Equal(uint64(0), atomic.LoadUint64(&signs))
+
+	result, err := typ.Fetch(cache.FetchOptions{Timeout: 10 * time.Second}, req)
+	require.NoError(err)
+
+	// Now the cached leaf is returned as is, due for renewal at its soft
+	// expiry
+	cert, renewAt, ok := typ.Peek(req)
+	require.True(ok)
+	require.Equal(result.Value, cert)
+	softExpiry, _ := calculateSoftExpiry(time.Now(), cert)
+	require.Equal(softExpiry, renewAt)
+	require.Equal(uint64(1), atomic.LoadUint64(&signs))
+
+	// Other leaves still aren't present
+	_, _, ok = typ.Peek(&ConnectCALeafRequest{Datacenter: "dc1", Service: "db"})
+	require.False(ok)
+	require.Equal(uint64(1), atomic.LoadUint64(&signs))
+}
+
+// Test that warming generates and caches leaves for each request, collecting
+// the errors of those that fail.
+func TestConnectCALeaf_warm(t *testing.T) {
+	t.Parallel()
+
+	require := require.New(t)
+	rpc := TestRPC(t)
+	defer rpc.AssertExpectations(t)
+
+	typ, rootsCh := testCALeafType(t, rpc)
+	defer close(rootsCh)
+	rootsCh <- structs.IndexedCARoots{
+		ActiveRootID: "1",
+		TrustDomain:  "fake-trust-domain.consul",
+		QueryMeta:    structs.QueryMeta{Index: 1},
+	}
+
+	// Signing fails for db
+	var signs uint64
+	rpc.On("RPC", "ConnectCA.Sign", mock.Anything, mock.Anything).
+		Return(func(method string, args, reply interface{}) error {
+			csr, err := connect.ParseCSR(args.(*structs.CASignRequest).CSR)
+			require.NoError(err)
+			uri, err := connect.ParseCertURI(csr.URIs[0])
+			require.NoError(err)
+			if uri.(*connect.SpiffeIDService).Service == "db" {
+				return errors.New("sign failed")
+			}
+			return nil
+		}).
+		Run(func(args mock.Arguments) {
+			reply := args.Get(2).(*structs.IssuedCert)
+			reply.ValidBefore = time.Now().Add(12 * time.Hour)
+			reply.CreateIndex = atomic.AddUint64(&signs, 1)
+			reply.ModifyIndex = reply.CreateIndex
+		})
+
+	var reqs []*ConnectCALeafRequest
+	for _, service := range []string{"web", "db", "api"} {
+		reqs = append(reqs, &ConnectCALeafRequest{Datacenter: "dc1", Service: service})
+	}
+	err := typ.Warm(context.Background(), reqs)
+	require.Error(err)
+	require.Contains(err.Error(), `service "db": sign failed`)
+	require.Len(err.(*multierror.Error).Errors, 1)
+	require.Equal(uint64(3), atomic.LoadUint64(&signs))
+
+	// The other leaves are cached, so a Fetch returns them without signing
+	for _, req := range []*ConnectCALeafRequest{reqs[0], reqs[2]} {
+		cert, _, ok := typ.Peek(req)
+		require.True(ok, "service %s", req.Service)
+		result, err := typ.Fetch(cache.FetchOptions{Timeout: 10 * time.Second}, req)
+		require.NoError(err)
+		require.Equal(cert, result.Value)
+	}
+	_, _, ok := typ.Peek(reqs[1])
+	require.False(ok)
+	require.Equal(uint64(3), atomic.LoadUint64(&signs))
+
+	// Warming again only retries the failed leaf
+	require.Error(typ.Warm(context.Background(), reqs))
+	require.Equal(uint64(4), atomic.LoadUint64(&signs))
+
+	// A cancelled context stops the batch without signing
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	err = typ.Warm(ctx, []*ConnectCALeafRequest{{Datacenter: "dc1", Service: "new"}})
+	require.Error(err)
+	require.Contains(err.Error(), "context canceled")
+	require.Equal(uint64(4), atomic.LoadUint64(&signs))
+}
+
+// Test that a batch fetch returns a leaf for each service, generating only
+// those that aren't cached, and reports failures per service.
+func TestConnectCALeaf_fetchBatch(t *testing.T) {
+	t.Parallel()
+
+	require := require.New(t)
+	rpc := TestRPC(t)
+	defer rpc.AssertExpectations(t)
+
+	typ, rootsCh := testCALeafType(t, rpc)
+	defer close(rootsCh)
+	rootsCh <- structs.IndexedCARoots{
+		ActiveRootID: "1",
+		TrustDomain:  "fake-trust-domain.consul",
+		QueryMeta:    structs.QueryMeta{Index: 1},
+	}
+
+	var lock sync.Mutex
+	signed := make(map[string]int)
+	var idx uint64
+	rpc.On("RPC", "ConnectCA.Sign", mock.Anything, mock.Anything).
+		Return(func(_ string, args interface{}, reply interface{}) error {
+			csr, err := connect.ParseCSR(args.(*structs.CASignRequest).CSR)
+			require.NoError(err)
+			uri, err := connect.ParseCertURI(csr.URIs[0])
+			require.NoError(err)
+			service := uri.(*connect.SpiffeIDService).Service
+
+			lock.Lock()
+			signed[service]++
+			lock.Unlock()
+			if service == "bad" {
+				return errors.New("sign failed")
+			}
+			r := reply.(*structs.IssuedCert)
+			r.Service = service
+			r.ValidBefore = time.Now().Add(12 * time.Hour)
+			r.CreateIndex = atomic.AddUint64(&idx, 1)
+			r.ModifyIndex = r.CreateIndex
+			return nil
+		})
+
+	// The leaves are got through the cache
+	c := typ.Cache.(*cache.Cache)
+	c.RegisterType(ConnectCALeafName, typ, &cache.RegisterOptions{
+		Refresh:        false,
+		RefreshTimeout: 10 * time.Second,
+	})
+
+	// One leaf is already cached
+	_, err := typ.Fetch(cache.FetchOptions{Timeout: 10 * time.Second},
+		&ConnectCALeafRequest{Datacenter: "dc1", Service: "web"})
+	require.NoError(err)
+
+	certs, errs := typ.FetchBatch(10*time.Second, &ConnectCALeafBatchRequest{
+		Datacenter: "dc1",
+		Services:   []string{"web", "api", "admin", "api"},
+	})
+	require.Empty(errs)
+	require.Len(certs, 3)
+	for _, service := range []string{"web", "api", "admin"} {
+		require.Equal(service, certs[service].Service)
+		require.Equal(1, signed[service], service)
+
+		// The batch filled the cache
+		cert, meta, err := c.Get(ConnectCALeafName, &ConnectCALeafRequest{Datacenter: "dc1", Service: service})
+		require.NoError(err)
+		require.True(meta.Hit, service)
+		require.Equal(certs[service], cert)
+	}
+
+	// A failing service doesn't stop the others
+	certs, errs = typ.FetchBatch(10*time.Second, &ConnectCALeafBatchRequest{
+		Datacenter: "dc1",
+		Services:   []string{"web", "bad"},
+	})
+	require.Len(certs, 1)
+	require.NotNil(certs["web"])
+	require.Len(errs, 1)
+	require.EqualError(errs["bad"], "sign failed")
+}
+
+// Test that invalidating a leaf makes both blocked and new Fetches for it
+// regenerate, without affecting other leaves.
+// Test that the leaves held are listed with their expiry and signing key.
+func TestConnectCALeaf_leaves(t *testing.T) {
+	t.Parallel()
+
+	require := require.New(t)
+	rpc := TestRPC(t)
+	defer rpc.AssertExpectations(t)
+
+	typ, rootsCh := testCALeafType(t, rpc)
+	defer close(rootsCh)
+	rootsCh <- structs.IndexedCARoots{
+		ActiveRootID: "1",
+		TrustDomain:  connect.TestClusterID + ".consul",
+		QueryMeta:    structs.QueryMeta{Index: 1},
+	}
+
+	root := connect.TestCA(t, nil)
+	rootCert, err := connect.ParseCert(root.RootCert)
+	require.NoError(err)
+	signingKeyID := connect.HexString(rootCert.SubjectKeyId)
+
+	validity := map[string]time.Duration{
+		"web": 12 * time.Hour,
+		"db":  6 * time.Hour,
+		"api": 3 * time.Hour,
+	}
+	expiry := make(map[string]time.Time)
+	var idx uint64
+	rpc.On("RPC", "ConnectCA.Sign", mock.Anything, mock.Anything).Return(nil).
+		Run(func(args mock.Arguments) {
+			csr, err := connect.ParseCSR(args.Get(1).(*structs.CASignRequest).CSR)
+			require.NoError(err)
+			uri, err := connect.ParseCertURI(csr.URIs[0])
+			require.NoError(err)
+			service := uri.(*connect.SpiffeIDService).Service
+
+			reply := args.Get(2).(*structs.IssuedCert)
+			reply.CertPEM, _ = connect.TestLeaf(t, service, root)
+			reply.ValidBefore = time.Now().Add(validity[service])
+			reply.CreateIndex = atomic.AddUint64(&idx, 1)
+			reply.ModifyIndex = reply.CreateIndex
+			expiry[service] = reply.ValidBefore
+		})
+
+	require.Empty(typ.Leaves())
+
+	opts := cache.FetchOptions{MinIndex: 0, Timeout: 10 * time.Second}
+	for _, service := range []string{"web", "db", "api"} {
+		_, err := typ.Fetch(opts, &ConnectCALeafRequest{
+			Datacenter: "dc1", Service: service, Token: "secret"})
+		require.NoError(err)
+	}
+
+	leaves := typ.Leaves()
+	require.Len(leaves, 3)
+	for i, service := range []string{"api", "db", "web"} {
+		require.Equal(service, leaves[i].Request.Service)
+		require.Equal("dc1", leaves[i].Request.Datacenter)
+		require.Empty(leaves[i].Request.Token)
+		require.Equal(expiry[service], leaves[i].ValidBefore)
+		require.Equal(signingKeyID, leaves[i].SigningKeyID)
+	}
+
+	// Invalidated leaves aren't listed
+	typ.Invalidate(&ConnectCALeafRequest{Datacenter: "dc1", Service: "db", Token: "secret"})
+	leaves = typ.Leaves()
+	require.Len(leaves, 2)
+	require.Equal("api", leaves[0].Request.Service)
+	require.Equal("web", leaves[1].Request.Service)
+}
+
+func TestConnectCALeaf_invalidate(t *testing.T) {
+	t.Parallel()
+
+	require := require.New(t)
+	rpc := TestRPC(t)
+	defer rpc.AssertExpectations(t)
+
+	typ, rootsCh := testCALeafType(t, rpc)
+	defer close(rootsCh)
+	rootsCh <- structs.IndexedCARoots{
+		ActiveRootID: "1",
+		TrustDomain:  "fake-trust-domain.consul",
+		QueryMeta:    structs.QueryMeta{Index: 1},
+	}
+
+	var idx uint64
+	rpc.On("RPC", "ConnectCA.Sign", mock.Anything, mock.Anything).Return(nil).
+		Run(func(args mock.Arguments) {
+			reply := args.Get(2).(*structs.IssuedCert)
+			reply.ValidBefore = time.Now().Add(12 * time.Hour)
+			reply.CreateIndex = atomic.AddUint64(&idx, 1)
+			reply.ModifyIndex = reply.CreateIndex
+		})
+
+	opts := cache.FetchOptions{MinIndex: 0, Timeout: 10 * time.Second}
+	web := &ConnectCALeafRequest{Datacenter: "dc1", Service: "web"}
+	db := &ConnectCALeafRequest{Datacenter: "dc1", Service: "db"}
+
+	result, err := typ.Fetch(opts, web)
+	require.NoError(err)
+	require.Equal(uint64(1), result.Index)
+	result, err = typ.Fetch(opts, db)
+	require.NoError(err)
+	require.Equal(uint64(2), result.Index)
+
+	// A blocked Fetch regenerates as soon as its leaf is invalidated
+	fetchCh := TestFetchCh(t, typ, cache.FetchOptions{MinIndex: 1, Timeout: 10 * time.Second}, web)
+	select {
+	case result := <-fetchCh:
+		t.Fatalf("should not return: %#v", result)
+	case <-time.After(100 * time.Millisecond):
+	}
+	typ.Invalidate(web)
+	select {
+	case <-time.After(100 * time.Millisecond):
+		t.Fatal("shouldn't block after invalidating")
+	case result := <-fetchCh:
+		require.IsType(cache.FetchResult{}, result)
+		require.True(result.(cache.FetchResult).Generated)
+		require.Equal(uint64(3), result.(cache.FetchResult).Index)
+	}
+
+	// A new Fetch after invalidating regenerates rather than serving the
+	// cached leaf
+	typ.Invalidate(web)
+	result, err = typ.Fetch(opts, web)
+	require.NoError(err)
+	require.True(result.Generated)
+	require.Equal(uint64(4), result.Index)
+
+	// Other leaves are untouched
+	result, err = typ.Fetch(opts, db)
+	require.NoError(err)
+	require.False(result.Generated)
+	require.Equal(uint64(2), result.Index)
+
+	// Invalidating a leaf that was never issued is a no-op
+	typ.Invalidate(&ConnectCALeafRequest{Datacenter: "dc1", Service: "api"})
+}
+
+// Test that a SPIFFE ID formatter sets the ID requested in the CSR, and is
+// what supplied CSRs are checked against.
+func TestConnectCALeaf_spiffeIDFormatter(t *testing.T) {
+	t.Parallel()
+
+	require := require.New(t)
+	rpc := TestRPC(t)
+	defer rpc.AssertExpectations(t)
+
+	typ, rootsCh := testCALeafType(t, rpc)
+	defer close(rootsCh)
+	rootsCh <- structs.IndexedCARoots{
+		ActiveRootID: "1",
+		TrustDomain:  "fake-trust-domain.consul",
+		QueryMeta:    structs.QueryMeta{Index: 1},
+	}
+	typ.SpiffeIDFormatter = func(id *connect.SpiffeIDService) *url.URL {
+		return &url.URL{Scheme: "spiffe", Host: id.Host, Path: "/consul/" + id.Datacenter + "/" + id.Service}
+	}
+
+	var uris []string
+	rpc.On("RPC", "ConnectCA.Sign", mock.Anything, mock.Anything).Return(nil).
+		Run(func(args mock.Arguments) {
+			csr, err := connect.ParseCSR(args.Get(1).(*structs.CASignRequest).CSR)
+			require.NoError(err)
+			for _, uri := range csr.URIs {
+				uris = append(uris, uri.String())
+			}
+
+			reply := args.Get(2).(*structs.IssuedCert)
+			reply.ValidBefore = time.Now().Add(12 * time.Hour)
+			reply.CreateIndex = 1
+			reply.ModifyIndex = 1
+		}).Once()
+
+	opts := cache.FetchOptions{MinIndex: 0, Timeout: 10 * time.Second}
+	_, err := typ.Fetch(opts, &ConnectCALeafRequest{Datacenter: "dc1", Service: "web"})
+	require.NoError(err)
+	require.Equal([]string{"spiffe://fake-trust-domain.consul/consul/dc1/web"}, uris)
+
+	// A supplied CSR for the Consul format no longer matches
+	csr, _ := connect.TestCSR(t, &connect.SpiffeIDService{
+		Host:       "fake-trust-domain.consul",
+		Datacenter: "dc1",
+		Namespace:  "default",
+		Service:    "db",
+	})
+	_, err = typ.Fetch(opts, &ConnectCALeafRequest{Datacenter: "dc1", Service: "db", CSR: csr})
+	require.EqualError(err, `CSR must have the SPIFFE ID "spiffe://fake-trust-domain.consul/consul/dc1/db" as its first URI SAN`)
+}
+
+// Test that the recording sign RPC captures the generated CSRs so their
+// SANs, subject and key can be asserted on, and that its replies can be
+// changed.
+func TestConnectCALeaf_signRecorder(t *testing.T) {
+	t.Parallel()
+
+	require := require.New(t)
+	rpc := TestSignRPC(t)
+	typ, rootsCh := testCALeafType(t, rpc)
+	defer close(rootsCh)
+	rootsCh <- structs.IndexedCARoots{
+		ActiveRootID: "1",
+		TrustDomain:  "fake-trust-domain.consul",
+		QueryMeta:    structs.QueryMeta{Index: 1},
+	}
+
+	opts := cache.FetchOptions{MinIndex: 0, Timeout: 10 * time.Second}
+	result, err := typ.Fetch(opts, &ConnectCALeafRequest{
+		Token:      "token",
+		Datacenter: "dc1",
+		Service:    "web",
+		SNI:        "web.ingress.consul",
+		SubjectOrg: "Example",
+	})
+	require.NoError(err)
+	require.Equal(uint64(1), result.Index)
+
+	reqs := rpc.Requests()
+	require.Len(reqs, 1)
+	require.Equal("token", reqs[0].Token)
+	csrs := rpc.CSRs(t)
+	require.Len(csrs, 1)
+	require.NoError(csrs[0].CheckSignature())
+	require.Equal("spiffe://fake-trust-domain.consul/ns/default/dc/dc1/svc/web", csrs[0].URIs[0].String())
+	require.Equal([]string{"web.ingress.consul"}, csrs[0].DNSNames)
+	require.Equal([]string{"Example"}, csrs[0].Subject.Organization)
+	require.Equal(x509.ECDSA, csrs[0].PublicKeyAlgorithm)
+
+	// Replies can be changed or failed
+	rpc.Reply = func(req *structs.CASignRequest, reply *structs.IssuedCert) error {
+		return errors.New("sign failed")
+	}
+	_, err = typ.Fetch(opts, &ConnectCALeafRequest{Datacenter: "dc1", Service: "db"})
+	require.EqualError(err, "sign failed")
+	require.Len(rpc.Requests(), 2)
+}
+
+// Test that a CSR supplied by the caller is signed as is without generating
+// a private key.
+func TestConnectCALeaf_suppliedCSR(t *testing.T) {
+	t.Parallel()
+
+	require := require.New(t)
+	rpc := TestRPC(t)
+	defer rpc.AssertExpectations(t)
+
+	typ, rootsCh := testCALeafType(t, rpc)
+	defer close(rootsCh)
+	rootsCh <- structs.IndexedCARoots{
+		ActiveRootID: "1",
+		TrustDomain:  connect.TestClusterID + ".consul",
+		QueryMeta:    structs.QueryMeta{Index: 1},
+	}
+
+	leafPEM, _ := connect.TestLeaf(t, "web", connect.TestCA(t, nil))
+	var signedCSR string
+	rpc.On("RPC", "ConnectCA.Sign", mock.Anything, mock.Anything).Return(nil).
+		Run(func(args mock.Arguments) {
+			signedCSR = args.Get(1).(*structs.CASignRequest).CSR
+			reply := args.Get(2).(*structs.IssuedCert)
+			reply.CertPEM = leafPEM
+			reply.ValidBefore = time.Now().Add(12 * time.Hour)
+			reply.CreateIndex = 1
+			reply.ModifyIndex = 1
+		}).Once()
+
+	id := func(service string) *connect.SpiffeIDService {
+		return &connect.SpiffeIDService{
+			Host:       connect.TestClusterID + ".consul",
+			Datacenter: "dc1",
+			Namespace:  "default",
+			Service:    service,
+		}
+	}
+	csr, _ := connect.TestCSR(t, id("web"))
+
+	opts := cache.FetchOptions{MinIndex: 0, Timeout: 10 * time.Second}
+	req := &ConnectCALeafRequest{Datacenter: "dc1", Service: "web", CSR: csr}
+	result, err := typ.Fetch(opts, req)
+	require.NoError(err)
+	require.Equal(csr, signedCSR)
+	issued := result.Value.(*structs.IssuedCert)
+	require.Equal(leafPEM, issued.CertPEM)
+	require.Empty(issued.PrivateKeyPEM)
+
+	// The CSR is part of the cache key
+	other, _ := connect.TestCSR(t, id("web"))
+	plain := &ConnectCALeafRequest{Datacenter: "dc1", Service: "web"}
+	otherReq := &ConnectCALeafRequest{Datacenter: "dc1", Service: "web", CSR: other}
+	require.NotEqual(plain.CacheInfo().Key, req.CacheInfo().Key)
+	require.NotEqual(otherReq.CacheInfo().Key, req.CacheInfo().Key)
+
+	// A CSR for another service is rejected, as is bundling a key we don't
+	// have
+	wrong, _ := connect.TestCSR(t, id("db"))
+	_, err = typ.Fetch(opts, &ConnectCALeafRequest{Datacenter: "dc1", Service: "web", CSR: wrong})
+	require.Error(err)
+	require.Contains(err.Error(), "as its first URI SAN")
+	_, err = typ.Fetch(opts, &ConnectCALeafRequest{
+		Datacenter:   "dc1",
+		Service:      "web",
+		CSR:          other,
+		BundleFormat: LeafBundleFormatPKCS12,
+	})
+	require.Error(err)
+	_, err = typ.Fetch(opts, &ConnectCALeafRequest{Datacenter: "dc1", Service: "web", CSR: "not a CSR"})
+	require.Error(err)
+	require.Contains(err.Error(), "invalid CSR")
+}
+
+// Test that the server that signed a leaf is kept with it, and is left empty
+// when the server doesn't report it.
+func TestConnectCALeaf_signedBy(t *testing.T) {
+	t.Parallel()
+
+	require := require.New(t)
+	rpc := TestRPC(t)
+	defer rpc.AssertExpectations(t)
+
+	typ, rootsCh := testCALeafType(t, rpc)
+	defer close(rootsCh)
+	rootsCh <- structs.IndexedCARoots{
+		ActiveRootID: "1",
+		TrustDomain:  "fake-trust-domain.consul",
+		QueryMeta:    structs.QueryMeta{Index: 1},
+	}
+
+	var idx uint64
+	rpc.On("RPC", "ConnectCA.Sign", mock.Anything, mock.Anything).Return(nil).
+		Run(func(args mock.Arguments) {
+			reply := args.Get(2).(*structs.IssuedCert)
+			reply.ValidBefore = time.Now().Add(12 * time.Hour)
+			reply.CreateIndex = atomic.AddUint64(&idx, 1)
+			reply.ModifyIndex = reply.CreateIndex
+			if reply.CreateIndex == 1 {
+				reply.SignedBy = "server-2"
+			}
+		})
+
+	opts := cache.FetchOptions{MinIndex: 0, Timeout: 10 * time.Second}
+	req := &ConnectCALeafRequest{Datacenter: "dc1", Service: "web"}
+	result, err := typ.Fetch(opts, req)
+	require.NoError(err)
+	require.Equal("server-2", result.Value.(*structs.IssuedCert).SignedBy)
+
+	// The cached leaf keeps it
+	result, err = typ.Fetch(opts, req)
+	require.NoError(err)
+	require.False(result.Generated)
+	require.Equal("server-2", result.Value.(*structs.IssuedCert).SignedBy)
+
+	// Older servers don't report it
+	result, err = typ.Fetch(opts, &ConnectCALeafRequest{Datacenter: "dc1", Service: "db"})
+	require.NoError(err)
+	require.Empty(result.Value.(*structs.IssuedCert).SignedBy)
+}
+
+// Test that no more than MaxConcurrentGenerations leaves are generated at
+// once and that the rest wait their turn.
+func TestConnectCALeaf_maxConcurrentGenerations(t *testing.T) {
+	t.Parallel()
+
+	require := require.New(t)
+	rpc := TestRPC(t)
+	defer rpc.AssertExpectations(t)
+
+	typ, rootsCh := testCALeafType(t, rpc)
+	defer close(rootsCh)
+	typ.MaxConcurrentGenerations = 3
+	rootsCh <- structs.IndexedCARoots{
+		ActiveRootID: "1",
+		TrustDomain:  "fake-trust-domain.consul",
+		QueryMeta:    structs.QueryMeta{Index: 1},
+	}
+
+	// Signs block until released, tracking how many are in flight
+	var inFlight, maxInFlight, idx int64
+	var maxLock sync.Mutex
+	releaseCh := make(chan struct{})
+	rpc.On("RPC", "ConnectCA.Sign", mock.Anything, mock.Anything).Return(nil).
+		Run(func(args mock.Arguments) {
+			n := atomic.AddInt64(&inFlight, 1)
+			maxLock.Lock()
+			if n > maxInFlight {
+				maxInFlight = n
+			}
+			maxLock.Unlock()
+			<-releaseCh
+			atomic.AddInt64(&inFlight, -1)
+
+			reply := args.Get(2).(*structs.IssuedCert)
+			reply.ValidBefore = time.Now().Add(12 * time.Hour)
+			reply.CreateIndex = uint64(atomic.AddInt64(&idx, 1))
+			reply.ModifyIndex = reply.CreateIndex
+		})
+
+	// Load the roots first so the generations don't wait on them
+	_, _, err := typ.Cache.Get(ConnectCARootName, &structs.DCSpecificRequest{Datacenter: "dc1"})
+	require.NoError(err)
+
+	opts := cache.FetchOptions{MinIndex: 0, Timeout: 10 * time.Second}
+	var fetchChs []<-chan interface{}
+	for i := 0; i < 10; i++ {
+		fetchChs = append(fetchChs, TestFetchCh(t, typ, opts,
+			&ConnectCALeafRequest{Datacenter: "dc1", Service: fmt.Sprintf("web-%d", i)}))
+	}
+
+	var releaseOnce sync.Once
+	release := func() { releaseOnce.Do(func() { close(releaseCh) }) }
+	defer release()
+
+	// Wait for the first signs to start, then check no more do
+	retry.Run(t, func(r *retry.R) {
+		if n := atomic.LoadInt64(&inFlight); n != 3 {
+			r.Fatalf("got %d signs in flight", n)
+		}
+	})
+	time.Sleep(100 * time.Millisecond)
+	require.Equal(int64(3), atomic.LoadInt64(&inFlight))
+
+	// Once released they all complete without exceeding the bound
+	release()
+	timeoutCh := time.After(5 * time.Second)
+	for _, fetchCh := range fetchChs {
+		select {
+		case <-timeoutCh:
+			t.Fatal("shouldn't block once signs are released")
+		case result := <-fetchCh:
+			require.IsType(cache.FetchResult{}, result)
+			require.True(result.(cache.FetchResult).Generated)
+		}
+	}
+	maxLock.Lock()
+	defer maxLock.Unlock()
+	require.Equal(int64(3), maxInFlight)
+}
+
+// Test that the sign latency average tracks the latencies and widens the
+// generation timeout when AdaptiveTimeout is set.
+func TestConnectCALeaf_signLatency(t *testing.T) {
+	t.Parallel()
+
+	require := require.New(t)
+	typ := &ConnectCALeaf{}
+	require.Equal(time.Duration(0), typ.SignLatency())
+	require.Equal(10*time.Second, typ.generateTimeout(10*time.Second))
+
+	// The first sample is taken as is, and later ones move the average a
+	// fifth of the way towards them
+	typ.observeSignLatency(100 * time.Millisecond)
+	require.Equal(100*time.Millisecond, typ.SignLatency())
+	typ.observeSignLatency(600 * time.Millisecond)
+	require.Equal(200*time.Millisecond, typ.SignLatency())
+
+	// A sustained slowdown pulls the average up to it
+	for i := 0; i < 50; i++ {
+		typ.observeSignLatency(2 * time.Second)
+	}
+	require.InDelta(float64(2*time.Second), float64(typ.SignLatency()), float64(time.Millisecond))
+
+	// The timeout is only widened when asked, by three times the average
+	// and at most doubled
+	require.Equal(10*time.Second, typ.generateTimeout(10*time.Second))
+	typ.AdaptiveTimeout = true
+	require.InDelta(float64(16*time.Second), float64(typ.generateTimeout(10*time.Second)), float64(5*time.Millisecond))
+	require.Equal(2*time.Second, typ.generateTimeout(time.Second))
+
+	// Once the servers speed up again so does the timeout
+	for i := 0; i < 50; i++ {
+		typ.observeSignLatency(10 * time.Millisecond)
+	}
+	require.InDelta(float64(10*time.Second), float64(typ.generateTimeout(10*time.Second)), float64(50*time.Millisecond))
+}
+
+// Test that signs are recorded in the sign latency average.
+func TestConnectCALeaf_signLatencyObserved(t *testing.T) {
+	t.Parallel()
+
+	require := require.New(t)
+	rpc := TestRPC(t)
+	defer rpc.AssertExpectations(t)
+
+	typ, rootsCh := testCALeafType(t, rpc)
+	defer close(rootsCh)
+	rootsCh <- structs.IndexedCARoots{
+		ActiveRootID: "1",
+		TrustDomain:  "fake-trust-domain.consul",
+		QueryMeta:    structs.QueryMeta{Index: 1},
+	}
+	rpc.On("RPC", "ConnectCA.Sign", mock.Anything, mock.Anything).Return(nil).
+		Run(func(args mock.Arguments) {
+			time.Sleep(20 * time.Millisecond)
+			reply := args.Get(2).(*structs.IssuedCert)
+			reply.ValidBefore = time.Now().Add(12 * time.Hour)
+			reply.CreateIndex = 1
+			reply.ModifyIndex = 1
+		}).Once()
+
+	_, err := typ.Fetch(cache.FetchOptions{MinIndex: 0, Timeout: 10 * time.Second},
+		&ConnectCALeafRequest{Datacenter: "dc1", Service: "web"})
+	require.NoError(err)
+	require.True(typ.SignLatency() >= 20*time.Millisecond)
+}
+
+// Test that a generation waiting for a slot gives up when the Fetch times out.
+func TestConnectCALeaf_maxConcurrentGenerationsTimeout(t *testing.T) {
+	t.Parallel()
+
+	require := require.New(t)
+	rpc := TestRPC(t)
+	defer rpc.AssertExpectations(t)
+
+	typ, rootsCh := testCALeafType(t, rpc)
+	defer close(rootsCh)
+	typ.MaxConcurrentGenerations = 1
+	rootsCh <- structs.IndexedCARoots{
+		ActiveRootID: "1",
+		TrustDomain:  "fake-trust-domain.consul",
+		QueryMeta:    structs.QueryMeta{Index: 1},
+	}
+
+	// The sign for web holds the only slot until it's released.
+	signingCh := make(chan struct{})
+	releaseCh := make(chan struct{})
+	rpc.On("RPC", "ConnectCA.Sign", mock.Anything, mock.Anything).Return(nil).
+		Run(func(args mock.Arguments) {
+			close(signingCh)
+			<-releaseCh
+			reply := args.Get(2).(*structs.IssuedCert)
+			reply.ValidBefore = time.Now().Add(12 * time.Hour)
+			reply.CreateIndex = 1
+			reply.ModifyIndex = 1
+		}).Once()
+
+	webCh := TestFetchCh(t, typ, cache.FetchOptions{MinIndex: 0, Timeout: 10 * time.Second},
+		&ConnectCALeafRequest{Datacenter: "dc1", Service: "web"})
+	select {
+	case <-signingCh:
+	case <-time.After(time.Second):
+		t.Fatal("web leaf wasn't signed")
+	}
+
+	_, err := typ.Fetch(cache.FetchOptions{MinIndex: 0, Timeout: 100 * time.Millisecond},
+		&ConnectCALeafRequest{Datacenter: "dc1", Service: "db"})
+	require.Error(err)
+	require.Contains(err.Error(), "timed out waiting to generate leaf cert")
+
+	// Let web finish before the mock's expectations are checked.
+	close(releaseCh)
+	select {
+	case result := <-webCh:
+		_, ok := result.(cache.FetchResult)
+		require.True(ok, "not a FetchResult: %#v", result)
+	case <-time.After(time.Second):
+		t.Fatal("web Fetch didn't return")
+	}
+}
+
+// Test that the remaining validity of the served cert is reported both when
+// signing a new one and when serving the cached one.
+func TestConnectCALeaf_ttlRemaining(t *testing.T) {
+	t.Parallel()
+
+	require := require.New(t)
+	rpc := TestRPC(t)
+	defer rpc.AssertExpectations(t)
+
+	typ, rootsCh := testCALeafType(t, rpc)
+	defer close(rootsCh)
+	rootsCh <- structs.IndexedCARoots{
+		ActiveRootID: "1",
+		TrustDomain:  "fake-trust-domain.consul",
+		QueryMeta:    structs.QueryMeta{Index: 1},
+	}
+
+	const validity = 12 * time.Hour
+	rpc.On("RPC", "ConnectCA.Sign", mock.Anything, mock.Anything).Return(nil).
+		Run(func(args mock.Arguments) {
+			reply := args.Get(2).(*structs.IssuedCert)
+			reply.ValidBefore = time.Now().Add(validity)
+			reply.CreateIndex = 1
+			reply.ModifyIndex = 1
+		}).Once()
+
+	opts := cache.FetchOptions{MinIndex: 0, Timeout: 10 * time.Second}
+	req := &ConnectCALeafRequest{Datacenter: "dc1", Service: "web"}
+
+	result, err := typ.Fetch(opts, req)
+	require.NoError(err)
+	require.True(result.Generated)
+	require.True(result.TTLRemaining <= validity, "TTL %s", result.TTLRemaining)
+	require.True(result.TTLRemaining > validity-time.Minute, "TTL %s", result.TTLRemaining)
+	first := result.TTLRemaining
+
+	time.Sleep(10 * time.Millisecond)
+	result, err = typ.Fetch(opts, req)
+	require.NoError(err)
+	require.False(result.Generated)
+	require.True(result.TTLRemaining < first, "TTL %s not less than %s", result.TTLRemaining, first)
+	require.True(result.TTLRemaining > validity-time.Minute, "TTL %s", result.TTLRemaining)
+}
+
+// Test that a cert for a trust domain other than the expected one is
+// rejected and logged rather than cached.
+func TestConnectCALeaf_trustDomainMismatch(t *testing.T) {
+	t.Parallel()
+
+	require := require.New(t)
+	rpc := TestRPC(t)
+	defer rpc.AssertExpectations(t)
+
+	var logs bytes.Buffer
+	typ, rootsCh := testCALeafType(t, rpc)
+	typ.Logger = log.New(&logs, "", 0)
+	defer close(rootsCh)
+	rootsCh <- structs.IndexedCARoots{
+		ActiveRootID: "1",
+		TrustDomain:  "fake-trust-domain.consul",
+		QueryMeta:    structs.QueryMeta{Index: 1},
+	}
+
+	// The test CA signs for its own cluster's trust domain
+	leafPEM, _ := connect.TestLeaf(t, "web", connect.TestCA(t, nil))
+	rpc.On("RPC", "ConnectCA.Sign", mock.Anything, mock.Anything).Return(nil).
+		Run(func(args mock.Arguments) {
+			reply := args.Get(2).(*structs.IssuedCert)
+			reply.CertPEM = leafPEM
+			reply.ValidBefore = time.Now().Add(12 * time.Hour)
+			reply.CreateIndex = 1
+			reply.ModifyIndex = 1
+		})
+
+	opts := cache.FetchOptions{MinIndex: 0, Timeout: 10 * time.Second}
+	req := &ConnectCALeafRequest{Datacenter: "dc1", Service: "web"}
+	_, err := typ.Fetch(opts, req)
+	require.Error(err)
+	require.Contains(err.Error(), `expected "fake-trust-domain.consul"`)
+	require.Contains(logs.String(), `[ERR] connect: rejected leaf cert for service "web"`)
+	require.Empty(typ.Leaves())
+}
+
+// Test that with MinAcceptableTTL, a cert with a shorter lifetime is rejected
+// and logged rather than cached, while one long enough is accepted.
+func TestConnectCALeaf_minAcceptableTTL(t *testing.T) {
+	t.Parallel()
+
+	require := require.New(t)
+	rpc := TestRPC(t)
+	defer rpc.AssertExpectations(t)
+
+	var logs bytes.Buffer
+	typ, rootsCh := testCALeafType(t, rpc)
+	typ.Logger = log.New(&logs, "", 0)
+	typ.MinAcceptableTTL = time.Hour
+	defer close(rootsCh)
+	rootsCh <- structs.IndexedCARoots{
+		ActiveRootID: "1",
+		TrustDomain:  "fake-trust-domain.consul",
+		QueryMeta:    structs.QueryMeta{Index: 1},
+	}
+
+	var idx uint64
+	validity := int64(2 * time.Minute)
+	rpc.On("RPC", "ConnectCA.Sign", mock.Anything, mock.Anything).Return(nil).
+		Run(func(args mock.Arguments) {
+			reply := args.Get(2).(*structs.IssuedCert)
+			reply.ValidAfter = time.Now()
+			reply.ValidBefore = reply.ValidAfter.Add(time.Duration(atomic.LoadInt64(&validity)))
+			reply.CreateIndex = atomic.AddUint64(&idx, 1)
+			reply.ModifyIndex = reply.CreateIndex
+		})
+
+	opts := cache.FetchOptions{MinIndex: 0, Timeout: 10 * time.Second}
+	req := &ConnectCALeafRequest{Datacenter: "dc1", Service: "web"}
+	_, err := typ.Fetch(opts, req)
+	require.Error(err)
+	require.Contains(err.Error(), "less than the minimum of 1h0m0s")
+	require.Contains(logs.String(), `[ERR] connect: rejected leaf cert for service "web"`)
+	require.Empty(typ.Leaves())
+
+	atomic.StoreInt64(&validity, int64(time.Hour))
+	result, err := typ.Fetch(opts, req)
+	require.NoError(err)
+	require.NotNil(result.Value)
+	require.Len(typ.Leaves(), 1)
+}
+
+// Test that certs with a validity window that is inverted or already over
+// are rejected rather than cached.
+func TestConnectCALeaf_invalidValidity(t *testing.T) {
+	t.Parallel()
+
+	cases := []struct {
+		name        string
+		validAfter  time.Duration
+		validBefore time.Duration
+		err         string
+	}{
+		{"expired", -2 * time.Hour, -1 * time.Hour, "expired"},
+		{"inverted", 2 * time.Hour, 1 * time.Hour, "inverted validity window"},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			require := require.New(t)
+			rpc := TestRPC(t)
+			defer rpc.AssertExpectations(t)
+
+			typ, rootsCh := testCALeafType(t, rpc)
+			defer close(rootsCh)
+			rootsCh <- structs.IndexedCARoots{
+				ActiveRootID: "1",
+				TrustDomain:  "fake-trust-domain.consul",
+				QueryMeta:    structs.QueryMeta{Index: 1},
+			}
+
+			// Both fetches should sign since the bad cert isn't cached
+			rpc.On("RPC", "ConnectCA.Sign", mock.Anything, mock.Anything).Return(nil).
+				Run(func(args mock.Arguments) {
+					reply := args.Get(2).(*structs.IssuedCert)
+					reply.ValidAfter = time.Now().Add(tc.validAfter)
+					reply.ValidBefore = time.Now().Add(tc.validBefore)
+					reply.CreateIndex = 1
+					reply.ModifyIndex = 1
+				}).Twice()
+
+			opts := cache.FetchOptions{MinIndex: 0, Timeout: 10 * time.Second}
+			req := &ConnectCALeafRequest{Datacenter: "dc1", Service: "web"}
+			for i := 0; i < 2; i++ {
+				_, err := typ.Fetch(opts, req)
+				require.Error(err)
+				require.Contains(err.Error(), tc.err)
+			}
+		})
+	}
+}
+
+// Test that serving a cert past its soft expiry because renewals are failing
+// is reported. This test is not parallel since it uses the global metrics
+// sink.
+func TestConnectCALeaf_overdue(t *testing.T) {
+	require := require.New(t)
+	sink := testMetricsSink(t)
+	rpc := TestRPC(t)
+	defer rpc.AssertExpectations(t)
+
+	typ, rootsCh := testCALeafType(t, rpc)
+	defer close(rootsCh)
+	rootsCh <- structs.IndexedCARoots{
+		ActiveRootID: "1",
+		TrustDomain:  "fake-trust-domain.consul",
+		QueryMeta:    structs.QueryMeta{Index: 1},
+	}
+
+	// The cert is already half an hour into its soft renewal window, and
+	// every renewal fails
+	rpc.On("RPC", "ConnectCA.Sign", mock.Anything, mock.Anything).Return(nil).
+		Run(func(args mock.Arguments) {
+			reply := args.Get(2).(*structs.IssuedCert)
+			reply.ValidBefore = time.Now().Add(30 * time.Minute)
+			reply.CreateIndex = 1
+			reply.ModifyIndex = 1
+		}).Once()
+	rpc.On("RPC", "ConnectCA.Sign", mock.Anything, mock.Anything).
+		Return(errors.New("servers unavailable")).Twice()
+
+	opts := cache.FetchOptions{MinIndex: 0, Timeout: 10 * time.Second}
+	req := &ConnectCALeafRequest{Datacenter: "dc1", Service: "web"}
+	result, err := typ.Fetch(opts, req)
+	require.NoError(err)
+
+	// The first cert isn't overdue since nothing was being served
+	for _, intv := range sink.Data() {
+		require.NotContains(intv.Counters, "consul.connect.leaf.overdue")
+	}
+
+	opts.MinIndex = result.Index
+	for i := 0; i < 2; i++ {
+		_, err = typ.Fetch(opts, req)
+		require.EqualError(err, "servers unavailable")
+	}
+	require.Equal(2, testMetricsCounter(t, sink, "consul.connect.leaf.overdue").Count)
+
+	var overdue float32
+	for _, intv := range sink.Data() {
+		if g, ok := intv.Gauges["consul.connect.leaf.overdue_seconds;service=web"]; ok {
+			overdue = g.Value
+		}
+	}
+	require.True(overdue >= 29*60 && overdue <= 31*60, "overdue by %v", overdue)
+}
+
+// Test that an expired cert is still returned, marked expired, within the
+// emergency grace period while it can't be renewed.
+func TestConnectCALeaf_emergencyGrace(t *testing.T) {
+	t.Parallel()
+
+	require := require.New(t)
+	rpc := TestRPC(t)
+	defer rpc.AssertExpectations(t)
+
+	typ, rootsCh := testCALeafType(t, rpc)
+	defer close(rootsCh)
+	rootsCh <- structs.IndexedCARoots{
+		ActiveRootID: "1",
+		TrustDomain:  "fake-trust-domain.consul",
+		QueryMeta:    structs.QueryMeta{Index: 1},
+	}
+	clk := newTestClock(time.Now())
+	typ.clock = clk
+	typ.EmergencyGrace = 2 * time.Hour
+
+	rpc.On("RPC", "ConnectCA.Sign", mock.Anything, mock.Anything).Return(nil).
+		Run(func(args mock.Arguments) {
+			reply := args.Get(2).(*structs.IssuedCert)
+			reply.ValidAfter = clk.Now().Add(-time.Minute)
+			reply.ValidBefore = clk.Now().Add(time.Hour)
+			reply.CreateIndex = 1
+			reply.ModifyIndex = 1
+		}).Once()
+	rpc.On("RPC", "ConnectCA.Sign", mock.Anything, mock.Anything).
+		Return(errors.New("servers unavailable")).Once()
+	rpc.On("RPC", "ConnectCA.Sign", mock.Anything, mock.Anything).
+		Return(errors.New(acl.ErrPermissionDenied.Error())).Once()
+	rpc.On("RPC", "ConnectCA.Sign", mock.Anything, mock.Anything).
+		Return(errors.New("servers unavailable")).Once()
+
+	opts := cache.FetchOptions{MinIndex: 0, Timeout: 10 * time.Second}
+	req := &ConnectCALeafRequest{Datacenter: "dc1", Service: "web"}
+	result, err := typ.Fetch(opts, req)
+	require.NoError(err)
+	issued := result.Value.(*structs.IssuedCert)
+	require.False(issued.Expired)
+
+	// An hour after expiry the cert is served marked expired
+	clk.Advance(2 * time.Hour)
+	result, err = typ.Fetch(opts, req)
+	require.NoError(err)
+	served := result.Value.(*structs.IssuedCert)
+	require.True(served.Expired)
+	require.Equal(issued.ValidBefore, served.ValidBefore)
+	require.Equal(issued.ModifyIndex, result.Index)
+	require.False(issued.Expired, "the cached cert must not be modified")
+
+	// Permission denied isn't masked
+	_, err = typ.Fetch(opts, req)
+	require.Error(err)
+	require.True(acl.IsErrPermissionDenied(err))
+
+	// Past the grace the error is returned
+	clk.Advance(2 * time.Hour)
+	_, err = typ.Fetch(opts, req)
+	require.EqualError(err, "servers unavailable")
+}
+
+// Test that the OnNewLeaf hook is given each new cert with its key, and that
+// a failing hook stops the cert being cached.
+func TestConnectCALeaf_onNewLeaf(t *testing.T) {
+	t.Parallel()
+
+	require := require.New(t)
+	rpc := TestRPC(t)
+	defer rpc.AssertExpectations(t)
+
+	typ, rootsCh := testCALeafType(t, rpc)
+	defer close(rootsCh)
+	rootsCh <- structs.IndexedCARoots{
+		ActiveRootID: "1",
+		TrustDomain:  "fake-trust-domain.consul",
+		QueryMeta:    structs.QueryMeta{Index: 1},
+	}
+
+	var idx uint64
+	rpc.On("RPC", "ConnectCA.Sign", mock.Anything, mock.Anything).Return(nil).
+		Run(func(args mock.Arguments) {
+			reply := args.Get(2).(*structs.IssuedCert)
+			reply.ValidBefore = time.Now().Add(12 * time.Hour)
+			reply.CreateIndex = atomic.AddUint64(&idx, 1)
+			reply.ModifyIndex = reply.CreateIndex
+		})
+
+	var hookErr error
+	var hooked []*structs.IssuedCert
+	typ.OnNewLeaf = func(req *ConnectCALeafRequest, cert *structs.IssuedCert) error {
+		require.Equal("web", req.Service)
+		hooked = append(hooked, cert)
+		return hookErr
+	}
+
+	opts := cache.FetchOptions{MinIndex: 0, Timeout: 10 * time.Second}
+	req := &ConnectCALeafRequest{Datacenter: "dc1", Service: "web"}
+
+	// A failing hook fails the fetch and nothing is cached
+	hookErr = fmt.Errorf("secret store unavailable")
+	_, err := typ.Fetch(opts, req)
+	require.Error(err)
+	require.Contains(err.Error(), "secret store unavailable")
+	require.Len(hooked, 1)
+
+	// So the next fetch signs again, and its cert is cached once the hook
+	// succeeds
+	hookErr = nil
+	result, err := typ.Fetch(opts, req)
+	require.NoError(err)
+	require.Len(hooked, 2)
+	require.Equal(hooked[1], result.Value)
+	require.NotEmpty(hooked[1].PrivateKeyPEM)
+	require.True(result.Generated)
+
+	// The cached cert is served without calling the hook
+	result, err = typ.Fetch(opts, req)
+	require.NoError(err)
+	require.False(result.Generated)
+	require.Len(hooked, 2)
+}
+
+// Test that a sign denied by ACLs returns a typed permission denied error
+// and that the cache doesn't keep retrying it in the background.
+func TestConnectCALeaf_permissionDenied(t *testing.T) {
+	t.Parallel()
+
+	require := require.New(t)
+	rpc := TestRPC(t)
+	defer rpc.AssertExpectations(t)
+
+	typ, rootsCh := testCALeafType(t, rpc)
+	defer close(rootsCh)
+	rootsCh <- structs.IndexedCARoots{
+		ActiveRootID: "1",
+		TrustDomain:  "fake-trust-domain.consul",
+		QueryMeta:    structs.QueryMeta{Index: 1},
+	}
+
+	// Errors lose their type over RPC so return it as a plain error
+	var signs uint32
+	rpc.On("RPC", "ConnectCA.Sign", mock.Anything, mock.Anything).
+		Return(errors.New("rpc error making call: Permission denied")).
+		Run(func(mock.Arguments) { atomic.AddUint32(&signs, 1) })
+
+	req := &ConnectCALeafRequest{Datacenter: "dc1", Service: "web"}
+	_, err := typ.Fetch(cache.FetchOptions{Timeout: 10 * time.Second}, req)
+	require.Error(err)
+	require.IsType(acl.PermissionDeniedError{}, err)
+	require.Contains(err.Error(), `service "web"`)
+
+	// Through the cache, the failed fetch is not retried rapidly
+	c := typ.Cache.(*cache.Cache)
+	c.RegisterType(ConnectCALeafName, typ, &cache.RegisterOptions{
+		Refresh:        true,
+		RefreshTimer:   0,
+		RefreshTimeout: 10 * time.Minute,
+	})
+	_, _, err = c.Get(ConnectCALeafName, req)
+	require.True(acl.IsErrPermissionDenied(err))
+	time.Sleep(500 * time.Millisecond)
+	require.Equal(uint32(2), atomic.LoadUint32(&signs))
+}
+
+// Test that rootsFromCache distinguishes a cache entry that hasn't been
+// populated by the servers yet from a populated one.
+// Test that a watching Fetch returns promptly once its token is revoked.
+func TestConnectCALeaf_tokenRevoked(t *testing.T) {
+	t.Parallel()
+
+	require := require.New(t)
+	rpc := TestRPC(t)
+	defer rpc.AssertExpectations(t)
+
+	typ, rootsCh := testCALeafType(t, rpc)
+	defer close(rootsCh)
+	typ.TokenCheckInterval = 20 * time.Millisecond
+	rootsCh <- structs.IndexedCARoots{
+		ActiveRootID: "1",
+		TrustDomain:  "fake-trust-domain.consul",
+		QueryMeta:    structs.QueryMeta{Index: 1},
+	}
+
+	rpc.On("RPC", "ConnectCA.Sign", mock.Anything, mock.Anything).Return(nil).
+		Run(func(args mock.Arguments) {
+			reply := args.Get(2).(*structs.IssuedCert)
+			reply.ValidBefore = time.Now().Add(12 * time.Hour)
+			reply.CreateIndex = 1
+			reply.ModifyIndex = 1
+		}).Once()
+	rpc.On("RPC", "ConnectCA.Sign", mock.Anything, mock.Anything).
+		Return(acl.ErrPermissionDenied).Once()
+
+	// The token exists for the first couple of checks and is then revoked
+	rpc.On("RPC", "ACL.TokenRead", mock.Anything, mock.Anything).Return(nil).
+		Run(func(args mock.Arguments) {
+			req := args.Get(1).(*structs.ACLTokenGetRequest)
+			require.Equal("abc", req.TokenID)
+			require.Equal(structs.ACLTokenSecret, req.TokenIDType)
+			reply := args.Get(2).(*structs.ACLTokenResponse)
+			reply.Token = &structs.ACLToken{SecretID: req.TokenID}
+		}).Twice()
+	rpc.On("RPC", "ACL.TokenRead", mock.Anything, mock.Anything).Return(nil).Once()
+
+	req := &ConnectCALeafRequest{Datacenter: "dc1", Service: "web", Token: "abc"}
+	result, err := typ.Fetch(cache.FetchOptions{MinIndex: 0, Timeout: 10 * time.Second}, req)
+	require.NoError(err)
+	require.Equal(uint64(1), result.Index)
+
+	fetchCh := TestFetchCh(t, typ, cache.FetchOptions{MinIndex: 1, Timeout: 10 * time.Second}, req)
+	select {
+	case <-time.After(time.Second):
+		t.Fatal("shouldn't block after the token is revoked")
+	case result := <-fetchCh:
+		err, ok := result.(error)
+		require.True(ok, "should be an error: %#v", result)
+		require.True(acl.IsErrPermissionDenied(err))
+	}
+
+	// The leaf isn't served to later Fetches
+	_, err = typ.Fetch(cache.FetchOptions{MinIndex: 0, Timeout: 10 * time.Second}, req)
+	require.Error(err)
+	require.True(acl.IsErrPermissionDenied(err))
+}
+
+// Test that token checks are retried after transient errors but stop after
+// others, e.g. from servers that don't support the endpoint.
+func TestConnectCALeaf_tokenCheckErrors(t *testing.T) {
+	t.Parallel()
+
+	cases := []struct {
+		name  string
+		err   error
+		retry bool
+	}{
+		{"no leader", structs.ErrNoLeader, true},
+		{"rate limited", structs.ErrRPCRateExceeded, true},
+		{"unsupported", errors.New("rpc: can't find method ACL.TokenRead"), false},
+		{"legacy acls", errors.New("The ACL system is currently in legacy mode."), false},
+	}
+	for _, tc := range cases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			require := require.New(t)
+			rpc := TestRPC(t)
+			defer rpc.AssertExpectations(t)
+
+			typ, rootsCh := testCALeafType(t, rpc)
+			defer close(rootsCh)
+			typ.TokenCheckInterval = 10 * time.Millisecond
+			rootsCh <- structs.IndexedCARoots{
+				ActiveRootID: "1",
+				TrustDomain:  "fake-trust-domain.consul",
+				QueryMeta:    structs.QueryMeta{Index: 1},
+			}
+
+			rpc.On("RPC", "ConnectCA.Sign", mock.Anything, mock.Anything).Return(nil).
+				Run(func(args mock.Arguments) {
+					reply := args.Get(2).(*structs.IssuedCert)
+					reply.ValidBefore = time.Now().Add(12 * time.Hour)
+					reply.CreateIndex = 1
+					reply.ModifyIndex = 1
+				}).Once()
+			var checks uint64
+			rpc.On("RPC", "ACL.TokenRead", mock.Anything, mock.Anything).Return(tc.err).
+				Run(func(mock.Arguments) { atomic.AddUint64(&checks, 1) })
+
+			req := &ConnectCALeafRequest{Datacenter: "dc1", Service: "web", Token: "abc"}
+			_, err := typ.Fetch(cache.FetchOptions{MinIndex: 0, Timeout: 10 * time.Second}, req)
+			require.NoError(err)
+
+			// The Fetch times out as usual either way
+			result, err := typ.Fetch(cache.FetchOptions{MinIndex: 1, Timeout: 200 * time.Millisecond}, req)
+			require.NoError(err)
+			require.Nil(result.Value)
+			if tc.retry {
+				require.True(atomic.LoadUint64(&checks) > 1)
+			} else {
+				require.Equal(uint64(1), atomic.LoadUint64(&checks))
+			}
+		})
+	}
+}
+
+// Test that token checks stop when ACLs are disabled.
+func TestConnectCALeaf_tokenCheckACLsDisabled(t *testing.T) {
+	t.Parallel()
+
+	require := require.New(t)
+	rpc := TestRPC(t)
+	defer rpc.AssertExpectations(t)
+
+	typ, rootsCh := testCALeafType(t, rpc)
+	defer close(rootsCh)
+	typ.TokenCheckInterval = 10 * time.Millisecond
+	rootsCh <- structs.IndexedCARoots{
+		ActiveRootID: "1",
+		TrustDomain:  "fake-trust-domain.consul",
+		QueryMeta:    structs.QueryMeta{Index: 1},
+	}
+
+	rpc.On("RPC", "ConnectCA.Sign", mock.Anything, mock.Anything).Return(nil).
+		Run(func(args mock.Arguments) {
+			reply := args.Get(2).(*structs.IssuedCert)
+			reply.ValidBefore = time.Now().Add(12 * time.Hour)
+			reply.CreateIndex = 1
+			reply.ModifyIndex = 1
+		}).Once()
+	rpc.On("RPC", "ACL.TokenRead", mock.Anything, mock.Anything).
+		Return(acl.ErrDisabled).Once()
+
+	req := &ConnectCALeafRequest{Datacenter: "dc1", Service: "web", Token: "abc"}
+	_, err := typ.Fetch(cache.FetchOptions{MinIndex: 0, Timeout: 10 * time.Second}, req)
+	require.NoError(err)
+
+	// The Fetch times out as usual after a single check
+	result, err := typ.Fetch(cache.FetchOptions{MinIndex: 1, Timeout: 200 * time.Millisecond}, req)
+	require.NoError(err)
+	require.Nil(result.Value)
+}
+
+func TestConnectCALeaf_rootsFromCache(t *testing.T) {
+	t.Parallel()
+
+	require := require.New(t)
+	rpc := TestRPC(t)
+	defer rpc.AssertExpectations(t)
+
+	typ, rootsCh := testCALeafType(t, rpc)
+	defer close(rootsCh)
+
+	// Cold cache, the servers return an empty result
+	rootsCh <- structs.IndexedCARoots{}
+	roots, err := typ.rootsFromCache("dc1")
+	require.Equal(errRootsNotPopulated, err)
+	require.Nil(roots)
+
+	// A populated cache returns the roots
+	rootsCh <- structs.IndexedCARoots{
+		ActiveRootID: "1",
+		TrustDomain:  "fake-trust-domain.consul",
+		QueryMeta:    structs.QueryMeta{Index: 1},
+	}
+	roots, err = typ.rootsFromCache("dc2")
+	require.NoError(err)
+	require.Equal("1", roots.ActiveRootID)
+}
+
+// Test that a Fetch on a cold roots cache waits for the roots to be
+// populated rather than failing.
+func TestConnectCALeaf_rootsNotPopulated(t *testing.T) {
+	t.Parallel()
+
+	rpc := TestRPC(t)
+	defer rpc.AssertExpectations(t)
+
+	typ, rootsCh := testCALeafType(t, rpc)
+	defer close(rootsCh)
+	rootsCh <- structs.IndexedCARoots{}
+
+	// Instrument ConnectCA.Sign to return signed cert
+	var resp *structs.IssuedCert
+	var idx uint64
+	rpc.On("RPC", "ConnectCA.Sign", mock.Anything, mock.Anything).Return(nil).
+		Run(func(args mock.Arguments) {
+			reply := args.Get(2).(*structs.IssuedCert)
+			reply.ValidBefore = time.Now().Add(12 * time.Hour)
+			reply.CreateIndex = atomic.AddUint64(&idx, 1)
+			reply.ModifyIndex = reply.CreateIndex
+			resp = reply
+		})
+
+	opts := cache.FetchOptions{MinIndex: 0, Timeout: 10 * time.Second}
+	req := &ConnectCALeafRequest{Datacenter: "dc1", Service: "web"}
+
+	// Fetch should block until the roots show up
+	fetchCh := TestFetchCh(t, typ, opts, req)
+	select {
+	case result := <-fetchCh:
+		t.Fatalf("should not return: %#v", result)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	rootsCh <- structs.IndexedCARoots{
+		ActiveRootID: "1",
+		TrustDomain:  "fake-trust-domain.consul",
+		QueryMeta:    structs.QueryMeta{Index: 2},
+	}
+	select {
+	case <-time.After(100 * time.Millisecond):
+		t.Fatal("shouldn't block waiting for fetch")
+	case result := <-fetchCh:
+		requireFetchResult(t, cache.FetchResult{
+			Value:     resp,
+			Index:     1,
+			Generated: true,
+		}, result)
+	}
+}
+
+// Test that a trust domain override is used in the SPIFFE ID of the leaf
+// and is only allowed for known federated trust domains.
+func TestConnectCALeaf_trustDomainOverride(t *testing.T) {
+	t.Parallel()
+
+	require := require.New(t)
+	rpc := TestRPC(t)
+	defer rpc.AssertExpectations(t)
+
+	typ, rootsCh := testCALeafType(t, rpc)
+	defer close(rootsCh)
+	typ.FederatedTrustDomains = []string{"peer-trust-domain.consul"}
+	rootsCh <- structs.IndexedCARoots{
+		ActiveRootID: "1",
+		TrustDomain:  "fake-trust-domain.consul",
+		QueryMeta:    structs.QueryMeta{Index: 1},
+	}
+
+	// Instrument ConnectCA.Sign to capture the CSR
+	var csrURI string
+	var idx uint64
+	rpc.On("RPC", "ConnectCA.Sign", mock.Anything, mock.Anything).Return(nil).
+		Run(func(args mock.Arguments) {
+			csr, err := connect.ParseCSR(args.Get(1).(*structs.CASignRequest).CSR)
+			require.NoError(err)
+			require.Len(csr.URIs, 1)
+			csrURI = csr.URIs[0].String()
+
+			reply := args.Get(2).(*structs.IssuedCert)
+			reply.ValidBefore = time.Now().Add(12 * time.Hour)
+			reply.CreateIndex = atomic.AddUint64(&idx, 1)
+			reply.ModifyIndex = reply.CreateIndex
+		})
+
+	opts := cache.FetchOptions{MinIndex: 0, Timeout: 10 * time.Second}
+
+	// No override uses the local trust domain
+	req := &ConnectCALeafRequest{Datacenter: "dc1", Service: "web"}
+	_, err := typ.Fetch(opts, req)
+	require.NoError(err)
+	require.Equal("spiffe://fake-trust-domain.consul/ns/default/dc/dc1/svc/web", csrURI)
+
+	// A federated override is used instead
+	reqOverride := &ConnectCALeafRequest{Datacenter: "dc1", Service: "web",
+		TrustDomainOverride: "peer-trust-domain.consul"}
+	require.NotEqual(req.CacheInfo().Key, reqOverride.CacheInfo().Key)
+	_, err = typ.Fetch(opts, reqOverride)
+	require.NoError(err)
+	require.Equal("spiffe://peer-trust-domain.consul/ns/default/dc/dc1/svc/web", csrURI)
+
+	// An unknown override is rejected
+	_, err = typ.Fetch(opts, &ConnectCALeafRequest{Datacenter: "dc1", Service: "web",
+		TrustDomainOverride: "evil-trust-domain.consul"})
+	require.Error(err)
+	require.Contains(err.Error(), "unknown trust domain")
+}
+
+// Test that the sign request goes to the signing datacenter while the leaf's
+// SPIFFE ID uses the service's datacenter.
+func TestConnectCALeaf_signingDatacenter(t *testing.T) {
+	t.Parallel()
+
+	require := require.New(t)
+	rpc := TestRPC(t)
+	defer rpc.AssertExpectations(t)
+
+	typ, rootsCh := testCALeafType(t, rpc)
+	defer close(rootsCh)
+	rootsCh <- structs.IndexedCARoots{
+		ActiveRootID: "1",
+		TrustDomain:  "fake-trust-domain.consul",
+		QueryMeta:    structs.QueryMeta{Index: 1},
+	}
+
+	// Instrument ConnectCA.Sign to capture the datacenter and CSR
+	var signDC, csrURI string
+	var idx uint64
+	rpc.On("RPC", "ConnectCA.Sign", mock.Anything, mock.Anything).Return(nil).
+		Run(func(args mock.Arguments) {
+			signReq := args.Get(1).(*structs.CASignRequest)
+			signDC = signReq.Datacenter
+			csr, err := connect.ParseCSR(signReq.CSR)
+			require.NoError(err)
+			require.Len(csr.URIs, 1)
+			csrURI = csr.URIs[0].String()
+
+			reply := args.Get(2).(*structs.IssuedCert)
+			reply.ValidBefore = time.Now().Add(12 * time.Hour)
+			reply.CreateIndex = atomic.AddUint64(&idx, 1)
+			reply.ModifyIndex = reply.CreateIndex
+		})
+
+	opts := cache.FetchOptions{MinIndex: 0, Timeout: 10 * time.Second}
+
+	// By default the service's datacenter signs
+	req := &ConnectCALeafRequest{Datacenter: "dc2", Service: "web"}
+	_, err := typ.Fetch(opts, req)
+	require.NoError(err)
+	require.Equal("dc2", signDC)
+	require.Equal("spiffe://fake-trust-domain.consul/ns/default/dc/dc2/svc/web", csrURI)
+
+	// A signing datacenter gets the RPC but doesn't change the SPIFFE ID
+	reqSigning := &ConnectCALeafRequest{Datacenter: "dc2", Service: "web",
+		SigningDatacenter: "dc1"}
+	require.NotEqual(req.CacheInfo().Key, reqSigning.CacheInfo().Key)
+	_, err = typ.Fetch(opts, reqSigning)
+	require.NoError(err)
+	require.Equal("dc1", signDC)
+	require.Equal("spiffe://fake-trust-domain.consul/ns/default/dc/dc2/svc/web", csrURI)
+
+	// Naming the service's own datacenter is the same as the default
+	require.Equal(req.CacheInfo().Key, (&ConnectCALeafRequest{Datacenter: "dc2",
+		Service: "web", SigningDatacenter: "dc2"}).CacheInfo().Key)
+}
+
+// Test that a SPIFFE datacenter alias changes the leaf's SPIFFE ID but not
+// the datacenter the sign request goes to.
+func TestConnectCALeaf_spiffeDatacenterAlias(t *testing.T) {
+	t.Parallel()
+
+	require := require.New(t)
+	rpc := TestSignRPC(t)
+	typ, rootsCh := testCALeafType(t, rpc)
+	defer close(rootsCh)
+	rootsCh <- structs.IndexedCARoots{
+		ActiveRootID: "1",
+		TrustDomain:  "fake-trust-domain.consul",
+		QueryMeta:    structs.QueryMeta{Index: 1},
+	}
+
+	opts := cache.FetchOptions{MinIndex: 0, Timeout: 10 * time.Second}
+	req := &ConnectCALeafRequest{Datacenter: "dc2", Service: "web"}
+	reqAlias := &ConnectCALeafRequest{Datacenter: "dc2", Service: "web",
+		SpiffeDatacenterAlias: "old-dc2"}
+	require.NotEqual(req.CacheInfo().Key, reqAlias.CacheInfo().Key)
+	_, err := typ.Fetch(opts, reqAlias)
+	require.NoError(err)
+
+	reqs := rpc.Requests()
+	require.Len(reqs, 1)
+	require.Equal("dc2", reqs[0].Datacenter)
+	require.Equal("spiffe://fake-trust-domain.consul/ns/default/dc/old-dc2/svc/web",
+		rpc.CSRs(t)[0].URIs[0].String())
+
+	// Aliasing the datacenter to itself is the same as no alias
+	require.Equal(req.CacheInfo().Key, (&ConnectCALeafRequest{Datacenter: "dc2",
+		Service: "web", SpiffeDatacenterAlias: "dc2"}).CacheInfo().Key)
+}
+
+// Test that leaves are requested under the configured default namespace.
+func TestConnectCALeaf_defaultNamespace(t *testing.T) {
+	t.Parallel()
+
+	require := require.New(t)
+	rpc := TestSignRPC(t)
+	typ, rootsCh := testCALeafType(t, rpc)
+	defer close(rootsCh)
+	rootsCh <- structs.IndexedCARoots{
+		ActiveRootID: "1",
+		TrustDomain:  "fake-trust-domain.consul",
+		QueryMeta:    structs.QueryMeta{Index: 1},
+	}
+
+	typ.DefaultNamespace = "main"
+	opts := cache.FetchOptions{MinIndex: 0, Timeout: 10 * time.Second}
+	_, err := typ.Fetch(opts, &ConnectCALeafRequest{Datacenter: "dc1", Service: "web"})
+	require.NoError(err)
+	require.Equal("spiffe://fake-trust-domain.consul/ns/main/dc/dc1/svc/web",
+		rpc.CSRs(t)[0].URIs[0].String())
+
+	// A namespace that isn't a path segment is rejected before signing
+	for _, ns := range []string{" ", "a/b"} {
+		typ.DefaultNamespace = ns
+		_, err = typ.Fetch(opts, &ConnectCALeafRequest{Datacenter: "dc1", Service: "db"})
+		require.EqualError(err, fmt.Sprintf("invalid default namespace %q", ns))
+	}
+	require.Len(rpc.Requests(), 1)
+}
+
+// Test that additional SPIFFE IDs are added to the CSR as URI SANs after the
+// service's own, and that the cache key doesn't depend on their order.
+func TestConnectCALeaf_additionalSpiffeIDs(t *testing.T) {
+	t.Parallel()
+
+	require := require.New(t)
+	rpc := TestRPC(t)
+	defer rpc.AssertExpectations(t)
+
+	typ, rootsCh := testCALeafType(t, rpc)
+	defer close(rootsCh)
+	rootsCh <- structs.IndexedCARoots{
+		ActiveRootID: "1",
+		TrustDomain:  "fake-trust-domain.consul",
+		QueryMeta:    structs.QueryMeta{Index: 1},
+	}
+
+	// Instrument ConnectCA.Sign to capture the CSR's URIs
+	var csrURIs []string
+	var idx uint64
+	rpc.On("RPC", "ConnectCA.Sign", mock.Anything, mock.Anything).Return(nil).
+		Run(func(args mock.Arguments) {
+			csr, err := connect.ParseCSR(args.Get(1).(*structs.CASignRequest).CSR)
+			require.NoError(err)
+			csrURIs = nil
+			for _, uri := range csr.URIs {
+				csrURIs = append(csrURIs, uri.String())
+			}
+
+			reply := args.Get(2).(*structs.IssuedCert)
+			reply.ValidBefore = time.Now().Add(12 * time.Hour)
+			reply.CreateIndex = atomic.AddUint64(&idx, 1)
+			reply.ModifyIndex = reply.CreateIndex
+		})
+
+	opts := cache.FetchOptions{MinIndex: 0, Timeout: 10 * time.Second}
+	oldID := "spiffe://old-trust-domain.consul/ns/default/dc/dc1/svc/web"
+	otherID := "spiffe://other-trust-domain.consul/ns/default/dc/dc1/svc/web"
+
+	req := &ConnectCALeafRequest{Datacenter: "dc1", Service: "web",
+		AdditionalSpiffeIDs: []string{oldID, otherID}}
+	_, err := typ.Fetch(opts, req)
+	require.NoError(err)
+	require.Equal([]string{
+		"spiffe://fake-trust-domain.consul/ns/default/dc/dc1/svc/web",
+		oldID,
+		otherID,
+	}, csrURIs)
+
+	// The extra IDs are part of the cache key, in any order
+	plain := &ConnectCALeafRequest{Datacenter: "dc1", Service: "web"}
+	reordered := &ConnectCALeafRequest{Datacenter: "dc1", Service: "web",
+		AdditionalSpiffeIDs: []string{otherID, oldID}}
+	require.NotEqual(plain.CacheInfo().Key, req.CacheInfo().Key)
+	require.Equal(req.CacheInfo().Key, reordered.CacheInfo().Key)
+	require.Equal([]string{oldID, otherID}, req.AdditionalSpiffeIDs)
+
+	// Anything that isn't a SPIFFE ID is rejected
+	_, err = typ.Fetch(opts, &ConnectCALeafRequest{Datacenter: "dc1", Service: "web",
+		AdditionalSpiffeIDs: []string{"https://example.com/web"}})
+	require.Error(err)
+	require.Contains(err.Error(), "invalid additional SPIFFE ID")
+}
+
+// Test that the requested SNI name is the CSR's first DNS name and is part of
+// the cache key.
+func TestConnectCALeaf_sni(t *testing.T) {
+	t.Parallel()
+
+	require := require.New(t)
+	rpc := TestRPC(t)
+	defer rpc.AssertExpectations(t)
+
+	typ, rootsCh := testCALeafType(t, rpc)
+	defer close(rootsCh)
+	rootsCh <- structs.IndexedCARoots{
+		ActiveRootID: "1",
+		TrustDomain:  "fake-trust-domain.consul",
+		QueryMeta:    structs.QueryMeta{Index: 1},
+	}
+
+	// Instrument ConnectCA.Sign to capture the CSR's DNS names
+	var csrDNSNames []string
+	var idx uint64
+	rpc.On("RPC", "ConnectCA.Sign", mock.Anything, mock.Anything).Return(nil).
+		Run(func(args mock.Arguments) {
+			csr, err := connect.ParseCSR(args.Get(1).(*structs.CASignRequest).CSR)
+			require.NoError(err)
+			csrDNSNames = csr.DNSNames
+
+			reply := args.Get(2).(*structs.IssuedCert)
+			reply.ValidBefore = time.Now().Add(12 * time.Hour)
+			reply.CreateIndex = atomic.AddUint64(&idx, 1)
+			reply.ModifyIndex = reply.CreateIndex
+		})
+
+	opts := cache.FetchOptions{MinIndex: 0, Timeout: 10 * time.Second}
+	req := &ConnectCALeafRequest{Datacenter: "dc1", Service: "web", SNI: "web.gateway.example.com"}
+	_, err := typ.Fetch(opts, req)
+	require.NoError(err)
+	require.Equal([]string{"web.gateway.example.com"}, csrDNSNames)
+
+	// Without an SNI name there are no DNS names
+	plain := &ConnectCALeafRequest{Datacenter: "dc1", Service: "web"}
+	_, err = typ.Fetch(opts, plain)
+	require.NoError(err)
+	require.Empty(csrDNSNames)
+
+	// The SNI name is part of the cache key
+	other := &ConnectCALeafRequest{Datacenter: "dc1", Service: "web", SNI: "web.other.example.com"}
+	require.NotEqual(plain.CacheInfo().Key, req.CacheInfo().Key)
+	require.NotEqual(other.CacheInfo().Key, req.CacheInfo().Key)
+
+	// Names that aren't valid DNS names are rejected
+	for _, name := range []string{"web gateway", "-web.example.com", "web..example.com", "https://web"} {
+		_, err = typ.Fetch(opts, &ConnectCALeafRequest{Datacenter: "dc1", Service: "web", SNI: name})
+		require.Error(err, name)
+		require.Contains(err.Error(), "invalid SNI name")
+	}
+}
+
+// Test that a PKCS#12 bundle of the leaf, its chain and its key is added when
+// requested.
+func TestConnectCALeaf_pkcs12(t *testing.T) {
+	t.Parallel()
+
+	require := require.New(t)
+	rpc := TestRPC(t)
+	defer rpc.AssertExpectations(t)
+
+	root := connect.TestCA(t, nil)
+	typ, rootsCh := testCALeafType(t, rpc)
+	defer close(rootsCh)
+	rootsCh <- structs.IndexedCARoots{
+		ActiveRootID: root.ID,
+		TrustDomain:  connect.TestClusterID + ".consul",
+		Roots:        []*structs.CARoot{root},
+		QueryMeta:    structs.QueryMeta{Index: 1},
+	}
+
+	var idx uint64
+	rpc.On("RPC", "ConnectCA.Sign", mock.Anything, mock.Anything).Return(nil).
+		Run(func(args mock.Arguments) {
+			reply := args.Get(2).(*structs.IssuedCert)
+			reply.CertPEM, _ = connect.TestLeaf(t, "web", root)
+			reply.ValidBefore = time.Now().Add(12 * time.Hour)
+			reply.CreateIndex = atomic.AddUint64(&idx, 1)
+			reply.ModifyIndex = reply.CreateIndex
+		})
+
+	opts := cache.FetchOptions{MinIndex: 0, Timeout: 10 * time.Second}
+	req := &ConnectCALeafRequest{
+		Datacenter:     "dc1",
+		Service:        "web",
+		BundleFormat:   LeafBundleFormatPKCS12,
+		BundlePassword: "hunter2",
+	}
+	result, err := typ.Fetch(opts, req)
+	require.NoError(err)
+	issued := result.Value.(*structs.IssuedCert)
+	require.NotEmpty(issued.CertPEM)
+	require.NotEmpty(issued.PrivateKeyPEM)
+
+	// The bundle holds the issued key, the leaf and then the root
+	key, certs := connect.TestDecodePKCS12(t, issued.PKCS12, "hunter2")
+	pk, err := connect.ParseSigner(issued.PrivateKeyPEM)
+	require.NoError(err)
+	require.Equal(pk.Public(), key.Public())
+	leaf, err := connect.ParseCert(issued.CertPEM)
+	require.NoError(err)
+	rootCert, err := connect.ParseCert(root.RootCert)
+	require.NoError(err)
+	require.Len(certs, 2)
+	require.Equal(leaf.Raw, certs[0].Raw)
+	require.Equal(rootCert.Raw, certs[1].Raw)
+
+	// PEM alone is the default, and both the format and password are part
+	// of the cache key, the password only through a keyed hash that's stable
+	// for the process
+	plain := &ConnectCALeafRequest{Datacenter: "dc1", Service: "web"}
+	result, err = typ.Fetch(opts, plain)
+	require.NoError(err)
+	require.Empty(result.Value.(*structs.IssuedCert).PKCS12)
+	other := *req
+	other.BundlePassword = "other"
+	require.NotEqual(plain.CacheInfo().Key, req.CacheInfo().Key)
+	require.NotEqual(other.CacheInfo().Key, req.CacheInfo().Key)
+	same := *req
+	require.Equal(same.CacheInfo().Key, req.CacheInfo().Key)
+	require.NotContains(req.CacheInfo().Key, "hunter2")
+
+	// The password isn't exposed by the cached leaves
+	for _, leaf := range typ.Leaves() {
+		require.Empty(leaf.Request.BundlePassword)
+	}
+
+	// Other formats are rejected
+	_, err = typ.Fetch(opts, &ConnectCALeafRequest{Datacenter: "dc1", Service: "web", BundleFormat: "jks"})
+	require.Error(err)
+	require.Contains(err.Error(), "unsupported bundle format")
+}
+
+// Test that the leaf, its chain and its key are written to a directory with
+// the key only readable by the owner, replacing any earlier files.
+func TestWriteLeafFiles(t *testing.T) {
+	t.Parallel()
+
+	require := require.New(t)
+	root := connect.TestCA(t, nil)
+	roots := &structs.IndexedCARoots{ActiveRootID: root.ID, Roots: []*structs.CARoot{root}}
+	certPEM, keyPEM := connect.TestLeaf(t, "web", root)
+	cert := &structs.IssuedCert{Service: "web", CertPEM: certPEM, PrivateKeyPEM: keyPEM}
+
+	td, err := ioutil.TempDir("", "consul")
+	require.NoError(err)
+	defer os.RemoveAll(td)
+	dir := filepath.Join(td, "leaf")
+	require.NoError(os.MkdirAll(dir, 0700))
+	require.NoError(ioutil.WriteFile(filepath.Join(dir, LeafKeyFile), []byte("old key"), 0644))
+
+	require.NoError(WriteLeafFiles(dir, cert, roots))
+	check := func(name, contents string, mode os.FileMode) {
+		t.Helper()
+		data, err := ioutil.ReadFile(filepath.Join(dir, name))
+		require.NoError(err)
+		require.Equal(contents, string(data))
+		fi, err := os.Stat(filepath.Join(dir, name))
+		require.NoError(err)
+		require.Equal(mode, fi.Mode().Perm(), name)
+	}
+	check(LeafCertFile, certPEM, 0644)
+	check(LeafChainFile, root.RootCert, 0644)
+	check(LeafKeyFile, keyPEM, 0600)
+
+	// No temporary files are left behind
+	entries, err := ioutil.ReadDir(dir)
+	require.NoError(err)
+	require.Len(entries, 3)
+
+	// A failure leaves the earlier files as they were
+	err = WriteLeafFiles(dir, &structs.IssuedCert{Service: "web", CertPEM: "other"}, &structs.IndexedCARoots{})
+	require.Error(err)
+	check(LeafCertFile, certPEM, 0644)
+	err = WriteLeafFiles(dir, &structs.IssuedCert{Service: "web"}, roots)
+	require.Error(err)
+	check(LeafCertFile, certPEM, 0644)
+	entries, err = ioutil.ReadDir(dir)
+	require.NoError(err)
+	require.Len(entries, 3)
+
+	// A failure renaming the files can leave a mix of new and existing
+	// files, but no temporary files
+	other := connect.TestCA(t, nil)
+	otherRoots := &structs.IndexedCARoots{ActiveRootID: other.ID, Roots: []*structs.CARoot{other}}
+	otherPEM, otherKeyPEM := connect.TestLeaf(t, "web", other)
+	renames := 0
+	err = writeLeafFiles(dir, &structs.IssuedCert{Service: "web", CertPEM: otherPEM, PrivateKeyPEM: otherKeyPEM},
+		otherRoots, func(oldpath, newpath string) error {
+			if renames++; renames > 1 {
+				return fmt.Errorf("rename failed")
+			}
+			return os.Rename(oldpath, newpath)
+		})
+	require.Error(err)
+	check(LeafCertFile, otherPEM, 0644)
+	check(LeafChainFile, root.RootCert, 0644)
+	check(LeafKeyFile, keyPEM, 0600)
+	entries, err = ioutil.ReadDir(dir)
+	require.NoError(err)
+	require.Len(entries, 3)
+
+	// A leaf signed from a CSR has no key, so the existing key that doesn't
+	// match it is removed
+	require.NoError(WriteLeafFiles(dir, &structs.IssuedCert{Service: "web", CertPEM: otherPEM}, otherRoots))
+	check(LeafCertFile, otherPEM, 0644)
+	check(LeafChainFile, other.RootCert, 0644)
+	_, err = os.Stat(filepath.Join(dir, LeafKeyFile))
+	require.True(os.IsNotExist(err))
+	entries, err = ioutil.ReadDir(dir)
+	require.NoError(err)
+	require.Len(entries, 2)
+}
+
+// Test that a requested not-before time is forwarded to the servers and that
+// a leaf that isn't valid yet is served without renewing it.
+func TestConnectCALeaf_notBefore(t *testing.T) {
+	t.Parallel()
+
+	require := require.New(t)
+	rpc := TestRPC(t)
+	defer rpc.AssertExpectations(t)
+
+	typ, rootsCh := testCALeafType(t, rpc)
+	defer close(rootsCh)
+	rootsCh <- structs.IndexedCARoots{
+		ActiveRootID: "1",
+		TrustDomain:  "fake-trust-domain.consul",
+		QueryMeta:    structs.QueryMeta{Index: 1},
+	}
+
+	// The server honours the requested not-before time
+	notBefore := time.Now().Add(time.Hour).Truncate(time.Second)
+	var idx uint64
+	rpc.On("RPC", "ConnectCA.Sign", mock.Anything, mock.Anything).Return(nil).
+		Run(func(args mock.Arguments) {
+			signReq := args.Get(1).(*structs.CASignRequest)
+			require.True(notBefore.Equal(signReq.NotBefore))
+
+			reply := args.Get(2).(*structs.IssuedCert)
+			reply.ValidAfter = signReq.NotBefore
+			reply.ValidBefore = signReq.NotBefore.Add(30 * time.Minute)
+			reply.CreateIndex = atomic.AddUint64(&idx, 1)
+			reply.ModifyIndex = reply.CreateIndex
+		}).Once()
+
+	req := &ConnectCALeafRequest{Datacenter: "dc1", Service: "web", NotBefore: notBefore}
+	result, err := typ.Fetch(cache.FetchOptions{MinIndex: 0, Timeout: 10 * time.Second}, req)
+	require.NoError(err)
+	require.True(result.Generated)
+
+	// The leaf's renewal is after it becomes valid, so a blocking Fetch
+	// times out rather than renewing it straight away
+	result, err = typ.Fetch(cache.FetchOptions{MinIndex: 1, Timeout: 100 * time.Millisecond}, req)
+	require.NoError(err)
+	require.Nil(result.Value)
+	_, renewAt, ok := typ.Peek(req)
+	require.True(ok)
+	require.True(notBefore.Equal(renewAt))
+
+	// The not-before time is part of the cache key, wherever it's expressed
+	plain := &ConnectCALeafRequest{Datacenter: "dc1", Service: "web"}
+	utc := &ConnectCALeafRequest{Datacenter: "dc1", Service: "web", NotBefore: notBefore.UTC()}
+	require.NotEqual(plain.CacheInfo().Key, req.CacheInfo().Key)
+	require.Equal(req.CacheInfo().Key, utc.CacheInfo().Key)
+}
+
+// Test that a renewed leaf that isn't valid yet is held back, with the
+// current leaf served until the renewed one becomes valid.
+func TestConnectCALeaf_futureRenewal(t *testing.T) {
+	t.Parallel()
+
+	require := require.New(t)
+	rpc := TestRPC(t)
+	defer rpc.AssertExpectations(t)
+
+	typ, rootsCh := testCALeafType(t, rpc)
+	defer close(rootsCh)
+	clk := newTestClock(time.Now())
+	typ.clock = clk
+	rootsCh <- structs.IndexedCARoots{
+		ActiveRootID: "1",
+		TrustDomain:  "fake-trust-domain.consul",
+		QueryMeta:    structs.QueryMeta{Index: 1},
+	}
+
+	// Instrument ConnectCA.Sign to issue certs valid for 12 hours from
+	// validIn after the fake now.
+	var validIn int64
+	var signs, idx uint64
+	var resp *structs.IssuedCert
+	rpc.On("RPC", "ConnectCA.Sign", mock.Anything, mock.Anything).Return(nil).
+		Run(func(args mock.Arguments) {
+			atomic.AddUint64(&signs, 1)
+			reply := args.Get(2).(*structs.IssuedCert)
+			reply.ValidAfter = clk.Now().Add(time.Duration(atomic.LoadInt64(&validIn)))
+			reply.ValidBefore = reply.ValidAfter.Add(12 * time.Hour)
+			reply.CreateIndex = atomic.AddUint64(&idx, 1)
+			reply.ModifyIndex = reply.CreateIndex
+			resp = reply
+		})
+
+	opts := cache.FetchOptions{MinIndex: 0, Timeout: 24 * time.Hour}
+	req := &ConnectCALeafRequest{Datacenter: "dc1", Service: "web"}
+	result, err := typ.Fetch(opts, req)
+	require.NoError(err)
+	first := resp
+	requireFetchResult(t, cache.FetchResult{Value: first, Index: 1, Generated: true}, result)
+
+	// The renewal at the soft expiry is only valid in 30 minutes, so the
+	// first cert is still returned and not reported as generated.
+	atomic.StoreInt64(&validIn, int64(30*time.Minute))
+	opts.MinIndex = 1
+	fetchCh := TestFetchCh(t, typ, opts, req)
+	clk.waitForWaiters(t, 1)
+	clk.Advance(11 * time.Hour)
+	select {
+	case <-time.After(time.Second):
+		t.Fatal("shouldn't block waiting for fetch")
+	case result := <-fetchCh:
+		requireFetchResult(t, cache.FetchResult{Value: first, Index: 1}, result)
+	}
+	second := resp
+	require.NotEqual(first, second)
+	require.Equal(uint64(2), atomic.LoadUint64(&signs))
+
+	result, err = typ.Fetch(cache.FetchOptions{Timeout: time.Minute}, req)
+	require.NoError(err)
+	require.Equal(first, result.Value)
+
+	// A blocking Fetch switches to the renewed cert once it's valid,
+	// without signing another.
+	fetchCh = TestFetchCh(t, typ, opts, req)
+	clk.waitForWaiters(t, 1)
+	clk.Advance(20 * time.Minute)
+	select {
+	case result := <-fetchCh:
+		t.Fatalf("should not return: %#v", result)
+	case <-time.After(100 * time.Millisecond):
+	}
+	clk.Advance(10 * time.Minute)
+	select {
+	case <-time.After(time.Second):
+		t.Fatal("shouldn't block waiting for fetch")
+	case result := <-fetchCh:
+		requireFetchResult(t, cache.FetchResult{Value: second, Index: 2}, result)
+	}
+	require.Equal(uint64(2), atomic.LoadUint64(&signs))
+
+	// With ServeFutureLeaves, the next renewal is served straight away.
+	typ.ServeFutureLeaves = true
+	opts.MinIndex = 2
+	fetchCh = TestFetchCh(t, typ, opts, req)
+	clk.waitForWaiters(t, 1)
+	clk.Advance(11 * time.Hour)
+	select {
+	case <-time.After(time.Second):
+		t.Fatal("shouldn't block waiting for fetch")
+	case result := <-fetchCh:
+		requireFetchResult(t, cache.FetchResult{Value: resp, Index: 3, Generated: true}, result)
+	}
+	require.True(resp.ValidAfter.After(clk.Now()))
+}
+
+// Test that the usage hint is forwarded to the servers and that leaves with
+// different usages are cached separately.
+func TestConnectCALeaf_usage(t *testing.T) {
+	t.Parallel()
+
+	require := require.New(t)
+	rpc := TestRPC(t)
+	defer rpc.AssertExpectations(t)
+
+	typ, rootsCh := testCALeafType(t, rpc)
+	defer close(rootsCh)
+	rootsCh <- structs.IndexedCARoots{
+		ActiveRootID: "1",
+		TrustDomain:  "fake-trust-domain.consul",
+		QueryMeta:    structs.QueryMeta{Index: 1},
+	}
+
+	var usages []string
+	var idx uint64
+	rpc.On("RPC", "ConnectCA.Sign", mock.Anything, mock.Anything).Return(nil).
+		Run(func(args mock.Arguments) {
+			usages = append(usages, args.Get(1).(*structs.CASignRequest).Usage)
+
+			reply := args.Get(2).(*structs.IssuedCert)
+			reply.ValidBefore = time.Now().Add(12 * time.Hour)
+			reply.CreateIndex = atomic.AddUint64(&idx, 1)
+			reply.ModifyIndex = reply.CreateIndex
+		})
+
+	opts := cache.FetchOptions{MinIndex: 0, Timeout: 10 * time.Second}
+	for _, usage := range []string{LeafUsageClient, LeafUsageServer, ""} {
+		_, err := typ.Fetch(opts, &ConnectCALeafRequest{Datacenter: "dc1", Service: "web", Usage: usage})
+		require.NoError(err)
+	}
+	require.Equal([]string{"client", "server", ""}, usages)
+
+	// Each usage has its own cache entry, with "both" the same as the
+	// default
+	keys := make(map[string]bool)
+	for _, usage := range []string{LeafUsageClient, LeafUsageServer, ""} {
+		keys[(&ConnectCALeafRequest{Service: "web", Usage: usage}).Key()] = true
+	}
+	require.Len(keys, 3)
+	require.Equal("/web", (&ConnectCALeafRequest{Service: "web", Usage: LeafUsageBoth}).Key())
+
+	_, err := typ.Fetch(opts, &ConnectCALeafRequest{Datacenter: "dc1", Service: "web", Usage: "peer"})
+	require.EqualError(err, `unsupported leaf usage "peer"`)
+	require.Len(usages, 3)
+}
+
+// Test that the on-behalf-of identity is forwarded to the servers and that
+// leaves requested on behalf of different identities are cached separately.
+func TestConnectCALeaf_onBehalfOf(t *testing.T) {
+	t.Parallel()
+
+	require := require.New(t)
+	rpc := TestRPC(t)
+	defer rpc.AssertExpectations(t)
+
+	typ, rootsCh := testCALeafType(t, rpc)
+	defer close(rootsCh)
+	rootsCh <- structs.IndexedCARoots{
+		ActiveRootID: "1",
+		TrustDomain:  "fake-trust-domain.consul",
+		QueryMeta:    structs.QueryMeta{Index: 1},
+	}
+
+	var onBehalfOf []string
+	var idx uint64
+	rpc.On("RPC", "ConnectCA.Sign", mock.Anything, mock.Anything).Return(nil).
+		Run(func(args mock.Arguments) {
+			signReq := args.Get(1).(*structs.CASignRequest)
+			require.Equal("delegation-token", signReq.Token)
+			onBehalfOf = append(onBehalfOf, signReq.OnBehalfOf)
+
+			reply := args.Get(2).(*structs.IssuedCert)
+			reply.ValidBefore = time.Now().Add(12 * time.Hour)
+			reply.CreateIndex = atomic.AddUint64(&idx, 1)
+			reply.ModifyIndex = reply.CreateIndex
+		})
+
+	opts := cache.FetchOptions{MinIndex: 0, Timeout: 10 * time.Second}
+	var values []interface{}
+	for _, identity := range []string{"web-team", "payments-team", "web-team"} {
+		result, err := typ.Fetch(opts, &ConnectCALeafRequest{
+			Datacenter: "dc1",
+			Service:    "web",
+			Token:      "delegation-token",
+			OnBehalfOf: identity,
+		})
+		require.NoError(err)
+		values = append(values, result.Value)
+	}
+
+	// The repeated identity is served from its own cached leaf
+	require.Equal([]string{"web-team", "payments-team"}, onBehalfOf)
+	require.NotEqual(values[0], values[1])
+	require.Equal(values[0], values[2])
+
+	plain := &ConnectCALeafRequest{Datacenter: "dc1", Service: "web"}
+	delegated := &ConnectCALeafRequest{Datacenter: "dc1", Service: "web", OnBehalfOf: "web-team"}
+	require.NotEqual(plain.Key(), delegated.Key())
+}
+
+// Test that requested subject fields are set on the CSR and that leaves
+// requested with different subjects are cached separately.
+func TestConnectCALeaf_subject(t *testing.T) {
+	t.Parallel()
+
+	require := require.New(t)
+	rpc := TestRPC(t)
+	defer rpc.AssertExpectations(t)
+
+	typ, rootsCh := testCALeafType(t, rpc)
+	defer close(rootsCh)
+	rootsCh <- structs.IndexedCARoots{
+		ActiveRootID: "1",
+		TrustDomain:  "fake-trust-domain.consul",
+		QueryMeta:    structs.QueryMeta{Index: 1},
+	}
+
+	// Instrument ConnectCA.Sign to capture the CSR subject
+	var subject pkix.Name
+	var idx uint64
+	rpc.On("RPC", "ConnectCA.Sign", mock.Anything, mock.Anything).Return(nil).
+		Run(func(args mock.Arguments) {
+			csr, err := connect.ParseCSR(args.Get(1).(*structs.CASignRequest).CSR)
+			require.NoError(err)
+			subject = csr.Subject
+
+			reply := args.Get(2).(*structs.IssuedCert)
+			reply.ValidBefore = time.Now().Add(12 * time.Hour)
+			reply.CreateIndex = atomic.AddUint64(&idx, 1)
+			reply.ModifyIndex = reply.CreateIndex
+		})
+
+	opts := cache.FetchOptions{MinIndex: 0, Timeout: 10 * time.Second}
+
+	// No subject fields by default
+	req := &ConnectCALeafRequest{Datacenter: "dc1", Service: "web"}
+	_, err := typ.Fetch(opts, req)
+	require.NoError(err)
+	require.Empty(subject.Organization)
+	require.Empty(subject.OrganizationalUnit)
+
+	// Requested fields are carried on the CSR
+	reqSubject := &ConnectCALeafRequest{Datacenter: "dc1", Service: "web",
+		SubjectOrg: "Example Corp", SubjectOU: "Payments"}
+	require.NotEqual(req.CacheInfo().Key, reqSubject.CacheInfo().Key)
+	_, err = typ.Fetch(opts, reqSubject)
+	require.NoError(err)
+	require.Equal([]string{"Example Corp"}, subject.Organization)
+	require.Equal([]string{"Payments"}, subject.OrganizationalUnit)
+
+	// A different unit is a different leaf
+	reqOther := &ConnectCALeafRequest{Datacenter: "dc1", Service: "web",
+		SubjectOrg: "Example Corp", SubjectOU: "Billing"}
+	require.NotEqual(reqSubject.CacheInfo().Key, reqOther.CacheInfo().Key)
+}
+
+// Test that Close stops blocking Fetches and makes further Fetches fail fast.
+func TestConnectCALeaf_close(t *testing.T) {
+	t.Parallel()
+
+	require := require.New(t)
+	rpc := TestRPC(t)
+	defer rpc.AssertExpectations(t)
+
+	typ, rootsCh := testCALeafType(t, rpc)
+	defer close(rootsCh)
+	rootsCh <- structs.IndexedCARoots{
+		ActiveRootID: "1",
+		TrustDomain:  "fake-trust-domain.consul",
+		QueryMeta:    structs.QueryMeta{Index: 1},
+	}
+
+	// Instrument ConnectCA.Sign to return signed cert
+	var idx uint64
+	rpc.On("RPC", "ConnectCA.Sign", mock.Anything, mock.Anything).Return(nil).
+		Run(func(args mock.Arguments) {
+			reply := args.Get(2).(*structs.IssuedCert)
+			reply.ValidBefore = time.Now().Add(12 * time.Hour)
+			reply.CreateIndex = atomic.AddUint64(&idx, 1)
+			reply.ModifyIndex = reply.CreateIndex
+		})
+
+	opts := cache.FetchOptions{MinIndex: 0, Timeout: 10 * time.Second}
+	req := &ConnectCALeafRequest{Datacenter: "dc1", Service: "web"}
+	_, err := typ.Fetch(opts, req)
+	require.NoError(err)
+
+	// A blocking fetch should return once closed
+	opts.MinIndex = 1
+	fetchCh := TestFetchCh(t, typ, opts, req)
+	select {
+	case result := <-fetchCh:
+		t.Fatalf("should not return: %#v", result)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	require.NoError(typ.Close())
+	select {
+	case <-time.After(100 * time.Millisecond):
+		t.Fatal("shouldn't block after close")
+	case result := <-fetchCh:
+		require.Equal(errLeafClosed, result)
+	}
+
+	// New fetches fail fast without signing
+	_, err = typ.Fetch(cache.FetchOptions{Timeout: 10 * time.Second},
+		&ConnectCALeafRequest{Datacenter: "dc1", Service: "db"})
+	require.Equal(errLeafClosed, err)
+	rpc.AssertNumberOfCalls(t, "RPC", 1)
+
+	// Closing again is fine
+	require.NoError(typ.Close())
+}
+
+// Test a cert's full renewal lifecycle using a fake clock so nothing has to
+// actually wait for the renewal time.
+func TestConnectCALeaf_clockLifecycle(t *testing.T) {
+	t.Parallel()
+
+	rpc := TestRPC(t)
+	defer rpc.AssertExpectations(t)
+
+	typ, rootsCh := testCALeafType(t, rpc)
+	defer close(rootsCh)
+	clk := newTestClock(time.Now())
+	typ.clock = clk
+	rootsCh <- structs.IndexedCARoots{
+		ActiveRootID: "1",
+		TrustDomain:  "fake-trust-domain.consul",
+		QueryMeta:    structs.QueryMeta{Index: 1},
+	}
+
+	// Instrument ConnectCA.Sign to issue certs valid for 12 hours from the
+	// fake now.
+	var resp *structs.IssuedCert
+	var idx uint64
+	rpc.On("RPC", "ConnectCA.Sign", mock.Anything, mock.Anything).Return(nil).
+		Run(func(args mock.Arguments) {
+			reply := args.Get(2).(*structs.IssuedCert)
+			reply.ValidAfter = clk.Now()
+			reply.ValidBefore = clk.Now().Add(12 * time.Hour)
+			reply.CreateIndex = atomic.AddUint64(&idx, 1)
+			reply.ModifyIndex = reply.CreateIndex
+			resp = reply
+		})
+
+	opts := cache.FetchOptions{MinIndex: 0, Timeout: 10 * time.Minute}
+	req := &ConnectCALeafRequest{Datacenter: "dc1", Service: "web"}
+
+	// First fetch generates immediately
+	fetchCh := TestFetchCh(t, typ, opts, req)
+	select {
+	case <-time.After(time.Second):
+		t.Fatal("shouldn't block waiting for fetch")
+	case result := <-fetchCh:
+		requireFetchResult(t, cache.FetchResult{Value: resp, Index: 1, Generated: true}, result)
+	}
+
+	// A blocking fetch times out with no value once the clock passes the
+	// timeout.
+	opts.MinIndex = 1
+	fetchCh = TestFetchCh(t, typ, opts, req)
+	clk.waitForWaiters(t, 1)
+	clk.Advance(11 * time.Minute)
+	select {
+	case <-time.After(time.Second):
+		t.Fatal("shouldn't block waiting for fetch")
+	case result := <-fetchCh:
+		requireFetchResult(t, cache.FetchResult{}, result)
+	}
+
+	// Blocking with a long timeout, the cert isn't renewed before its soft
+	// expiry.
+	opts.Timeout = 24 * time.Hour
+	fetchCh = TestFetchCh(t, typ, opts, req)
+	clk.waitForWaiters(t, 1)
+	clk.Advance(10 * time.Hour)
+	select {
+	case result := <-fetchCh:
+		t.Fatalf("should not return: %#v", result)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	// Once past it, the cert is renewed
+	clk.Advance(1 * time.Hour)
+	select {
+	case <-time.After(time.Second):
+		t.Fatal("shouldn't block waiting for fetch")
+	case result := <-fetchCh:
+		requireFetchResult(t, cache.FetchResult{Value: resp, Index: 2, Generated: true}, result)
+	}
+}
+
+// Test that a CA change with next to no rotation jitter renews the leaf only
+// once, and that a forced renewal time that passed without a renewal isn't
+// retried straight away.
+func TestConnectCALeaf_forceExpireFloor(t *testing.T) {
+	t.Parallel()
+
+	require := require.New(t)
+	rpc := TestRPC(t)
+	defer rpc.AssertExpectations(t)
+
+	typ, rootsCh := testCALeafType(t, rpc)
+	defer close(rootsCh)
+	clk := newTestClock(time.Now())
+	typ.clock = clk
+	rootsCh <- structs.IndexedCARoots{
+		ActiveRootID: "1",
+		TrustDomain:  "fake-trust-domain.consul",
+		QueryMeta:    structs.QueryMeta{Index: 1},
+	}
+
+	var signs, idx uint64
+	rpc.On("RPC", "ConnectCA.Sign", mock.Anything, mock.Anything).Return(nil).
+		Run(func(args mock.Arguments) {
+			atomic.AddUint64(&signs, 1)
+			reply := args.Get(2).(*structs.IssuedCert)
+			reply.ValidAfter = clk.Now()
+			reply.ValidBefore = clk.Now().Add(12 * time.Hour)
+			reply.CreateIndex = atomic.AddUint64(&idx, 1)
+			reply.ModifyIndex = reply.CreateIndex
+		})
+
+	opts := cache.FetchOptions{MinIndex: 0, Timeout: 10 * time.Minute}
+	req := &ConnectCALeafRequest{Datacenter: "dc1", Service: "web"}
+	_, err := typ.Fetch(opts, req)
+	require.NoError(err)
+
+	// Pace rotations with no jitter to speak of
+	typ.RotationLimiter = rate.NewLimiter(rate.Every(time.Millisecond), 1)
+
+	requireGenerated := func(fetchCh <-chan interface{}, index uint64) {
+		t.Helper()
+		select {
+		case <-time.After(time.Second):
+			t.Fatal("shouldn't block waiting for fetch")
+		case result := <-fetchCh:
+			require.IsType(cache.FetchResult{}, result)
+			require.True(result.(cache.FetchResult).Generated)
+			require.Equal(index, result.(cache.FetchResult).Index)
+		}
+	}
+
+	// The rotation renews the leaf. The Fetch's timeout stays pending on
+	// the clock.
+	opts.MinIndex = 1
+	fetchCh := TestFetchCh(t, typ, opts, req)
+	clk.waitForWaiters(t, 1)
+	rootsCh <- structs.IndexedCARoots{
+		ActiveRootID: "2",
+		TrustDomain:  "fake-trust-domain.consul",
+		QueryMeta:    structs.QueryMeta{Index: 2},
+	}
+	requireGenerated(fetchCh, 2)
+
+	// The renewed leaf isn't renewed again
+	opts.MinIndex = 2
+	fetchCh = TestFetchCh(t, typ, opts, req)
+	clk.waitForWaiters(t, 2)
+	select {
+	case result := <-fetchCh:
+		t.Fatalf("should not return: %#v", result)
+	case <-time.After(100 * time.Millisecond):
+	}
+	clk.Advance(11 * time.Minute)
+	select {
+	case <-time.After(time.Second):
+		t.Fatal("shouldn't block waiting for fetch")
+	case result := <-fetchCh:
+		requireFetchResult(t, cache.FetchResult{}, result)
+	}
+	require.Equal(uint64(2), atomic.LoadUint64(&signs))
+
+	// A renewal time that passed before the Fetch started, e.g. because the
+	// Fetch that woke for it failed, is put off rather than renewed at once.
+	typ.issuedCertsLock.Lock()
+	typ.issuedCerts[issuedKey(req.Key(), req.Token)].forceExpireAfter = clk.Now().Add(-time.Second)
+	typ.issuedCertsLock.Unlock()
+	fetchCh = TestFetchCh(t, typ, opts, req)
+	clk.waitForWaiters(t, 1)
+	select {
+	case result := <-fetchCh:
+		t.Fatalf("should not return: %#v", result)
+	case <-time.After(100 * time.Millisecond):
+	}
+	require.Equal(uint64(2), atomic.LoadUint64(&signs))
+	clk.Advance(minForceExpireDelay)
+	requireGenerated(fetchCh, 3)
+}
+
+// Test that a leaf is renewed with a new key once the key reaches MaxKeyAge,
+// even though its cert is nowhere near expiring.
+func TestConnectCALeaf_maxKeyAge(t *testing.T) {
+	t.Parallel()
+
+	require := require.New(t)
+	rpc := TestRPC(t)
+	defer rpc.AssertExpectations(t)
+
+	typ, rootsCh := testCALeafType(t, rpc)
+	defer close(rootsCh)
+	clk := newTestClock(time.Now())
+	typ.clock = clk
+	typ.MaxKeyAge = 7 * 24 * time.Hour
+	rootsCh <- structs.IndexedCARoots{
+		ActiveRootID: "1",
+		TrustDomain:  "fake-trust-domain.consul",
+		QueryMeta:    structs.QueryMeta{Index: 1},
+	}
+
+	var idx uint64
+	rpc.On("RPC", "ConnectCA.Sign", mock.Anything, mock.Anything).Return(nil).
+		Run(func(args mock.Arguments) {
+			reply := args.Get(2).(*structs.IssuedCert)
+			reply.ValidAfter = clk.Now()
+			reply.ValidBefore = clk.Now().Add(30 * 24 * time.Hour)
+			reply.CreateIndex = atomic.AddUint64(&idx, 1)
+			reply.ModifyIndex = reply.CreateIndex
+		})
+
+	opts := cache.FetchOptions{MinIndex: 0, Timeout: 8 * 24 * time.Hour}
+	req := &ConnectCALeafRequest{Datacenter: "dc1", Service: "web"}
+	result, err := typ.Fetch(opts, req)
+	require.NoError(err)
+	first := result.Value.(*structs.IssuedCert)
+
+	// The renewal is due when the key reaches its maximum age
+	_, renewAt, ok := typ.Peek(req)
+	require.True(ok)
+	require.Equal(clk.Now().Add(typ.MaxKeyAge), renewAt)
+
+	opts.MinIndex = 1
+	fetchCh := TestFetchCh(t, typ, opts, req)
+	clk.waitForWaiters(t, 1)
+	clk.Advance(typ.MaxKeyAge - time.Minute)
+	select {
+	case result := <-fetchCh:
+		t.Fatalf("should not return: %#v", result)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	clk.Advance(time.Minute)
+	select {
+	case <-time.After(time.Second):
+		t.Fatal("shouldn't block waiting for fetch")
+	case result := <-fetchCh:
+		require.IsType(cache.FetchResult{}, result)
+		v := result.(cache.FetchResult)
+		require.True(v.Generated)
+		require.Equal(uint64(2), v.Index)
+		require.NotEqual(first.PrivateKeyPEM, v.Value.(*structs.IssuedCert).PrivateKeyPEM)
+	}
+
+	// The new key's age counts from when it was generated
+	_, renewAt, ok = typ.Peek(req)
+	require.True(ok)
+	require.Equal(clk.Now().Add(typ.MaxKeyAge), renewAt)
+}
+
+// Test that the reason for a leaf's next renewal tells CA rotations apart
+// from key age and expiry.
+func TestConnectCALeaf_renewalReason(t *testing.T) {
+	t.Parallel()
+
+	require := require.New(t)
+	rpc := TestRPC(t)
+	defer rpc.AssertExpectations(t)
+
+	typ, rootsCh := testCALeafType(t, rpc)
+	defer close(rootsCh)
+	rootsCh <- structs.IndexedCARoots{
+		ActiveRootID: "1",
+		TrustDomain:  "fake-trust-domain.consul",
+		QueryMeta:    structs.QueryMeta{Index: 1},
+	}
+
+	var idx uint64
+	rpc.On("RPC", "ConnectCA.Sign", mock.Anything, mock.Anything).Return(nil).
+		Run(func(args mock.Arguments) {
+			reply := args.Get(2).(*structs.IssuedCert)
+			reply.ValidBefore = time.Now().Add(12 * time.Hour)
+			reply.CreateIndex = atomic.AddUint64(&idx, 1)
+			reply.ModifyIndex = reply.CreateIndex
+		})
+
+	req := &ConnectCALeafRequest{Datacenter: "dc1", Service: "web"}
+	_, ok := typ.RenewalReason(req)
+	require.False(ok)
+
+	result, err := typ.Fetch(cache.FetchOptions{Timeout: 10 * time.Second}, req)
+	require.NoError(err)
+	reason, ok := typ.RenewalReason(req)
+	require.True(ok)
+	require.Equal(LeafRenewalExpiry, reason)
+
+	// A key age limit before the soft expiry makes it the reason
+	typ.MaxKeyAge = 2 * time.Hour
+	reason, _ = typ.RenewalReason(req)
+	require.Equal(LeafRenewalKeyAge, reason)
+
+	// A rotation paced to renew before then takes over. The limiter's only
+	// token is used up so the renewal waits for the next one.
+	typ.RotationLimiter = rate.NewLimiter(rate.Every(time.Hour), 1)
+	require.True(typ.RotationLimiter.Allow())
+	fetchCh := TestFetchCh(t, typ, cache.FetchOptions{MinIndex: result.Index, Timeout: 10 * time.Second}, req)
+	time.Sleep(100 * time.Millisecond)
+	rootsCh <- structs.IndexedCARoots{
+		ActiveRootID: "2",
+		TrustDomain:  "fake-trust-domain.consul",
+		QueryMeta:    structs.QueryMeta{Index: 2},
+	}
+	retry.Run(t, func(r *retry.R) {
+		if reason, _ := typ.RenewalReason(req); reason != LeafRenewalRotation {
+			r.Fatalf("got reason %q", reason)
+		}
+	})
+	select {
+	case result := <-fetchCh:
+		t.Fatalf("should not return: %#v", result)
+	default:
+	}
+}
+
+// Test that DebugDump reports the renewal schedule of each leaf.
+func TestConnectCALeaf_debugDump(t *testing.T) {
+	t.Parallel()
+
+	require := require.New(t)
+	rpc := TestRPC(t)
+	defer rpc.AssertExpectations(t)
+
+	typ, rootsCh := testCALeafType(t, rpc)
+	defer close(rootsCh)
+	rootsCh <- structs.IndexedCARoots{
+		ActiveRootID: "1",
+		TrustDomain:  connect.TestClusterID + ".consul",
+		QueryMeta:    structs.QueryMeta{Index: 1},
+	}
+
+	root := connect.TestCA(t, nil)
+	rootCert, err := connect.ParseCert(root.RootCert)
+	require.NoError(err)
+	signingKeyID := connect.HexString(rootCert.SubjectKeyId)
+
+	validity := map[string]time.Duration{
+		"web": 12 * time.Hour,
+		"db":  6 * time.Hour,
+	}
+	var idx uint64
+	rpc.On("RPC", "ConnectCA.Sign", mock.Anything, mock.Anything).Return(nil).
+		Run(func(args mock.Arguments) {
+			csr, err := connect.ParseCSR(args.Get(1).(*structs.CASignRequest).CSR)
+			require.NoError(err)
+			uri, err := connect.ParseCertURI(csr.URIs[0])
+			require.NoError(err)
+			service := uri.(*connect.SpiffeIDService).Service
+
+			reply := args.Get(2).(*structs.IssuedCert)
+			reply.CertPEM, _ = connect.TestLeaf(t, service, root)
+			reply.SerialNumber = "serial-" + service
+			reply.ValidAfter = time.Now()
+			reply.ValidBefore = reply.ValidAfter.Add(validity[service])
+			reply.CreateIndex = atomic.AddUint64(&idx, 1)
+			reply.ModifyIndex = reply.CreateIndex
+		})
+
+	require.Empty(typ.DebugDump())
+
+	opts := cache.FetchOptions{Timeout: 10 * time.Second}
+	certs := make(map[string]*structs.IssuedCert)
+	for _, service := range []string{"web", "db"} {
+		result, err := typ.Fetch(opts, &ConnectCALeafRequest{
+			Datacenter: "dc1", Service: service, Token: "secret"})
+		require.NoError(err)
+		certs[service] = result.Value.(*structs.IssuedCert)
+	}
+
+	// Schedule a paced rotation for db. The limiter's only token is used
+	// up so it's due in about an hour, before db's soft expiry.
+	typ.RotationLimiter = rate.NewLimiter(rate.Every(time.Hour), 1)
+	require.True(typ.RotationLimiter.Allow())
+	dbReq := &ConnectCALeafRequest{Datacenter: "dc1", Service: "db", Token: "secret"}
+	require.True(typ.scheduleRotation(issuedKey(dbReq.Key(), dbReq.Token), 0) > 30*time.Minute)
+
+	dump := typ.DebugDump()
+	require.Len(dump, 2)
+	for i, service := range []string{"db", "web"} {
+		info := dump[i]
+		require.Equal(service, info.Request.Service)
+		require.Empty(info.Request.Token)
+		require.Equal("serial-"+service, info.SerialNumber)
+		require.Equal(certs[service].ValidAfter, info.ValidAfter)
+		require.Equal(certs[service].ValidBefore, info.ValidBefore)
+		require.Equal(signingKeyID, info.SigningKeyID)
+		require.Equal(uint64(1), info.RootsIndex)
+		require.False(info.KeyCreatedAt.IsZero())
+	}
+
+	require.Equal(LeafRenewalRotation, dump[0].RenewalReason)
+	require.False(dump[0].ForceExpireAfter.IsZero())
+	require.Equal(dump[0].ForceExpireAfter, dump[0].RenewAt)
+
+	require.Equal(LeafRenewalExpiry, dump[1].RenewalReason)
+	require.True(dump[1].ForceExpireAfter.IsZero())
+	require.Equal(certs["web"].ValidBefore.Add(-1*time.Hour), dump[1].RenewAt)
+
+	// The dump is meant for support bundles so must serialize.
+	_, err = json.Marshal(dump)
+	require.NoError(err)
+}
+
+// Test that requests whose names contain the key's separators don't alias
+// each other or requests with options.
+func TestConnectCALeafRequest_keyAliasing(t *testing.T) {
+	t.Parallel()
+
+	reqs := []*ConnectCALeafRequest{
+		{Datacenter: "dc1", Service: "web"},
+		{Datacenter: "dc2", Service: "web"},
+		{Datacenter: "dc1", Service: "web:1"},
+		{Datacenter: "dc1/web", Service: ""},
+		{Datacenter: "dc1", Service: "/web"},
+		{Datacenter: "dc1", Service: "web%3A1"},
+		{Datacenter: "dc1", Service: "web 1"},
+		{Datacenter: "dc1", Service: "web+1"},
+		{Datacenter: "dc1", Service: "web", SNI: "web.example.com"},
+	}
+
+	// Make a name that collides with the hashed key of a request with
+	// options if the name isn't escaped.
+	withOptions := reqs[len(reqs)-1].Key()
+	reqs = append(reqs, &ConnectCALeafRequest{
+		Datacenter: "dc1",
+		Service:    withOptions[strings.Index(withOptions, "/")+1:],
+	})
+
+	keys := make(map[string]*ConnectCALeafRequest)
+	issued := make(map[string]*ConnectCALeafRequest)
+	for _, req := range reqs {
+		key := req.Key()
+		require.NotContains(t, keys, key, "%#v aliases %#v", req, keys[key])
+		keys[key] = req
+
+		// The key is stable
+		require.Equal(t, key, req.Key())
+
+		// Keys can't be split differently against the token either
+		for _, token := range []string{"", "0", ":0", "secret"} {
+			k := issuedKey(key, token)
+			require.NotContains(t, issued, k)
+			issued[k] = req
+		}
+	}
+}
+
+// Test that repeated sign failures open the sign breaker, which suppresses
+// signs until its cooldown ends and then lets a single trial through.
+func TestConnectCALeaf_signBreaker(t *testing.T) {
+	t.Parallel()
+
+	require := require.New(t)
+	rpc := TestRPC(t)
+	defer rpc.AssertExpectations(t)
+
+	typ, rootsCh := testCALeafType(t, rpc)
+	defer close(rootsCh)
+	clk := newTestClock(time.Now())
+	typ.clock = clk
+	typ.SignBreakerThreshold = 3
+	typ.SignBreakerCooldown = time.Minute
+	rootsCh <- structs.IndexedCARoots{
+		ActiveRootID: "1",
+		TrustDomain:  "fake-trust-domain.consul",
+		QueryMeta:    structs.QueryMeta{Index: 1},
+	}
+
+	var signs, idx uint64
+	var healthy uint32
+	rpc.On("RPC", "ConnectCA.Sign", mock.Anything, mock.Anything).
+		Return(func(string, interface{}, interface{}) error {
+			if atomic.LoadUint32(&healthy) == 0 {
+				return errors.New("rpc error: No cluster leader")
+			}
+			return nil
+		}).
+		Run(func(args mock.Arguments) {
+			atomic.AddUint64(&signs, 1)
+			reply := args.Get(2).(*structs.IssuedCert)
+			reply.ValidBefore = clk.Now().Add(12 * time.Hour)
+			reply.CreateIndex = atomic.AddUint64(&idx, 1)
+			reply.ModifyIndex = reply.CreateIndex
+		})
+
+	opts := cache.FetchOptions{Timeout: 10 * time.Second}
+	req := &ConnectCALeafRequest{Datacenter: "dc1", Service: "web"}
+	fetch := func() error {
+		_, err := typ.Fetch(opts, req)
+		return err
+	}
+
+	// The failures up to the threshold reach the servers, then the breaker
+	// opens and signs fail fast.
+	for i := 0; i < 3; i++ {
+		require.EqualError(fetch(), "rpc error: No cluster leader")
+	}
+	for i := 0; i < 3; i++ {
+		require.Equal(errSignBreakerOpen, fetch())
+	}
+	require.Equal(uint64(3), atomic.LoadUint64(&signs))
+
+	// After the cooldown a failed trial opens it again straight away
+	clk.Advance(time.Minute)
+	require.EqualError(fetch(), "rpc error: No cluster leader")
+	require.Equal(errSignBreakerOpen, fetch())
+	require.Equal(uint64(4), atomic.LoadUint64(&signs))
+
+	// A successful trial closes it
+	atomic.StoreUint32(&healthy, 1)
+	clk.Advance(time.Minute)
+	require.NoError(fetch())
+	require.NoError(typ.Warm(context.Background(), []*ConnectCALeafRequest{
+		{Datacenter: "dc1", Service: "db"},
+	}))
+	require.Equal(uint64(6), atomic.LoadUint64(&signs))
+}
+
+func TestCalculateSoftExpiry(t *testing.T) {
+	now := time.Now()
+	tests := []struct {
+		name        string
+		validAfter  time.Time
+		validBefore time.Time
+		want        time.Time
+	}{
+		{"valid now", now.Add(-time.Minute), now.Add(72 * time.Hour), now.Add(71 * time.Hour)},
+		{"valid in the future", now.Add(24 * time.Hour), now.Add(96 * time.Hour), now.Add(95 * time.Hour)},
+		{"short validity in the future", now.Add(2 * time.Hour), now.Add(150 * time.Minute), now.Add(2 * time.Hour)},
+		{"short validity now", now.Add(-time.Minute), now.Add(30 * time.Minute), now.Add(-time.Minute)},
+		{"inverted validity", now.Add(time.Hour), now.Add(30 * time.Minute), now.Add(30 * time.Minute)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cert := &structs.IssuedCert{ValidAfter: tt.validAfter, ValidBefore: tt.validBefore}
+			softExpiry, hardRenewTime := calculateSoftExpiry(now, cert)
+			require.Equal(t, tt.want, softExpiry)
+
+			// The cert is served until it expires, and renewal is always
+			// due by then.
+			require.Equal(t, tt.validBefore, hardRenewTime)
+			require.False(t, softExpiry.After(hardRenewTime))
+		})
+	}
+}
+
+func TestLeafRenewalScheduler(t *testing.T) {
+	t.Parallel()
+
+	now := time.Now()
+	cert := &structs.IssuedCert{
+		ValidAfter:  now.Add(-time.Hour),
+		ValidBefore: now.Add(12 * time.Hour),
+	}
+	softExpiry, _ := calculateSoftExpiry(now, cert)
+
+	t.Run("no cert", func(t *testing.T) {
+		s := &leafRenewalScheduler{deadline: now.Add(time.Minute)}
+		at, reason := s.next(now)
+		require.Equal(t, leafWakeNoCert, reason)
+		require.Equal(t, now, at)
+	})
+
+	t.Run("expired cert", func(t *testing.T) {
+		s := &leafRenewalScheduler{
+			cert: &structs.IssuedCert{
+				ValidAfter:  now.Add(-2 * time.Hour),
+				ValidBefore: now.Add(-time.Hour),
+			},
+			deadline: now.Add(time.Minute),
+		}
+		at, reason := s.next(now)
+		require.Equal(t, leafWakeNoCert, reason)
+		require.Equal(t, now, at)
+	})
+
+	t.Run("timeout", func(t *testing.T) {
+		s := &leafRenewalScheduler{cert: cert, deadline: now.Add(time.Minute)}
+		at, reason := s.next(now)
+		require.Equal(t, leafWakeTimeout, reason)
+		require.Equal(t, now.Add(time.Minute), at)
+	})
+
+	t.Run("soft expiry", func(t *testing.T) {
+		s := &leafRenewalScheduler{cert: cert, deadline: now.Add(24 * time.Hour)}
+		at, reason := s.next(now)
+		require.Equal(t, leafWakeSoftExpiry, reason)
+		require.Equal(t, softExpiry, at)
+	})
+
+	t.Run("force expiry", func(t *testing.T) {
+		s := &leafRenewalScheduler{
+			cert:             cert,
+			forceExpireAfter: now.Add(time.Hour),
+			deadline:         now.Add(24 * time.Hour),
+		}
+		at, reason := s.next(now)
+		require.Equal(t, leafWakeForceExpiry, reason)
+		require.Equal(t, now.Add(time.Hour), at)
+
+		// A force expiry after the soft expiry doesn't matter
+		s.forceExpireAfter = softExpiry.Add(time.Minute)
+		at, reason = s.next(now)
+		require.Equal(t, leafWakeSoftExpiry, reason)
+		require.Equal(t, softExpiry, at)
+	})
+
+	t.Run("root change", func(t *testing.T) {
+		s := &leafRenewalScheduler{cert: cert, deadline: now.Add(24 * time.Hour)}
+		at, reason := s.rootChanged(now, 0)
+		require.Equal(t, leafWakeRootChange, reason)
+		require.Equal(t, now, at)
+	})
+
+	t.Run("paced root change", func(t *testing.T) {
+		s := &leafRenewalScheduler{cert: cert, deadline: now.Add(24 * time.Hour)}
+		at, reason := s.rootChanged(now, 5*time.Second)
+		require.Equal(t, leafWakeForceExpiry, reason)
+		require.Equal(t, now.Add(5*time.Second), at)
+
+		// A later root change doesn't push the renewal back
+		at, reason = s.rootChanged(now.Add(time.Second), 10*time.Second)
+		require.Equal(t, leafWakeForceExpiry, reason)
+		require.Equal(t, now.Add(5*time.Second), at)
+	})
+
+	t.Run("paced root change after timeout", func(t *testing.T) {
+		s := &leafRenewalScheduler{cert: cert, deadline: now.Add(time.Second)}
+		at, reason := s.rootChanged(now, 5*time.Second)
+		require.Equal(t, leafWakeTimeout, reason)
+		require.Equal(t, now.Add(time.Second), at)
+	})
+}
+
+// Test that renewals triggered by a CA rotation are paced by the
+// RotationLimiter rather than all happening at once.
+func TestConnectCALeaf_rotationLimiter(t *testing.T) {
+	// Not parallel since the assertions below depend on the sign times.
+	require := require.New(t)
+	rpc := TestRPC(t)
+	defer rpc.AssertExpectations(t)
+
+	typ, rootsCh := testCALeafType(t, rpc)
+	defer close(rootsCh)
+	rootsCh <- structs.IndexedCARoots{
+		ActiveRootID: "1",
+		TrustDomain:  "fake-trust-domain.consul",
+		QueryMeta:    structs.QueryMeta{Index: 1},
+	}
+
+	// Instrument ConnectCA.Sign to record when each sign happens
+	var signLock sync.Mutex
+	var signTimes []time.Time
+	var idx uint64
+	rpc.On("RPC", "ConnectCA.Sign", mock.Anything, mock.Anything).Return(nil).
+		Run(func(args mock.Arguments) {
+			signLock.Lock()
+			signTimes = append(signTimes, time.Now())
+			signLock.Unlock()
+
+			reply := args.Get(2).(*structs.IssuedCert)
+			reply.ValidBefore = time.Now().Add(12 * time.Hour)
+			reply.CreateIndex = atomic.AddUint64(&idx, 1)
+			reply.ModifyIndex = reply.CreateIndex
+		})
+
+	// Issue the initial leaves unpaced
+	const services = 10
+	opts := cache.FetchOptions{MinIndex: 0, Timeout: 10 * time.Second}
+	indexes := make([]uint64, services)
+	for i := 0; i < services; i++ {
+		req := &ConnectCALeafRequest{Datacenter: "dc1", Service: fmt.Sprintf("web%d", i)}
+		result, err := typ.Fetch(opts, req)
+		require.NoError(err)
+		indexes[i] = result.Index
+	}
+
+	// Allow one rotation renewal every 50ms
+	const interval = 50 * time.Millisecond
+	typ.RotationLimiter = rate.NewLimiter(rate.Every(interval), 1)
+
+	// Start the blocking fetches and make sure they are all running before
+	// the rotation so none of them misses it.
+	var started sync.WaitGroup
+	fetchChs := make([]chan interface{}, services)
+	for i := 0; i < services; i++ {
+		req := &ConnectCALeafRequest{Datacenter: "dc1", Service: fmt.Sprintf("web%d", i)}
+		opts := cache.FetchOptions{MinIndex: indexes[i], Timeout: 10 * time.Second}
+		fetchChs[i] = make(chan interface{}, 1)
+		started.Add(1)
+		go func(ch chan<- interface{}) {
+			started.Done()
+			result, err := typ.Fetch(opts, req)
+			if err != nil {
+				ch <- err
+				return
+			}
+			ch <- result
+		}(fetchChs[i])
+	}
+	started.Wait()
+	time.Sleep(100 * time.Millisecond)
+
+	signLock.Lock()
+	rotationStart := len(signTimes)
+	signLock.Unlock()
+
+	// Rotate
+	rootsCh <- structs.IndexedCARoots{
+		ActiveRootID: "2",
+		TrustDomain:  "fake-trust-domain.consul",
+		QueryMeta:    structs.QueryMeta{Index: 2},
+	}
+	for i, ch := range fetchChs {
+		select {
+		case <-time.After(5 * time.Second):
+			t.Fatalf("fetch %d didn't renew", i)
+		case result := <-ch:
+			require.IsType(cache.FetchResult{}, result)
+		}
+	}
+
+	// The renewals should have been spread over the limiter's schedule. Allow
+	// plenty of slack for scheduling; unpaced renewals would all land within
+	// a few milliseconds of each other.
+	signLock.Lock()
+	defer signLock.Unlock()
+	renewals := signTimes[rotationStart:]
+	require.Len(renewals, services)
+	first, last := renewals[0], renewals[0]
+	for _, ts := range renewals {
+		if ts.Before(first) {
+			first = ts
+		}
+		if ts.After(last) {
+			last = ts
+		}
+	}
+	minSpread := time.Duration(services/2) * interval
+	require.True(last.Sub(first) >= minSpread,
+		"renewals spread over %s, want at least %s", last.Sub(first), minSpread)
+}
+
+// Test that with age weighting a leaf closer to expiry is scheduled to renew
+// sooner after a rotation, even when its limiter slot is later.
+func TestConnectCALeaf_rotationAgeWeighted(t *testing.T) {
+	t.Parallel()
+
+	require := require.New(t)
+	now := time.Now()
+	clk := newTestClock(now)
+	typ := &ConnectCALeaf{
+		RotationLimiter:     rate.NewLimiter(rate.Every(time.Hour), 1),
+		RotationAgeWeighted: true,
+		clock:               clk,
+		issuedCerts: map[string]*fetchState{
+			"fresh": {cert: &structs.IssuedCert{
+				ValidAfter:  now,
+				ValidBefore: now.Add(12 * time.Hour),
+			}},
+			"old": {cert: &structs.IssuedCert{
+				ValidAfter:  now.Add(-9 * time.Hour),
+				ValidBefore: now.Add(3 * time.Hour),
+			}},
+		},
+	}
+
+	// Use up the burst so both leaves wait for a slot
+	typ.RotationLimiter.Reserve()
+	fresh := typ.scheduleRotation("fresh", 0)
+	old := typ.scheduleRotation("old", 0)
+
+	// The fresh leaf keeps its whole hour's delay while the old one, with
+	// a quarter of its lifetime left, waits a quarter of its two hours.
+	require.InDelta(float64(time.Hour), float64(fresh), float64(time.Minute))
+	require.InDelta(float64(30*time.Minute), float64(old), float64(time.Minute))
+	require.True(typ.issuedCerts["old"].forceExpireAfter.Before(typ.issuedCerts["fresh"].forceExpireAfter))
+
+	// Without a known lifetime the delay isn't weighted
+	require.Equal(time.Hour, ageWeightedDelay(now, &structs.IssuedCert{ValidBefore: now.Add(time.Hour)}, time.Hour))
+	require.Equal(time.Duration(0), ageWeightedDelay(now.Add(4*time.Hour), typ.issuedCerts["old"].cert, time.Hour))
+}
+
+// Test that a request's MaxCAChangeJitter caps its rotation delay so it is
+// renewed ahead of leaves that wait for their turn on the limiter.
+func TestConnectCALeaf_maxCAChangeJitter(t *testing.T) {
+	// Not parallel since the assertions below depend on the renewal times.
+	require := require.New(t)
+	rpc := TestRPC(t)
+	defer rpc.AssertExpectations(t)
+
+	typ, rootsCh := testCALeafType(t, rpc)
+	defer close(rootsCh)
+	rootsCh <- structs.IndexedCARoots{
+		ActiveRootID: "1",
+		TrustDomain:  "fake-trust-domain.consul",
+		QueryMeta:    structs.QueryMeta{Index: 1},
+	}
+
+	var idx uint64
+	rpc.On("RPC", "ConnectCA.Sign", mock.Anything, mock.Anything).Return(nil).
+		Run(func(args mock.Arguments) {
+			reply := args.Get(2).(*structs.IssuedCert)
+			reply.ValidBefore = time.Now().Add(12 * time.Hour)
+			reply.CreateIndex = atomic.AddUint64(&idx, 1)
+			reply.ModifyIndex = reply.CreateIndex
+		})
+
+	bulk := &ConnectCALeafRequest{Datacenter: "dc1", Service: "bulk"}
+	fast := &ConnectCALeafRequest{
+		Datacenter:        "dc1",
+		Service:           "fast",
+		MaxCAChangeJitter: 10 * time.Millisecond,
+	}
+
+	// Issue the initial leaves unpaced
+	opts := cache.FetchOptions{MinIndex: 0, Timeout: 10 * time.Second}
+	bulkResult, err := typ.Fetch(opts, bulk)
+	require.NoError(err)
+	fastResult, err := typ.Fetch(opts, fast)
+	require.NoError(err)
+
+	// Allow one rotation renewal a second, with the burst already used up so
+	// both leaves would have to wait without a cap.
+	typ.RotationLimiter = rate.NewLimiter(rate.Every(time.Second), 1)
+	require.True(typ.RotationLimiter.Allow())
+
+	fetch := func(req *ConnectCALeafRequest, minIndex uint64) <-chan interface{} {
+		return TestFetchCh(t, typ, cache.FetchOptions{
+			MinIndex: minIndex,
+			Timeout:  10 * time.Second,
+		}, req)
+	}
+	bulkCh := fetch(bulk, bulkResult.Index)
+	fastCh := fetch(fast, fastResult.Index)
+	time.Sleep(100 * time.Millisecond)
+
+	// Rotate
+	rootsCh <- structs.IndexedCARoots{
+		ActiveRootID: "2",
+		TrustDomain:  "fake-trust-domain.consul",
+		QueryMeta:    structs.QueryMeta{Index: 2},
+	}
+
+	// The capped leaf is renewed right away, the other waits its turn
+	select {
+	case <-time.After(500 * time.Millisecond):
+		t.Fatal("capped leaf should renew quickly")
+	case result := <-fastCh:
+		require.IsType(cache.FetchResult{}, result)
+	}
+	select {
+	case result := <-bulkCh:
+		t.Fatalf("should not return yet: %#v", result)
+	default:
+	}
+	select {
+	case <-time.After(5 * time.Second):
+		t.Fatal("bulk leaf didn't renew")
+	case result := <-bulkCh:
+		require.IsType(cache.FetchResult{}, result)
+	}
+}
+
+// Test that a generate deadline bounds generating a leaf without shortening
+// the blocking wait on an existing one.
+func TestConnectCALeaf_generateDeadline(t *testing.T) {
+	t.Parallel()
+
+	require := require.New(t)
+	rpc := TestRPC(t)
+	defer rpc.AssertExpectations(t)
+
+	typ, rootsCh := testCALeafType(t, rpc)
+	defer close(rootsCh)
+	rootsCh <- structs.IndexedCARoots{
+		ActiveRootID: "1",
+		TrustDomain:  "fake-trust-domain.consul",
+		QueryMeta:    structs.QueryMeta{Index: 1},
+	}
+
+	// Signs after the first have to wait a second, well within the timeout
+	typ.SignLimiter = rate.NewLimiter(rate.Every(time.Second), 1)
+	var idx uint64
+	rpc.On("RPC", "ConnectCA.Sign", mock.Anything, mock.Anything).Return(nil).
+		Run(func(args mock.Arguments) {
+			reply := args.Get(2).(*structs.IssuedCert)
+			reply.ValidBefore = time.Now().Add(12 * time.Hour)
+			reply.CreateIndex = atomic.AddUint64(&idx, 1)
+			reply.ModifyIndex = reply.CreateIndex
+		}).Once()
+
+	opts := cache.FetchOptions{MinIndex: 0, Timeout: 10 * time.Second}
+	req := &ConnectCALeafRequest{Datacenter: "dc1", Service: "web", GenerateDeadline: 50 * time.Millisecond}
+	result, err := typ.Fetch(opts, req)
+	require.NoError(err)
+	require.True(result.Generated)
+
+	// Generating another leaf gives up at the deadline, not the timeout
+	start := time.Now()
+	_, err = typ.Fetch(opts, &ConnectCALeafRequest{Datacenter: "dc1", Service: "db", GenerateDeadline: 50 * time.Millisecond})
+	require.Error(err)
+	require.Contains(err.Error(), "sign rate limit")
+	require.True(time.Since(start) < 500*time.Millisecond, "took %s", time.Since(start))
+
+	// Blocking on the existing leaf still waits for the whole timeout
+	opts = cache.FetchOptions{MinIndex: result.Index, Timeout: 300 * time.Millisecond}
+	start = time.Now()
+	result, err = typ.Fetch(opts, req)
+	require.NoError(err)
+	require.Nil(result.Value)
+	require.True(time.Since(start) >= 300*time.Millisecond, "took %s", time.Since(start))
+}
+
+// Test that the duration of the sign RPC and of any client-side limiter wait
+// are recorded as metrics.
+// Test that roots flapping between two active roots only renew the leaf once
+// per cooldown, while a genuinely new root still renews it straight away.
+func TestConnectCALeaf_rootChangeCooldown(t *testing.T) {
+	t.Parallel()
+
+	rpc := TestRPC(t)
+	defer rpc.AssertExpectations(t)
+
+	typ, rootsCh := testCALeafType(t, rpc)
+	defer close(rootsCh)
+	const cooldown = 400 * time.Millisecond
+	typ.RootChangeCooldown = cooldown
+
+	// Root "a" is the oldest and "c" the newest
+	roots := func(idx uint64, active string) structs.IndexedCARoots {
+		result := structs.IndexedCARoots{
+			ActiveRootID: active,
+			TrustDomain:  "fake-trust-domain.consul",
+			QueryMeta:    structs.QueryMeta{Index: idx},
+		}
+		for i, id := range []string{"a", "b", "c"} {
+			result.Roots = append(result.Roots, &structs.CARoot{
+				ID:        id,
+				Active:    id == active,
+				RaftIndex: structs.RaftIndex{CreateIndex: uint64(i + 1)},
+			})
+		}
+		return result
+	}
+	rootsCh <- roots(1, "a")
+
+	var idx uint64
+	rpc.On("RPC", "ConnectCA.Sign", mock.Anything, mock.Anything).Return(nil).
+		Run(func(args mock.Arguments) {
+			reply := args.Get(2).(*structs.IssuedCert)
+			reply.ValidBefore = time.Now().Add(12 * time.Hour)
+			reply.CreateIndex = atomic.AddUint64(&idx, 1)
+			reply.ModifyIndex = reply.CreateIndex
+		})
+
+	req := &ConnectCALeafRequest{Datacenter: "dc1", Service: "web"}
+	fetch := func(minIndex uint64) <-chan interface{} {
+		return TestFetchCh(t, typ, cache.FetchOptions{MinIndex: minIndex, Timeout: 10 * time.Second}, req)
+	}
+	requireGenerated := func(fetchCh <-chan interface{}, wait time.Duration, index uint64) {
+		t.Helper()
+		select {
+		case <-time.After(wait):
+			t.Fatal("shouldn't block waiting for fetch")
+		case result := <-fetchCh:
+			require.IsType(t, cache.FetchResult{}, result)
+			require.True(t, result.(cache.FetchResult).Generated)
+			require.Equal(t, index, result.(cache.FetchResult).Index)
+		}
+	}
+	requireBlocked := func(fetchCh <-chan interface{}) {
+		t.Helper()
+		select {
+		case result := <-fetchCh:
+			t.Fatalf("should not return: %#v", result)
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+
+	requireGenerated(fetch(0), 100*time.Millisecond, 1)
+
+	// The first roots change renews straight away
+	fetchCh := fetch(1)
+	rootsCh <- roots(2, "b")
+	requireGenerated(fetchCh, 100*time.Millisecond, 2)
+
+	// Flapping back and forth during the cooldown doesn't renew
+	fetchCh = fetch(2)
+	rootsCh <- roots(3, "a")
+	requireBlocked(fetchCh)
+	rootsCh <- roots(4, "b")
+	requireBlocked(fetchCh)
+
+	// A genuinely new root does
+	rootsCh <- roots(5, "c")
+	requireGenerated(fetchCh, 100*time.Millisecond, 3)
+	renewed := time.Now()
+
+	// That restarts the cooldown, after which the flaps are batched into a
+	// single renewal
+	fetchCh = fetch(3)
+	rootsCh <- roots(6, "b")
+	requireBlocked(fetchCh)
+	rootsCh <- roots(7, "c")
+	requireGenerated(fetchCh, cooldown, 4)
+	require.True(t, time.Since(renewed) >= cooldown-50*time.Millisecond,
+		"renewed after %s", time.Since(renewed))
+}
+
+func TestConnectCALeaf_signMetrics(t *testing.T) {
+	// Not parallel since this replaces the global metrics sink.
+	require := require.New(t)
+	sink := testMetricsSink(t)
+	rpc := TestRPC(t)
+	defer rpc.AssertExpectations(t)
+
+	typ, rootsCh := testCALeafType(t, rpc)
+	defer close(rootsCh)
+	rootsCh <- structs.IndexedCARoots{
+		ActiveRootID: "1",
+		TrustDomain:  "fake-trust-domain.consul",
+		QueryMeta:    structs.QueryMeta{Index: 1},
+	}
+
+	// Only allow a single sign every 250ms so the second fetch has to wait.
+	typ.SignLimiter = rate.NewLimiter(rate.Every(250*time.Millisecond), 1)
+
+	// Instrument ConnectCA.Sign to be deliberately slow
+	var idx uint64
+	rpc.On("RPC", "ConnectCA.Sign", mock.Anything, mock.Anything).Return(nil).
+		Run(func(args mock.Arguments) {
+			time.Sleep(20 * time.Millisecond)
+			reply := args.Get(2).(*structs.IssuedCert)
+			reply.ValidBefore = time.Now().Add(12 * time.Hour)
+			reply.CreateIndex = atomic.AddUint64(&idx, 1)
+			reply.ModifyIndex = reply.CreateIndex
+		})
+
+	opts := cache.FetchOptions{MinIndex: 0, Timeout: 10 * time.Second}
+	for _, token := range []string{"A-token", "B-token"} {
+		req := &ConnectCALeafRequest{Datacenter: "dc1", Service: "web", Token: token}
+		_, err := typ.Fetch(opts, req)
+		require.NoError(err)
+	}
+
+	sign := testMetricsSample(t, sink, "consul.connect.leaf.sign_duration_ms")
+	require.Equal(2, sign.Count)
+	require.True(sign.Min >= 20, "sign duration too short: %v", sign.Min)
+
+	wait := testMetricsSample(t, sink, "consul.connect.leaf.sign_limiter_wait_ms")
+	require.Equal(2, wait.Count)
+	require.True(wait.Max >= 20, "limiter wait too short: %v", wait.Max)
+}
+
+// Test that a Fetch waits for the servers to bootstrap the CA, and that the
+// wait is recorded in metrics.
+func TestConnectCALeaf_caBootstrapWait(t *testing.T) {
+	// Not parallel since this replaces the global metrics sink.
+	require := require.New(t)
+	sink := testMetricsSink(t)
+	rpc := TestRPC(t)
+	defer rpc.AssertExpectations(t)
+
+	// The servers answer but haven't bootstrapped the CA yet
+	typ, rootsCh := testCALeafType(t, rpc)
+	defer close(rootsCh)
+	rootsCh <- structs.IndexedCARoots{
+		QueryMeta: structs.QueryMeta{Index: 1},
+	}
+
+	var idx uint64
+	rpc.On("RPC", "ConnectCA.Sign", mock.Anything, mock.Anything).Return(nil).
+		Run(func(args mock.Arguments) {
+			reply := args.Get(2).(*structs.IssuedCert)
+			reply.ValidBefore = time.Now().Add(12 * time.Hour)
+			reply.CreateIndex = atomic.AddUint64(&idx, 1)
+			reply.ModifyIndex = reply.CreateIndex
+		})
+
+	opts := cache.FetchOptions{MinIndex: 0, Timeout: 10 * time.Second}
+	req := &ConnectCALeafRequest{Datacenter: "dc1", Service: "web"}
+	fetchCh := TestFetchCh(t, typ, opts, req)
+	select {
+	case result := <-fetchCh:
+		t.Fatalf("should not return: %#v", result)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	// Once the CA is bootstrapped the leaf is signed
+	rootsCh <- structs.IndexedCARoots{
+		ActiveRootID: "1",
+		TrustDomain:  "fake-trust-domain.consul",
+		QueryMeta:    structs.QueryMeta{Index: 2},
+	}
+	select {
+	case <-time.After(time.Second):
+		t.Fatal("shouldn't block once the CA is bootstrapped")
+	case result := <-fetchCh:
+		require.IsType(cache.FetchResult{}, result)
+		require.True(result.(cache.FetchResult).Generated)
+	}
+
+	wait := testMetricsSample(t, sink, "consul.connect.leaf.ca_bootstrap_wait_ms")
+	require.Equal(1, wait.Count)
+	require.True(wait.Min >= 50, "wait too short: %v", wait.Min)
+	require.True(wait.Max < 10000, "wait too long: %v", wait.Max)
+	waits := testMetricsCounter(t, sink, "consul.connect.leaf.ca_bootstrap_wait")
+	require.Equal(1, waits.Count)
+
+	// Later fetches don't wait
+	_, err := typ.Fetch(opts, &ConnectCALeafRequest{Datacenter: "dc1", Service: "db"})
+	require.NoError(err)
+	require.Equal(1, testMetricsCounter(t, sink, "consul.connect.leaf.ca_bootstrap_wait").Count)
+}
+
+// Test that the wait for the servers to bootstrap the CA is timed by the
+// ConnectCALeaf's clock.
+func TestConnectCALeaf_caBootstrapWaitClock(t *testing.T) {
+	t.Parallel()
+
+	rpc := TestRPC(t)
+	defer rpc.AssertExpectations(t)
+
+	// The servers answer but haven't bootstrapped the CA yet
+	typ, rootsCh := testCALeafType(t, rpc)
+	defer close(rootsCh)
+	clk := newTestClock(time.Now())
+	typ.clock = clk
+	rootsCh <- structs.IndexedCARoots{
+		QueryMeta: structs.QueryMeta{Index: 1},
+	}
+
+	opts := cache.FetchOptions{MinIndex: 0, Timeout: time.Minute}
+	req := &ConnectCALeafRequest{Datacenter: "dc1", Service: "web"}
+	fetchCh := TestFetchCh(t, typ, opts, req)
+	clk.waitForWaiters(t, 1)
+	select {
+	case result := <-fetchCh:
+		t.Fatalf("should not return: %#v", result)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	// The wait times out once the clock passes the Fetch timeout, well
+	// before the real deadline
+	clk.Advance(2 * time.Minute)
+	select {
+	case <-time.After(time.Second):
+		t.Fatal("shouldn't block once the clock passes the timeout")
+	case result := <-fetchCh:
+		require.Equal(t, cache.FetchResult{}, result)
+	}
+}
+
+// Test that roots indexes are tracked per datacenter, so that roots seen
+// in one datacenter don't stop leaves in another from seeing its roots
+// change.
+func TestConnectCALeaf_multipleDatacenters(t *testing.T) {
+	t.Parallel()
+
+	require := require.New(t)
+	rpc := TestRPC(t)
+	defer rpc.AssertExpectations(t)
+
+	rootsRPC := testDCGatedRootsRPC{
+		"dc1": &testGatedRootsRPC{ValueCh: make(chan structs.IndexedCARoots, 10)},
+		"dc2": &testGatedRootsRPC{ValueCh: make(chan structs.IndexedCARoots, 10)},
+	}
+	for _, r := range rootsRPC {
+		defer close(r.ValueCh)
+	}
+	c := cache.TestCache(t)
+	c.RegisterType(ConnectCARootName, &ConnectCARoot{RPC: rootsRPC}, &cache.RegisterOptions{
+		Refresh: false,
+	})
+	typ := &ConnectCALeaf{RPC: rpc, Cache: c}
+
+	var idx uint64
+	rpc.On("RPC", "ConnectCA.Sign", mock.Anything, mock.Anything).Return(nil).
+		Run(func(args mock.Arguments) {
+			reply := args.Get(2).(*structs.IssuedCert)
+			reply.ValidBefore = time.Now().Add(12 * time.Hour)
+			reply.CreateIndex = atomic.AddUint64(&idx, 1)
+			reply.ModifyIndex = reply.CreateIndex
+		})
+
+	// dc2's servers are at a much higher index than dc1's
+	rootsRPC["dc2"].ValueCh <- structs.IndexedCARoots{
+		ActiveRootID: "dc2-1",
+		TrustDomain:  "fake-trust-domain.consul",
+		QueryMeta:    structs.QueryMeta{Index: 100},
+	}
+	opts := cache.FetchOptions{MinIndex: 0, Timeout: 10 * time.Second}
+	reqDC2 := &ConnectCALeafRequest{Datacenter: "dc2", Service: "web"}
+	result, err := typ.Fetch(opts, reqDC2)
+	require.NoError(err)
+	optsDC2 := opts
+	optsDC2.MinIndex = result.Index
+
+	rootsRPC["dc2"].ValueCh <- structs.IndexedCARoots{
+		ActiveRootID: "dc2-2",
+		TrustDomain:  "fake-trust-domain.consul",
+		QueryMeta:    structs.QueryMeta{Index: 101},
+	}
+	result, err = typ.Fetch(optsDC2, reqDC2)
+	require.NoError(err)
+	require.True(result.Generated)
+	optsDC2.MinIndex = result.Index
+
+	// dc1's CA bootstraps at an index below dc2's and its leaf is signed
+	rootsRPC["dc1"].ValueCh <- structs.IndexedCARoots{
+		QueryMeta: structs.QueryMeta{Index: 1},
+	}
+	reqDC1 := &ConnectCALeafRequest{Datacenter: "dc1", Service: "web"}
+	fetchCh := TestFetchCh(t, typ, opts, reqDC1)
+	rootsRPC["dc1"].ValueCh <- structs.IndexedCARoots{
+		ActiveRootID: "dc1-1",
+		TrustDomain:  "fake-trust-domain.consul",
+		QueryMeta:    structs.QueryMeta{Index: 2},
+	}
+	var optsDC1 cache.FetchOptions
+	select {
+	case <-time.After(time.Second):
+		t.Fatal("shouldn't block once dc1's CA is bootstrapped")
+	case result := <-fetchCh:
+		require.IsType(cache.FetchResult{}, result)
+		require.True(result.(cache.FetchResult).Generated)
+		optsDC1 = opts
+		optsDC1.MinIndex = result.(cache.FetchResult).Index
+	}
+
+	// A rotation in dc1 renews only dc1's leaf
+	fetchDC1 := TestFetchCh(t, typ, optsDC1, reqDC1)
+	fetchDC2 := TestFetchCh(t, typ, optsDC2, reqDC2)
+	rootsRPC["dc1"].ValueCh <- structs.IndexedCARoots{
+		ActiveRootID: "dc1-2",
+		TrustDomain:  "fake-trust-domain.consul",
+		QueryMeta:    structs.QueryMeta{Index: 3},
+	}
+	select {
+	case <-time.After(time.Second):
+		t.Fatal("dc1 rotation should renew dc1's leaf")
+	case result := <-fetchDC1:
+		require.IsType(cache.FetchResult{}, result)
+		require.True(result.(cache.FetchResult).Generated)
+	}
+	select {
+	case result := <-fetchDC2:
+		t.Fatalf("dc2's leaf should not be renewed: %#v", result)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	// And a rotation in dc2 renews dc2's
+	rootsRPC["dc2"].ValueCh <- structs.IndexedCARoots{
+		ActiveRootID: "dc2-3",
+		TrustDomain:  "fake-trust-domain.consul",
+		QueryMeta:    structs.QueryMeta{Index: 102},
+	}
+	select {
+	case <-time.After(time.Second):
+		t.Fatal("dc2 rotation should renew dc2's leaf")
+	case result := <-fetchDC2:
+		require.IsType(cache.FetchResult{}, result)
+		require.True(result.(cache.FetchResult).Generated)
+	}
+}
+
+// Test that a one-shot Fetch doesn't leave a roots watch running and
+// Test that leaves can be generated and renewed on roots changes with a
+// RootsSource other than the cache.
+func TestConnectCALeaf_rootsSource(t *testing.T) {
+	t.Parallel()
+
+	require := require.New(t)
+	rpc := TestRPC(t)
+	defer rpc.AssertExpectations(t)
+
+	src := newTestRootsSource()
+	typ := &ConnectCALeaf{RPC: rpc, Cache: src}
+	src.Set(&structs.IndexedCARoots{
+		ActiveRootID: "1",
+		TrustDomain:  "fake-trust-domain.consul",
+		QueryMeta:    structs.QueryMeta{Index: 1},
+	})
+
+	var idx uint64
+	rpc.On("RPC", "ConnectCA.Sign", mock.Anything, mock.Anything).Return(nil).
+		Run(func(args mock.Arguments) {
+			csr, err := connect.ParseCSR(args.Get(1).(*structs.CASignRequest).CSR)
+			require.NoError(err)
+			require.Equal("fake-trust-domain.consul", csr.URIs[0].Host)
+
+			reply := args.Get(2).(*structs.IssuedCert)
+			reply.ValidBefore = time.Now().Add(12 * time.Hour)
+			reply.CreateIndex = atomic.AddUint64(&idx, 1)
+			reply.ModifyIndex = reply.CreateIndex
+		})
+
+	opts := cache.FetchOptions{Timeout: 10 * time.Second}
+	req := &ConnectCALeafRequest{Datacenter: "dc1", Service: "web"}
+	result, err := typ.Fetch(opts, req)
+	require.NoError(err)
+	require.Equal(uint64(1), result.Index)
+
+	// A blocking Fetch renews the leaf once the source has new roots.
+	opts.MinIndex = result.Index
+	fetchCh := TestFetchCh(t, typ, opts, req)
+	select {
+	case result := <-fetchCh:
+		t.Fatalf("should not return: %#v", result)
+	case <-time.After(100 * time.Millisecond):
+	}
+	src.Set(&structs.IndexedCARoots{
+		ActiveRootID: "2",
+		TrustDomain:  "fake-trust-domain.consul",
+		QueryMeta:    structs.QueryMeta{Index: 2},
+	})
+	select {
+	case <-time.After(time.Second):
+		t.Fatal("shouldn't block waiting for fetch")
+	case result := <-fetchCh:
+		res, ok := result.(cache.FetchResult)
+		require.True(ok, "not a FetchResult: %#v", result)
+		require.Equal(uint64(2), res.Index)
+	}
+}
+
+// doesn't block on a valid cert.
+func TestConnectCALeaf_oneShot(t *testing.T) {
+	t.Parallel()
+
+	require := require.New(t)
+	rpc := TestRPC(t)
+	defer rpc.AssertExpectations(t)
+
+	rootsRPC := &testCountingRootsRPC{Roots: structs.IndexedCARoots{
+		ActiveRootID: "1",
+		TrustDomain:  "fake-trust-domain.consul",
+		QueryMeta:    structs.QueryMeta{Index: 1},
+	}}
+	c := cache.TestCache(t)
+	c.RegisterType(ConnectCARootName, &ConnectCARoot{RPC: rootsRPC}, &cache.RegisterOptions{
+		Refresh: false,
+	})
+	typ := &ConnectCALeaf{RPC: rpc, Cache: c, OneShot: true}
+
+	var idx uint64
+	rpc.On("RPC", "ConnectCA.Sign", mock.Anything, mock.Anything).Return(nil).
+		Run(func(args mock.Arguments) {
+			reply := args.Get(2).(*structs.IssuedCert)
+			reply.ValidBefore = time.Now().Add(12 * time.Hour)
+			reply.CreateIndex = atomic.AddUint64(&idx, 1)
+			reply.ModifyIndex = reply.CreateIndex
+		})
+
+	req := &ConnectCALeafRequest{Datacenter: "dc1", Service: "web"}
+	result, err := typ.Fetch(cache.FetchOptions{Timeout: 10 * time.Second}, req)
+	require.NoError(err)
+	require.True(result.Generated)
+
+	// A blocking Fetch returns the same cert straight away
+	start := time.Now()
+	result2, err := typ.Fetch(cache.FetchOptions{MinIndex: result.Index, Timeout: 10 * time.Second}, req)
+	require.NoError(err)
+	require.False(result2.Generated)
+	require.Equal(result.Value, result2.Value)
+	require.True(time.Since(start) < time.Second)
+
+	// The roots were only fetched to sign the leaf, never watched
+	time.Sleep(100 * time.Millisecond)
+	require.Equal(uint64(1), atomic.LoadUint64(&rootsRPC.calls))
+}
+
+// testMetricsSink installs an in-memory sink as the global metrics sink and
+// returns it so tests can assert on emitted metrics.
+// Test that the last rotation time is only updated when the active root
+// changes. This test is not parallel since it uses the global metrics sink.
+func TestConnectCALeaf_lastRootChange(t *testing.T) {
+	require := require.New(t)
+	sink := testMetricsSink(t)
+	rpc := TestRPC(t)
+	defer rpc.AssertExpectations(t)
+
+	typ, rootsCh := testCALeafType(t, rpc)
+	defer close(rootsCh)
+	clk := newTestClock(time.Now())
+	typ.clock = clk
+
+	observe := func(idx uint64, activeRootID string) {
+		t.Helper()
+		rootsCh <- structs.IndexedCARoots{
+			ActiveRootID: activeRootID,
+			TrustDomain:  "fake-trust-domain.consul",
+			QueryMeta:    structs.QueryMeta{Index: idx},
+		}
+		ch := make(chan error, 1)
+		typ.waitNewRootCA("dc1", ch, 10*time.Second, idx-1)
+		require.NoError(<-ch)
+	}
+	const gauge = "consul.connect.ca.last_rotation_age_seconds;datacenter=dc1"
+
+	// Neither the first roots nor a later update to them is a rotation
+	observe(2, "1")
+	clk.Advance(time.Hour)
+	observe(3, "1")
+	_, ok := typ.lastRootChange("dc1")
+	require.False(ok)
+	for _, intv := range sink.Data() {
+		require.NotContains(intv.Gauges, gauge)
+	}
+
+	// A new active root is
+	observe(4, "2")
+	changedAt, ok := typ.lastRootChange("dc1")
+	require.True(ok)
+	require.Equal(clk.Now(), changedAt)
+
+	// A spurious update after it leaves the time alone and reports the age
+	clk.Advance(30 * time.Minute)
+	observe(5, "2")
+	at, ok := typ.lastRootChange("dc1")
+	require.True(ok)
+	require.Equal(changedAt, at)
+	var age float32
+	for _, intv := range sink.Data() {
+		if g, ok := intv.Gauges[gauge]; ok {
+			age = g.Value
+		}
+	}
+	require.Equal(float32(30*60), age)
+}
+
+// Test that the root change hook is called once for each change of the
+// active root and not for other roots updates.
+func TestConnectCALeaf_onRootChange(t *testing.T) {
+	t.Parallel()
+
+	require := require.New(t)
+	rpc := TestRPC(t)
+	defer rpc.AssertExpectations(t)
+
+	typ, rootsCh := testCALeafType(t, rpc)
+	defer close(rootsCh)
+	var changes []string
+	typ.OnRootChange = func(dc string, roots *structs.IndexedCARoots) {
+		changes = append(changes, fmt.Sprintf("%s/%s@%d", dc, roots.ActiveRootID, roots.Index))
+	}
+
+	observe := func(idx uint64, activeRootID string) {
+		t.Helper()
+		rootsCh <- structs.IndexedCARoots{
+			ActiveRootID: activeRootID,
+			TrustDomain:  "fake-trust-domain.consul",
+			QueryMeta:    structs.QueryMeta{Index: idx},
+		}
+		ch := make(chan error, 1)
+		typ.waitNewRootCA("dc1", ch, 10*time.Second, idx-1)
+		require.NoError(<-ch)
+	}
+
+	// Neither the first roots nor a later update to them is a change
+	observe(2, "1")
+	observe(3, "1")
+	require.Empty(changes)
+
+	// Each rotation is reported once, even when another waiter sees the
+	// same roots again
+	observe(4, "2")
+	ch := make(chan error, 1)
+	typ.waitNewRootCA("dc1", ch, 10*time.Second, 3)
+	require.NoError(<-ch)
+	observe(5, "2")
+	observe(6, "3")
+	require.Equal([]string{"dc1/2@4", "dc1/3@6"}, changes)
+}
+
+// Test that PokeRoots picks up a rotation before the cache's roots query
+// returns, reporting it and renewing blocked leaves.
+func TestConnectCALeaf_pokeRoots(t *testing.T) {
+	t.Parallel()
+
+	require := require.New(t)
+	rpc := TestRPC(t)
+	defer rpc.AssertExpectations(t)
+
+	typ, rootsCh := testCALeafType(t, rpc)
+	defer close(rootsCh)
+	var changes []string
+	typ.OnRootChange = func(dc string, roots *structs.IndexedCARoots) {
+		changes = append(changes, fmt.Sprintf("%s/%s@%d", dc, roots.ActiveRootID, roots.Index))
+	}
+	roots := structs.IndexedCARoots{
+		ActiveRootID: "1",
+		TrustDomain:  "fake-trust-domain.consul",
+		QueryMeta:    structs.QueryMeta{Index: 1},
+	}
+	rootsCh <- roots
+
+	// Rotations are only reported once the active root is known
+	typ.observeRoots("dc1", &roots)
+
+	var idx uint64
+	rpc.On("RPC", "ConnectCA.Sign", mock.Anything, mock.Anything).Return(nil).
+		Run(func(args mock.Arguments) {
+			reply := args.Get(2).(*structs.IssuedCert)
+			reply.ValidBefore = time.Now().Add(12 * time.Hour)
+			reply.CreateIndex = atomic.AddUint64(&idx, 1)
+			reply.ModifyIndex = reply.CreateIndex
+		})
+	newRoots := structs.IndexedCARoots{
+		ActiveRootID: "2",
+		TrustDomain:  "fake-trust-domain.consul",
+		QueryMeta:    structs.QueryMeta{Index: 2},
+	}
+	rpc.On("RPC", "ConnectCA.Roots", mock.Anything, mock.Anything).Return(nil).
+		Run(func(args mock.Arguments) {
+			*args.Get(2).(*structs.IndexedCARoots) = newRoots
+		})
+
+	opts := cache.FetchOptions{MinIndex: 0, Timeout: 10 * time.Second}
+	req := &ConnectCALeafRequest{Datacenter: "dc1", Service: "web"}
+	result, err := typ.Fetch(opts, req)
+	require.NoError(err)
+	require.Equal(uint64(1), result.Index)
+
+	// The blocked Fetch's roots query never returns, so only the poke can
+	// wake it
+	opts.MinIndex = 1
+	fetchCh := TestFetchCh(t, typ, opts, req)
+	select {
+	case result := <-fetchCh:
+		t.Fatalf("should not return: %#v", result)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	require.NoError(typ.PokeRoots("dc1"))
+	select {
+	case <-time.After(time.Second):
+		t.Fatal("should return after the poke")
+	case result := <-fetchCh:
+		require.Equal(uint64(2), result.(cache.FetchResult).Index)
+	}
+	require.Equal([]string{"dc1/2@2"}, changes)
+
+	// The renewed leaf was signed under the poked roots, so poking again
+	// with the same roots changes nothing
+	fetchCh = TestFetchCh(t, typ, cache.FetchOptions{MinIndex: 2, Timeout: 10 * time.Second}, req)
+	require.NoError(typ.PokeRoots("dc1"))
+	select {
+	case result := <-fetchCh:
+		t.Fatalf("should not return: %#v", result)
+	case <-time.After(200 * time.Millisecond):
+	}
+	require.Equal([]string{"dc1/2@2"}, changes)
+	require.Equal(uint64(2), atomic.LoadUint64(&idx))
+}
+
+// Test that after an error fetching the roots, e.g. because the roots were
+// reset, the next roots are checked for a rotation even at a lower index.
+func TestConnectCALeaf_onRootChangeAfterReset(t *testing.T) {
+	t.Parallel()
+
+	require := require.New(t)
+	rpc := TestRPC(t)
+	defer rpc.AssertExpectations(t)
+
+	typ, rootsCh := testCALeafType(t, rpc)
+	roots := func(idx uint64, activeRootID string) *structs.IndexedCARoots {
+		return &structs.IndexedCARoots{
+			ActiveRootID: activeRootID,
+			TrustDomain:  "fake-trust-domain.consul",
+			QueryMeta:    structs.QueryMeta{Index: idx},
+		}
+	}
+
+	rootsCh <- *roots(5, "1")
+	ch := make(chan error, 1)
+	typ.waitNewRootCA("dc1", ch, 10*time.Second, 0)
+	require.NoError(<-ch)
+
+	// Fetching the roots fails, which the closed channel does from now on
+	close(rootsCh)
+	typ.waitNewRootCA("dc1", ch, 10*time.Second, 5)
+	require.Error(<-ch)
+
+	// The same roots at a lower index aren't a change, but a new active
+	// root after them is, and would be passed to OnRootChange, even though
+	// its index is below the first roots'
+	require.False(typ.observeRoots("dc1", roots(3, "1")))
+	require.True(typ.observeRoots("dc1", roots(4, "2")))
+	require.False(typ.observeRoots("dc1", roots(4, "2")))
+}
+
+func testMetricsSink(t *testing.T) *metrics.InmemSink {
+	sink := metrics.NewInmemSink(time.Minute, time.Minute)
+	cfg := metrics.DefaultConfig("")
+	cfg.EnableHostname = false
+	cfg.EnableRuntimeMetrics = false
+	if _, err := metrics.NewGlobal(cfg, sink); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	return sink
+}
+
+// testMetricsSample returns the aggregated sample recorded under name,
+// failing the test if there isn't one.
+func testMetricsSample(t *testing.T, sink *metrics.InmemSink, name string) metrics.SampledValue {
+	t.Helper()
+	for _, intv := range sink.Data() {
+		if sample, ok := intv.Samples[name]; ok {
+			return sample
+		}
+	}
+	t.Fatalf("no samples recorded for %q", name)
+	return metrics.SampledValue{}
+}
+
+// testMetricsCounter returns the aggregated counter recorded under name,
+// failing the test if there isn't one.
+func testMetricsCounter(t *testing.T, sink *metrics.InmemSink, name string) metrics.SampledValue {
+	t.Helper()
+	for _, intv := range sink.Data() {
+		if counter, ok := intv.Counters[name]; ok {
+			return counter
+		}
+	}
+	t.Fatalf("no counter recorded for %q", name)
+	return metrics.SampledValue{}
+}
+
+// testRootsSource is a RootsSource holding roots set by the test, without a
+// cache.
+type testRootsSource struct {
+	lock    sync.Mutex
+	roots   *structs.IndexedCARoots
+	changed chan struct{}
+}
+
+func newTestRootsSource() *testRootsSource {
+	return &testRootsSource{changed: make(chan struct{})}
+}
+
+// Set makes the roots the source's latest and wakes blocked Gets.
+func (s *testRootsSource) Set(roots *structs.IndexedCARoots) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.roots = roots
+	close(s.changed)
+	s.changed = make(chan struct{})
+}
+
+func (s *testRootsSource) Get(t string, r cache.Request) (interface{}, cache.ResultMeta, error) {
+	if t != ConnectCARootName {
+		return nil, cache.ResultMeta{}, fmt.Errorf("unexpected type %q", t)
+	}
+	info := r.CacheInfo()
+	var timeout <-chan time.Time
+	if info.Timeout > 0 {
+		timeout = time.After(info.Timeout)
+	}
+	for {
+		s.lock.Lock()
+		roots, changed := s.roots, s.changed
+		s.lock.Unlock()
+		if info.MinIndex == 0 || (roots != nil && roots.Index > info.MinIndex) {
+			return roots, cache.ResultMeta{}, nil
+		}
+		select {
+		case <-changed:
+		case <-timeout:
+			return roots, cache.ResultMeta{}, nil
+		}
+	}
+}
+
+// testCALeafType returns a *ConnectCALeaf that is pre-configured to
+// use the given RPC implementation for "ConnectCA.Sign" operations.
+func testCALeafType(t *testing.T, rpc RPC) (*ConnectCALeaf, chan structs.IndexedCARoots) {
+	// This creates an RPC implementation that will block until the
+	// value is sent on the channel. This lets us control when the
+	// next values show up.
+	rootsCh := make(chan structs.IndexedCARoots, 10)
+	rootsRPC := &testGatedRootsRPC{ValueCh: rootsCh}
+
+	// Create a cache
+	c := cache.TestCache(t)
+	c.RegisterType(ConnectCARootName, &ConnectCARoot{RPC: rootsRPC}, &cache.RegisterOptions{
+		// Disable refresh so that the gated channel controls the
+		// request directly. Otherwise, we get background refreshes and
+		// it screws up the ordering of the channel reads of the
+		// testGatedRootsRPC implementation.
+		Refresh: false,
+	})
+
+	// Create the leaf type
+	return &ConnectCALeaf{RPC: rpc, Cache: c}, rootsCh
+}
+
+// testGatedRootsRPC will send each subsequent value on the channel as the
+// RPC response, blocking if it is waiting for a value on the channel. This
+// can be used to control when background fetches are returned and what they
+// return.
+//
+// This should be used with Refresh = false for the registration options so
+// automatic refreshes don't mess up the channel read ordering.
+type testGatedRootsRPC struct {
+	ValueCh chan structs.IndexedCARoots
+}
+
+func (r *testGatedRootsRPC) RPC(method string, args interface{}, reply interface{}) error {
+	if method != "ConnectCA.Roots" {
+		return fmt.Errorf("invalid RPC method: %s", method)
+	}
+
+	// Once the test closes the channel, fail rather than returning empty
+	// roots, which blocking Gets left over from the test would otherwise
+	// spin on until they time out.
+	v, ok := <-r.ValueCh
+	if !ok {
+		return fmt.Errorf("test roots channel closed")
+	}
+	replyReal := reply.(*structs.IndexedCARoots)
+	*replyReal = v
+	return nil
+}
+
+// testDCGatedRootsRPC serves the roots of each datacenter from its own
+// testGatedRootsRPC.
+type testDCGatedRootsRPC map[string]*testGatedRootsRPC
+
+func (r testDCGatedRootsRPC) RPC(method string, args interface{}, reply interface{}) error {
+	dc := args.(*structs.DCSpecificRequest).Datacenter
+	rpc, ok := r[dc]
+	if !ok {
+		return fmt.Errorf("unknown datacenter: %s", dc)
+	}
+	return rpc.RPC(method, args, reply)
+}
+
+// testCountingRootsRPC always returns Roots straight away and counts the
+// calls made.
+type testCountingRootsRPC struct {
+	calls uint64
+	Roots structs.IndexedCARoots
+}
+
+func (r *testCountingRootsRPC) RPC(method string, args interface{}, reply interface{}) error {
+	if method != "ConnectCA.Roots" {
+		return fmt.Errorf("invalid RPC method: %s", method)
+	}
+	atomic.AddUint64(&r.calls, 1)
+	*reply.(*structs.IndexedCARoots) = r.Roots
+	return nil
+}
+
+// testClock is a clock whose time only moves when Advance is called.
+type testClock struct {
+	lock    sync.Mutex
+	now     time.Time
+	waiters []testClockWaiter
+}
+
+type testClockWaiter struct {
+	at time.Time
+	ch chan time.Time
+}
+
+func newTestClock(now time.Time) *testClock {
+	return &testClock{now: now}
+}
+
+func (c *testClock) Now() time.Time {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.now
+}
+
+func (c *testClock) After(d time.Duration) <-chan time.Time {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	ch := make(chan time.Time, 1)
+	at := c.now.Add(d)
+	if d <= 0 {
+		ch <- c.now
+		return ch
+	}
+	c.waiters = append(c.waiters, testClockWaiter{at: at, ch: ch})
+	return ch
+}
+
+// Advance moves the clock forward, firing any waiters that are now due.
+func (c *testClock) Advance(d time.Duration) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.now = c.now.Add(d)
+	var pending []testClockWaiter
+	for _, w := range c.waiters {
+		if w.at.After(c.now) {
+			pending = append(pending, w)
+			continue
+		}
+		w.ch <- c.now
+	}
+	c.waiters = pending
+}
+
+// waitForWaiters blocks until at least n calls to After are pending so that
+// tests don't Advance before a Fetch has started waiting.
+func (c *testClock) waitForWaiters(t *testing.T, n int) {
+	t.Helper()
+	for i := 0; i < 1000; i++ {
+		c.lock.Lock()
+		count := len(c.waiters)
+		c.lock.Unlock()
+		if count >= n {
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+	t.Fatalf("timed out waiting for %d clock waiters", n)
+}
+
+// requireFetchResult asserts that result is the expected FetchResult. The
+// TTLRemaining depends on when the fetch ran, so it's only checked to be
+// positive whenever a cert is served rather than compared.
+func requireFetchResult(t *testing.T, expected cache.FetchResult, result interface{}) {
+	t.Helper()
+	actual, ok := result.(cache.FetchResult)
+	require.True(t, ok, "not a FetchResult: %#v", result)
+	if expected.Value != nil {
+		require.True(t, actual.TTLRemaining > 0, "TTLRemaining not positive: %s", actual.TTLRemaining)
+		actual.TTLRemaining = 0
+	}
+	require.Equal(t, expected, actual)
+}
+
+// Test that a local signer issues leaves that verify against its own root
+// Test that Subscribe sends the current leaf and then each renewal, and
+// closes its channel when the context is done.
+func TestConnectCALeaf_subscribe(t *testing.T) {
+	t.Parallel()
+
+	require := require.New(t)
+	rpc := TestSignRPC(t)
+	typ, rootsCh := testCALeafType(t, rpc)
+	defer close(rootsCh)
+	rootsCh <- structs.IndexedCARoots{
+		ActiveRootID: "1",
+		TrustDomain:  "fake-trust-domain.consul",
+		QueryMeta:    structs.QueryMeta{Index: 1},
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ch, err := typ.Subscribe(ctx, &ConnectCALeafRequest{Datacenter: "dc1", Service: "web"})
+	require.NoError(err)
+
+	next := func() *structs.IssuedCert {
+		t.Helper()
+		select {
+		case cert, ok := <-ch:
+			require.True(ok)
+			return cert
+		case <-time.After(time.Second):
+			t.Fatal("should send a leaf")
+			return nil
+		}
+	}
+	require.Equal(uint64(1), next().ModifyIndex)
+
+	// A rotation pushes the renewed leaf
+	rootsCh <- structs.IndexedCARoots{
+		ActiveRootID: "2",
+		TrustDomain:  "fake-trust-domain.consul",
+		QueryMeta:    structs.QueryMeta{Index: 2},
+	}
+	require.Equal(uint64(2), next().ModifyIndex)
+	select {
+	case cert := <-ch:
+		t.Fatalf("should not send: %#v", cert)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	// Cancelling closes the channel even though a Fetch is still blocked
+	cancel()
+	select {
+	case _, ok := <-ch:
+		require.False(ok)
+	case <-time.After(time.Second):
+		t.Fatal("should close")
+	}
+	require.Len(rpc.Requests(), 2)
+}
+
+// Test that blocking Fetches and subscriptions starting and stopping
+// concurrently don't leave watchers behind that renew the leaf, or a later
+// Test that a blocked Fetch returns promptly with the context's error once
+// its context is done.
+func TestConnectCALeaf_fetchContext(t *testing.T) {
+	t.Parallel()
+
+	require := require.New(t)
+	rpc := TestRPC(t)
+	defer rpc.AssertExpectations(t)
+
+	typ, rootsCh := testCALeafType(t, rpc)
+	defer close(rootsCh)
+	rootsCh <- structs.IndexedCARoots{
+		ActiveRootID: "1",
+		TrustDomain:  "fake-trust-domain.consul",
+		QueryMeta:    structs.QueryMeta{Index: 1},
+	}
+
+	var signs uint64
+	rpc.On("RPC", "ConnectCA.Sign", mock.Anything, mock.Anything).Return(nil).
+		Run(func(args mock.Arguments) {
+			reply := args.Get(2).(*structs.IssuedCert)
+			reply.ValidBefore = time.Now().Add(12 * time.Hour)
+			reply.CreateIndex = atomic.AddUint64(&signs, 1)
+			reply.ModifyIndex = reply.CreateIndex
+		})
+
+	req := &ConnectCALeafRequest{Datacenter: "dc1", Service: "web"}
+	result, err := typ.Fetch(cache.FetchOptions{Timeout: 10 * time.Second}, req)
+	require.NoError(err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	fetchCh := TestFetchCh(t, typ, cache.FetchOptions{
+		MinIndex: result.Index,
+		Timeout:  10 * time.Minute,
+		Context:  ctx,
+	}, req)
+	select {
+	case result := <-fetchCh:
+		t.Fatalf("should not return: %#v", result)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	cancel()
+	select {
+	case <-time.After(time.Second):
+		t.Fatal("shouldn't block after the context is cancelled")
+	case result := <-fetchCh:
+		err, ok := result.(error)
+		require.True(ok, "not an error: %#v", result)
+		require.Equal(context.Canceled, err)
+	}
+
+	// A context that's already done returns straight away too.
+	ctx, cancel = context.WithTimeout(context.Background(), time.Nanosecond)
+	defer cancel()
+	<-ctx.Done()
+	_, err = typ.Fetch(cache.FetchOptions{MinIndex: result.Index, Timeout: 10 * time.Minute, Context: ctx}, req)
+	require.Equal(context.DeadlineExceeded, err)
+	require.Equal(uint64(1), atomic.LoadUint64(&signs))
+}
+
+// Fetch without a watcher. Run with -race.
+func TestConnectCALeaf_watcherChurn(t *testing.T) {
+	t.Parallel()
+
+	require := require.New(t)
+	rpc := TestSignRPC(t)
+	typ, rootsCh := testCALeafType(t, rpc)
+	defer close(rootsCh)
+	rootsCh <- structs.IndexedCARoots{
+		ActiveRootID: "1",
+		TrustDomain:  "fake-trust-domain.consul",
+		QueryMeta:    structs.QueryMeta{Index: 1},
+	}
+
+	req := &ConnectCALeafRequest{Datacenter: "dc1", Service: "web"}
+	_, err := typ.Fetch(cache.FetchOptions{MinIndex: 0, Timeout: 10 * time.Second}, req)
+	require.NoError(err)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 20; j++ {
+				if i%2 == 0 {
+					typ.Fetch(cache.FetchOptions{MinIndex: 1, Timeout: time.Duration(j%3+1) * time.Millisecond}, req)
+					continue
+				}
+				ctx, cancel := context.WithCancel(context.Background())
+				if ch, err := typ.Subscribe(ctx, req); err == nil {
+					<-ch
+				}
+				cancel()
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	// A watcher that times out without newer roots doesn't report them
+	ch := make(chan error, 1)
+	typ.waitNewRootCA("dc1", ch, 10*time.Millisecond, 1)
+	require.Len(ch, 0)
+
+	// A Fetch started after the churn still sees the rotation
+	fetchCh := TestFetchCh(t, typ, cache.FetchOptions{MinIndex: 1, Timeout: 10 * time.Second}, req)
+	rootsCh <- structs.IndexedCARoots{
+		ActiveRootID: "2",
+		TrustDomain:  "fake-trust-domain.consul",
+		QueryMeta:    structs.QueryMeta{Index: 2},
+	}
+	select {
+	case result := <-fetchCh:
+		require.Equal(uint64(2), result.(cache.FetchResult).Index)
+	case <-time.After(2 * time.Second):
+		t.Fatal("should renew on the rotation")
+	}
+}
+
+// Test that HealthCheck signs a throwaway leaf without caching it, and
+// reports the stage it fails at.
+func TestConnectCALeaf_healthCheck(t *testing.T) {
+	t.Parallel()
+
+	require := require.New(t)
+	rpc := TestSignRPC(t)
+	typ, rootsCh := testCALeafType(t, rpc)
+	defer close(rootsCh)
+	rootsCh <- structs.IndexedCARoots{
+		ActiveRootID: "1",
+		TrustDomain:  "fake-trust-domain.consul",
+		QueryMeta:    structs.QueryMeta{Index: 1},
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	require.NoError(typ.HealthCheck(ctx, "dc1", "token"))
+	reqs := rpc.Requests()
+	require.Len(reqs, 1)
+	require.Equal("token", reqs[0].Token)
+	require.Equal("spiffe://fake-trust-domain.consul/ns/default/dc/dc1/svc/"+LeafHealthCheckService,
+		rpc.CSRs(t)[0].URIs[0].String())
+	require.Empty(typ.Leaves())
+
+	// A failed sign
+	rpc.Reply = func(req *structs.CASignRequest, reply *structs.IssuedCert) error {
+		return errors.New("sign failed")
+	}
+	err := typ.HealthCheck(ctx, "dc1", "token")
+	require.Error(err)
+	herr, ok := err.(*LeafHealthError)
+	require.True(ok)
+	require.Equal(LeafHealthStageSign, herr.Stage)
+	require.EqualError(herr.Err, "sign failed")
+
+	// An unusable leaf
+	rpc.Reply = func(req *structs.CASignRequest, reply *structs.IssuedCert) error {
+		reply.ValidBefore = time.Now().Add(-1 * time.Second)
+		return nil
+	}
+	err = typ.HealthCheck(ctx, "dc1", "token")
+	require.Error(err)
+	herr, ok = err.(*LeafHealthError)
+	require.True(ok)
+	require.Equal(LeafHealthStageVerify, herr.Stage)
+
+	// Roots without a bootstrapped CA fail without signing
+	typ2, rootsCh2 := testCALeafType(t, rpc)
+	defer close(rootsCh2)
+	rootsCh2 <- structs.IndexedCARoots{QueryMeta: structs.QueryMeta{Index: 1}}
+	err = typ2.HealthCheck(ctx, "dc1", "token")
+	require.Error(err)
+	herr, ok = err.(*LeafHealthError)
+	require.True(ok)
+	require.Equal(LeafHealthStageRoots, herr.Stage)
+	require.Equal(errRootsNotPopulated, herr.Err)
+	require.Len(rpc.Requests(), 3)
+
+	// A local signer's leaves are real certs for the probe service
+	signer, err := NewLocalSigner("11111111-2222-3333-4444-555555555555.consul")
+	require.NoError(err)
+	require.NoError((&ConnectCALeaf{LocalSigner: signer}).HealthCheck(ctx, "dc1", ""))
+}
+
+// without the servers or the roots cache.
+func TestConnectCALeaf_localSigner(t *testing.T) {
+	t.Parallel()
+
+	require := require.New(t)
+	rpc := TestRPC(t)
+	defer rpc.AssertExpectations(t)
+
+	signer, err := NewLocalSigner("11111111-2222-3333-4444-555555555555.consul")
+	require.NoError(err)
+	typ := &ConnectCALeaf{RPC: rpc, LocalSigner: signer}
+
+	opts := cache.FetchOptions{MinIndex: 0, Timeout: 10 * time.Second}
+	result, err := typ.Fetch(opts, &ConnectCALeafRequest{Datacenter: "dc1", Service: "web"})
+	require.NoError(err)
+	issued, ok := result.Value.(*structs.IssuedCert)
+	require.True(ok)
+	require.Equal("web", issued.Service)
+	require.NotEmpty(issued.PrivateKeyPEM)
+	require.True(result.Index > signer.Roots().Index)
+
+	cert, err := connect.ParseCert(issued.CertPEM)
+	require.NoError(err)
+	require.Len(cert.URIs, 1)
+	require.Equal("spiffe://11111111-2222-3333-4444-555555555555.consul/ns/default/dc/dc1/svc/web",
+		cert.URIs[0].String())
+	require.Equal(cert.URIs[0].String(), issued.ServiceURI)
+
+	roots := signer.Roots()
+	require.Len(roots.Roots, 1)
+	require.Equal(roots.ActiveRootID, roots.Roots[0].ID)
+	pool := x509.NewCertPool()
+	require.True(pool.AppendCertsFromPEM([]byte(roots.Roots[0].RootCert)))
+	_, err = cert.Verify(x509.VerifyOptions{
+		Roots:     pool,
+		KeyUsages: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	})
+	require.NoError(err)
+
+	// A server-only leaf can't be used as a client.
+	result, err = typ.Fetch(opts, &ConnectCALeafRequest{Datacenter: "dc1", Service: "web", Usage: LeafUsageServer})
+	require.NoError(err)
+	cert, err = connect.ParseCert(result.Value.(*structs.IssuedCert).CertPEM)
+	require.NoError(err)
+	require.Equal([]x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth}, cert.ExtKeyUsage)
 }
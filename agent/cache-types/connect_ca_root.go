@@ -2,6 +2,7 @@ package cachetype
 
 import (
 	"fmt"
+	"time"
 
 	"github.com/hashicorp/consul/agent/cache"
 	"github.com/hashicorp/consul/agent/structs"
@@ -15,6 +16,13 @@ const ConnectCARootName = "connect-ca-root"
 // index and return the data.
 type ConnectCARoot struct {
 	RPC RPC
+
+	// QueryTime, if non-zero, is how long each blocking roots query waits
+	// for a change, replacing the timeout the cache fetches with. Roots
+	// rarely change and a rotation ends the query straight away, so a long
+	// wait saves round trips on idle clusters without delaying rotations.
+	// The servers cap it at 10 minutes.
+	QueryTime time.Duration
 }
 
 func (c *ConnectCARoot) Fetch(opts cache.FetchOptions, req cache.Request) (cache.FetchResult, error) {
@@ -30,6 +38,9 @@ func (c *ConnectCARoot) Fetch(opts cache.FetchOptions, req cache.Request) (cache
 	// Set the minimum query index to our current index so we block
 	reqReal.QueryOptions.MinQueryIndex = opts.MinIndex
 	reqReal.QueryOptions.MaxQueryTime = opts.Timeout
+	if c.QueryTime > 0 && opts.MinIndex > 0 {
+		reqReal.QueryOptions.MaxQueryTime = c.QueryTime
+	}
 
 	// Fetch
 	var reply structs.IndexedCARoots
@@ -42,6 +42,31 @@ func TestConnectCARoot(t *testing.T) {
 	}, result)
 }
 
+func TestConnectCARoot_queryTime(t *testing.T) {
+	require := require.New(t)
+	rpc := TestRPC(t)
+	defer rpc.AssertExpectations(t)
+	typ := &ConnectCARoot{RPC: rpc, QueryTime: 10 * time.Minute}
+
+	var queryTimes []time.Duration
+	rpc.On("RPC", "ConnectCA.Roots", mock.Anything, mock.Anything).Return(nil).
+		Run(func(args mock.Arguments) {
+			req := args.Get(1).(*structs.DCSpecificRequest)
+			queryTimes = append(queryTimes, req.QueryOptions.MaxQueryTime)
+		})
+
+	// Blocking queries wait for the configured time rather than the
+	// cache's timeout, but the initial non-blocking query is left alone.
+	for _, minIndex := range []uint64{24, 0} {
+		_, err := typ.Fetch(cache.FetchOptions{
+			MinIndex: minIndex,
+			Timeout:  1 * time.Second,
+		}, &structs.DCSpecificRequest{Datacenter: "dc1"})
+		require.NoError(err)
+	}
+	require.Equal([]time.Duration{10 * time.Minute, 1 * time.Second}, queryTimes)
+}
+
 func TestConnectCARoot_badReqType(t *testing.T) {
 	require := require.New(t)
 	rpc := TestRPC(t)
@@ -5,6 +5,11 @@ package cachetype
 // RPC is an interface that an RPC client must implement. This is a helper
 // interface that is implemented by the agent delegate so that Type
 // implementations can request RPC access.
+//
+// Implementations other than the agent, such as HTTPRPC, must decode the
+// result into reply just as the RPC would and return errors whose messages
+// match the server's, since callers compare them using helpers such as
+// acl.IsErrPermissionDenied.
 type RPC interface {
 	RPC(method string, args interface{}, reply interface{}) error
 }
@@ -0,0 +1,89 @@
+package cachetype
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	"github.com/hashicorp/consul/acl"
+	"github.com/hashicorp/consul/agent/structs"
+)
+
+// HTTPRPC is an RPC implementation that sends each call over HTTP rather than
+// the agent's internal RPC. It lets the cache types be embedded in processes
+// that aren't agents, such as a lightweight sidecar, so long as something
+// serves the calls they make over HTTP.
+//
+// Each call is sent as a POST of the JSON encoded args to the path routed for
+// its method, and a 2xx response body is decoded as JSON into the reply. The
+// args' ACL token, if any, is sent in the X-Consul-Token header. A 403 is
+// returned as an acl.PermissionDeniedError so callers handle it the same way as
+// the error from an RPC. Other responses are returned as errors holding the
+// response body.
+//
+// Consul's HTTP API doesn't expose every RPC the cache types use, notably
+// ConnectCA.Sign, so the routes must be provided for the server in use.
+type HTTPRPC struct {
+	// Address is the base URL the routes are relative to, for example
+	// "https://127.0.0.1:8501".
+	Address string
+
+	// Routes maps RPC methods, such as "ConnectCA.Sign", to the path that
+	// serves them. Calls for methods that aren't routed return an error.
+	Routes map[string]string
+
+	// Client is used to make the requests. If nil, http.DefaultClient is
+	// used.
+	Client *http.Client
+}
+
+func (r *HTTPRPC) RPC(method string, args interface{}, reply interface{}) error {
+	path, ok := r.Routes[method]
+	if !ok {
+		return fmt.Errorf("no HTTP route for RPC method %q", method)
+	}
+
+	body, err := json.Marshal(args)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("POST", strings.TrimSuffix(r.Address, "/")+path, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if info, ok := args.(structs.RPCInfo); ok && info.TokenSecret() != "" {
+		req.Header.Set("X-Consul-Token", info.TokenSecret())
+	}
+
+	client := r.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	respBody, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	msg := strings.TrimSpace(string(respBody))
+	switch {
+	case resp.StatusCode == http.StatusForbidden:
+		// Consul's own 403s already start with the permission denied
+		// message so don't repeat it in the cause.
+		cause := strings.TrimPrefix(msg, acl.ErrPermissionDenied.Error())
+		return acl.PermissionDeniedError{Cause: strings.TrimPrefix(cause, ": ")}
+
+	case resp.StatusCode < 200 || resp.StatusCode > 299:
+		return fmt.Errorf("%s failed (%d): %s", method, resp.StatusCode, msg)
+	}
+
+	return json.Unmarshal(respBody, reply)
+}
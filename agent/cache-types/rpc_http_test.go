@@ -0,0 +1,91 @@
+package cachetype
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/consul/acl"
+	"github.com/hashicorp/consul/agent/cache"
+	"github.com/hashicorp/consul/agent/structs"
+	"github.com/stretchr/testify/require"
+)
+
+// Test that a leaf can be signed through the HTTP adapter.
+func TestHTTPRPC_connectCALeaf(t *testing.T) {
+	t.Parallel()
+
+	require := require.New(t)
+
+	var signReq structs.CASignRequest
+	var signToken string
+	mux := http.NewServeMux()
+	mux.HandleFunc("/sign", func(w http.ResponseWriter, r *http.Request) {
+		require.Equal("POST", r.Method)
+		require.NoError(json.NewDecoder(r.Body).Decode(&signReq))
+		signToken = r.Header.Get("X-Consul-Token")
+		switch signReq.Token {
+		case "denied":
+			w.WriteHeader(http.StatusForbidden)
+			w.Write([]byte("Permission denied"))
+		case "broken":
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte("CA provider unavailable\n"))
+		default:
+			json.NewEncoder(w).Encode(&structs.IssuedCert{
+				SerialNumber: "01",
+				ValidBefore:  time.Now().Add(12 * time.Hour),
+				RaftIndex:    structs.RaftIndex{CreateIndex: 7, ModifyIndex: 7},
+			})
+		}
+	})
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	rpc := &HTTPRPC{
+		Address: srv.URL + "/",
+		Routes:  map[string]string{"ConnectCA.Sign": "/sign"},
+	}
+	typ, rootsCh := testCALeafType(t, rpc)
+	defer close(rootsCh)
+	rootsCh <- structs.IndexedCARoots{
+		ActiveRootID: "1",
+		TrustDomain:  "fake-trust-domain.consul",
+		QueryMeta:    structs.QueryMeta{Index: 1},
+	}
+
+	opts := cache.FetchOptions{MinIndex: 0, Timeout: 10 * time.Second}
+	result, err := typ.Fetch(opts, &ConnectCALeafRequest{
+		Datacenter: "dc1", Service: "web", Token: "abc"})
+	require.NoError(err)
+	require.True(result.Generated)
+	require.Equal(uint64(7), result.Index)
+	require.Equal("01", result.Value.(*structs.IssuedCert).SerialNumber)
+	require.Equal("abc", signToken)
+	require.Equal("dc1", signReq.Datacenter)
+	require.NotEmpty(signReq.CSR)
+
+	// A 403 is a permission denied error
+	_, err = typ.Fetch(opts, &ConnectCALeafRequest{
+		Datacenter: "dc1", Service: "web", Token: "denied"})
+	require.Error(err)
+	require.True(acl.IsErrPermissionDenied(err))
+	require.Contains(err.Error(), "can't sign a leaf cert")
+
+	// Other errors carry the response body
+	_, err = typ.Fetch(opts, &ConnectCALeafRequest{
+		Datacenter: "dc1", Service: "web", Token: "broken"})
+	require.Error(err)
+	require.Contains(err.Error(), "ConnectCA.Sign failed (500): CA provider unavailable")
+}
+
+func TestHTTPRPC_unroutedMethod(t *testing.T) {
+	t.Parallel()
+
+	rpc := &HTTPRPC{Address: "http://127.0.0.1:0"}
+	err := rpc.RPC("ConnectCA.Sign", &structs.CASignRequest{}, &structs.IssuedCert{})
+	require.Error(t, err)
+	require.Contains(t, err.Error(), `no HTTP route for RPC method "ConnectCA.Sign"`)
+}
@@ -1,10 +1,15 @@
 package cachetype
 
 import (
+	"crypto/x509"
+	"fmt"
 	"reflect"
+	"sync"
 	"time"
 
 	"github.com/hashicorp/consul/agent/cache"
+	"github.com/hashicorp/consul/agent/connect"
+	"github.com/hashicorp/consul/agent/structs"
 	"github.com/mitchellh/go-testing-interface"
 )
 
@@ -58,3 +63,70 @@ func TestFetchChResult(t testing.T, ch <-chan interface{}, expected interface{})
 	case <-time.After(50 * time.Millisecond):
 	}
 }
+
+// TestSignRPC returns an RPC implementation that records every
+// ConnectCA.Sign request so tests can decode and assert on the CSRs that
+// ConnectCALeaf generates. Sign replies default to an empty cert valid for
+// 12 hours with increasing indexes, and can be changed with Reply.
+func TestSignRPC(t testing.T) *SignRecorderRPC {
+	return &SignRecorderRPC{}
+}
+
+// SignRecorderRPC is the RPC implementation returned by TestSignRPC. Calls
+// for other methods fail.
+type SignRecorderRPC struct {
+	// Reply, if set, is called for each sign request once the default
+	// reply is filled in. It can change the reply, or fail the sign by
+	// returning an error.
+	Reply func(req *structs.CASignRequest, reply *structs.IssuedCert) error
+
+	lock     sync.Mutex
+	requests []*structs.CASignRequest
+	index    uint64
+}
+
+func (r *SignRecorderRPC) RPC(method string, args interface{}, reply interface{}) error {
+	if method != "ConnectCA.Sign" {
+		return fmt.Errorf("invalid RPC method: %s", method)
+	}
+	req := args.(*structs.CASignRequest)
+	cert := reply.(*structs.IssuedCert)
+
+	r.lock.Lock()
+	r.requests = append(r.requests, req)
+	r.index++
+	index := r.index
+	replyFn := r.Reply
+	r.lock.Unlock()
+
+	*cert = structs.IssuedCert{
+		ValidAfter:  time.Now().Add(-1 * time.Minute),
+		ValidBefore: time.Now().Add(12 * time.Hour),
+		RaftIndex:   structs.RaftIndex{CreateIndex: index, ModifyIndex: index},
+	}
+	if replyFn != nil {
+		return replyFn(req, cert)
+	}
+	return nil
+}
+
+// Requests returns the sign requests made so far, in order.
+func (r *SignRecorderRPC) Requests() []*structs.CASignRequest {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return append([]*structs.CASignRequest(nil), r.requests...)
+}
+
+// CSRs returns the decoded CSRs of the sign requests made so far, in order,
+// failing the test if any can't be parsed.
+func (r *SignRecorderRPC) CSRs(t testing.T) []*x509.CertificateRequest {
+	var csrs []*x509.CertificateRequest
+	for _, req := range r.Requests() {
+		csr, err := connect.ParseCSR(req.CSR)
+		if err != nil {
+			t.Fatalf("err: %s", err)
+		}
+		csrs = append(csrs, csr)
+	}
+	return csrs
+}
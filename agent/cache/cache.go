@@ -16,12 +16,15 @@ package cache
 
 import (
 	"container/heap"
+	"context"
 	"fmt"
+	"io"
 	"sync"
 	"sync/atomic"
 	"time"
 
 	"github.com/armon/go-metrics"
+	"github.com/hashicorp/consul/acl"
 )
 
 //go:generate mockery -all -inpkg
@@ -31,6 +34,10 @@ import (
 const (
 	CacheRefreshBackoffMin = 3               // 3 attempts before backing off
 	CacheRefreshMaxWait    = 1 * time.Minute // maximum backoff wait time
+
+	// cacheRefreshMaxWaitAttempt is the first attempt count that is backed
+	// off by the full CacheRefreshMaxWait.
+	cacheRefreshMaxWaitAttempt = CacheRefreshBackoffMin + 6
 )
 
 // Cache is a agent-local cache of Consul data. Create a Cache using the
@@ -78,6 +85,10 @@ type Cache struct {
 	stopped uint32
 	// stopCh is closed when Close is called
 	stopCh chan struct{}
+	// stopCtx is passed to every Fetch and is cancelled by Close so that
+	// in-flight blocking fetches can return early.
+	stopCtx    context.Context
+	stopCancel context.CancelFunc
 }
 
 // typeEntry is a single type that is registered with a Cache.
@@ -113,6 +124,17 @@ type ResultMeta struct {
 	// already but this allows generic code to reason about whether cache values
 	// have changed.
 	Index uint64
+
+	// TTLRemaining is how long the result remains valid for, for types that
+	// report it in FetchResult.TTLRemaining. It is counted down from when the
+	// result was fetched so it can be used to align refresh timers. Zero if
+	// the type doesn't report it.
+	TTLRemaining time.Duration
+
+	// Generated is true if the type produced the result during the fetch this
+	// Get waited on, as reported in FetchResult.Generated. It is always false
+	// for cache hits.
+	Generated bool
 }
 
 // Options are options for the Cache.
@@ -129,11 +151,14 @@ func New(*Options) *Cache {
 	h := &expiryHeap{NotifyCh: make(chan struct{}, 1)}
 	heap.Init(h)
 
+	ctx, cancel := context.WithCancel(context.Background())
 	c := &Cache{
 		types:             make(map[string]typeEntry),
 		entries:           make(map[string]cacheEntry),
 		entriesExpiryHeap: h,
 		stopCh:            make(chan struct{}),
+		stopCtx:           ctx,
+		stopCancel:        cancel,
 	}
 
 	// Start the expiry watcher
@@ -280,9 +305,17 @@ RETRY_GET:
 
 	if cacheHit {
 		meta := ResultMeta{Index: entry.Index}
+		if entry.TTLRemaining > 0 {
+			meta.TTLRemaining = entry.TTLRemaining - time.Since(entry.FetchedAt)
+			if meta.TTLRemaining < 0 {
+				meta.TTLRemaining = 0
+			}
+		}
 		if first {
 			metrics.IncrCounter([]string{"consul", "cache", t, "hit"}, 1)
 			meta.Hit = true
+		} else {
+			meta.Generated = entry.Generated
 		}
 
 		// If refresh is enabled, calculate age based on whether the background
@@ -439,7 +472,7 @@ func (c *Cache) fetch(t, key string, r Request, allowNew bool, attempt uint) (<-
 			})
 		}
 
-		fOpts := FetchOptions{}
+		fOpts := FetchOptions{Context: c.stopCtx}
 		if tEntry.Type.SupportsBlocking() {
 			fOpts.MinIndex = entry.Index
 			fOpts.Timeout = tEntry.Opts.RefreshTimeout
@@ -459,6 +492,8 @@ func (c *Cache) fetch(t, key string, r Request, allowNew bool, attempt uint) (<-
 			newEntry.Value = result.Value
 			newEntry.Index = result.Index
 			newEntry.FetchedAt = time.Now()
+			newEntry.TTLRemaining = result.TTLRemaining
+			newEntry.Generated = result.Generated
 			if newEntry.Index < 1 {
 				// Less than one is invalid unless there was an error and in this case
 				// there wasn't since a value was returned. If a badly behaved RPC
@@ -512,6 +547,13 @@ func (c *Cache) fetch(t, key string, r Request, allowNew bool, attempt uint) (<-
 			// Increment attempt counter
 			attempt++
 
+			// Permission denied won't go away until the token or its policies
+			// change, so back off fully straight away rather than retrying
+			// rapidly and flooding the servers and logs.
+			if acl.IsErrPermissionDenied(err) && attempt < cacheRefreshMaxWaitAttempt {
+				attempt = cacheRefreshMaxWaitAttempt
+			}
+
 			// Always set the error. We don't override the value here because
 			// if Valid is true, then we can reuse the Value in the case a
 			// specific index isn't requested. However, for blocking queries,
@@ -577,13 +619,17 @@ func (c *Cache) fetchDirect(t string, r Request, minIndex uint64) (interface{},
 	// Fetch it with the min index specified directly by the request.
 	result, err := tEntry.Type.Fetch(FetchOptions{
 		MinIndex: minIndex,
+		Context:  c.stopCtx,
 	}, r)
 	if err != nil {
 		return nil, ResultMeta{}, err
 	}
 
 	// Return the result and ignore the rest
-	return result.Value, ResultMeta{}, nil
+	return result.Value, ResultMeta{
+		TTLRemaining: result.TTLRemaining,
+		Generated:    result.Generated,
+	}, nil
 }
 
 func backOffWait(failures uint) time.Duration {
@@ -678,16 +724,29 @@ func (c *Cache) runExpiryLoop() {
 }
 
 // Close stops any background work and frees all resources for the cache.
-// Current Fetch requests are allowed to continue to completion and callers may
-// still access the current cache values so coordination isn't needed with
-// callers, however no background activity will continue. It's intended to close
+// Current Fetch requests have their FetchOptions.Context cancelled so types
+// that honour it return early, and callers may still access the current cache
+// values so coordination isn't needed with callers, however no background
+// activity will continue. It's intended to close
 // the cache at agent shutdown so no further requests should be made, however
 // concurrent or in-flight ones won't break.
+//
+// Registered types that implement io.Closer are closed too so they can stop
+// any background work of their own.
 func (c *Cache) Close() error {
 	wasStopped := atomic.SwapUint32(&c.stopped, 1)
 	if wasStopped == 0 {
-		// First time only, close stop chan
+		// First time only, close stop chan and cancel in-flight fetches
 		close(c.stopCh)
+		c.stopCancel()
+
+		c.typesLock.RLock()
+		defer c.typesLock.RUnlock()
+		for _, tEntry := range c.types {
+			if closer, ok := tEntry.Type.(io.Closer); ok {
+				closer.Close()
+			}
+		}
 	}
 	return nil
 }
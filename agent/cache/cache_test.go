@@ -1,6 +1,7 @@
 package cache
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"sort"
@@ -9,6 +10,7 @@ import (
 	"testing"
 	"time"
 
+	"github.com/hashicorp/consul/acl"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/mock"
 	"github.com/stretchr/testify/require"
@@ -472,6 +474,39 @@ func TestCacheGet_periodicRefreshErrorBackoff(t *testing.T) {
 	require.True(t, actual < 10, fmt.Sprintf("actual: %d", actual))
 }
 
+// Test that a refresh failing with permission denied backs off fully
+// straight away rather than retrying a few times first.
+func TestCacheGet_periodicRefreshPermissionDeniedBackoff(t *testing.T) {
+	t.Parallel()
+
+	typ := TestType(t)
+	defer typ.AssertExpectations(t)
+	c := TestCache(t)
+	c.RegisterType("t", typ, &RegisterOptions{
+		Refresh:        true,
+		RefreshTimer:   0,
+		RefreshTimeout: 5 * time.Minute,
+	})
+
+	// Configure the type
+	var retries uint32
+	typ.Static(FetchResult{Value: 1, Index: 4}, nil).Once()
+	typ.Static(FetchResult{Value: nil, Index: 5}, acl.ErrPermissionDenied).Run(func(args mock.Arguments) {
+		atomic.AddUint32(&retries, 1)
+	})
+
+	// Fetch
+	resultCh := TestCacheGetCh(t, c, "t", TestRequest(t, RequestInfo{Key: "hello"}))
+	TestCacheGetChResult(t, resultCh, 1)
+
+	// Other errors are retried a few times before backing off, so within
+	// this sleep we'd see several retries without the full backoff.
+	time.Sleep(500 * time.Millisecond)
+
+	// Only the one failed refresh happened
+	require.Equal(t, uint32(1), atomic.LoadUint32(&retries))
+}
+
 // Test that a badly behaved RPC that returns 0 index will perform a backoff.
 func TestCacheGet_periodicRefreshBadRPCZeroIndexErrorBackoff(t *testing.T) {
 	t.Parallel()
@@ -1095,3 +1130,141 @@ func TestCacheGet_nonBlockingType(t *testing.T) {
 	time.Sleep(20 * time.Millisecond)
 	typ.AssertExpectations(t)
 }
+
+// Test that the TTLRemaining a type reports is returned in the Get meta and
+// counts down while the result is cached.
+func TestCacheGet_ttlRemaining(t *testing.T) {
+	t.Parallel()
+
+	require := require.New(t)
+
+	typ := TestTypeNonBlocking(t)
+	defer typ.AssertExpectations(t)
+	c := TestCache(t)
+	c.RegisterType("t", typ, nil)
+
+	// Configure the type
+	typ.Static(FetchResult{Value: 42, Index: 1, TTLRemaining: time.Hour}, nil).Once()
+
+	// Get, should fetch
+	req := TestRequest(t, RequestInfo{Key: "hello"})
+	result, meta, err := c.Get("t", req)
+	require.NoError(err)
+	require.Equal(42, result)
+	require.False(meta.Hit)
+	require.True(meta.TTLRemaining > 0)
+	require.True(meta.TTLRemaining <= time.Hour)
+	lastTTL := meta.TTLRemaining
+
+	time.Sleep(5 * time.Millisecond)
+
+	// Get, should return the cached value with less time remaining
+	result, meta, err = c.Get("t", req)
+	require.NoError(err)
+	require.Equal(42, result)
+	require.True(meta.Hit)
+	require.True(meta.TTLRemaining > 0)
+	require.True(meta.TTLRemaining < lastTTL)
+}
+
+// Test that Generated is reported in the Get meta for the fetch that produced
+// the result but not for later cache hits.
+func TestCacheGet_generated(t *testing.T) {
+	t.Parallel()
+
+	require := require.New(t)
+
+	typ := TestTypeNonBlocking(t)
+	defer typ.AssertExpectations(t)
+	c := TestCache(t)
+	c.RegisterType("t", typ, nil)
+
+	// Configure the type
+	typ.Static(FetchResult{Value: 42, Index: 1, Generated: true}, nil).Once()
+
+	// Get, should fetch
+	req := TestRequest(t, RequestInfo{Key: "hello"})
+	result, meta, err := c.Get("t", req)
+	require.NoError(err)
+	require.Equal(42, result)
+	require.False(meta.Hit)
+	require.True(meta.Generated)
+
+	// Get, should not fetch and so not report Generated
+	result, meta, err = c.Get("t", req)
+	require.NoError(err)
+	require.Equal(42, result)
+	require.True(meta.Hit)
+	require.False(meta.Generated)
+}
+
+// closerType is a Type that records whether it has been closed.
+type closerType struct {
+	*MockType
+	closed bool
+}
+
+func (t *closerType) Close() error {
+	t.closed = true
+	return nil
+}
+
+// Test that closing the cache closes registered types that implement
+// io.Closer.
+func TestCacheClose_closesTypes(t *testing.T) {
+	t.Parallel()
+
+	require := require.New(t)
+
+	typ := &closerType{MockType: TestType(t)}
+	c := TestCache(t)
+	c.RegisterType("t", typ, nil)
+
+	require.NoError(c.Close())
+	require.True(typ.closed)
+}
+
+// Test that closing the cache cancels the context given to in-flight fetches
+// so that they return early.
+func TestCacheClose_cancelsFetch(t *testing.T) {
+	t.Parallel()
+
+	require := require.New(t)
+
+	typ := TestType(t)
+	defer typ.AssertExpectations(t)
+	c := TestCache(t)
+	c.RegisterType("t", typ, nil)
+
+	// Block the fetch until its context is done
+	fetchingCh := make(chan struct{})
+	typ.Static(FetchResult{}, context.Canceled).Once().Run(func(args mock.Arguments) {
+		opts := args.Get(0).(FetchOptions)
+		require.NotNil(opts.Context)
+		close(fetchingCh)
+		<-opts.Context.Done()
+	})
+
+	// Get, should block on the fetch
+	errCh := make(chan error, 1)
+	go func() {
+		_, _, err := c.Get("t", TestRequest(t, RequestInfo{
+			Key: "hello", Timeout: 10 * time.Minute}))
+		errCh <- err
+	}()
+
+	select {
+	case <-fetchingCh:
+	case <-time.After(time.Second):
+		t.Fatal("fetch not started")
+	}
+
+	// Close should make the fetch return with the context's error
+	require.NoError(c.Close())
+	select {
+	case err := <-errCh:
+		require.Equal(context.Canceled, err)
+	case <-time.After(time.Second):
+		t.Fatal("fetch not cancelled")
+	}
+}
@@ -29,6 +29,13 @@ type cacheEntry struct {
 	// it's age later.
 	FetchedAt time.Time
 
+	// TTLRemaining is the FetchResult.TTLRemaining the Value was fetched
+	// with, counted from FetchedAt. Zero if the type didn't report one.
+	TTLRemaining time.Duration
+
+	// Generated is the FetchResult.Generated the Value was fetched with.
+	Generated bool
+
 	// RefreshLostContact stores the time background refresh failed. It gets reset
 	// to zero after a background fetch has returned successfully, or after a
 	// background request has be blocking for at least 5 seconds, which ever
@@ -1,6 +1,7 @@
 package cache
 
 import (
+	"context"
 	"time"
 )
 
@@ -41,6 +42,11 @@ type FetchOptions struct {
 	// Timeout is the maximum time for the query. This must be implemented
 	// in the Fetch itself.
 	Timeout time.Duration
+
+	// Context optionally cancels the query, e.g. when the request it's for
+	// is aborted. Types that block should return the context's error soon
+	// after it's done. It may be nil, in which case only Timeout applies.
+	Context context.Context
 }
 
 // FetchResult is the result of a Type Fetch operation and contains the
@@ -51,4 +57,17 @@ type FetchResult struct {
 
 	// Index is the corresponding index value for this data.
 	Index uint64
+
+	// Generated is true if the type produced Value during this fetch, for
+	// example by signing a new certificate, rather than returning a value it
+	// already held. The cache doesn't act on it but reports it in
+	// ResultMeta.Generated for the Get that waited on this fetch.
+	Generated bool
+
+	// TTLRemaining is how long Value remains valid for, if the type knows,
+	// for example the time left until a certificate expires. This lets
+	// callers align their own refresh timers without inspecting Value. The
+	// cache doesn't act on it but reports it, counted down since the fetch,
+	// in ResultMeta.TTLRemaining.
+	TTLRemaining time.Duration
 }
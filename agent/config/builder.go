@@ -758,6 +758,7 @@ func (b *Builder) Build() (rt RuntimeConfig, err error) {
 		ConnectEnabled:                          connectEnabled,
 		ConnectCAProvider:                       connectCAProvider,
 		ConnectCAConfig:                         connectCAConfig,
+		ConnectLeafTokenCheckInterval:           b.durationVal("connect.leaf_token_check_interval", c.Connect.LeafTokenCheckInterval),
 		ConnectProxyAllowManagedRoot:            b.boolVal(c.Connect.Proxy.AllowManagedRoot),
 		ConnectProxyAllowManagedAPIRegistration: b.boolVal(c.Connect.Proxy.AllowManagedAPIRegistration),
 		ConnectProxyBindMinPort:                 proxyMinPort,
@@ -817,11 +818,19 @@ func (b *Builder) Build() (rt RuntimeConfig, err error) {
 		ReconnectTimeoutLAN:                     b.durationVal("reconnect_timeout", c.ReconnectTimeoutLAN),
 		ReconnectTimeoutWAN:                     b.durationVal("reconnect_timeout_wan", c.ReconnectTimeoutWAN),
 		RejoinAfterLeave:                        b.boolVal(c.RejoinAfterLeave),
+		RetryJoinFailFast:                       b.boolVal(c.RetryJoinFailFast),
+		RetryJoinHints:                          b.boolVal(c.RetryJoinHints),
 		RetryJoinIntervalLAN:                    b.durationVal("retry_interval", c.RetryJoinIntervalLAN),
 		RetryJoinIntervalWAN:                    b.durationVal("retry_interval_wan", c.RetryJoinIntervalWAN),
 		RetryJoinLAN:                            b.expandAllOptionalAddrs("retry_join", c.RetryJoinLAN),
+		RetryJoinLogJSON:                        b.boolVal(c.RetryJoinLogJSON),
+		RetryJoinMaxAddrsPerAttempt:             b.intVal(c.RetryJoinMaxAddrsPerAttempt),
 		RetryJoinMaxAttemptsLAN:                 b.intVal(c.RetryJoinMaxAttemptsLAN),
+		RetryJoinMaxAttemptsTotal:               b.intVal(c.RetryJoinMaxAttemptsTotal),
 		RetryJoinMaxAttemptsWAN:                 b.intVal(c.RetryJoinMaxAttemptsWAN),
+		RetryJoinMinServers:                     b.intVal(c.RetryJoinMinServers),
+		RetryJoinShuffle:                        b.boolVal(c.RetryJoinShuffle),
+		RetryJoinVerifyTimeout:                  b.durationVal("retry_join_verify_timeout", c.RetryJoinVerifyTimeout),
 		RetryJoinWAN:                            b.expandAllOptionalAddrs("retry_join_wan", c.RetryJoinWAN),
 		SegmentName:                             b.stringVal(c.SegmentName),
 		Segments:                                segments,
@@ -233,11 +233,19 @@ type Config struct {
 	ReconnectTimeoutLAN              *string                  `json:"reconnect_timeout,omitempty" hcl:"reconnect_timeout" mapstructure:"reconnect_timeout"`
 	ReconnectTimeoutWAN              *string                  `json:"reconnect_timeout_wan,omitempty" hcl:"reconnect_timeout_wan" mapstructure:"reconnect_timeout_wan"`
 	RejoinAfterLeave                 *bool                    `json:"rejoin_after_leave,omitempty" hcl:"rejoin_after_leave" mapstructure:"rejoin_after_leave"`
+	RetryJoinFailFast                *bool                    `json:"retry_join_fail_fast,omitempty" hcl:"retry_join_fail_fast" mapstructure:"retry_join_fail_fast"`
+	RetryJoinHints                   *bool                    `json:"retry_join_hints,omitempty" hcl:"retry_join_hints" mapstructure:"retry_join_hints"`
 	RetryJoinIntervalLAN             *string                  `json:"retry_interval,omitempty" hcl:"retry_interval" mapstructure:"retry_interval"`
 	RetryJoinIntervalWAN             *string                  `json:"retry_interval_wan,omitempty" hcl:"retry_interval_wan" mapstructure:"retry_interval_wan"`
 	RetryJoinLAN                     []string                 `json:"retry_join,omitempty" hcl:"retry_join" mapstructure:"retry_join"`
+	RetryJoinLogJSON                 *bool                    `json:"retry_join_log_json,omitempty" hcl:"retry_join_log_json" mapstructure:"retry_join_log_json"`
+	RetryJoinMaxAddrsPerAttempt      *int                     `json:"retry_join_max_addrs_per_attempt,omitempty" hcl:"retry_join_max_addrs_per_attempt" mapstructure:"retry_join_max_addrs_per_attempt"`
 	RetryJoinMaxAttemptsLAN          *int                     `json:"retry_max,omitempty" hcl:"retry_max" mapstructure:"retry_max"`
+	RetryJoinMaxAttemptsTotal        *int                     `json:"retry_max_total,omitempty" hcl:"retry_max_total" mapstructure:"retry_max_total"`
 	RetryJoinMaxAttemptsWAN          *int                     `json:"retry_max_wan,omitempty" hcl:"retry_max_wan" mapstructure:"retry_max_wan"`
+	RetryJoinMinServers              *int                     `json:"retry_join_min_servers,omitempty" hcl:"retry_join_min_servers" mapstructure:"retry_join_min_servers"`
+	RetryJoinShuffle                 *bool                    `json:"retry_join_shuffle,omitempty" hcl:"retry_join_shuffle" mapstructure:"retry_join_shuffle"`
+	RetryJoinVerifyTimeout           *string                  `json:"retry_join_verify_timeout,omitempty" hcl:"retry_join_verify_timeout" mapstructure:"retry_join_verify_timeout"`
 	RetryJoinWAN                     []string                 `json:"retry_join_wan,omitempty" hcl:"retry_join_wan" mapstructure:"retry_join_wan"`
 	SegmentName                      *string                  `json:"segment,omitempty" hcl:"segment" mapstructure:"segment"`
 	Segments                         []Segment                `json:"segments,omitempty" hcl:"segments" mapstructure:"segments"`
@@ -504,6 +512,10 @@ type Connect struct {
 	ProxyDefaults ConnectProxyDefaults   `json:"proxy_defaults,omitempty" hcl:"proxy_defaults" mapstructure:"proxy_defaults"`
 	CAProvider    *string                `json:"ca_provider,omitempty" hcl:"ca_provider" mapstructure:"ca_provider"`
 	CAConfig      map[string]interface{} `json:"ca_config,omitempty" hcl:"ca_config" mapstructure:"ca_config"`
+
+	// LeafTokenCheckInterval opts in to periodically checking that the ACL
+	// token of a blocked leaf certificate watch still exists.
+	LeafTokenCheckInterval *string `json:"leaf_token_check_interval,omitempty" hcl:"leaf_token_check_interval" mapstructure:"leaf_token_check_interval"`
 }
 
 // ConnectProxy is the agent-global connect proxy configuration.
@@ -528,6 +528,12 @@ type RuntimeConfig struct {
 	// ConnectCAConfig is the config to use for the CA provider.
 	ConnectCAConfig map[string]interface{}
 
+	// ConnectLeafTokenCheckInterval, if non-zero, is how often a blocked leaf
+	// certificate watch checks that its ACL token still exists, so that a
+	// revoked token is noticed before the leaf needs renewing. Each check is
+	// an RPC to the servers, so it is disabled by default.
+	ConnectLeafTokenCheckInterval time.Duration
+
 	// ConnectReplicationToken is the ACL token used for replicating intentions.
 	ConnectReplicationToken string
 
@@ -918,6 +924,21 @@ type RuntimeConfig struct {
 	// flag: -rejoin
 	RejoinAfterLeave bool
 
+	// RetryJoinFailFast makes retry join give up after the first failed
+	// attempt, returning its error without waiting for the retry interval.
+	// This gives tests and short-lived agents immediate feedback.
+	//
+	// hcl: retry_join_fail_fast = (true|false)
+	RetryJoinFailFast bool
+
+	// RetryJoinHints makes retry join save the addresses of each successful
+	// join in the data directory and try them first when the agent next
+	// starts, before discovering servers, so that a restarted agent rejoins
+	// quickly. If joining them fails, discovery proceeds as usual.
+	//
+	// hcl: retry_join_hints = (true|false)
+	RetryJoinHints bool
+
 	// RetryJoinIntervalLAN specifies the amount of time to wait in between join
 	// attempts on agent start. The minimum allowed value is 1 second and
 	// the default is 30s.
@@ -941,6 +962,22 @@ type RuntimeConfig struct {
 	// flag: -retry-join string -retry-join string
 	RetryJoinLAN []string
 
+	// RetryJoinLogJSON enables logging the progress of the retry joins as
+	// JSON events with fields such as the cluster, attempt and error,
+	// instead of the human readable log lines.
+	//
+	// hcl: retry_join_log_json = (true|false)
+	RetryJoinLogJSON bool
+
+	// RetryJoinMaxAddrsPerAttempt limits how many of the discovered and
+	// configured addresses each retry join attempt contacts. When there are
+	// more, each attempt joins the next ones in turn, starting at a random
+	// one, so that all of them are tried over several attempts. If 0, every
+	// address is joined on each attempt.
+	//
+	// hcl: retry_join_max_addrs_per_attempt = int
+	RetryJoinMaxAddrsPerAttempt int
+
 	// RetryJoinMaxAttemptsLAN specifies the maximum number of times to retry
 	// joining a host on startup. This is useful for cases where we know the
 	// node will be online eventually.
@@ -949,6 +986,16 @@ type RuntimeConfig struct {
 	// flag: -retry-max int
 	RetryJoinMaxAttemptsLAN int
 
+	// RetryJoinMaxAttemptsTotal specifies the maximum number of times to
+	// retry joining on startup across both the LAN and WAN joins. Once it is
+	// used up both give up, even if their own maximums haven't been reached.
+	// This is useful when startup has a single overall retry budget. If 0,
+	// only RetryJoinMaxAttemptsLAN and RetryJoinMaxAttemptsWAN apply.
+	//
+	// hcl: retry_max_total = int
+	// flag: -retry-max-total int
+	RetryJoinMaxAttemptsTotal int
+
 	// RetryJoinMaxAttemptsWAN specifies the maximum number of times to retry
 	// joining a host on startup. This is useful for cases where we know the
 	// node will be online eventually.
@@ -957,6 +1004,29 @@ type RuntimeConfig struct {
 	// flag: -retry-max-wan int
 	RetryJoinMaxAttemptsWAN int
 
+	// RetryJoinMinServers is the minimum number of agents a LAN retry join
+	// must sync with to be considered complete. An attempt that syncs with
+	// fewer is retried. If 0, any successful join is enough.
+	//
+	// hcl: retry_join_min_servers = int
+	RetryJoinMinServers int
+
+	// RetryJoinShuffle randomizes the order of the discovered and configured
+	// addresses on each retry join attempt, so that agents bootstrapping at
+	// the same time don't all contact the same first few servers.
+	//
+	// hcl: retry_join_shuffle = (true|false)
+	RetryJoinShuffle bool
+
+	// RetryJoinVerifyTimeout enables checking that a successful LAN retry
+	// join connected the agent to at least one alive server other than
+	// itself. The check is repeated for up to this long after each join and
+	// the join is retried if no server is seen. If 0, the default, a join
+	// that serf accepts is considered successful.
+	//
+	// hcl: retry_join_verify_timeout = "duration"
+	RetryJoinVerifyTimeout time.Duration
+
 	// RetryJoinWAN is a list of addresses and/or go-discover expressions to
 	// join -wan with retry enabled. See
 	// https://www.consul.io/docs/agent/options.html#cloud-auto-joining for
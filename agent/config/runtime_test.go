@@ -624,6 +624,17 @@ func TestConfigFlagsAndEdgecases(t *testing.T) {
 				rt.DataDir = dataDir
 			},
 		},
+		{
+			desc: "-retry-max-total",
+			args: []string{
+				`-retry-max-total=1`,
+				`-data-dir=` + dataDir,
+			},
+			patch: func(rt *RuntimeConfig) {
+				rt.RetryJoinMaxAttemptsTotal = 1
+				rt.DataDir = dataDir
+			},
+		},
 		{
 			desc: "-retry-max-wan",
 			args: []string{
@@ -2952,6 +2963,7 @@ func TestFullConfig(t *testing.T) {
 					"LeafCertTTL": "1h"
 				},
 				"enabled": true,
+				"leaf_token_check_interval": "37s",
 				"proxy_defaults": {
 					"exec_mode": "script",
 					"daemon_command": ["consul", "connect", "proxy"],
@@ -3064,8 +3076,16 @@ func TestFullConfig(t *testing.T) {
 			"retry_interval": "8067s",
 			"retry_interval_wan": "28866s",
 			"retry_join": [ "pbsSFY7U", "l0qLtWij" ],
+			"retry_join_fail_fast": true,
+			"retry_join_hints": true,
+			"retry_join_log_json": true,
+			"retry_join_max_addrs_per_attempt": 19,
+			"retry_join_min_servers": 7,
+			"retry_join_shuffle": true,
+			"retry_join_verify_timeout": "41s",
 			"retry_join_wan": [ "PFsR02Ye", "rJdQIhER" ],
 			"retry_max": 913,
+			"retry_max_total": 3014,
 			"retry_max_wan": 23160,
 			"segment": "BC2NhTDi",
 			"segments": [
@@ -3498,6 +3518,7 @@ func TestFullConfig(t *testing.T) {
 					leaf_cert_ttl = "1h"
 				}
 				enabled = true
+				leaf_token_check_interval = "37s"
 				proxy_defaults {
 					exec_mode = "script"
 					daemon_command = ["consul", "connect", "proxy"]
@@ -3612,8 +3633,16 @@ func TestFullConfig(t *testing.T) {
 			retry_interval = "8067s"
 			retry_interval_wan = "28866s"
 			retry_join = [ "pbsSFY7U", "l0qLtWij" ]
+			retry_join_fail_fast = true
+			retry_join_hints = true
+			retry_join_log_json = true
+			retry_join_max_addrs_per_attempt = 19
+			retry_join_min_servers = 7
+			retry_join_shuffle = true
+			retry_join_verify_timeout = "41s"
 			retry_join_wan = [ "PFsR02Ye", "rJdQIhER" ]
 			retry_max = 913
+			retry_max_total = 3014
 			retry_max_wan = 23160
 			segment = "BC2NhTDi"
 			segments = [
@@ -4151,6 +4180,7 @@ func TestFullConfig(t *testing.T) {
 			"RotationPeriod": "90h",
 			"LeafCertTTL":    "1h",
 		},
+		ConnectLeafTokenCheckInterval:           37 * time.Second,
 		ConnectProxyAllowManagedRoot:            false,
 		ConnectProxyAllowManagedAPIRegistration: false,
 		ConnectProxyDefaultExecMode:             "script",
@@ -4229,11 +4259,19 @@ func TestFullConfig(t *testing.T) {
 		ReconnectTimeoutLAN:              23739 * time.Second,
 		ReconnectTimeoutWAN:              26694 * time.Second,
 		RejoinAfterLeave:                 true,
+		RetryJoinFailFast:                true,
+		RetryJoinHints:                   true,
 		RetryJoinIntervalLAN:             8067 * time.Second,
 		RetryJoinIntervalWAN:             28866 * time.Second,
 		RetryJoinLAN:                     []string{"pbsSFY7U", "l0qLtWij"},
+		RetryJoinLogJSON:                 true,
+		RetryJoinMaxAddrsPerAttempt:      19,
 		RetryJoinMaxAttemptsLAN:          913,
+		RetryJoinMaxAttemptsTotal:        3014,
 		RetryJoinMaxAttemptsWAN:          23160,
+		RetryJoinMinServers:              7,
+		RetryJoinShuffle:                 true,
+		RetryJoinVerifyTimeout:           41 * time.Second,
 		RetryJoinWAN:                     []string{"PFsR02Ye", "rJdQIhER"},
 		SegmentName:                      "BC2NhTDi",
 		Segments: []structs.NetworkSegment{
@@ -4915,6 +4953,7 @@ func TestSanitize(t *testing.T) {
 		"ConnectCAConfig": {},
 		"ConnectCAProvider": "",
 		"ConnectEnabled": false,
+		"ConnectLeafTokenCheckInterval": "0s",
 		"ConnectProxyAllowManagedAPIRegistration": false,
 		"ConnectProxyAllowManagedRoot": false,
 		"ConnectProxyBindMaxPort": 0,
@@ -5027,13 +5066,21 @@ func TestSanitize(t *testing.T) {
 		"ReconnectTimeoutLAN": "0s",
 		"ReconnectTimeoutWAN": "0s",
 		"RejoinAfterLeave": false,
+		"RetryJoinFailFast": false,
+		"RetryJoinHints": false,
 		"RetryJoinIntervalLAN": "0s",
 		"RetryJoinIntervalWAN": "0s",
 		"RetryJoinLAN": [
 			"foo=bar key=hidden secret=hidden bang=bar"
 		],
+		"RetryJoinLogJSON": false,
+		"RetryJoinMaxAddrsPerAttempt": 0,
 		"RetryJoinMaxAttemptsLAN": 0,
+		"RetryJoinMaxAttemptsTotal": 0,
 		"RetryJoinMaxAttemptsWAN": 0,
+		"RetryJoinMinServers": 0,
+		"RetryJoinShuffle": false,
+		"RetryJoinVerifyTimeout": "0s",
 		"RetryJoinWAN": [
 			"wan_foo=bar wan_key=hidden wan_secret=hidden wan_bang=bar"
 		],
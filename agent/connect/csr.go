@@ -14,8 +14,35 @@ import (
 // CreateCSR returns a CSR to sign the given service along with the PEM-encoded
 // private key for this certificate.
 func CreateCSR(uri CertURI, privateKey crypto.Signer, extensions ...pkix.Extension) (string, error) {
+	return CreateCSRWithSubject(uri, pkix.Name{}, privateKey, extensions...)
+}
+
+// CreateCSRWithSubject is like CreateCSR but also sets the given subject on
+// the CSR, e.g. to carry an Organization for external validators. The CA may
+// not preserve the subject in the signed cert.
+func CreateCSRWithSubject(uri CertURI, subject pkix.Name, privateKey crypto.Signer,
+	extensions ...pkix.Extension) (string, error) {
+	return CreateCSRWithURIs(uri, nil, subject, privateKey, extensions...)
+}
+
+// CreateCSRWithURIs is like CreateCSRWithSubject but also adds the given
+// URIs as SANs after the primary uri, e.g. to request a cert that is valid
+// under more than one trust domain. The CA must permit the extra URIs for
+// them to be in the signed cert.
+func CreateCSRWithURIs(uri CertURI, extraURIs []*url.URL, subject pkix.Name,
+	privateKey crypto.Signer, extensions ...pkix.Extension) (string, error) {
+	return CreateCSRWithSANs(uri, extraURIs, nil, subject, privateKey, extensions...)
+}
+
+// CreateCSRWithSANs is like CreateCSRWithURIs but also adds the given DNS
+// names as SANs, in order. The CA must permit the DNS names for them to be in
+// the signed cert.
+func CreateCSRWithSANs(uri CertURI, extraURIs []*url.URL, dnsNames []string,
+	subject pkix.Name, privateKey crypto.Signer, extensions ...pkix.Extension) (string, error) {
 	template := &x509.CertificateRequest{
-		URIs:               []*url.URL{uri.URI()},
+		Subject:            subject,
+		URIs:               append([]*url.URL{uri.URI()}, extraURIs...),
+		DNSNames:           dnsNames,
 		SignatureAlgorithm: x509.ECDSAWithSHA256,
 		ExtraExtensions:    extensions,
 	}
@@ -0,0 +1,317 @@
+package connect
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/cipher"
+	"crypto/des"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"fmt"
+	"unicode/utf16"
+)
+
+// EncodePKCS12 returns a PKCS#12 (PFX) bundle of the private key and certs,
+// for consumers such as Java and .NET that can't easily use separate PEM
+// files. The first cert must be the one for the key and the rest are its
+// chain. The key is encrypted and the bundle integrity protected with the
+// password, which may be empty.
+//
+// The bundle uses the widely supported pbeWithSHAAnd3-KeyTripleDES-CBC
+// encryption and an HMAC-SHA1 MAC, as OpenSSL and keytool do by default.
+func EncodePKCS12(key crypto.Signer, certs []*x509.Certificate, password string) ([]byte, error) {
+	if len(certs) == 0 {
+		return nil, fmt.Errorf("error encoding PKCS#12 bundle: no certificates")
+	}
+	pw := bmpString(password)
+
+	// The key and its cert are linked by a local key ID attribute.
+	keyID := sha1.Sum(certs[0].Raw)
+	keyIDAttrs, err := pkcs12LocalKeyIDAttrs(keyID[:])
+	if err != nil {
+		return nil, err
+	}
+
+	// Certs are stored unencrypted since they're public.
+	var certBags []pkcs12SafeBag
+	for i, cert := range certs {
+		bag, err := asn1.Marshal(pkcs12CertBag{ID: oidCertTypeX509, Data: cert.Raw})
+		if err != nil {
+			return nil, fmt.Errorf("error encoding PKCS#12 cert: %s", err)
+		}
+		safeBag := pkcs12SafeBag{ID: oidCertBag, Value: pkcs12Explicit(bag)}
+		if i == 0 {
+			safeBag.Attributes = keyIDAttrs
+		}
+		certBags = append(certBags, safeBag)
+	}
+
+	keyBag, err := pkcs12ShroudedKeyBag(key, pw)
+	if err != nil {
+		return nil, err
+	}
+	keyBag.Attributes = keyIDAttrs
+
+	var authSafe []pkcs12ContentInfo
+	for _, bags := range [][]pkcs12SafeBag{certBags, {keyBag}} {
+		ci, err := pkcs12DataContentInfo(bags)
+		if err != nil {
+			return nil, err
+		}
+		authSafe = append(authSafe, ci)
+	}
+	authSafeBytes, err := asn1.Marshal(authSafe)
+	if err != nil {
+		return nil, fmt.Errorf("error encoding PKCS#12 bundle: %s", err)
+	}
+	authSafeContent, err := asn1.Marshal(authSafeBytes)
+	if err != nil {
+		return nil, fmt.Errorf("error encoding PKCS#12 bundle: %s", err)
+	}
+
+	macSalt, err := pkcs12Salt()
+	if err != nil {
+		return nil, err
+	}
+	mac := hmac.New(sha1.New, pkcs12KDF(macSalt, pw, pkcs12Iterations, 3, sha1.Size))
+	mac.Write(authSafeBytes)
+
+	pfx := pkcs12PFX{
+		Version: 3,
+		AuthSafe: pkcs12ContentInfo{
+			ContentType: oidDataContentType,
+			Content:     pkcs12Explicit(authSafeContent),
+		},
+		MacData: pkcs12MacData{
+			Mac: pkcs12DigestInfo{
+				Algorithm: pkix.AlgorithmIdentifier{Algorithm: oidSHA1, Parameters: asn1.NullRawValue},
+				Digest:    mac.Sum(nil),
+			},
+			MacSalt:    macSalt,
+			Iterations: pkcs12Iterations,
+		},
+	}
+	out, err := asn1.Marshal(pfx)
+	if err != nil {
+		return nil, fmt.Errorf("error encoding PKCS#12 bundle: %s", err)
+	}
+	return out, nil
+}
+
+// pkcs12Iterations is the number of KDF iterations for the key encryption
+// and MAC, matching OpenSSL's default.
+const pkcs12Iterations = 2048
+
+var (
+	oidDataContentType            = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 7, 1}
+	oidPKCS8ShroudedKeyBag        = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 12, 10, 1, 2}
+	oidCertBag                    = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 12, 10, 1, 3}
+	oidCertTypeX509               = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 22, 1}
+	oidLocalKeyID                 = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 21}
+	oidPBEWithSHAAnd3KeyTripleDES = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 12, 1, 3}
+	oidSHA1                       = asn1.ObjectIdentifier{1, 3, 14, 3, 2, 26}
+)
+
+// The ASN.1 structures of RFC 7292.
+type pkcs12PFX struct {
+	Version  int
+	AuthSafe pkcs12ContentInfo
+	MacData  pkcs12MacData `asn1:"optional"`
+}
+
+type pkcs12ContentInfo struct {
+	ContentType asn1.ObjectIdentifier
+	Content     asn1.RawValue `asn1:"tag:0,explicit,optional"`
+}
+
+type pkcs12MacData struct {
+	Mac        pkcs12DigestInfo
+	MacSalt    []byte
+	Iterations int `asn1:"optional,default:1"`
+}
+
+type pkcs12DigestInfo struct {
+	Algorithm pkix.AlgorithmIdentifier
+	Digest    []byte
+}
+
+type pkcs12SafeBag struct {
+	ID         asn1.ObjectIdentifier
+	Value      asn1.RawValue     `asn1:"tag:0,explicit"`
+	Attributes []pkcs12Attribute `asn1:"set,optional"`
+}
+
+type pkcs12Attribute struct {
+	ID    asn1.ObjectIdentifier
+	Value asn1.RawValue `asn1:"set"`
+}
+
+type pkcs12CertBag struct {
+	ID   asn1.ObjectIdentifier
+	Data []byte `asn1:"tag:0,explicit"`
+}
+
+type pkcs12EncryptedPrivateKeyInfo struct {
+	Algorithm     pkix.AlgorithmIdentifier
+	EncryptedData []byte
+}
+
+type pkcs12PBEParams struct {
+	Salt       []byte
+	Iterations int
+}
+
+// pkcs12Explicit wraps the DER value in the [0] EXPLICIT tag the structures
+// use for their contents. The asn1 package marshals a RawValue as is, so the
+// tag has to be added by hand.
+func pkcs12Explicit(der []byte) asn1.RawValue {
+	return asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 0, IsCompound: true, Bytes: der}
+}
+
+// pkcs12LocalKeyIDAttrs returns the bag attributes setting the local key ID.
+func pkcs12LocalKeyIDAttrs(id []byte) ([]pkcs12Attribute, error) {
+	value, err := asn1.Marshal(id)
+	if err != nil {
+		return nil, fmt.Errorf("error encoding PKCS#12 local key ID: %s", err)
+	}
+	return []pkcs12Attribute{{
+		ID:    oidLocalKeyID,
+		Value: asn1.RawValue{Tag: asn1.TagSet, IsCompound: true, Bytes: value},
+	}}, nil
+}
+
+// pkcs12ShroudedKeyBag returns a bag of the PKCS#8 private key encrypted with
+// the BMP-encoded password.
+func pkcs12ShroudedKeyBag(key crypto.Signer, pw []byte) (pkcs12SafeBag, error) {
+	var bag pkcs12SafeBag
+	pkcs8, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return bag, fmt.Errorf("error encoding PKCS#12 private key: %s", err)
+	}
+
+	salt, err := pkcs12Salt()
+	if err != nil {
+		return bag, err
+	}
+	params, err := asn1.Marshal(pkcs12PBEParams{Salt: salt, Iterations: pkcs12Iterations})
+	if err != nil {
+		return bag, fmt.Errorf("error encoding PKCS#12 private key: %s", err)
+	}
+	encrypted, err := pkcs12Encrypt(pkcs8, salt, pw, pkcs12Iterations)
+	if err != nil {
+		return bag, err
+	}
+	value, err := asn1.Marshal(pkcs12EncryptedPrivateKeyInfo{
+		Algorithm: pkix.AlgorithmIdentifier{
+			Algorithm:  oidPBEWithSHAAnd3KeyTripleDES,
+			Parameters: asn1.RawValue{FullBytes: params},
+		},
+		EncryptedData: encrypted,
+	})
+	if err != nil {
+		return bag, fmt.Errorf("error encoding PKCS#12 private key: %s", err)
+	}
+
+	bag.ID = oidPKCS8ShroudedKeyBag
+	bag.Value = pkcs12Explicit(value)
+	return bag, nil
+}
+
+// pkcs12DataContentInfo returns an unencrypted content info holding the bags.
+func pkcs12DataContentInfo(bags []pkcs12SafeBag) (pkcs12ContentInfo, error) {
+	var ci pkcs12ContentInfo
+	safeContents, err := asn1.Marshal(bags)
+	if err != nil {
+		return ci, fmt.Errorf("error encoding PKCS#12 bags: %s", err)
+	}
+	data, err := asn1.Marshal(safeContents)
+	if err != nil {
+		return ci, fmt.Errorf("error encoding PKCS#12 bags: %s", err)
+	}
+	ci.ContentType = oidDataContentType
+	ci.Content = pkcs12Explicit(data)
+	return ci, nil
+}
+
+// pkcs12Encrypt encrypts the data with pbeWithSHAAnd3-KeyTripleDES-CBC.
+func pkcs12Encrypt(data, salt, pw []byte, iterations int) ([]byte, error) {
+	block, err := des.NewTripleDESCipher(pkcs12KDF(salt, pw, iterations, 1, 24))
+	if err != nil {
+		return nil, fmt.Errorf("error encrypting PKCS#12 private key: %s", err)
+	}
+	iv := pkcs12KDF(salt, pw, iterations, 2, block.BlockSize())
+
+	// PKCS#7 padding, which always adds at least one byte.
+	pad := block.BlockSize() - len(data)%block.BlockSize()
+	out := append(append([]byte(nil), data...), bytes.Repeat([]byte{byte(pad)}, pad)...)
+	cipher.NewCBCEncrypter(block, iv).CryptBlocks(out, out)
+	return out, nil
+}
+
+// pkcs12KDF derives size bytes of key material for the given purpose (1 for
+// encryption keys, 2 for IVs and 3 for MAC keys) using the SHA-1 based KDF of
+// RFC 7292 appendix B.
+func pkcs12KDF(salt, pw []byte, iterations int, id byte, size int) []byte {
+	const u, v = sha1.Size, 64
+
+	// fill repeats b to the next multiple of v bytes.
+	fill := func(b []byte) []byte {
+		out := make([]byte, v*((len(b)+v-1)/v))
+		for i := range out {
+			out[i] = b[i%len(b)]
+		}
+		return out
+	}
+
+	d := bytes.Repeat([]byte{id}, v)
+	i := append(fill(salt), fill(pw)...)
+	var out []byte
+	for {
+		h := sha1.New()
+		h.Write(d)
+		h.Write(i)
+		a := h.Sum(nil)
+		for n := 1; n < iterations; n++ {
+			sum := sha1.Sum(a)
+			a = sum[:]
+		}
+		out = append(out, a...)
+		if len(out) >= size {
+			return out[:size]
+		}
+
+		// Each v byte block of i becomes (block + b + 1) mod 2^(v*8).
+		b := fill(a[:u])
+		for j := 0; j < len(i); j += v {
+			carry := 1
+			for k := v - 1; k >= 0; k-- {
+				carry += int(i[j+k]) + int(b[k])
+				i[j+k] = byte(carry)
+				carry >>= 8
+			}
+		}
+	}
+}
+
+// pkcs12Salt returns a random salt.
+func pkcs12Salt() ([]byte, error) {
+	salt := make([]byte, 8)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, fmt.Errorf("error generating PKCS#12 salt: %s", err)
+	}
+	return salt, nil
+}
+
+// bmpString returns the password as a NUL-terminated big-endian UTF-16
+// string, as PKCS#12 requires.
+func bmpString(s string) []byte {
+	var out []byte
+	for _, c := range utf16.Encode([]rune(s)) {
+		out = append(out, byte(c>>8), byte(c))
+	}
+	return append(out, 0, 0)
+}
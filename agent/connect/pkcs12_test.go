@@ -0,0 +1,71 @@
+package connect
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestEncodePKCS12(t *testing.T) {
+	require := require.New(t)
+
+	ca := TestCA(t, nil)
+	leafPEM, keyPEM := TestLeaf(t, "web", ca)
+	key, err := ParseSigner(keyPEM)
+	require.NoError(err)
+	certs, err := ParseCerts(leafPEM + ca.RootCert)
+	require.NoError(err)
+	require.Len(certs, 2)
+
+	for _, password := range []string{"", "hunter2", "pässwörd"} {
+		bundle, err := EncodePKCS12(key, certs, password)
+		require.NoError(err)
+
+		gotKey, gotCerts := TestDecodePKCS12(t, bundle, password)
+		require.Equal(key.Public(), gotKey.Public())
+		require.Len(gotCerts, 2)
+		require.Equal(certs[0].Raw, gotCerts[0].Raw)
+		require.Equal(certs[1].Raw, gotCerts[1].Raw)
+	}
+
+	_, err = EncodePKCS12(key, nil, "")
+	require.Error(err)
+}
+
+// Test that OpenSSL can read the bundle, as a check on the encoding beyond
+// our own decoder.
+func TestEncodePKCS12_openssl(t *testing.T) {
+	if !hasOpenSSL {
+		t.Skip("openssl not found")
+		return
+	}
+
+	require := require.New(t)
+
+	ca := TestCA(t, nil)
+	leafPEM, keyPEM := TestLeaf(t, "web", ca)
+	key, err := ParseSigner(keyPEM)
+	require.NoError(err)
+	certs, err := ParseCerts(leafPEM + ca.RootCert)
+	require.NoError(err)
+	bundle, err := EncodePKCS12(key, certs, "hunter2")
+	require.NoError(err)
+
+	td, err := ioutil.TempDir("", "consul")
+	require.NoError(err)
+	defer os.RemoveAll(td)
+	require.NoError(ioutil.WriteFile(filepath.Join(td, "leaf.p12"), bundle, 0644))
+
+	cmd := exec.Command("openssl", "pkcs12", "-in", "leaf.p12", "-passin", "pass:hunter2", "-nodes")
+	cmd.Dir = td
+	out, err := cmd.CombinedOutput()
+	require.NoError(err, string(out))
+	require.Contains(string(out), strings.TrimSpace(leafPEM))
+	require.Contains(string(out), strings.TrimSpace(ca.RootCert))
+	require.Contains(string(out), "PRIVATE KEY")
+}
@@ -0,0 +1,99 @@
+package connect
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/cipher"
+	"crypto/des"
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/x509"
+	"encoding/asn1"
+
+	"github.com/mitchellh/go-testing-interface"
+)
+
+// TestDecodePKCS12 decodes a bundle created by EncodePKCS12, verifying its
+// MAC with the password, and returns the private key and certs in the order
+// they were given. It only supports the algorithms EncodePKCS12 uses.
+func TestDecodePKCS12(t testing.T, data []byte, password string) (crypto.Signer, []*x509.Certificate) {
+	pw := bmpString(password)
+
+	var pfx pkcs12PFX
+	testUnmarshal(t, data, &pfx)
+	if pfx.Version != 3 || !pfx.AuthSafe.ContentType.Equal(oidDataContentType) {
+		t.Fatalf("unexpected PKCS#12 version %d or content type %s", pfx.Version, pfx.AuthSafe.ContentType)
+	}
+	var authSafeBytes []byte
+	testUnmarshal(t, pfx.AuthSafe.Content.Bytes, &authSafeBytes)
+
+	mac := hmac.New(sha1.New, pkcs12KDF(pfx.MacData.MacSalt, pw, pfx.MacData.Iterations, 3, sha1.Size))
+	mac.Write(authSafeBytes)
+	if !hmac.Equal(mac.Sum(nil), pfx.MacData.Mac.Digest) {
+		t.Fatalf("PKCS#12 MAC doesn't match")
+	}
+
+	var authSafe []pkcs12ContentInfo
+	testUnmarshal(t, authSafeBytes, &authSafe)
+
+	var key crypto.Signer
+	var certs []*x509.Certificate
+	for _, ci := range authSafe {
+		var safeContents []byte
+		testUnmarshal(t, ci.Content.Bytes, &safeContents)
+		var bags []pkcs12SafeBag
+		testUnmarshal(t, safeContents, &bags)
+
+		for _, bag := range bags {
+			switch {
+			case bag.ID.Equal(oidCertBag):
+				var cb pkcs12CertBag
+				testUnmarshal(t, bag.Value.Bytes, &cb)
+				cert, err := x509.ParseCertificate(cb.Data)
+				if err != nil {
+					t.Fatalf("err: %s", err)
+				}
+				certs = append(certs, cert)
+
+			case bag.ID.Equal(oidPKCS8ShroudedKeyBag):
+				var info pkcs12EncryptedPrivateKeyInfo
+				testUnmarshal(t, bag.Value.Bytes, &info)
+				var params pkcs12PBEParams
+				testUnmarshal(t, info.Algorithm.Parameters.FullBytes, &params)
+
+				block, err := des.NewTripleDESCipher(pkcs12KDF(params.Salt, pw, params.Iterations, 1, 24))
+				if err != nil {
+					t.Fatalf("err: %s", err)
+				}
+				iv := pkcs12KDF(params.Salt, pw, params.Iterations, 2, block.BlockSize())
+				decrypted := make([]byte, len(info.EncryptedData))
+				cipher.NewCBCDecrypter(block, iv).CryptBlocks(decrypted, info.EncryptedData)
+				pad := int(decrypted[len(decrypted)-1])
+				if pad == 0 || pad > block.BlockSize() ||
+					!bytes.Equal(decrypted[len(decrypted)-pad:], bytes.Repeat([]byte{byte(pad)}, pad)) {
+					t.Fatalf("invalid PKCS#12 key padding")
+				}
+
+				pk, err := x509.ParsePKCS8PrivateKey(decrypted[:len(decrypted)-pad])
+				if err != nil {
+					t.Fatalf("err: %s", err)
+				}
+				key = pk.(crypto.Signer)
+
+			default:
+				t.Fatalf("unexpected PKCS#12 bag type %s", bag.ID)
+			}
+		}
+	}
+	return key, certs
+}
+
+func testUnmarshal(t testing.T, data []byte, v interface{}) {
+	rest, err := asn1.Unmarshal(data, v)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if len(rest) > 0 {
+		t.Fatalf("trailing data after %T", v)
+	}
+}
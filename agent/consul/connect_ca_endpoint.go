@@ -297,10 +297,15 @@ func (s *ConnectCA) Roots(
 					RaftIndex:           r.RaftIndex,
 					Active:              r.Active,
 				}
+			}
 
-				if r.Active {
-					reply.ActiveRootID = r.ID
-				}
+			active, count := structs.CARoots(reply.Roots).Active()
+			if active != nil {
+				reply.ActiveRootID = active.ID
+			}
+			if count > 1 {
+				s.srv.logger.Printf("[WARN] connect: %d CA roots are marked active, using the newest: %s",
+					count, active.ID)
 			}
 
 			return nil
@@ -421,6 +426,7 @@ func (s *ConnectCA) Sign(
 		ServiceURI:   cert.URIs[0].String(),
 		ValidAfter:   cert.NotBefore,
 		ValidBefore:  cert.NotAfter,
+		SignedBy:     s.srv.config.NodeName,
 		RaftIndex: structs.RaftIndex{
 			ModifyIndex: modIdx,
 			CreateIndex: modIdx,
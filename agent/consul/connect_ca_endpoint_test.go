@@ -334,6 +334,7 @@ func TestConnectCASign(t *testing.T) {
 	// Verify other fields
 	assert.Equal("web", reply.Service)
 	assert.Equal(spiffeId.URI().String(), reply.ServiceURI)
+	assert.Equal(s1.config.NodeName, reply.SignedBy)
 }
 
 func TestConnectCASignValidation(t *testing.T) {
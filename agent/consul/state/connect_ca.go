@@ -251,12 +251,7 @@ func (s *Store) CARootActive(ws memdb.WatchSet) (uint64, *structs.CARoot, error)
 	var result *structs.CARoot
 	idx, roots, err := s.CARoots(ws)
 	if err == nil {
-		for _, r := range roots {
-			if r.Active {
-				result = r
-				break
-			}
-		}
+		result, _ = roots.Active()
 	}
 
 	return idx, result, err
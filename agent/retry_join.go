@@ -1,44 +1,134 @@
 package agent
 
 import (
+	"encoding/json"
 	"fmt"
+	"io/ioutil"
 	"log"
+	"math/rand"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
+	"unicode"
 
+	"github.com/hashicorp/consul/agent/config"
 	"github.com/hashicorp/consul/lib"
+	"github.com/hashicorp/consul/lib/file"
 	discover "github.com/hashicorp/go-discover"
 	discoverk8s "github.com/hashicorp/go-discover/provider/k8s"
+	"github.com/hashicorp/go-hclog"
+	"github.com/hashicorp/serf/serf"
 )
 
-func (a *Agent) retryJoinLAN() {
+func (a *Agent) retryJoinLAN(budget *retryJoinBudget) {
 	r := &retryJoiner{
 		cluster:     "LAN",
 		addrs:       a.config.RetryJoinLAN,
 		maxAttempts: a.config.RetryJoinMaxAttemptsLAN,
+		budget:      budget,
 		interval:    a.config.RetryJoinIntervalLAN,
+		shuffle:     a.config.RetryJoinShuffle,
+		minServers:  a.config.RetryJoinMinServers,
+		maxAddrs:    a.config.RetryJoinMaxAddrsPerAttempt,
+		failFast:    a.config.RetryJoinFailFast,
 		join:        a.JoinLAN,
+		status:      a.retryJoinLANStatus,
+		settings:    a.retryJoinSettings,
+		hintsFile:   a.retryJoinHintsFile("lan"),
+		self:        a.config.SerfAdvertiseAddrLAN,
 		logger:      a.logger,
+		structured:  a.retryJoinLogger(),
+	}
+	if timeout := a.config.RetryJoinVerifyTimeout; timeout > 0 {
+		r.verify = a.verifyLANServers
+		r.verifyTimeout = timeout
 	}
 	if err := r.retryJoin(); err != nil {
 		a.retryJoinCh <- err
 	}
 }
 
-func (a *Agent) retryJoinWAN() {
+func (a *Agent) retryJoinWAN(budget *retryJoinBudget) {
 	r := &retryJoiner{
 		cluster:     "WAN",
 		addrs:       a.config.RetryJoinWAN,
 		maxAttempts: a.config.RetryJoinMaxAttemptsWAN,
+		budget:      budget,
 		interval:    a.config.RetryJoinIntervalWAN,
+		shuffle:     a.config.RetryJoinShuffle,
+		maxAddrs:    a.config.RetryJoinMaxAddrsPerAttempt,
+		failFast:    a.config.RetryJoinFailFast,
 		join:        a.JoinWAN,
+		status:      a.retryJoinWANStatus,
+		settings:    a.retryJoinSettings,
+		hintsFile:   a.retryJoinHintsFile("wan"),
+		self:        a.config.SerfAdvertiseAddrWAN,
 		logger:      a.logger,
+		structured:  a.retryJoinLogger(),
 	}
 	if err := r.retryJoin(); err != nil {
 		a.retryJoinCh <- err
 	}
 }
 
+// retryJoinHintsFile returns the file the given cluster's retry join keeps
+// its hints in, or empty if retry_join_hints isn't enabled.
+func (a *Agent) retryJoinHintsFile(cluster string) string {
+	if !a.config.RetryJoinHints || a.config.DataDir == "" {
+		return ""
+	}
+	return filepath.Join(a.config.DataDir, retryJoinHintsDir, cluster+".json")
+}
+
+// verifyLANServers returns an error unless the agent sees at least one alive
+// server other than itself in the LAN pool.
+func (a *Agent) verifyLANServers() error {
+	for _, m := range a.LANMembers() {
+		if m.Name == a.config.NodeName || m.Status != serf.StatusAlive {
+			continue
+		}
+		if m.Tags["role"] == "consul" {
+			return nil
+		}
+	}
+	return fmt.Errorf("no alive servers seen")
+}
+
+// retryJoinLogger returns the logger for structured retry join events, or
+// nil if the agent isn't configured to log them as JSON.
+func (a *Agent) retryJoinLogger() hclog.Logger {
+	if !a.config.RetryJoinLogJSON {
+		return nil
+	}
+
+	// The agent uses "err" where hclog uses "error".
+	level := hclog.LevelFromString(a.config.LogLevel)
+	if strings.EqualFold(a.config.LogLevel, "err") {
+		level = hclog.Error
+	}
+	if level == hclog.NoLevel {
+		level = hclog.Info
+	}
+
+	output := a.LogOutput
+	if output == nil {
+		output = os.Stderr
+	}
+	return hclog.New(&hclog.LoggerOptions{
+		Name:       "agent",
+		Level:      level,
+		Output:     output,
+		JSONFormat: true,
+	})
+}
+
 // retryJoiner is used to handle retrying a join until it succeeds or all
 // retries are exhausted.
 type retryJoiner struct {
@@ -52,16 +142,611 @@ type retryJoiner struct {
 	// maxAttempts is the number of join attempts before giving up.
 	maxAttempts int
 
+	// budget is an optional number of join attempts shared with other
+	// joiners. Once it is used up, every joiner sharing it gives up.
+	budget *retryJoinBudget
+
 	// interval is the time between two join attempts.
 	interval time.Duration
 
+	// settings optionally holds the interval and maxAttempts, replacing the
+	// fields, so that a config reload takes effect on the next attempt.
+	settings *retryJoinSettings
+
+	// failFast returns the error from the first failed attempt rather than
+	// retrying.
+	failFast bool
+
+	// maxAddrs optionally limits how many addresses are passed to join on
+	// each attempt. When there are more, attempts work through them in turn.
+	maxAddrs int
+
+	// shuffle randomizes the order of the addresses passed to join on each
+	// attempt so that load is spread across the servers.
+	shuffle bool
+
 	// join adds the discovered or configured servers to the given
 	// serf cluster.
 	join func([]string) (int, error)
 
+	// batchSize is the most addresses passed to each call to join. If
+	// zero, joinBatchSize is used.
+	batchSize int
+
+	// minServers is the number of agents a join must sync with to be
+	// complete. Joins that sync with fewer are retried.
+	minServers int
+
+	// verify optionally checks that a successful join actually connected
+	// the agent to the cluster, returning an error if not. It is polled
+	// every verifyInterval (default 1s) for up to verifyTimeout after each
+	// join and the join is retried if it never succeeds.
+	verify         func() error
+	verifyTimeout  time.Duration
+	verifyInterval time.Duration
+
+	// hintsFile optionally persists the addresses of the last successful
+	// join. When it has addresses, they're tried once before discovery so
+	// that a restarted agent rejoins the servers it knew quickly. The hint
+	// is advisory and discovery proceeds as usual if joining it fails.
+	hintsFile string
+
+	// status optionally receives the joiner's progress after each attempt.
+	status *retryJoinStatus
+
+	// self is optionally the agent's own serf advertise address. Addresses
+	// of the agent itself, e.g. returned by discovery in an auto-scaling
+	// group, aren't joined since joining ourselves does nothing but still
+	// counts as a synced agent. They're only joined when they're all there
+	// is, as before, so that a single agent listing itself still completes.
+	self *net.TCPAddr
+
+	// lookupHost resolves hostnames to check them against self. If nil,
+	// net.LookupHost is used.
+	lookupHost func(host string) ([]string, error)
+
 	// logger is the agent logger. Log messages should contain the
 	// "agent: " prefix.
 	logger *log.Logger
+
+	// structured optionally receives retry join events as key/value fields
+	// instead of the free-form lines written to logger.
+	structured hclog.Logger
+
+	// providers optionally replaces the go-discover providers used to
+	// resolve "provider=" addresses. This is only set in tests.
+	providers map[string]discover.Provider
+
+	// credential optionally returns the token to discover servers with,
+	// e.g. a bootstrap token fetched from a secrets API. It's given to the
+	// joinCredentialProviders entries that don't set a token themselves.
+	// Its result is reused for credentialTTL (default joinCredentialTTL)
+	// and a failure fails discovery for those entries, which is retried
+	// like any other discovery failure.
+	credential    func() (string, error)
+	credentialTTL time.Duration
+
+	// token and tokenExpires cache the last token returned by credential.
+	token        string
+	tokenExpires time.Time
+}
+
+// joinCredentialProviders are the go-discover providers that are given the
+// retryJoiner's credential as their token.
+var joinCredentialProviders = map[string]bool{
+	"consul": true,
+	"hcp":    true,
+	"kv":     true,
+}
+
+// joinCredentialTTL is the default for how long a token returned by a
+// retryJoiner's credential func is reused.
+const joinCredentialTTL = 30 * time.Second
+
+// joinCredential returns the token to discover servers with, calling the
+// credential func unless the last token is still fresh.
+func (r *retryJoiner) joinCredential() (string, error) {
+	if time.Now().Before(r.tokenExpires) {
+		return r.token, nil
+	}
+	token, err := r.credential()
+	if err != nil {
+		return "", fmt.Errorf("failed fetching join credential: %s", err)
+	}
+	ttl := r.credentialTTL
+	if ttl <= 0 {
+		ttl = joinCredentialTTL
+	}
+	r.token, r.tokenExpires = token, time.Now().Add(ttl)
+	return token, nil
+}
+
+// retryJoinSettings holds the retry join settings that a config reload can
+// change while the joiners are running.
+type retryJoinSettings struct {
+	lock           sync.RWMutex
+	intervalLAN    time.Duration
+	intervalWAN    time.Duration
+	maxAttemptsLAN int
+	maxAttemptsWAN int
+}
+
+// newRetryJoinSettings returns the settings from the given config.
+func newRetryJoinSettings(conf *config.RuntimeConfig) *retryJoinSettings {
+	s := &retryJoinSettings{}
+	s.update(conf)
+	return s
+}
+
+// update sets the settings from the given config.
+func (s *retryJoinSettings) update(conf *config.RuntimeConfig) {
+	if s == nil {
+		return
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.intervalLAN = conf.RetryJoinIntervalLAN
+	s.intervalWAN = conf.RetryJoinIntervalWAN
+	s.maxAttemptsLAN = conf.RetryJoinMaxAttemptsLAN
+	s.maxAttemptsWAN = conf.RetryJoinMaxAttemptsWAN
+}
+
+// get returns the interval and max attempts for the given cluster.
+func (s *retryJoinSettings) get(cluster string) (time.Duration, int) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	if cluster == "WAN" {
+		return s.intervalWAN, s.maxAttemptsWAN
+	}
+	return s.intervalLAN, s.maxAttemptsLAN
+}
+
+// retryJoinBudget is a number of join retries shared between joiners so that
+// they give up together once the total has been used, regardless of their
+// own maxAttempts.
+type retryJoinBudget struct {
+	remaining int64
+}
+
+// newRetryJoinBudget returns a budget of the given number of retries, or nil
+// if attempts is 0 which means the joiners only use their own limits.
+func newRetryJoinBudget(attempts int) *retryJoinBudget {
+	if attempts <= 0 {
+		return nil
+	}
+	return &retryJoinBudget{remaining: int64(attempts)}
+}
+
+// take uses up one retry and returns false if there were none left.
+func (b *retryJoinBudget) take() bool {
+	return atomic.AddInt64(&b.remaining, -1) >= 0
+}
+
+// retryJoinStatus is the progress of a retryJoiner. It's written by the
+// joiner and can be read concurrently, e.g. to report a join that is stuck
+// retrying.
+type retryJoinStatus struct {
+	lock sync.RWMutex
+	cur  retryJoinSnapshot
+}
+
+// retryJoinSnapshot is a point in time copy of a retryJoinStatus.
+type retryJoinSnapshot struct {
+	// Attempts is the number of join attempts made so far.
+	Attempts int
+
+	// LastError is the error from the most recent failed attempt, or empty
+	// once the join has succeeded.
+	LastError string
+
+	// Joined is true once an attempt has succeeded.
+	Joined bool
+}
+
+// update records the result of the given attempt.
+func (s *retryJoinStatus) update(attempt int, err error) {
+	if s == nil {
+		return
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.cur.Attempts = attempt
+	if err != nil {
+		s.cur.LastError = err.Error()
+	} else {
+		s.cur.LastError = ""
+		s.cur.Joined = true
+	}
+}
+
+// snapshot returns a copy of the current status.
+func (s *retryJoinStatus) snapshot() retryJoinSnapshot {
+	if s == nil {
+		return retryJoinSnapshot{}
+	}
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	return s.cur
+}
+
+// addStats adds the snapshot to the given agent stats section with the keys
+// prefixed by the cluster name.
+func (s retryJoinSnapshot) addStats(stats map[string]string, cluster string) {
+	stats[cluster+"_attempts"] = strconv.Itoa(s.Attempts)
+	stats[cluster+"_last_error"] = s.LastError
+	stats[cluster+"_joined"] = strconv.FormatBool(s.Joined)
+}
+
+// joinAddr is an address to join along with where it came from, so that
+// failures can be attributed to the configuration that produced them.
+type joinAddr struct {
+	addr string
+
+	// source is the sanitized go-discover configuration the address was
+	// discovered with, or empty if the address was configured statically.
+	source string
+}
+
+func (a joinAddr) String() string {
+	if a.source == "" {
+		return a.addr + " (static)"
+	}
+	return fmt.Sprintf("%s (%s)", a.addr, a.source)
+}
+
+// joinAddrSeparator separates multiple provider configurations or addresses
+// given in a single retry join entry, for tools that can only generate one.
+const joinAddrSeparator = ";;"
+
+// splitJoinAddrs returns the retry join entries with any that combine several
+// configurations using joinAddrSeparator split into one entry each.
+func splitJoinAddrs(addrs []string) []string {
+	out := make([]string, 0, len(addrs))
+	for _, addr := range addrs {
+		for _, part := range strings.Split(addr, joinAddrSeparator) {
+			if part = strings.TrimSpace(part); part != "" {
+				out = append(out, part)
+			}
+		}
+	}
+	return out
+}
+
+// limitJoinAddrs returns max of the addresses starting at the start'th in
+// address order, wrapping around, along with where the following call should
+// start. Sorting keeps the turns stable when discovery returns the addresses
+// in a different order each time.
+func limitJoinAddrs(addrs []joinAddr, max, start int) ([]joinAddr, int) {
+	sort.Slice(addrs, func(i, j int) bool { return addrs[i].addr < addrs[j].addr })
+	start = start % len(addrs)
+	out := make([]joinAddr, 0, max)
+	for i := 0; i < max; i++ {
+		out = append(out, addrs[(start+i)%len(addrs)])
+	}
+	return out, (start + max) % len(addrs)
+}
+
+// joinBatchSize is the default for the most addresses passed to each call to
+// join, so that very large discovered lists don't make a single huge join.
+const joinBatchSize = 256
+
+// joinBatches joins the addresses in batches of batchSize, stopping as soon
+// as a batch succeeds and the agents synced with so far reach minServers. It
+// returns how many agents were synced with, or the error from the last
+// failed batch if none succeeded.
+func (r *retryJoiner) joinBatches(attempt int, addrs []joinAddr) (int, error) {
+	size := r.batchSize
+	if size <= 0 {
+		size = joinBatchSize
+	}
+
+	synced, joined := 0, false
+	var lastErr error
+	for start := 0; start < len(addrs); start += size {
+		end := start + size
+		if end > len(addrs) {
+			end = len(addrs)
+		}
+		batch := addrs[start:end]
+
+		n, err := r.join(joinAddrStrings(batch))
+		if err != nil {
+			annotated := make([]string, 0, len(batch))
+			for _, a := range batch {
+				annotated = append(annotated, a.String())
+			}
+			r.logEvent(hclog.Warn, "join failed for addresses", []interface{}{"attempt", attempt, "addresses", annotated},
+				"[WARN] agent: Join %s failed for addresses: %s", r.cluster, strings.Join(annotated, ", "))
+			lastErr = err
+			continue
+		}
+
+		synced += n
+		joined = true
+		if synced >= r.minServers {
+			break
+		}
+	}
+	if !joined {
+		return 0, lastErr
+	}
+	return synced, nil
+}
+
+// joinAddrStrings returns the bare addresses to pass to join.
+func joinAddrStrings(addrs []joinAddr) []string {
+	out := make([]string, 0, len(addrs))
+	for _, a := range addrs {
+		out = append(out, a.addr)
+	}
+	return out
+}
+
+// sanitizeProviderConfig returns the go-discover configuration with the
+// values of any secret fields hidden so that it is safe to log.
+func sanitizeProviderConfig(cfg string) string {
+	args, err := discover.Parse(cfg)
+	if err != nil {
+		return "provider=unknown"
+	}
+	for k := range args {
+		lk := strings.ToLower(k)
+		if strings.Contains(lk, "key") || strings.Contains(lk, "token") || strings.Contains(lk, "secret") {
+			args[k] = "hidden"
+		}
+	}
+	return args.String()
+}
+
+// isJoinURL returns true if the retry join entry is a URL such as
+// "https://10.0.0.1:8501" rather than a serf address or a go-discover
+// configuration.
+func isJoinURL(addr string) bool {
+	return strings.Contains(addr, "://") && !strings.Contains(addr, "provider=")
+}
+
+// joinURLConfig returns the go-discover configuration for a retry join URL.
+// The URL is the HTTP API of an agent to discover the servers from using the
+// consul provider: "http://" and "https://" give the scheme and "consul://"
+// is plain HTTP on the default HTTP port. Query parameters are passed on as
+// provider settings, e.g. "https://10.0.0.1:8501?token=...".
+func joinURLConfig(addr string) (string, error) {
+	u, err := url.Parse(addr)
+	if err != nil {
+		// The error includes the URL, which may hold a token.
+		return "", fmt.Errorf("invalid retry join URL")
+	}
+
+	host := u.Host
+	var scheme string
+	switch u.Scheme {
+	case "http", "https":
+		scheme = u.Scheme
+	case "consul":
+		scheme = "http"
+		if u.Port() == "" && u.Hostname() != "" {
+			host = net.JoinHostPort(u.Hostname(), "8500")
+		}
+	default:
+		return "", fmt.Errorf("unsupported retry join URL scheme %q", u.Scheme)
+	}
+	if u.Hostname() == "" {
+		return "", fmt.Errorf("retry join URL with scheme %q has no host", u.Scheme)
+	}
+	if u.Path != "" && u.Path != "/" {
+		return "", fmt.Errorf("retry join URL for %s can't have a path", host)
+	}
+
+	args := map[string]string{}
+	for k, vs := range u.Query() {
+		args[k] = vs[len(vs)-1]
+	}
+	args["provider"] = "consul"
+	args["address"] = host
+	args["scheme"] = scheme
+
+	// discover.Config.String doesn't quote values containing "=", such as
+	// filters, so format it here.
+	keys := make([]string, 0, len(args))
+	for k := range args {
+		if k != "provider" {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	parts := []string{"provider=consul"}
+	for _, k := range keys {
+		if args[k] != "" {
+			parts = append(parts, quoteDiscoverValue(k)+"="+quoteDiscoverValue(args[k]))
+		}
+	}
+	return strings.Join(parts, " "), nil
+}
+
+// quoteDiscoverValue quotes a go-discover key or value if it needs to be.
+func quoteDiscoverValue(s string) string {
+	if strings.ContainsAny(s, ` "\=`) {
+		return strconv.Quote(s)
+	}
+	return s
+}
+
+// parsedJoinAddr is a retry join entry parsed by parseJoinAddr. Either config
+// or addr is set.
+type parsedJoinAddr struct {
+	// config is the go-discover configuration to discover the addresses to
+	// join with and provider is the provider it names. A retry join URL is
+	// given as the configuration it stands for.
+	config   string
+	provider string
+
+	// addr is the static address to join, as a host or host:port.
+	addr string
+}
+
+func (p parsedJoinAddr) String() string {
+	if p.config != "" {
+		return p.config
+	}
+	return p.addr
+}
+
+// parseJoinAddr parses a retry join entry, which is a go-discover
+// configuration, a retry join URL or a static address. Static addresses are
+// checked and normalized: a port must be valid, and the brackets of an IPv6
+// address without a port are dropped so that it's recognized like one with
+// a port. Errors for configurations don't include them since they may hold
+// secrets.
+func parseJoinAddr(s string) (parsedJoinAddr, error) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return parsedJoinAddr{}, fmt.Errorf("empty retry join address")
+	}
+
+	if isJoinURL(s) {
+		cfg, err := joinURLConfig(s)
+		if err != nil {
+			return parsedJoinAddr{}, err
+		}
+		s = cfg
+	}
+	if strings.Contains(s, "provider=") {
+		args, err := discover.Parse(s)
+		if err != nil {
+			return parsedJoinAddr{}, fmt.Errorf("invalid retry join configuration: %s", err)
+		}
+		if args["provider"] == "" {
+			return parsedJoinAddr{}, fmt.Errorf("retry join configuration has no provider")
+		}
+		return parsedJoinAddr{config: s, provider: args["provider"]}, nil
+	}
+
+	if strings.IndexFunc(s, func(r rune) bool { return unicode.IsSpace(r) || !unicode.IsPrint(r) }) >= 0 {
+		return parsedJoinAddr{}, fmt.Errorf("retry join address %q is invalid", s)
+	}
+	host, port, err := net.SplitHostPort(s)
+	if err == nil && port == "" {
+		return parsedJoinAddr{}, fmt.Errorf("retry join address %q has an invalid port", s)
+	}
+	if err != nil {
+		// Without a port, serf joins on its default port.
+		host, port = s, ""
+		if strings.HasPrefix(host, "[") && strings.HasSuffix(host, "]") {
+			host = host[1 : len(host)-1]
+			if !isJoinIPv6(host) {
+				return parsedJoinAddr{}, fmt.Errorf("retry join address %q is invalid", s)
+			}
+		}
+	}
+	if host == "" || strings.ContainsAny(host, "[]/") || (strings.Contains(host, ":") && !isJoinIPv6(host)) {
+		return parsedJoinAddr{}, fmt.Errorf("retry join address %q is invalid", s)
+	}
+	if port == "" {
+		return parsedJoinAddr{addr: host}, nil
+	}
+	if n, err := strconv.Atoi(port); err != nil || n < 1 || n > 65535 {
+		return parsedJoinAddr{}, fmt.Errorf("retry join address %q has an invalid port", s)
+	}
+	return parsedJoinAddr{addr: net.JoinHostPort(host, port)}, nil
+}
+
+// isJoinIPv6 returns true if the host is an IPv6 address, with an optional
+// zone.
+func isJoinIPv6(host string) bool {
+	if i := strings.LastIndex(host, "%"); i > 0 {
+		host = host[:i]
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && strings.Contains(host, ":")
+}
+
+// discoverMetaProvider is a go-discover provider that can also return the
+// metadata of each address, such as its tags, so that the addresses can be
+// filtered before they are joined.
+type discoverMetaProvider interface {
+	discover.Provider
+	AddrsWithMeta(args map[string]string, l *log.Logger) ([]discoveredAddr, error)
+}
+
+// discoveredAddr is an address found by a discoverMetaProvider.
+type discoveredAddr struct {
+	Addr string
+	Meta map[string]string
+}
+
+// joinFilterKey is the go-discover setting holding the tags discovered
+// addresses must have, e.g. filter="role==consul-server,env==prod".
+const joinFilterKey = "filter"
+
+// parseJoinFilter returns the value each key must have from a filter of
+// comma separated key==value terms.
+func parseJoinFilter(filter string) (map[string]string, error) {
+	out := make(map[string]string)
+	for _, term := range strings.Split(filter, ",") {
+		parts := strings.SplitN(term, "==", 2)
+		if len(parts) != 2 || strings.TrimSpace(parts[0]) == "" {
+			return nil, fmt.Errorf("invalid filter %q: terms must be key==value", filter)
+		}
+		out[strings.TrimSpace(parts[0])] = strings.TrimSpace(parts[1])
+	}
+	return out, nil
+}
+
+// discoverAddrs resolves the go-discover configuration to the addresses to
+// join. If the configuration has a filter and the provider returns metadata,
+// only the addresses whose metadata matches every term are returned.
+// Providers without metadata can't be filtered and return all addresses.
+// Providers that take the joiner's credential are given its token.
+func (r *retryJoiner) discoverAddrs(disco *discover.Discover, providers map[string]discover.Provider, cfg string, l *log.Logger) ([]string, error) {
+	args, err := discover.Parse(cfg)
+	if err != nil {
+		return nil, err
+	}
+	if r.credential != nil && joinCredentialProviders[args["provider"]] && args["token"] == "" {
+		token, err := r.joinCredential()
+		if err != nil {
+			return nil, err
+		}
+		if token != "" {
+			args["token"] = token
+			cfg += " token=" + quoteDiscoverValue(token)
+		}
+	}
+	filter, ok := args[joinFilterKey]
+	if !ok {
+		return disco.Addrs(cfg, l)
+	}
+	terms, err := parseJoinFilter(filter)
+	if err != nil {
+		return nil, err
+	}
+
+	p, ok := providers[args["provider"]].(discoverMetaProvider)
+	if !ok {
+		r.logEvent(hclog.Debug, "retry join filter ignored", []interface{}{"provider", args["provider"]},
+			"[DEBUG] agent: Join %s: provider %q has no metadata, ignoring filter", r.cluster, args["provider"])
+		return disco.Addrs(cfg, l)
+	}
+
+	delete(args, joinFilterKey)
+	found, err := p.AddrsWithMeta(args, l)
+	if err != nil {
+		return nil, err
+	}
+	var addrs []string
+	for _, a := range found {
+		matches := true
+		for k, v := range terms {
+			if a.Meta[k] != v {
+				matches = false
+				break
+			}
+		}
+		if matches {
+			addrs = append(addrs, a.Addr)
+		}
+	}
+	return addrs, nil
 }
 
 func (r *retryJoiner) retryJoin() error {
@@ -70,11 +755,18 @@ func (r *retryJoiner) retryJoin() error {
 	}
 
 	// Copy the default providers, and then add the non-default
-	providers := make(map[string]discover.Provider)
-	for k, v := range discover.Providers {
-		providers[k] = v
+	providers := r.providers
+	if providers == nil {
+		providers = make(map[string]discover.Provider)
+		for k, v := range discover.Providers {
+			providers[k] = v
+		}
+		providers["k8s"] = &k8sDiscoverProvider{pods: &discoverk8s.Provider{}}
+		providers["consul"] = &consulDiscoverProvider{}
+		providers["kv"] = &kvDiscoverProvider{}
+		providers["hcp"] = &hcpDiscoverProvider{}
+		providers["env"] = &envDiscoverProvider{}
 	}
-	providers["k8s"] = &discoverk8s.Provider{}
 
 	disco, err := discover.New(
 		discover.WithUserAgent(lib.UserAgent()),
@@ -84,33 +776,120 @@ func (r *retryJoiner) retryJoin() error {
 		return err
 	}
 
-	r.logger.Printf("[INFO] agent: Retry join %s is supported for: %s", r.cluster, strings.Join(disco.Names(), " "))
-	r.logger.Printf("[INFO] agent: Joining %s cluster...", r.cluster)
+	r.logEvent(hclog.Info, "retry join supported providers", []interface{}{"providers", disco.Names()},
+		"[INFO] agent: Retry join %s is supported for: %s", r.cluster, strings.Join(disco.Names(), " "))
+	r.logEvent(hclog.Info, "joining cluster", nil,
+		"[INFO] agent: Joining %s cluster...", r.cluster)
+
+	// go-discover logs on its own, so have it log as JSON too if the events
+	// are structured.
+	discoLogger := r.logger
+	if r.structured != nil {
+		discoLogger = r.structured.StandardLogger(&hclog.StandardLoggerOptions{InferLevels: true})
+	}
+
+	// Report entries for providers that don't exist once up front, e.g. a
+	// typo, rather than having them fail on every attempt without saying why.
+	entries := make([]parsedJoinAddr, 0, len(r.addrs))
+	for _, addr := range splitJoinAddrs(r.addrs) {
+		entry, err := parseJoinAddr(addr)
+		if err != nil {
+			r.logEvent(hclog.Error, "invalid retry join address", []interface{}{"error", err},
+				"[ERR] agent: Join %s: %s", r.cluster, err)
+			continue
+		}
+		if _, ok := providers[entry.provider]; entry.config != "" && !ok {
+			source := sanitizeProviderConfig(entry.config)
+			r.logEvent(hclog.Error, "unknown retry join provider",
+				[]interface{}{"source", source, "provider", entry.provider, "providers", disco.Names()},
+				"[ERR] agent: Join %s: unknown provider %q in %q, supported providers are: %s",
+				r.cluster, entry.provider, source, strings.Join(disco.Names(), " "))
+			continue
+		}
+		entries = append(entries, entry)
+	}
+
+	if r.joinHints() {
+		return nil
+	}
+
+	// lastDiscovered holds the servers each provider last resolved to, so
+	// that a join can still be attempted while the provider is failing, e.g.
+	// during a cloud API outage.
+	lastDiscovered := make(map[string][]string)
+
+	// nextAddr is where the next attempt starts when limited to maxAddrs.
+	nextAddr := -1
+
 	attempt := 0
 	for {
-		var addrs []string
+		var addrs []joinAddr
 		var err error
+		attempt++
 
-		for _, addr := range r.addrs {
-			switch {
-			case strings.Contains(addr, "provider="):
-				servers, err := disco.Addrs(addr, r.logger)
+		for _, entry := range entries {
+			switch addr := entry.String(); {
+			case entry.config != "":
+				servers, err := r.discoverAddrs(disco, providers, addr, discoLogger)
+				source := sanitizeProviderConfig(addr)
 				if err != nil {
-					r.logger.Printf("[ERR] agent: Join %s: %s", r.cluster, err)
+					r.logEvent(hclog.Error, "discovery failed",
+						[]interface{}{"attempt", attempt, "source", source, "error", err},
+						"[ERR] agent: Join %s: %s", r.cluster, err)
 				} else {
-					addrs = append(addrs, servers...)
-					r.logger.Printf("[INFO] agent: Discovered %s servers: %s", r.cluster, strings.Join(servers, " "))
+					for _, server := range servers {
+						addrs = append(addrs, joinAddr{addr: server, source: source})
+					}
+					r.logEvent(hclog.Info, "discovered servers",
+						[]interface{}{"attempt", attempt, "source", source, "discovered", len(servers), "servers", servers},
+						"[INFO] agent: Discovered %s servers: %s", r.cluster, strings.Join(servers, " "))
+				}
+
+				if len(servers) > 0 {
+					lastDiscovered[addr] = servers
+				} else if last := lastDiscovered[addr]; len(last) > 0 {
+					for _, server := range last {
+						addrs = append(addrs, joinAddr{addr: server, source: source})
+					}
+					r.logEvent(hclog.Warn, "using last discovered servers",
+						[]interface{}{"attempt", attempt, "source", source, "servers", last},
+						"[WARN] agent: Join %s using last discovered servers: %s", r.cluster, strings.Join(last, " "))
 				}
 
 			default:
-				addrs = append(addrs, addr)
+				addrs = append(addrs, joinAddr{addr: addr})
+			}
+		}
+
+		addrs = r.dropSelf(attempt, addrs)
+
+		if r.maxAddrs > 0 && len(addrs) > r.maxAddrs {
+			if nextAddr < 0 {
+				nextAddr = rand.Intn(len(addrs))
 			}
+			addrs, nextAddr = limitJoinAddrs(addrs, r.maxAddrs, nextAddr)
+		}
+
+		if r.shuffle {
+			rand.Shuffle(len(addrs), func(i, j int) {
+				addrs[i], addrs[j] = addrs[j], addrs[i]
+			})
 		}
 
 		if len(addrs) > 0 {
-			n, err := r.join(addrs)
+			var n int
+			n, err = r.joinBatches(attempt, addrs)
+			if err == nil && n < r.minServers {
+				err = fmt.Errorf("synced with %d agents, need at least %d", n, r.minServers)
+			}
 			if err == nil {
-				r.logger.Printf("[INFO] agent: Join %s completed. Synced with %d initial agents", r.cluster, n)
+				err = r.verifyJoin()
+			}
+			if err == nil {
+				r.writeHints(addrs)
+				r.status.update(attempt, nil)
+				r.logEvent(hclog.Info, "join completed", []interface{}{"attempt", attempt, "synced", n},
+					"[INFO] agent: Join %s completed. Synced with %d initial agents", r.cluster, n)
 				return nil
 			}
 		}
@@ -118,13 +897,190 @@ func (r *retryJoiner) retryJoin() error {
 		if len(addrs) == 0 {
 			err = fmt.Errorf("No servers to join")
 		}
+		r.status.update(attempt, err)
 
-		attempt++
-		if r.maxAttempts > 0 && attempt > r.maxAttempts {
+		if r.failFast {
+			return fmt.Errorf("agent: join %s failed: %v", r.cluster, err)
+		}
+
+		interval, maxAttempts := r.interval, r.maxAttempts
+		if r.settings != nil {
+			interval, maxAttempts = r.settings.get(r.cluster)
+		}
+
+		if maxAttempts > 0 && attempt > maxAttempts {
 			return fmt.Errorf("agent: max join %s retry exhausted, exiting", r.cluster)
 		}
+		if r.budget != nil && !r.budget.take() {
+			return fmt.Errorf("agent: max total join retry exhausted, exiting")
+		}
+
+		r.logEvent(hclog.Warn, "join failed, retrying",
+			[]interface{}{"attempt", attempt, "discovered", len(addrs), "interval", interval.String(), "error", err},
+			"[WARN] agent: Join %s failed: %v, retrying in %v", r.cluster, err, interval)
+		time.Sleep(interval)
+	}
+}
+
+// dropSelf returns the addresses without those of the agent itself, unless
+// that would leave none.
+func (r *retryJoiner) dropSelf(attempt int, addrs []joinAddr) []joinAddr {
+	if r.self == nil {
+		return addrs
+	}
+	out := make([]joinAddr, 0, len(addrs))
+	var skipped []string
+	for _, a := range addrs {
+		if r.isSelf(a.addr) {
+			skipped = append(skipped, a.String())
+			continue
+		}
+		out = append(out, a)
+	}
+	if len(skipped) == 0 || len(out) == 0 {
+		return addrs
+	}
+	r.logEvent(hclog.Debug, "skipping own address", []interface{}{"attempt", attempt, "addresses", skipped},
+		"[DEBUG] agent: Join %s skipping own address: %s", r.cluster, strings.Join(skipped, ", "))
+	return out
+}
+
+// isSelf returns true if the join address is the agent's own. An address
+// without a port is joined on the agent's own serf port, and a hostname is
+// only the agent's own if every address it resolves to is, since serf joins
+// all of them.
+func (r *retryJoiner) isSelf(addr string) bool {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		host, port = addr, ""
+	}
+	if port != "" && port != strconv.Itoa(r.self.Port) {
+		return false
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		return ip.Equal(r.self.IP)
+	}
+
+	lookup := r.lookupHost
+	if lookup == nil {
+		lookup = net.LookupHost
+	}
+	ips, err := lookup(host)
+	if err != nil || len(ips) == 0 {
+		return false
+	}
+	for _, s := range ips {
+		if ip := net.ParseIP(s); ip == nil || !ip.Equal(r.self.IP) {
+			return false
+		}
+	}
+	return true
+}
+
+// joinHints tries to join the servers in the hints file, returning true if
+// that completed the join.
+func (r *retryJoiner) joinHints() bool {
+	if r.hintsFile == "" {
+		return false
+	}
+	data, err := ioutil.ReadFile(r.hintsFile)
+	if os.IsNotExist(err) {
+		return false
+	}
+	var hints []string
+	if err == nil {
+		err = json.Unmarshal(data, &hints)
+	}
+	if err != nil {
+		r.logEvent(hclog.Warn, "failed reading join hints", []interface{}{"file", r.hintsFile, "error", err},
+			"[WARN] agent: Join %s failed reading hints %q: %s", r.cluster, r.hintsFile, err)
+		return false
+	}
+	if len(hints) == 0 {
+		return false
+	}
+
+	r.logEvent(hclog.Info, "joining hinted servers", []interface{}{"servers", hints},
+		"[INFO] agent: Join %s trying servers from the last join: %s", r.cluster, strings.Join(hints, " "))
+	n, err := r.join(hints)
+	if err == nil && n < r.minServers {
+		err = fmt.Errorf("synced with %d agents, need at least %d", n, r.minServers)
+	}
+	if err == nil {
+		err = r.verifyJoin()
+	}
+	if err != nil {
+		r.logEvent(hclog.Warn, "join hinted servers failed", []interface{}{"error", err},
+			"[WARN] agent: Join %s with servers from the last join failed: %v, discovering servers", r.cluster, err)
+		return false
+	}
+
+	r.status.update(1, nil)
+	r.logEvent(hclog.Info, "join completed", []interface{}{"hinted", true, "synced", n},
+		"[INFO] agent: Join %s completed. Synced with %d initial agents", r.cluster, n)
+	return true
+}
+
+// writeHints saves the addresses of a successful join to the hints file.
+// Failing to is only logged since the hints are advisory.
+func (r *retryJoiner) writeHints(addrs []joinAddr) {
+	if r.hintsFile == "" {
+		return
+	}
+	data, err := json.Marshal(joinAddrStrings(addrs))
+	if err == nil {
+		err = file.WriteAtomic(r.hintsFile, data)
+	}
+	if err != nil {
+		r.logEvent(hclog.Warn, "failed writing join hints", []interface{}{"file", r.hintsFile, "error", err},
+			"[WARN] agent: Join %s failed writing hints %q: %s", r.cluster, r.hintsFile, err)
+	}
+}
+
+// verifyJoin polls the verify func until it succeeds, returning its last
+// error if it doesn't within verifyTimeout. Without a verify func every join
+// is considered successful.
+func (r *retryJoiner) verifyJoin() error {
+	if r.verify == nil {
+		return nil
+	}
+
+	interval := r.verifyInterval
+	if interval <= 0 {
+		interval = time.Second
+	}
+	deadline := time.Now().Add(r.verifyTimeout)
+	for {
+		err := r.verify()
+		if err == nil {
+			return nil
+		}
+		if !time.Now().Before(deadline) {
+			return fmt.Errorf("join not verified within %s: %s", r.verifyTimeout, err)
+		}
+		time.Sleep(interval)
+	}
+}
+
+// logEvent logs a retry join event. By default the human readable line given
+// by format and args is written to the agent logger. If the joiner has a
+// structured logger, the event is logged there instead as msg along with the
+// cluster and the given key/value fields.
+func (r *retryJoiner) logEvent(level hclog.Level, msg string, fields []interface{}, format string, args ...interface{}) {
+	if r.structured == nil {
+		r.logger.Printf(format, args...)
+		return
+	}
 
-		r.logger.Printf("[WARN] agent: Join %s failed: %v, retrying in %v", r.cluster, err, r.interval)
-		time.Sleep(r.interval)
+	fields = append([]interface{}{"cluster", r.cluster}, fields...)
+	switch level {
+	case hclog.Error:
+		r.structured.Error(msg, fields...)
+	case hclog.Warn:
+		r.structured.Warn(msg, fields...)
+	case hclog.Debug:
+		r.structured.Debug(msg, fields...)
+	default:
+		r.structured.Info(msg, fields...)
 	}
 }
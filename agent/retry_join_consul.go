@@ -0,0 +1,162 @@
+package agent
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+
+	"github.com/hashicorp/consul/api"
+	"github.com/hashicorp/go-cleanhttp"
+	"github.com/hashicorp/serf/serf"
+)
+
+// consulDiscoverProvider is a go-discover provider that finds the servers
+// of an existing cluster by asking one of its agents for the LAN members
+// over the HTTP API. This lets a new agent bootstrap from any agent it can
+// reach without having to know the current server addresses.
+type consulDiscoverProvider struct{}
+
+func (p *consulDiscoverProvider) Help() string {
+	return `Consul:
+
+    provider:        "consul"
+    address:         Address of a reachable agent's HTTP API, e.g. "10.0.0.1:8500".
+    scheme:          "http" or "https" (defaults to "http").
+    token:           ACL token to use for the request.
+    service:         Role tag of the members to join (defaults to "consul",
+                     which selects servers).
+    ca_file:         Path to a CA file to verify the agent's certificate.
+    cert_file:       Path to a client certificate for the agent.
+    key_file:        Path to the private key for the client certificate.
+    tls_skip_verify: "true" to disable verification of the agent's certificate.
+    filter:          Tags the members must have, e.g. "dc==dc1,env==prod".
+`
+}
+
+func (p *consulDiscoverProvider) Addrs(args map[string]string, l *log.Logger) ([]string, error) {
+	found, err := p.AddrsWithMeta(args, l)
+	if err != nil {
+		return nil, err
+	}
+	addrs := make([]string, 0, len(found))
+	for _, a := range found {
+		addrs = append(addrs, a.Addr)
+	}
+	return addrs, nil
+}
+
+// AddrsWithMeta returns the addresses along with the serf tags of their
+// members, so that retry join filters can match on them.
+func (p *consulDiscoverProvider) AddrsWithMeta(args map[string]string, l *log.Logger) ([]discoveredAddr, error) {
+	if args["provider"] != "consul" {
+		return nil, fmt.Errorf("discover-consul: invalid provider %s", args["provider"])
+	}
+	if args["address"] == "" {
+		return nil, fmt.Errorf("discover-consul: address is required")
+	}
+
+	client, err := discoverAPIClient("consul", args)
+	if err != nil {
+		return nil, err
+	}
+
+	members, err := client.Agent().Members(false)
+	if err != nil {
+		return nil, fmt.Errorf("discover-consul: error listing members: %s", err)
+	}
+
+	role := args["service"]
+	if role == "" {
+		role = "consul"
+	}
+
+	var addrs []discoveredAddr
+	for _, m := range members {
+		if m.Tags["role"] != role {
+			continue
+		}
+		if m.Status != int(serf.StatusAlive) {
+			l.Printf("[DEBUG] discover-consul: ignoring member %q, not alive", m.Name)
+			continue
+		}
+		addrs = append(addrs, discoveredAddr{
+			Addr: net.JoinHostPort(m.Addr, strconv.Itoa(int(m.Port))),
+			Meta: m.Tags,
+		})
+	}
+	return addrs, nil
+}
+
+// discoverAPIClient returns a client for the agent HTTP API given by the
+// address, scheme, token and TLS settings of the named provider. Only the
+// provider's args are used, never the agent's own CONSUL_HTTP_* environment,
+// so that the agent's token and TLS settings aren't sent to the seed agent.
+func discoverAPIClient(provider string, args map[string]string) (*api.Client, error) {
+	if args["address"] == "" {
+		return nil, fmt.Errorf("discover-%s: address is required", provider)
+	}
+	scheme := args["scheme"]
+	if scheme == "" {
+		scheme = "http"
+	}
+	skipVerify := false
+	if v := args["tls_skip_verify"]; v != "" {
+		var err error
+		skipVerify, err = strconv.ParseBool(v)
+		if err != nil {
+			return nil, fmt.Errorf("discover-%s: tls_skip_verify must be boolean value: %s", provider, err)
+		}
+	}
+
+	// api.NewClient fills in anything left empty from the environment, so
+	// the HTTP client is built here from the args alone. It also falls back
+	// to the environment's token when none is given, so the token header is
+	// stripped from requests in that case.
+	tlsConfig := api.TLSConfig{
+		CAFile:             args["ca_file"],
+		CertFile:           args["cert_file"],
+		KeyFile:            args["key_file"],
+		InsecureSkipVerify: skipVerify,
+	}
+	transport := cleanhttp.DefaultPooledTransport()
+	httpClient, err := api.NewHttpClient(transport, tlsConfig)
+	if err != nil {
+		return nil, fmt.Errorf("discover-%s: error creating client: %s", provider, err)
+	}
+	if args["token"] == "" {
+		httpClient.Transport = noTokenTransport{httpClient.Transport}
+	}
+
+	client, err := api.NewClient(&api.Config{
+		Address:    args["address"],
+		Scheme:     scheme,
+		Token:      args["token"],
+		Transport:  transport,
+		TLSConfig:  tlsConfig,
+		HttpClient: httpClient,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("discover-%s: error creating client: %s", provider, err)
+	}
+	return client, nil
+}
+
+// noTokenTransport sends requests without an ACL token.
+type noTokenTransport struct {
+	http.RoundTripper
+}
+
+func (t noTokenTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Header.Get("X-Consul-Token") == "" {
+		return t.RoundTripper.RoundTrip(req)
+	}
+	clone := *req
+	clone.Header = make(http.Header, len(req.Header))
+	for k, v := range req.Header {
+		clone.Header[k] = v
+	}
+	clone.Header.Del("X-Consul-Token")
+	return t.RoundTripper.RoundTrip(&clone)
+}
@@ -0,0 +1,145 @@
+package agent
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/hashicorp/consul/api"
+	"github.com/hashicorp/serf/serf"
+	"github.com/stretchr/testify/require"
+)
+
+func testConsulDiscoverServer(t *testing.T, tls bool) *httptest.Server {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/agent/members" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		if r.Header.Get("X-Consul-Token") != "seed-token" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		json.NewEncoder(w).Encode([]*api.AgentMember{
+			{Name: "s1", Addr: "10.0.0.1", Port: 8301, Tags: map[string]string{"role": "consul"}, Status: int(serf.StatusAlive)},
+			{Name: "s2", Addr: "10.0.0.2", Port: 8301, Tags: map[string]string{"role": "consul"}, Status: int(serf.StatusFailed)},
+			{Name: "c1", Addr: "10.0.0.3", Port: 8301, Tags: map[string]string{"role": "node"}, Status: int(serf.StatusAlive)},
+		})
+	})
+	if tls {
+		return httptest.NewTLSServer(handler)
+	}
+	return httptest.NewServer(handler)
+}
+
+func TestConsulDiscoverProvider(t *testing.T) {
+	t.Parallel()
+
+	logger := log.New(os.Stderr, "", log.LstdFlags)
+	p := &consulDiscoverProvider{}
+
+	t.Run("http", func(t *testing.T) {
+		srv := testConsulDiscoverServer(t, false)
+		defer srv.Close()
+
+		addrs, err := p.Addrs(map[string]string{
+			"provider": "consul",
+			"address":  srv.URL,
+			"token":    "seed-token",
+		}, logger)
+		require.NoError(t, err)
+		require.Equal(t, []string{"10.0.0.1:8301"}, addrs)
+	})
+
+	t.Run("https", func(t *testing.T) {
+		srv := testConsulDiscoverServer(t, true)
+		defer srv.Close()
+
+		addrs, err := p.Addrs(map[string]string{
+			"provider":        "consul",
+			"address":         srv.URL,
+			"token":           "seed-token",
+			"tls_skip_verify": "true",
+		}, logger)
+		require.NoError(t, err)
+		require.Equal(t, []string{"10.0.0.1:8301"}, addrs)
+	})
+
+	t.Run("role", func(t *testing.T) {
+		srv := testConsulDiscoverServer(t, false)
+		defer srv.Close()
+
+		addrs, err := p.Addrs(map[string]string{
+			"provider": "consul",
+			"address":  srv.URL,
+			"token":    "seed-token",
+			"service":  "node",
+		}, logger)
+		require.NoError(t, err)
+		require.Equal(t, []string{"10.0.0.3:8301"}, addrs)
+	})
+
+	t.Run("bad token", func(t *testing.T) {
+		srv := testConsulDiscoverServer(t, false)
+		defer srv.Close()
+
+		addrs, err := p.Addrs(map[string]string{
+			"provider": "consul",
+			"address":  srv.URL,
+			"token":    "wrong",
+		}, logger)
+		require.Error(t, err)
+		require.Empty(t, addrs)
+	})
+
+	t.Run("missing address", func(t *testing.T) {
+		_, err := p.Addrs(map[string]string{"provider": "consul"}, logger)
+		require.Error(t, err)
+	})
+}
+
+// Test that the agent's own API environment isn't used for the seed agent.
+// This isn't parallel since it sets the environment.
+func TestDiscoverAPIClient_ignoresEnv(t *testing.T) {
+	for name, value := range map[string]string{
+		api.HTTPAddrEnvName:  "127.0.0.1:1",
+		api.HTTPTokenEnvName: "agent-token",
+		api.HTTPSSLEnvName:   "true",
+	} {
+		old, ok := os.LookupEnv(name)
+		require.NoError(t, os.Setenv(name, value))
+		if ok {
+			defer os.Setenv(name, old)
+		} else {
+			defer os.Unsetenv(name)
+		}
+	}
+
+	var tokens []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		tokens = append(tokens, r.Header.Get("X-Consul-Token"))
+		json.NewEncoder(w).Encode([]*api.AgentMember{})
+	}))
+	defer srv.Close()
+
+	// The address is required rather than taken from the environment
+	_, err := discoverAPIClient("consul", map[string]string{})
+	require.Error(t, err)
+
+	// No token is sent unless one is given, and the scheme isn't https
+	client, err := discoverAPIClient("consul", map[string]string{"address": srv.Listener.Addr().String()})
+	require.NoError(t, err)
+	_, err = client.Agent().Members(false)
+	require.NoError(t, err)
+	client, err = discoverAPIClient("consul", map[string]string{
+		"address": srv.Listener.Addr().String(),
+		"token":   "seed-token",
+	})
+	require.NoError(t, err)
+	_, err = client.Agent().Members(false)
+	require.NoError(t, err)
+	require.Equal(t, []string{"", "seed-token"}, tokens)
+}
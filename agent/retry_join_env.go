@@ -0,0 +1,51 @@
+package agent
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"strings"
+)
+
+// envDiscoverProvider is a go-discover provider that reads the addresses to
+// join from an environment variable. The variable is read on every attempt
+// so an orchestrator can update the addresses without changing the
+// configuration.
+type envDiscoverProvider struct{}
+
+func (p *envDiscoverProvider) Help() string {
+	return `Environment variable:
+
+    provider: "env"
+    var:      Name of the environment variable holding the addresses.
+    sep:      Separator between the addresses (defaults to ",").
+`
+}
+
+func (p *envDiscoverProvider) Addrs(args map[string]string, l *log.Logger) ([]string, error) {
+	if args["provider"] != "env" {
+		return nil, fmt.Errorf("discover-env: invalid provider %s", args["provider"])
+	}
+	name := args["var"]
+	if name == "" {
+		return nil, fmt.Errorf("discover-env: var is required")
+	}
+	sep := args["sep"]
+	if sep == "" {
+		sep = ","
+	}
+
+	value := os.Getenv(name)
+	if value == "" {
+		l.Printf("[DEBUG] discover-env: %s is unset or empty", name)
+		return nil, nil
+	}
+
+	var addrs []string
+	for _, addr := range strings.Split(value, sep) {
+		if addr = strings.TrimSpace(addr); addr != "" {
+			addrs = append(addrs, addr)
+		}
+	}
+	return addrs, nil
+}
@@ -0,0 +1,92 @@
+package agent
+
+import (
+	"io/ioutil"
+	"log"
+	"os"
+	"testing"
+	"time"
+
+	discover "github.com/hashicorp/go-discover"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEnvDiscoverProvider(t *testing.T) {
+	t.Parallel()
+
+	logger := log.New(ioutil.Discard, "", 0)
+	p := &envDiscoverProvider{}
+
+	const name = "CONSUL_TEST_ENV_DISCOVER_SERVERS"
+	defer os.Unsetenv(name)
+
+	t.Run("set", func(t *testing.T) {
+		os.Setenv(name, "10.0.0.1, 10.0.0.2:8301,,10.0.0.3")
+		addrs, err := p.Addrs(map[string]string{"provider": "env", "var": name}, logger)
+		require.NoError(t, err)
+		require.Equal(t, []string{"10.0.0.1", "10.0.0.2:8301", "10.0.0.3"}, addrs)
+	})
+
+	t.Run("separator", func(t *testing.T) {
+		os.Setenv(name, "10.0.0.1;10.0.0.2")
+		addrs, err := p.Addrs(map[string]string{"provider": "env", "var": name, "sep": ";"}, logger)
+		require.NoError(t, err)
+		require.Equal(t, []string{"10.0.0.1", "10.0.0.2"}, addrs)
+	})
+
+	t.Run("empty", func(t *testing.T) {
+		os.Setenv(name, "")
+		addrs, err := p.Addrs(map[string]string{"provider": "env", "var": name}, logger)
+		require.NoError(t, err)
+		require.Empty(t, addrs)
+	})
+
+	t.Run("unset", func(t *testing.T) {
+		os.Unsetenv(name)
+		addrs, err := p.Addrs(map[string]string{"provider": "env", "var": name}, logger)
+		require.NoError(t, err)
+		require.Empty(t, addrs)
+	})
+
+	t.Run("missing var", func(t *testing.T) {
+		_, err := p.Addrs(map[string]string{"provider": "env"}, logger)
+		require.Error(t, err)
+	})
+}
+
+func TestRetryJoin_envProvider(t *testing.T) {
+	t.Parallel()
+
+	const name = "CONSUL_TEST_RETRY_JOIN_ENV_SERVERS"
+	os.Unsetenv(name)
+	defer os.Unsetenv(name)
+
+	// The variable is unset for the first attempt, which is retried, and
+	// the value set in the meantime is picked up by the next one.
+	var joined []string
+	r := &retryJoiner{
+		cluster:  "LAN",
+		addrs:    []string{"provider=env var=" + name},
+		interval: 10 * time.Millisecond,
+		logger:   log.New(ioutil.Discard, "", 0),
+		providers: map[string]discover.Provider{
+			"env": &envDiscoverProvider{},
+		},
+		join: func(addrs []string) (int, error) {
+			joined = addrs
+			return len(addrs), nil
+		},
+	}
+	errCh := make(chan error, 1)
+	go func() { errCh <- r.retryJoin() }()
+	time.Sleep(5 * time.Millisecond)
+	os.Setenv(name, "10.0.0.1,10.0.0.2")
+
+	select {
+	case err := <-errCh:
+		require.NoError(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("join didn't complete")
+	}
+	require.Equal(t, []string{"10.0.0.1", "10.0.0.2"}, joined)
+}
@@ -0,0 +1,59 @@
+//go:build go1.18
+// +build go1.18
+
+package agent
+
+import (
+	"strings"
+	"testing"
+)
+
+// FuzzParseJoinAddr checks that parseJoinAddr doesn't panic on any input and
+// that parsing is stable on the entries it returns.
+func FuzzParseJoinAddr(f *testing.F) {
+	for _, seed := range []string{
+		"10.0.0.1",
+		"10.0.0.1:8301",
+		"consul.internal:8301",
+		"::1",
+		"[::1]",
+		"[::1]:8301",
+		"[fe80::1%eth0]:8301",
+		"provider=aws tag_key=consul tag_value=server",
+		`provider=consul address=10.0.0.1:8500 filter="env==prod"`,
+		"https://10.0.0.1:8501?token=abc",
+		"consul://[::1]",
+		"provider=",
+		`provider="aws`,
+		"[[::1]]:8301",
+		"10.0.0.1:99999",
+		"\x00\xff:1",
+		"::::",
+	} {
+		f.Add(seed)
+	}
+
+	f.Fuzz(func(t *testing.T, s string) {
+		entry, err := parseJoinAddr(s)
+		if err != nil {
+			return
+		}
+		if (entry.config == "") == (entry.addr == "") {
+			t.Fatalf("%q: exactly one of config and addr must be set: %#v", s, entry)
+		}
+		if entry.config != "" && entry.provider == "" {
+			t.Fatalf("%q: config without provider: %#v", s, entry)
+		}
+		if entry.addr != "" && strings.TrimSpace(entry.addr) != entry.addr {
+			t.Fatalf("%q: address not trimmed: %#v", s, entry)
+		}
+
+		again, err := parseJoinAddr(entry.String())
+		if err != nil {
+			t.Fatalf("%q: normalized entry %q doesn't parse: %s", s, entry, err)
+		}
+		if again != entry {
+			t.Fatalf("%q: parsing isn't stable: %#v then %#v", s, entry, again)
+		}
+	})
+}
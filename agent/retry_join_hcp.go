@@ -0,0 +1,206 @@
+package agent
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/go-cleanhttp"
+)
+
+const (
+	// hcpRequestTimeout bounds each request to HCP so a hung API doesn't
+	// stall retry join.
+	hcpRequestTimeout = 10 * time.Second
+
+	// hcpTokenExpiryBuffer is how long before its expiry a token fetched
+	// with client credentials is refreshed.
+	hcpTokenExpiryBuffer = 30 * time.Second
+)
+
+// errHCPUnauthorized is returned when HCP rejects the token.
+var errHCPUnauthorized = errors.New("unauthorized")
+
+// hcpDiscoverProvider is a go-discover provider that asks a cluster API for
+// the current server addresses of a managed cluster, whose servers may move
+// without notice. There are no default endpoints: the API, which must serve
+// GET <address>/consul/clusters/<cluster_id>/servers with a body of
+// {"servers": [{"address": ...}]}, and the OAuth token URL for client
+// credentials are always given in the config, so a token is only ever sent
+// where the operator says. Tokens fetched with client credentials are cached
+// and refreshed as they expire. Since retry join keeps retrying, API errors
+// are logged and resolve to no addresses rather than failing.
+type hcpDiscoverProvider struct {
+	// client is used for all requests. If nil, a client with
+	// hcpRequestTimeout is used.
+	client *http.Client
+
+	lock   sync.Mutex
+	tokens map[string]hcpToken // by auth URL and client ID
+}
+
+// hcpToken is an access token fetched with client credentials.
+type hcpToken struct {
+	token   string
+	expires time.Time
+}
+
+func (p *hcpDiscoverProvider) Help() string {
+	return `Managed cluster API:
+
+    provider:      "hcp"
+    address:       Address of the cluster API, which must serve
+                   GET <address>/consul/clusters/<cluster_id>/servers.
+    cluster_id:    ID of the managed cluster.
+    token:         Access token to use.
+    client_id:     OAuth client ID to fetch tokens with instead.
+    client_secret: OAuth client secret to fetch tokens with.
+    auth_url:      OAuth token URL, required with client_id.
+`
+}
+
+func (p *hcpDiscoverProvider) Addrs(args map[string]string, l *log.Logger) ([]string, error) {
+	if args["provider"] != "hcp" {
+		return nil, fmt.Errorf("discover-hcp: invalid provider %s", args["provider"])
+	}
+	if args["address"] == "" {
+		return nil, fmt.Errorf("discover-hcp: address is required")
+	}
+	if args["cluster_id"] == "" {
+		return nil, fmt.Errorf("discover-hcp: cluster_id is required")
+	}
+	clientCreds := args["client_id"] != "" || args["client_secret"] != ""
+	if clientCreds && (args["client_id"] == "" || args["client_secret"] == "") {
+		return nil, fmt.Errorf("discover-hcp: client_id and client_secret must be given together")
+	}
+	if !clientCreds && args["token"] == "" {
+		return nil, fmt.Errorf("discover-hcp: token or client_id and client_secret are required")
+	}
+	if clientCreds && args["auth_url"] == "" {
+		return nil, fmt.Errorf("discover-hcp: auth_url is required with client_id")
+	}
+
+	addrs, err := p.servers(args, false)
+	if err == errHCPUnauthorized && clientCreds {
+		// The cached token may have been revoked before its expiry, so
+		// try once more with a new one.
+		l.Printf("[DEBUG] discover-hcp: token rejected, refreshing")
+		addrs, err = p.servers(args, true)
+	}
+	if err != nil {
+		l.Printf("[WARN] discover-hcp: error listing servers of cluster %q: %s", args["cluster_id"], err)
+		return nil, nil
+	}
+	return addrs, nil
+}
+
+// servers lists the server addresses of the cluster, fetching a new token
+// first if refresh is true.
+func (p *hcpDiscoverProvider) servers(args map[string]string, refresh bool) ([]string, error) {
+	token := args["token"]
+	if args["client_id"] != "" {
+		var err error
+		if token, err = p.token(args, refresh); err != nil {
+			return nil, err
+		}
+	}
+
+	u := strings.TrimSuffix(args["address"], "/") + "/consul/clusters/" + url.PathEscape(args["cluster_id"]) + "/servers"
+	req, err := http.NewRequest("GET", u, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	resp, err := p.httpClient().Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	switch {
+	case resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden:
+		return nil, errHCPUnauthorized
+	case resp.StatusCode != http.StatusOK:
+		return nil, fmt.Errorf("unexpected response code %d", resp.StatusCode)
+	}
+
+	var out struct {
+		Servers []struct {
+			Address string `json:"address"`
+		} `json:"servers"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&out); err != nil {
+		return nil, fmt.Errorf("error decoding servers: %s", err)
+	}
+	var addrs []string
+	for _, s := range out.Servers {
+		if s.Address != "" {
+			addrs = append(addrs, s.Address)
+		}
+	}
+	return addrs, nil
+}
+
+// token returns an access token for the client credentials, using the
+// cached one unless it's close to expiring or refresh is true.
+func (p *hcpDiscoverProvider) token(args map[string]string, refresh bool) (string, error) {
+	authURL := args["auth_url"]
+	key := authURL + "\x00" + args["client_id"]
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if t, ok := p.tokens[key]; ok && !refresh && time.Now().Before(t.expires) {
+		return t.token, nil
+	}
+
+	resp, err := p.httpClient().PostForm(authURL, url.Values{
+		"grant_type":    {"client_credentials"},
+		"client_id":     {args["client_id"]},
+		"client_secret": {args["client_secret"]},
+	})
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	switch {
+	case resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden ||
+		resp.StatusCode == http.StatusBadRequest:
+		return "", fmt.Errorf("client credentials rejected with response code %d", resp.StatusCode)
+	case resp.StatusCode != http.StatusOK:
+		return "", fmt.Errorf("unexpected response code %d fetching token", resp.StatusCode)
+	}
+
+	var out struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int64  `json:"expires_in"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&out); err != nil {
+		return "", fmt.Errorf("error decoding token: %s", err)
+	}
+	if out.AccessToken == "" {
+		return "", fmt.Errorf("no access token returned")
+	}
+
+	if p.tokens == nil {
+		p.tokens = make(map[string]hcpToken)
+	}
+	p.tokens[key] = hcpToken{
+		token:   out.AccessToken,
+		expires: time.Now().Add(time.Duration(out.ExpiresIn)*time.Second - hcpTokenExpiryBuffer),
+	}
+	return out.AccessToken, nil
+}
+
+func (p *hcpDiscoverProvider) httpClient() *http.Client {
+	if p.client != nil {
+		return p.client
+	}
+	client := cleanhttp.DefaultPooledClient()
+	client.Timeout = hcpRequestTimeout
+	return client
+}
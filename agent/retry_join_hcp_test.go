@@ -0,0 +1,192 @@
+package agent
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// testHCPServer is a stub of the HCP API and its OAuth token endpoint. Each
+// token it issues revokes the one before.
+type testHCPServer struct {
+	*httptest.Server
+
+	lock   sync.Mutex
+	token  string
+	issued int
+	fail   bool
+}
+
+func newTestHCPServer(t *testing.T) *testHCPServer {
+	s := &testHCPServer{token: "static-token"}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/oauth2/token", func(w http.ResponseWriter, r *http.Request) {
+		if r.PostFormValue("grant_type") != "client_credentials" ||
+			r.PostFormValue("client_id") != "id" || r.PostFormValue("client_secret") != "secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		s.lock.Lock()
+		s.issued++
+		s.token = fmt.Sprintf("token-%d", s.issued)
+		token := s.token
+		s.lock.Unlock()
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"access_token": token,
+			"expires_in":   3600,
+		})
+	})
+	mux.HandleFunc("/consul/clusters/c1/servers", func(w http.ResponseWriter, r *http.Request) {
+		s.lock.Lock()
+		token, fail := s.token, s.fail
+		s.lock.Unlock()
+		if fail {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		if r.Header.Get("Authorization") != "Bearer "+token {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"servers": []map[string]string{
+				{"address": "10.0.0.1:8301"},
+				{"address": "10.0.0.2:8301"},
+			},
+		})
+	})
+	s.Server = httptest.NewServer(mux)
+	return s
+}
+
+func (s *testHCPServer) tokensIssued() int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.issued
+}
+
+func TestHCPDiscoverProvider(t *testing.T) {
+	t.Parallel()
+
+	logger := log.New(os.Stderr, "", log.LstdFlags)
+
+	t.Run("token", func(t *testing.T) {
+		srv := newTestHCPServer(t)
+		defer srv.Close()
+
+		p := &hcpDiscoverProvider{}
+		addrs, err := p.Addrs(map[string]string{
+			"provider":   "hcp",
+			"cluster_id": "c1",
+			"token":      "static-token",
+			"address":    srv.URL,
+		}, logger)
+		require.NoError(t, err)
+		require.Equal(t, []string{"10.0.0.1:8301", "10.0.0.2:8301"}, addrs)
+	})
+
+	t.Run("client credentials", func(t *testing.T) {
+		srv := newTestHCPServer(t)
+		defer srv.Close()
+
+		p := &hcpDiscoverProvider{}
+		args := map[string]string{
+			"provider":      "hcp",
+			"cluster_id":    "c1",
+			"client_id":     "id",
+			"client_secret": "secret",
+			"address":       srv.URL,
+			"auth_url":      srv.URL + "/oauth2/token",
+		}
+		addrs, err := p.Addrs(args, logger)
+		require.NoError(t, err)
+		require.Len(t, addrs, 2)
+		require.Equal(t, 1, srv.tokensIssued())
+
+		// The token is cached until it expires.
+		addrs, err = p.Addrs(args, logger)
+		require.NoError(t, err)
+		require.Len(t, addrs, 2)
+		require.Equal(t, 1, srv.tokensIssued())
+
+		// A token revoked before then is refreshed.
+		srv.lock.Lock()
+		srv.token = "revoked"
+		srv.lock.Unlock()
+		addrs, err = p.Addrs(args, logger)
+		require.NoError(t, err)
+		require.Len(t, addrs, 2)
+		require.Equal(t, 2, srv.tokensIssued())
+	})
+
+	t.Run("auth failure", func(t *testing.T) {
+		srv := newTestHCPServer(t)
+		defer srv.Close()
+
+		p := &hcpDiscoverProvider{}
+		addrs, err := p.Addrs(map[string]string{
+			"provider":   "hcp",
+			"cluster_id": "c1",
+			"token":      "wrong",
+			"address":    srv.URL,
+		}, logger)
+		require.NoError(t, err)
+		require.Empty(t, addrs)
+
+		addrs, err = p.Addrs(map[string]string{
+			"provider":      "hcp",
+			"cluster_id":    "c1",
+			"client_id":     "id",
+			"client_secret": "wrong",
+			"address":       srv.URL,
+			"auth_url":      srv.URL + "/oauth2/token",
+		}, logger)
+		require.NoError(t, err)
+		require.Empty(t, addrs)
+		require.Equal(t, 0, srv.tokensIssued())
+	})
+
+	t.Run("api error", func(t *testing.T) {
+		srv := newTestHCPServer(t)
+		defer srv.Close()
+		srv.lock.Lock()
+		srv.fail = true
+		srv.lock.Unlock()
+
+		p := &hcpDiscoverProvider{}
+		addrs, err := p.Addrs(map[string]string{
+			"provider":   "hcp",
+			"cluster_id": "c1",
+			"token":      "static-token",
+			"address":    srv.URL,
+		}, logger)
+		require.NoError(t, err)
+		require.Empty(t, addrs)
+	})
+
+	t.Run("missing args", func(t *testing.T) {
+		p := &hcpDiscoverProvider{}
+		_, err := p.Addrs(map[string]string{"provider": "hcp", "address": "http://127.0.0.1", "token": "t"}, logger)
+		require.Error(t, err)
+		_, err = p.Addrs(map[string]string{"provider": "hcp", "address": "http://127.0.0.1", "cluster_id": "c1"}, logger)
+		require.Error(t, err)
+		_, err = p.Addrs(map[string]string{"provider": "hcp", "address": "http://127.0.0.1", "cluster_id": "c1", "client_id": "id"}, logger)
+		require.Error(t, err)
+
+		// There are no default endpoints to send credentials to.
+		_, err = p.Addrs(map[string]string{"provider": "hcp", "cluster_id": "c1", "token": "t"}, logger)
+		require.Error(t, err)
+		require.Contains(t, err.Error(), "address is required")
+		_, err = p.Addrs(map[string]string{"provider": "hcp", "address": "http://127.0.0.1", "cluster_id": "c1",
+			"client_id": "id", "client_secret": "secret"}, logger)
+		require.Error(t, err)
+		require.Contains(t, err.Error(), "auth_url is required")
+	})
+}
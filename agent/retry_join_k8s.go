@@ -0,0 +1,133 @@
+package agent
+
+import (
+	"fmt"
+	"log"
+	"path/filepath"
+	"strconv"
+
+	discover "github.com/hashicorp/go-discover"
+	"github.com/hashicorp/go-multierror"
+	"github.com/mitchellh/go-homedir"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/clientcmd"
+)
+
+// k8sDiscoverProvider is a go-discover provider for Kubernetes that adds
+// discovery from the Endpoints of a Service, e.g. a headless Service in front
+// of the Consul servers, to the pod discovery of the go-discover provider.
+type k8sDiscoverProvider struct {
+	// pods is the go-discover provider used for the default pod discovery.
+	pods discover.Provider
+
+	// getEndpoints returns the named Endpoints. If nil, they're read from
+	// the cluster configured by the args. It's replaced in tests.
+	getEndpoints func(args map[string]string, namespace, name string) (*corev1.Endpoints, error)
+}
+
+func (p *k8sDiscoverProvider) Help() string {
+	return p.pods.Help() + `
+    kind:             "pods" (the default) or "endpoints" to join the
+                      addresses of the Endpoints of a Service.
+    name:             Name of the Endpoints when kind is "endpoints".
+    port:             Name or number of the Endpoints port to join. No port
+                      is used by default.
+`
+}
+
+func (p *k8sDiscoverProvider) Addrs(args map[string]string, l *log.Logger) ([]string, error) {
+	switch args["kind"] {
+	case "", "pods":
+		return p.pods.Addrs(args, l)
+	case "endpoints":
+	default:
+		return nil, fmt.Errorf("discover-k8s: invalid kind %q", args["kind"])
+	}
+
+	name := args["name"]
+	if name == "" {
+		return nil, fmt.Errorf("discover-k8s: name is required for endpoints")
+	}
+	namespace := args["namespace"]
+	if namespace == "" {
+		namespace = "default"
+	}
+
+	getEndpoints := p.getEndpoints
+	if getEndpoints == nil {
+		getEndpoints = k8sEndpoints
+	}
+	endpoints, err := getEndpoints(args, namespace, name)
+	if apierrors.IsNotFound(err) {
+		// The Service may not have been created yet so keep retrying.
+		l.Printf("[DEBUG] discover-k8s: endpoints %s/%s not found", namespace, name)
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("discover-k8s: error getting endpoints: %s", err)
+	}
+	return k8sEndpointsAddrs(endpoints, args["port"], l), nil
+}
+
+// k8sEndpointsAddrs returns the ready addresses of the endpoints. If port
+// is set, the subset port with that name or number is appended and subsets
+// without it are skipped.
+func k8sEndpointsAddrs(endpoints *corev1.Endpoints, port string, l *log.Logger) []string {
+	var addrs []string
+	for _, subset := range endpoints.Subsets {
+		var suffix string
+		if port != "" {
+			var found bool
+			for _, p := range subset.Ports {
+				if p.Name == port || strconv.Itoa(int(p.Port)) == port {
+					suffix, found = fmt.Sprintf(":%d", p.Port), true
+					break
+				}
+			}
+			if !found {
+				l.Printf("[DEBUG] discover-k8s: ignoring endpoints subset without port %q", port)
+				continue
+			}
+		}
+		for _, addr := range subset.Addresses {
+			addrs = append(addrs, addr.IP+suffix)
+		}
+	}
+	return addrs
+}
+
+// k8sEndpoints gets the named Endpoints, finding the cluster the same way
+// as the go-discover provider: from the kubeconfig arg or the default
+// kubeconfig path, falling back to the in-cluster config.
+func k8sEndpoints(args map[string]string, namespace, name string) (*corev1.Endpoints, error) {
+	kubeconfig := args["kubeconfig"]
+	if kubeconfig == "" {
+		dir, err := homedir.Dir()
+		if err != nil {
+			return nil, fmt.Errorf("error retrieving home directory: %s", err)
+		}
+		kubeconfig = filepath.Join(dir, ".kube", "config")
+	}
+
+	config, configErr := clientcmd.BuildConfigFromFlags("", kubeconfig)
+	if configErr != nil {
+		configErr = fmt.Errorf("error loading kubeconfig: %s", configErr)
+
+		var err error
+		config, err = rest.InClusterConfig()
+		if err != nil {
+			return nil, multierror.Append(configErr, fmt.Errorf(
+				"error loading in-cluster config: %s", err))
+		}
+	}
+
+	clientset, err := kubernetes.NewForConfig(config)
+	if err != nil {
+		return nil, fmt.Errorf("error initializing k8s client: %s", err)
+	}
+	return clientset.CoreV1().Endpoints(namespace).Get(name, metav1.GetOptions{})
+}
@@ -0,0 +1,110 @@
+package agent
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+func TestK8sDiscoverProvider_endpoints(t *testing.T) {
+	t.Parallel()
+
+	endpoints := &corev1.Endpoints{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "consul", Name: "consul-server"},
+		Subsets: []corev1.EndpointSubset{
+			{
+				Addresses:         []corev1.EndpointAddress{{IP: "10.0.0.1"}, {IP: "10.0.0.2"}},
+				NotReadyAddresses: []corev1.EndpointAddress{{IP: "10.0.0.3"}},
+				Ports: []corev1.EndpointPort{
+					{Name: "serflan", Port: 8301},
+					{Name: "server", Port: 8300},
+				},
+			},
+			{
+				Addresses: []corev1.EndpointAddress{{IP: "10.0.1.1"}},
+				Ports:     []corev1.EndpointPort{{Name: "http", Port: 8500}},
+			},
+		},
+	}
+	p := &k8sDiscoverProvider{
+		pods: &testDiscoverProvider{addrs: func(args map[string]string) ([]string, error) {
+			return []string{"10.0.9.9"}, nil
+		}},
+		getEndpoints: func(args map[string]string, namespace, name string) (*corev1.Endpoints, error) {
+			switch {
+			case namespace == "consul" && name == "consul-server":
+				return endpoints, nil
+			case name == "broken":
+				return nil, fmt.Errorf("connection refused")
+			}
+			return nil, apierrors.NewNotFound(schema.GroupResource{Resource: "endpoints"}, name)
+		},
+	}
+	logger := log.New(ioutil.Discard, "", 0)
+
+	tests := []struct {
+		name    string
+		args    map[string]string
+		want    []string
+		wantErr string
+	}{
+		{
+			name: "pods by default",
+			args: map[string]string{"provider": "k8s"},
+			want: []string{"10.0.9.9"},
+		},
+		{
+			name: "ready addresses",
+			args: map[string]string{"provider": "k8s", "kind": "endpoints", "namespace": "consul", "name": "consul-server"},
+			want: []string{"10.0.0.1", "10.0.0.2", "10.0.1.1"},
+		},
+		{
+			name: "named port",
+			args: map[string]string{"provider": "k8s", "kind": "endpoints", "namespace": "consul", "name": "consul-server", "port": "serflan"},
+			want: []string{"10.0.0.1:8301", "10.0.0.2:8301"},
+		},
+		{
+			name: "numbered port",
+			args: map[string]string{"provider": "k8s", "kind": "endpoints", "namespace": "consul", "name": "consul-server", "port": "8500"},
+			want: []string{"10.0.1.1:8500"},
+		},
+		{
+			name: "not found",
+			args: map[string]string{"provider": "k8s", "kind": "endpoints", "name": "consul-server"},
+		},
+		{
+			name:    "error",
+			args:    map[string]string{"provider": "k8s", "kind": "endpoints", "name": "broken"},
+			wantErr: "error getting endpoints: connection refused",
+		},
+		{
+			name:    "no name",
+			args:    map[string]string{"provider": "k8s", "kind": "endpoints"},
+			wantErr: "name is required",
+		},
+		{
+			name:    "bad kind",
+			args:    map[string]string{"provider": "k8s", "kind": "services"},
+			wantErr: `invalid kind "services"`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			addrs, err := p.Addrs(tt.args, logger)
+			if tt.wantErr != "" {
+				require.Error(t, err)
+				require.Contains(t, err.Error(), tt.wantErr)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tt.want, addrs)
+		})
+	}
+}
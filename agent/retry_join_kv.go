@@ -0,0 +1,81 @@
+package agent
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"strings"
+)
+
+// kvDiscoverProvider is a go-discover provider that reads the addresses to
+// join from a key in the KV store of an existing cluster, which a member of
+// the cluster keeps up to date with its current servers.
+type kvDiscoverProvider struct{}
+
+func (p *kvDiscoverProvider) Help() string {
+	return `Consul KV:
+
+    provider:        "kv"
+    address:         Address of a reachable agent's HTTP API, e.g. "10.0.0.1:8500".
+    key:             Key holding the addresses, one per line or as a JSON list.
+    scheme:          "http" or "https" (defaults to "http").
+    token:           ACL token to use for the request.
+    ca_file:         Path to a CA file to verify the agent's certificate.
+    cert_file:       Path to a client certificate for the agent.
+    key_file:        Path to the private key for the client certificate.
+    tls_skip_verify: "true" to disable verification of the agent's certificate.
+`
+}
+
+func (p *kvDiscoverProvider) Addrs(args map[string]string, l *log.Logger) ([]string, error) {
+	if args["provider"] != "kv" {
+		return nil, fmt.Errorf("discover-kv: invalid provider %s", args["provider"])
+	}
+	if args["address"] == "" {
+		return nil, fmt.Errorf("discover-kv: address is required")
+	}
+	key := args["key"]
+	if key == "" {
+		return nil, fmt.Errorf("discover-kv: key is required")
+	}
+
+	client, err := discoverAPIClient("kv", args)
+	if err != nil {
+		return nil, err
+	}
+	pair, _, err := client.KV().Get(key, nil)
+	if err != nil {
+		return nil, fmt.Errorf("discover-kv: error reading key %q: %s", key, err)
+	}
+	if pair == nil {
+		l.Printf("[DEBUG] discover-kv: key %q doesn't exist", key)
+		return nil, nil
+	}
+	addrs, err := parseKVJoinAddrs(pair.Value)
+	if err != nil {
+		return nil, fmt.Errorf("discover-kv: invalid addresses in key %q: %s", key, err)
+	}
+	return addrs, nil
+}
+
+// parseKVJoinAddrs returns the addresses in a KV value, which is either a
+// JSON list of strings or one address per line.
+func parseKVJoinAddrs(value []byte) ([]string, error) {
+	trimmed := strings.TrimSpace(string(value))
+	var lines []string
+	if strings.HasPrefix(trimmed, "[") {
+		if err := json.Unmarshal([]byte(trimmed), &lines); err != nil {
+			return nil, err
+		}
+	} else {
+		lines = strings.Split(trimmed, "\n")
+	}
+
+	var addrs []string
+	for _, addr := range lines {
+		if addr = strings.TrimSpace(addr); addr != "" {
+			addrs = append(addrs, addr)
+		}
+	}
+	return addrs, nil
+}
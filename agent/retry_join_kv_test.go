@@ -0,0 +1,121 @@
+package agent
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/hashicorp/consul/api"
+	"github.com/stretchr/testify/require"
+)
+
+func testKVDiscoverServer(t *testing.T, tls bool, values map[string]string) *httptest.Server {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Consul-Token") != "seed-token" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		key := r.URL.Path[len("/v1/kv/"):]
+		value, ok := values[key]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		json.NewEncoder(w).Encode([]*api.KVPair{{Key: key, Value: []byte(value)}})
+	})
+	if tls {
+		return httptest.NewTLSServer(handler)
+	}
+	return httptest.NewServer(handler)
+}
+
+func TestKVDiscoverProvider(t *testing.T) {
+	t.Parallel()
+
+	logger := log.New(os.Stderr, "", log.LstdFlags)
+	p := &kvDiscoverProvider{}
+	values := map[string]string{
+		"cluster/servers": "10.0.0.1:8301\n 10.0.0.2 \n\n",
+		"cluster/json":    `["10.0.0.3:8301", "10.0.0.4"]`,
+		"cluster/bad":     `["10.0.0.5"`,
+	}
+
+	t.Run("lines", func(t *testing.T) {
+		srv := testKVDiscoverServer(t, false, values)
+		defer srv.Close()
+
+		addrs, err := p.Addrs(map[string]string{
+			"provider": "kv",
+			"address":  srv.URL,
+			"key":      "cluster/servers",
+			"token":    "seed-token",
+		}, logger)
+		require.NoError(t, err)
+		require.Equal(t, []string{"10.0.0.1:8301", "10.0.0.2"}, addrs)
+	})
+
+	t.Run("json over https", func(t *testing.T) {
+		srv := testKVDiscoverServer(t, true, values)
+		defer srv.Close()
+
+		addrs, err := p.Addrs(map[string]string{
+			"provider":        "kv",
+			"address":         srv.URL,
+			"key":             "cluster/json",
+			"token":           "seed-token",
+			"tls_skip_verify": "true",
+		}, logger)
+		require.NoError(t, err)
+		require.Equal(t, []string{"10.0.0.3:8301", "10.0.0.4"}, addrs)
+	})
+
+	t.Run("missing key", func(t *testing.T) {
+		srv := testKVDiscoverServer(t, false, values)
+		defer srv.Close()
+
+		addrs, err := p.Addrs(map[string]string{
+			"provider": "kv",
+			"address":  srv.URL,
+			"key":      "cluster/nope",
+			"token":    "seed-token",
+		}, logger)
+		require.NoError(t, err)
+		require.Empty(t, addrs)
+	})
+
+	t.Run("invalid json", func(t *testing.T) {
+		srv := testKVDiscoverServer(t, false, values)
+		defer srv.Close()
+
+		_, err := p.Addrs(map[string]string{
+			"provider": "kv",
+			"address":  srv.URL,
+			"key":      "cluster/bad",
+			"token":    "seed-token",
+		}, logger)
+		require.Error(t, err)
+	})
+
+	t.Run("bad token", func(t *testing.T) {
+		srv := testKVDiscoverServer(t, false, values)
+		defer srv.Close()
+
+		_, err := p.Addrs(map[string]string{
+			"provider": "kv",
+			"address":  srv.URL,
+			"key":      "cluster/servers",
+			"token":    "nope",
+		}, logger)
+		require.Error(t, err)
+	})
+
+	t.Run("missing args", func(t *testing.T) {
+		_, err := p.Addrs(map[string]string{"provider": "kv", "key": "cluster/servers"}, logger)
+		require.Error(t, err)
+		_, err = p.Addrs(map[string]string{"provider": "kv", "address": "127.0.0.1:8500"}, logger)
+		require.Error(t, err)
+	})
+}
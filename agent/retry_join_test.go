@@ -1,10 +1,25 @@
 package agent
 
 import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math/rand"
+	"net"
+	"os"
+	"path/filepath"
 	"reflect"
+	"sync/atomic"
 	"testing"
+	"time"
 
+	"github.com/hashicorp/consul/agent/config"
+	"github.com/hashicorp/consul/testutil"
 	discover "github.com/hashicorp/go-discover"
+	"github.com/hashicorp/go-hclog"
+	"github.com/stretchr/testify/require"
 )
 
 func TestGoDiscoverRegistration(t *testing.T) {
@@ -18,3 +33,978 @@ func TestGoDiscoverRegistration(t *testing.T) {
 		t.Fatalf("got go-discover providers %v want %v", got, want)
 	}
 }
+
+// testDiscoverProvider is a go-discover provider that returns the addresses
+// from its addrs func.
+type testDiscoverProvider struct {
+	addrs func(args map[string]string) ([]string, error)
+}
+
+func (p *testDiscoverProvider) Addrs(args map[string]string, l *log.Logger) ([]string, error) {
+	return p.addrs(args)
+}
+
+func (p *testDiscoverProvider) Help() string {
+	return "test provider"
+}
+
+func TestRetryJoin_annotatesFailedAddrs(t *testing.T) {
+	t.Parallel()
+
+	var buf bytes.Buffer
+	attempt := 0
+	r := &retryJoiner{
+		cluster:  "LAN",
+		addrs:    []string{"provider=test secret_key=shh", "10.0.0.9"},
+		interval: time.Millisecond,
+		logger:   log.New(&buf, "", 0),
+		providers: map[string]discover.Provider{
+			"test": &testDiscoverProvider{addrs: func(map[string]string) ([]string, error) {
+				return []string{"10.0.0.1", "10.0.0.2"}, nil
+			}},
+		},
+		join: func(addrs []string) (int, error) {
+			attempt++
+			require.Equal(t, []string{"10.0.0.1", "10.0.0.2", "10.0.0.9"}, addrs)
+			if attempt == 1 {
+				return 0, fmt.Errorf("no route to host")
+			}
+			return len(addrs), nil
+		},
+	}
+	require.NoError(t, r.retryJoin())
+
+	out := buf.String()
+	require.Contains(t, out, "Join LAN failed for addresses: "+
+		"10.0.0.1 (provider=test secret_key=hidden), "+
+		"10.0.0.2 (provider=test secret_key=hidden), "+
+		"10.0.0.9 (static)")
+	require.Contains(t, out, "Join LAN failed: no route to host")
+	require.NotContains(t, out, "shh")
+}
+
+func TestRetryJoin_sharedBudget(t *testing.T) {
+	t.Parallel()
+
+	var joins int64
+	budget := newRetryJoinBudget(3)
+	joiner := func(cluster string) *retryJoiner {
+		return &retryJoiner{
+			cluster:  cluster,
+			addrs:    []string{"10.0.0.1"},
+			budget:   budget,
+			interval: time.Millisecond,
+			logger:   log.New(ioutil.Discard, "", 0),
+			join: func([]string) (int, error) {
+				atomic.AddInt64(&joins, 1)
+				return 0, fmt.Errorf("no route to host")
+			},
+		}
+	}
+
+	// Neither joiner has its own limit so they only stop once the shared
+	// budget is used up.
+	errCh := make(chan error, 2)
+	for _, cluster := range []string{"LAN", "WAN"} {
+		go func(r *retryJoiner) { errCh <- r.retryJoin() }(joiner(cluster))
+	}
+	for i := 0; i < 2; i++ {
+		select {
+		case err := <-errCh:
+			require.EqualError(t, err, "agent: max total join retry exhausted, exiting")
+		case <-time.After(5 * time.Second):
+			t.Fatal("joiners didn't give up")
+		}
+	}
+
+	// Each joiner makes its first attempt and then they share three retries.
+	require.Equal(t, int64(5), atomic.LoadInt64(&joins))
+}
+
+func TestRetryJoin_status(t *testing.T) {
+	t.Parallel()
+
+	var joins int64
+	status := &retryJoinStatus{}
+	r := &retryJoiner{
+		cluster:     "LAN",
+		addrs:       []string{"10.0.0.1"},
+		maxAttempts: 3,
+		interval:    time.Millisecond,
+		status:      status,
+		logger:      log.New(ioutil.Discard, "", 0),
+		join: func([]string) (int, error) {
+			n := atomic.AddInt64(&joins, 1)
+			return 0, fmt.Errorf("no route to host (%d)", n)
+		},
+	}
+	require.Error(t, r.retryJoin())
+	require.Equal(t, retryJoinSnapshot{
+		Attempts:  4,
+		LastError: "no route to host (4)",
+	}, status.snapshot())
+
+	// A later success clears the error
+	r.join = func([]string) (int, error) { return 1, nil }
+	require.NoError(t, r.retryJoin())
+	snap := status.snapshot()
+	require.True(t, snap.Joined)
+	require.Empty(t, snap.LastError)
+	require.Equal(t, 1, snap.Attempts)
+
+	stats := make(map[string]string)
+	snap.addStats(stats, "lan")
+	require.Equal(t, map[string]string{
+		"lan_attempts":   "1",
+		"lan_last_error": "",
+		"lan_joined":     "true",
+	}, stats)
+}
+
+func TestRetryJoin_shuffle(t *testing.T) {
+	t.Parallel()
+
+	var addrs []string
+	for i := 0; i < 10; i++ {
+		addrs = append(addrs, fmt.Sprintf("10.0.0.%d", i))
+	}
+
+	var orders [][]string
+	r := &retryJoiner{
+		cluster:     "LAN",
+		addrs:       addrs,
+		maxAttempts: 9,
+		interval:    time.Millisecond,
+		shuffle:     true,
+		logger:      log.New(ioutil.Discard, "", 0),
+		join: func(addrs []string) (int, error) {
+			orders = append(orders, append([]string(nil), addrs...))
+			return 0, fmt.Errorf("no route to host")
+		},
+	}
+	require.Error(t, r.retryJoin())
+	require.Len(t, orders, 10)
+
+	// Every attempt gets the same addresses, but not always in the same
+	// order.
+	varied := false
+	for _, order := range orders {
+		require.ElementsMatch(t, addrs, order)
+		if !reflect.DeepEqual(order, orders[0]) {
+			varied = true
+		}
+	}
+	require.True(t, varied, "order never changed: %v", orders[0])
+
+	// The configuration itself is left alone
+	require.Equal(t, "10.0.0.0", r.addrs[0])
+}
+
+func TestRetryJoin_minServers(t *testing.T) {
+	t.Parallel()
+
+	// The first attempts sync with too few agents, then enough
+	var joins int64
+	var logs bytes.Buffer
+	r := &retryJoiner{
+		cluster:    "LAN",
+		addrs:      []string{"10.0.0.1"},
+		minServers: 3,
+		interval:   time.Millisecond,
+		logger:     log.New(&logs, "", 0),
+		join: func([]string) (int, error) {
+			return int(atomic.AddInt64(&joins, 1)), nil
+		},
+	}
+	require.NoError(t, r.retryJoin())
+	require.Equal(t, int64(3), atomic.LoadInt64(&joins))
+	require.Contains(t, logs.String(), "synced with 2 agents, need at least 3")
+	require.Contains(t, logs.String(), "Synced with 3 initial agents")
+
+	// Without a minimum the first success is enough
+	joins = 0
+	r.minServers = 0
+	require.NoError(t, r.retryJoin())
+	require.Equal(t, int64(1), atomic.LoadInt64(&joins))
+}
+
+func TestRetryJoin_failFast(t *testing.T) {
+	t.Parallel()
+
+	// The interval is long enough that the test times out if it's slept
+	var joins int64
+	var logs bytes.Buffer
+	r := &retryJoiner{
+		cluster:  "LAN",
+		addrs:    []string{"10.0.0.1"},
+		failFast: true,
+		interval: time.Hour,
+		logger:   log.New(&logs, "", 0),
+		join: func([]string) (int, error) {
+			atomic.AddInt64(&joins, 1)
+			return 0, fmt.Errorf("connection refused")
+		},
+	}
+	start := time.Now()
+	err := r.retryJoin()
+	require.Error(t, err)
+	require.Equal(t, "agent: join LAN failed: connection refused", err.Error())
+	require.Equal(t, int64(1), atomic.LoadInt64(&joins))
+	require.True(t, time.Since(start) < time.Second)
+	require.NotContains(t, logs.String(), "retrying")
+}
+
+func TestRetryJoin_maxAddrs(t *testing.T) {
+	t.Parallel()
+
+	var addrs []string
+	for i := 0; i < 25; i++ {
+		addrs = append(addrs, fmt.Sprintf("10.0.0.%d", i+10))
+	}
+
+	// The addresses all come from discovery, in a different order each time
+	resolved := append([]string(nil), addrs...)
+	attempts := 0
+	seen := make(map[string]int)
+	r := &retryJoiner{
+		cluster:  "LAN",
+		addrs:    []string{"provider=test"},
+		maxAddrs: 10,
+		interval: time.Millisecond,
+		logger:   log.New(ioutil.Discard, "", 0),
+		providers: map[string]discover.Provider{
+			"test": &testDiscoverProvider{addrs: func(args map[string]string) ([]string, error) {
+				rand.Shuffle(len(resolved), func(i, j int) {
+					resolved[i], resolved[j] = resolved[j], resolved[i]
+				})
+				return append([]string(nil), resolved...), nil
+			}},
+		},
+		join: func(addrs []string) (int, error) {
+			attempts++
+			require.Len(t, addrs, 10)
+			for _, addr := range addrs {
+				seen[addr]++
+			}
+			if attempts < 5 {
+				return 0, fmt.Errorf("no route to host")
+			}
+			return len(addrs), nil
+		},
+	}
+	require.NoError(t, r.retryJoin())
+
+	// Five attempts of ten cover all 25 addresses twice
+	require.Len(t, seen, 25)
+	for addr, n := range seen {
+		require.Equal(t, 2, n, "address %s", addr)
+	}
+}
+
+func TestRetryJoin_noSharedBudget(t *testing.T) {
+	t.Parallel()
+
+	require.Nil(t, newRetryJoinBudget(0))
+
+	joins := 0
+	r := &retryJoiner{
+		cluster:     "LAN",
+		addrs:       []string{"10.0.0.1"},
+		maxAttempts: 2,
+		interval:    time.Millisecond,
+		logger:      log.New(ioutil.Discard, "", 0),
+		join: func([]string) (int, error) {
+			joins++
+			return 0, fmt.Errorf("no route to host")
+		},
+	}
+	require.EqualError(t, r.retryJoin(), "agent: max join LAN retry exhausted, exiting")
+	require.Equal(t, 3, joins)
+}
+
+func TestRetryJoin_structuredLogging(t *testing.T) {
+	t.Parallel()
+
+	var human, structured bytes.Buffer
+	attempt := 0
+	r := &retryJoiner{
+		cluster:  "WAN",
+		addrs:    []string{"provider=test", "10.0.0.9"},
+		interval: time.Millisecond,
+		logger:   log.New(&human, "", 0),
+		structured: hclog.New(&hclog.LoggerOptions{
+			Output:     &structured,
+			JSONFormat: true,
+		}),
+		providers: map[string]discover.Provider{
+			"test": &testDiscoverProvider{addrs: func(map[string]string) ([]string, error) {
+				return []string{"10.0.0.1", "10.0.0.2"}, nil
+			}},
+		},
+		join: func(addrs []string) (int, error) {
+			attempt++
+			if attempt == 1 {
+				return 0, fmt.Errorf("no route to host")
+			}
+			return len(addrs), nil
+		},
+	}
+	require.NoError(t, r.retryJoin())
+
+	// Nothing goes to the human readable log
+	require.Empty(t, human.String())
+
+	events := make(map[string]map[string]interface{})
+	dec := json.NewDecoder(&structured)
+	for dec.More() {
+		var event map[string]interface{}
+		require.NoError(t, dec.Decode(&event))
+		require.Equal(t, "WAN", event["cluster"])
+		events[event["@message"].(string)] = event
+	}
+
+	discovered := events["discovered servers"]
+	require.NotNil(t, discovered)
+	require.Equal(t, float64(2), discovered["discovered"])
+	require.Equal(t, "provider=test", discovered["source"])
+
+	retrying := events["join failed, retrying"]
+	require.NotNil(t, retrying)
+	require.Equal(t, "warn", retrying["@level"])
+	require.Equal(t, float64(1), retrying["attempt"])
+	require.Equal(t, float64(3), retrying["discovered"])
+	require.Equal(t, "1ms", retrying["interval"])
+	require.Equal(t, "no route to host", retrying["error"])
+
+	completed := events["join completed"]
+	require.NotNil(t, completed)
+	require.Equal(t, float64(2), completed["attempt"])
+	require.Equal(t, float64(3), completed["synced"])
+}
+
+func TestRetryJoin_forwardsProviderArgs(t *testing.T) {
+	t.Parallel()
+
+	cases := []struct {
+		name string
+		addr string
+		want map[string]string
+	}{
+		{
+			"aws",
+			"provider=aws region=us-east-1 tag_key=consul tag_value=server addr_type=private_v4 imds_version=2",
+			map[string]string{
+				"provider":     "aws",
+				"region":       "us-east-1",
+				"tag_key":      "consul",
+				"tag_value":    "server",
+				"addr_type":    "private_v4",
+				"imds_version": "2",
+			},
+		},
+		{
+			"azure",
+			"provider=azure subscription_id=sub resource_group=rg vm_scale_set=consul-servers use_msi=true",
+			map[string]string{
+				"provider":        "azure",
+				"subscription_id": "sub",
+				"resource_group":  "rg",
+				"vm_scale_set":    "consul-servers",
+				"use_msi":         "true",
+			},
+		},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			var got map[string]string
+			r := &retryJoiner{
+				cluster:  "LAN",
+				addrs:    []string{tc.addr},
+				interval: time.Millisecond,
+				logger:   log.New(ioutil.Discard, "", 0),
+				providers: map[string]discover.Provider{
+					tc.name: &testDiscoverProvider{addrs: func(args map[string]string) ([]string, error) {
+						got = args
+						return []string{"10.0.0.1"}, nil
+					}},
+				},
+				join: func(addrs []string) (int, error) {
+					return len(addrs), nil
+				},
+			}
+			require.NoError(t, r.retryJoin())
+
+			// Every setting, including ones Consul doesn't know about,
+			// reaches the provider as given.
+			require.Equal(t, tc.want, got)
+		})
+	}
+}
+
+func TestRetryJoin_lastDiscovered(t *testing.T) {
+	t.Parallel()
+
+	// The provider resolves once and then fails or finds nothing
+	resolves := 0
+	var buf bytes.Buffer
+	var joined [][]string
+	r := &retryJoiner{
+		cluster:  "LAN",
+		addrs:    []string{"provider=test"},
+		interval: time.Millisecond,
+		logger:   log.New(&buf, "", 0),
+		providers: map[string]discover.Provider{
+			"test": &testDiscoverProvider{addrs: func(args map[string]string) ([]string, error) {
+				resolves++
+				switch resolves {
+				case 1:
+					return []string{"10.0.0.1", "10.0.0.2"}, nil
+				case 2:
+					return nil, fmt.Errorf("metadata API unavailable")
+				default:
+					return nil, nil
+				}
+			}},
+		},
+		join: func(addrs []string) (int, error) {
+			joined = append(joined, addrs)
+			if len(joined) < 3 {
+				return 0, fmt.Errorf("no route to host")
+			}
+			return len(addrs), nil
+		},
+	}
+	require.NoError(t, r.retryJoin())
+
+	// Each attempt after the first falls back to the last resolved servers
+	want := []string{"10.0.0.1", "10.0.0.2"}
+	require.Equal(t, [][]string{want, want, want}, joined)
+	require.Contains(t, buf.String(), "Join LAN using last discovered servers: 10.0.0.1 10.0.0.2")
+}
+
+func TestRetryJoin_combinedAddrs(t *testing.T) {
+	t.Parallel()
+
+	provider := func(addr string, got *map[string]string) discover.Provider {
+		return &testDiscoverProvider{addrs: func(args map[string]string) ([]string, error) {
+			*got = args
+			return []string{addr}, nil
+		}}
+	}
+
+	var aws, gce map[string]string
+	var joined []string
+	r := &retryJoiner{
+		cluster:  "LAN",
+		addrs:    []string{"provider=aws tag_key=consul tag_value=server ;; provider=gce tag_value=consul;;10.0.0.3", "10.0.0.4"},
+		interval: time.Millisecond,
+		logger:   log.New(ioutil.Discard, "", 0),
+		providers: map[string]discover.Provider{
+			"aws": provider("10.0.0.1", &aws),
+			"gce": provider("10.0.0.2", &gce),
+		},
+		join: func(addrs []string) (int, error) {
+			joined = addrs
+			return len(addrs), nil
+		},
+	}
+	require.NoError(t, r.retryJoin())
+
+	// Both providers in the combined entry are queried with their own
+	// settings, alongside the static addresses.
+	require.Equal(t, map[string]string{"provider": "aws", "tag_key": "consul", "tag_value": "server"}, aws)
+	require.Equal(t, map[string]string{"provider": "gce", "tag_value": "consul"}, gce)
+	require.Equal(t, []string{"10.0.0.1", "10.0.0.2", "10.0.0.3", "10.0.0.4"}, joined)
+}
+
+func TestRetryJoin_verify(t *testing.T) {
+	t.Parallel()
+
+	var buf bytes.Buffer
+	joins, polls := 0, 0
+	r := &retryJoiner{
+		cluster:  "LAN",
+		addrs:    []string{"10.0.0.1"},
+		interval: time.Millisecond,
+		logger:   log.New(&buf, "", 0),
+		join: func(addrs []string) (int, error) {
+			joins++
+			polls = 0
+			return len(addrs), nil
+		},
+
+		// The first join never sees a server within the timeout, the
+		// second sees one after a few polls.
+		verify: func() error {
+			polls++
+			if joins < 2 || polls < 3 {
+				return fmt.Errorf("no alive servers seen")
+			}
+			return nil
+		},
+		verifyTimeout:  10 * time.Millisecond,
+		verifyInterval: time.Millisecond,
+	}
+	require.NoError(t, r.retryJoin())
+	require.Equal(t, 2, joins)
+
+	out := buf.String()
+	require.Contains(t, out, "Join LAN failed: join not verified within 10ms: no alive servers seen, retrying")
+	require.Contains(t, out, "Join LAN completed")
+	require.NotContains(t, out, "failed for addresses")
+}
+
+func TestRetryJoin_unknownProvider(t *testing.T) {
+	t.Parallel()
+
+	var buf bytes.Buffer
+	var joined []string
+	r := &retryJoiner{
+		cluster:  "LAN",
+		addrs:    []string{"provider=awss region=us-east-1 secret_access_key=shh", "provider=aws region=us-east-1"},
+		interval: time.Millisecond,
+		logger:   log.New(&buf, "", 0),
+		providers: map[string]discover.Provider{
+			"aws": &testDiscoverProvider{addrs: func(map[string]string) ([]string, error) {
+				return []string{"10.0.0.1"}, nil
+			}},
+			"gce": &testDiscoverProvider{addrs: func(map[string]string) ([]string, error) {
+				return []string{"10.0.0.2"}, nil
+			}},
+		},
+		join: func(addrs []string) (int, error) {
+			joined = addrs
+			return len(addrs), nil
+		},
+	}
+	require.NoError(t, r.retryJoin())
+
+	// The typo is reported with the supported providers and the known
+	// provider still resolves.
+	out := buf.String()
+	require.Contains(t, out, `[ERR] agent: Join LAN: unknown provider "awss" in `+
+		`"provider=awss region=us-east-1 secret_access_key=hidden", supported providers are: aws gce`)
+	require.NotContains(t, out, "shh")
+	require.Equal(t, []string{"10.0.0.1"}, joined)
+}
+
+func TestRetryJoin_reloadSettings(t *testing.T) {
+	t.Parallel()
+
+	var buf bytes.Buffer
+	settings := newRetryJoinSettings(&config.RuntimeConfig{RetryJoinIntervalLAN: time.Millisecond})
+	attempt := 0
+	r := &retryJoiner{
+		cluster:  "LAN",
+		addrs:    []string{"10.0.0.1"},
+		settings: settings,
+		logger:   log.New(&buf, "", 0),
+		join: func(addrs []string) (int, error) {
+			attempt++
+			if attempt == 2 {
+				// A reload while the join is running
+				settings.update(&config.RuntimeConfig{
+					RetryJoinIntervalLAN:    2 * time.Millisecond,
+					RetryJoinMaxAttemptsLAN: 3,
+				})
+			}
+			return 0, fmt.Errorf("no route to host")
+		},
+	}
+	require.EqualError(t, r.retryJoin(), "agent: max join LAN retry exhausted, exiting")
+
+	// The attempt after the reload waits for the new interval and the new
+	// limit stops the join.
+	out := buf.String()
+	require.Contains(t, out, "Join LAN failed: no route to host, retrying in 1ms\n"+
+		"[WARN] agent: Join LAN failed for addresses: 10.0.0.1 (static)\n"+
+		"[WARN] agent: Join LAN failed: no route to host, retrying in 2ms")
+	require.Equal(t, 4, attempt)
+}
+
+// testMetaDiscoverProvider is a go-discover provider that returns addresses
+// along with their metadata.
+type testMetaDiscoverProvider struct {
+	addrs []discoveredAddr
+	args  map[string]string
+}
+
+func (p *testMetaDiscoverProvider) Addrs(args map[string]string, l *log.Logger) ([]string, error) {
+	panic("Addrs shouldn't be called when filtering")
+}
+
+func (p *testMetaDiscoverProvider) AddrsWithMeta(args map[string]string, l *log.Logger) ([]discoveredAddr, error) {
+	p.args = args
+	return p.addrs, nil
+}
+
+func (p *testMetaDiscoverProvider) Help() string {
+	return "test meta provider"
+}
+
+func TestRetryJoin_filter(t *testing.T) {
+	t.Parallel()
+
+	tagged := &testMetaDiscoverProvider{addrs: []discoveredAddr{
+		{Addr: "10.0.0.1", Meta: map[string]string{"role": "consul-server", "env": "prod"}},
+		{Addr: "10.0.0.2", Meta: map[string]string{"role": "consul-server", "env": "dev"}},
+		{Addr: "10.0.0.3", Meta: map[string]string{"role": "web", "env": "prod"}},
+		{Addr: "10.0.0.4"},
+	}}
+	var joined []string
+	r := &retryJoiner{
+		cluster: "LAN",
+		addrs: []string{
+			`provider=tagged filter="role==consul-server,env==prod"`,
+			`provider=plain filter="role==consul-server"`,
+		},
+		interval: time.Millisecond,
+		logger:   log.New(ioutil.Discard, "", 0),
+		providers: map[string]discover.Provider{
+			"tagged": tagged,
+			"plain": &testDiscoverProvider{addrs: func(map[string]string) ([]string, error) {
+				return []string{"10.0.0.5"}, nil
+			}},
+		},
+		join: func(addrs []string) (int, error) {
+			joined = addrs
+			return len(addrs), nil
+		},
+	}
+	require.NoError(t, r.retryJoin())
+
+	// Only the tagged address matching every term is joined, and the
+	// provider without metadata bypasses the filter.
+	require.Equal(t, []string{"10.0.0.1", "10.0.0.5"}, joined)
+	require.Equal(t, map[string]string{"provider": "tagged"}, tagged.args)
+}
+
+func TestParseJoinFilter(t *testing.T) {
+	t.Parallel()
+
+	terms, err := parseJoinFilter("role==consul-server, env==prod")
+	require.NoError(t, err)
+	require.Equal(t, map[string]string{"role": "consul-server", "env": "prod"}, terms)
+
+	for _, filter := range []string{"", "role=consul-server", "==prod", "role==a,"} {
+		_, err := parseJoinFilter(filter)
+		require.Error(t, err, "filter %q", filter)
+	}
+}
+
+func TestRetryJoin_urls(t *testing.T) {
+	t.Parallel()
+
+	var discovered []map[string]string
+	var joined []string
+	r := &retryJoiner{
+		cluster: "LAN",
+		addrs: []string{
+			"https://10.0.0.1:8501?token=abc",
+			"consul://10.0.0.2",
+			"10.0.0.9:8301",
+			"ftp://10.0.0.3",
+		},
+		interval: time.Millisecond,
+		logger:   log.New(ioutil.Discard, "", 0),
+		providers: map[string]discover.Provider{
+			"consul": &testDiscoverProvider{addrs: func(args map[string]string) ([]string, error) {
+				discovered = append(discovered, args)
+				return []string{"discovered-from-" + args["address"]}, nil
+			}},
+		},
+		join: func(addrs []string) (int, error) {
+			joined = addrs
+			return len(addrs), nil
+		},
+	}
+	require.NoError(t, r.retryJoin())
+
+	// URLs are discovered from over the HTTP API, plain addresses are
+	// joined directly and the unsupported scheme is skipped.
+	require.Equal(t, []map[string]string{
+		{"provider": "consul", "address": "10.0.0.1:8501", "scheme": "https", "token": "abc"},
+		{"provider": "consul", "address": "10.0.0.2:8500", "scheme": "http"},
+	}, discovered)
+	require.Equal(t, []string{
+		"discovered-from-10.0.0.1:8501",
+		"discovered-from-10.0.0.2:8500",
+		"10.0.0.9:8301",
+	}, joined)
+}
+
+func TestJoinURLConfig(t *testing.T) {
+	t.Parallel()
+
+	cases := map[string]string{
+		"http://10.0.0.1:8500":            "provider=consul address=10.0.0.1:8500 scheme=http",
+		"https://consul.internal/":        "provider=consul address=consul.internal scheme=https",
+		"consul://[::1]":                  "provider=consul address=[::1]:8500 scheme=http",
+		"consul://10.0.0.1:9500":          "provider=consul address=10.0.0.1:9500 scheme=http",
+		"http://h:1?filter=env%3D%3Dprod": `provider=consul address=h:1 filter="env==prod" scheme=http`,
+	}
+	for in, want := range cases {
+		got, err := joinURLConfig(in)
+		require.NoError(t, err, in)
+		require.Equal(t, want, got, in)
+		_, err = discover.Parse(got)
+		require.NoError(t, err, in)
+	}
+
+	for _, in := range []string{"ftp://10.0.0.1", "http://", "http://10.0.0.1/v1/agent", "http://[::1"} {
+		_, err := joinURLConfig(in)
+		require.Error(t, err, in)
+	}
+}
+
+func TestParseJoinAddr(t *testing.T) {
+	t.Parallel()
+
+	cases := map[string]parsedJoinAddr{
+		"10.0.0.1":                       {addr: "10.0.0.1"},
+		" 10.0.0.1:8301 ":                {addr: "10.0.0.1:8301"},
+		"consul.internal":                {addr: "consul.internal"},
+		"consul.internal:8301":           {addr: "consul.internal:8301"},
+		"::1":                            {addr: "::1"},
+		"[::1]":                          {addr: "::1"},
+		"[::1]:8301":                     {addr: "[::1]:8301"},
+		"[fe80::1%eth0]:8301":            {addr: "[fe80::1%eth0]:8301"},
+		"provider=aws tag_key=k":         {config: "provider=aws tag_key=k", provider: "aws"},
+		`provider=consul filter="a==b"`:  {config: `provider=consul filter="a==b"`, provider: "consul"},
+		"https://10.0.0.1:8501?token=ab": {config: "provider=consul address=10.0.0.1:8501 scheme=https token=ab", provider: "consul"},
+	}
+	for in, want := range cases {
+		got, err := parseJoinAddr(in)
+		require.NoError(t, err, in)
+		require.Equal(t, want, got, in)
+
+		// Parsing is stable on the normalized entry.
+		again, err := parseJoinAddr(got.String())
+		require.NoError(t, err, in)
+		require.Equal(t, got, again, in)
+	}
+
+	for _, in := range []string{
+		"", "  ", "10.0.0.1:", ":8301", "10.0.0.1:0", "10.0.0.1:65536", "10.0.0.1:http",
+		"10.0.0.1 10.0.0.2", "[10.0.0.1]", "[::1", "::1]:8301", "a/b", "1:2:3:x",
+		"provider=", `provider="aws`, "tag_key=k provider", "ftp://10.0.0.1", "\x00",
+	} {
+		_, err := parseJoinAddr(in)
+		require.Error(t, err, in)
+	}
+}
+
+func TestRetryJoin_batches(t *testing.T) {
+	t.Parallel()
+
+	var resolved []string
+	for i := 0; i < 45; i++ {
+		resolved = append(resolved, fmt.Sprintf("10.0.%d.%d", i/10, i%10))
+	}
+
+	// The first batch fails and the second syncs with too few agents, so
+	// the third completes the join and the rest aren't tried.
+	var batches [][]string
+	r := &retryJoiner{
+		cluster:    "LAN",
+		addrs:      []string{"provider=test"},
+		batchSize:  10,
+		minServers: 3,
+		interval:   time.Millisecond,
+		logger:     log.New(ioutil.Discard, "", 0),
+		providers: map[string]discover.Provider{
+			"test": &testDiscoverProvider{addrs: func(map[string]string) ([]string, error) {
+				return resolved, nil
+			}},
+		},
+		join: func(addrs []string) (int, error) {
+			batches = append(batches, addrs)
+			switch len(batches) {
+			case 1:
+				return 0, fmt.Errorf("no route to host")
+			case 2:
+				return 1, nil
+			default:
+				return 2, nil
+			}
+		},
+	}
+	require.NoError(t, r.retryJoin())
+	require.Equal(t, [][]string{resolved[:10], resolved[10:20], resolved[20:30]}, batches)
+
+	// When every batch fails the attempt fails with the last error, the
+	// final batch holding the remainder.
+	batches = nil
+	r.maxAttempts = 0
+	r.failFast = true
+	r.join = func(addrs []string) (int, error) {
+		batches = append(batches, addrs)
+		return 0, fmt.Errorf("no route to host (%d)", len(batches))
+	}
+	require.EqualError(t, r.retryJoin(), "agent: join LAN failed: no route to host (5)")
+	require.Len(t, batches, 5)
+	require.Equal(t, resolved[40:], batches[4])
+}
+
+func TestRetryJoin_hints(t *testing.T) {
+	t.Parallel()
+
+	dir := testutil.TempDir(t, "retry-join-hints")
+	defer os.RemoveAll(dir)
+	hintsFile := filepath.Join(dir, "retry_join", "lan.json")
+
+	var joined [][]string
+	joiner := func() *retryJoiner {
+		return &retryJoiner{
+			cluster:   "LAN",
+			addrs:     []string{"provider=test"},
+			interval:  time.Millisecond,
+			hintsFile: hintsFile,
+			logger:    log.New(ioutil.Discard, "", 0),
+			providers: map[string]discover.Provider{
+				"test": &testDiscoverProvider{addrs: func(map[string]string) ([]string, error) {
+					return []string{"10.0.0.1", "10.0.0.2"}, nil
+				}},
+			},
+			join: func(addrs []string) (int, error) {
+				joined = append(joined, addrs)
+				if addrs[0] == "10.0.0.9" {
+					return 0, fmt.Errorf("no route to host")
+				}
+				return len(addrs), nil
+			},
+		}
+	}
+
+	// Without hints the join discovers the servers and saves them
+	require.NoError(t, joiner().retryJoin())
+	require.Equal(t, [][]string{{"10.0.0.1", "10.0.0.2"}}, joined)
+	data, err := ioutil.ReadFile(hintsFile)
+	require.NoError(t, err)
+	require.JSONEq(t, `["10.0.0.1","10.0.0.2"]`, string(data))
+
+	// After a restart the hinted servers are tried first
+	require.NoError(t, ioutil.WriteFile(hintsFile, []byte(`["10.0.0.2"]`), 0600))
+	joined = nil
+	require.NoError(t, joiner().retryJoin())
+	require.Equal(t, [][]string{{"10.0.0.2"}}, joined)
+
+	// Hints that fail fall back to discovery
+	require.NoError(t, ioutil.WriteFile(hintsFile, []byte(`["10.0.0.9"]`), 0600))
+	joined = nil
+	require.NoError(t, joiner().retryJoin())
+	require.Equal(t, [][]string{{"10.0.0.9"}, {"10.0.0.1", "10.0.0.2"}}, joined)
+	data, err = ioutil.ReadFile(hintsFile)
+	require.NoError(t, err)
+	require.JSONEq(t, `["10.0.0.1","10.0.0.2"]`, string(data))
+}
+
+func TestRetryJoin_credential(t *testing.T) {
+	t.Parallel()
+
+	// The credential can't be fetched at first
+	var buf bytes.Buffer
+	calls := 0
+	var tokens []string
+	joins := 0
+	r := &retryJoiner{
+		cluster: "LAN",
+		addrs: []string{
+			"provider=consul address=10.0.0.1:8500",
+			"provider=consul address=10.0.0.2:8500 token=explicit",
+			"provider=test",
+		},
+		interval: time.Millisecond,
+		logger:   log.New(&buf, "", 0),
+		credential: func() (string, error) {
+			calls++
+			if calls == 1 {
+				return "", fmt.Errorf("secrets API unavailable")
+			}
+			return "bootstrap-token", nil
+		},
+		providers: map[string]discover.Provider{
+			"consul": &testDiscoverProvider{addrs: func(args map[string]string) ([]string, error) {
+				tokens = append(tokens, args["address"]+"="+args["token"])
+				return []string{args["address"]}, nil
+			}},
+			"test": &testDiscoverProvider{addrs: func(args map[string]string) ([]string, error) {
+				require.Empty(t, args["token"])
+				return []string{"10.0.0.3"}, nil
+			}},
+		},
+		join: func(addrs []string) (int, error) {
+			joins++
+			if joins < 3 {
+				return 0, fmt.Errorf("no route to host")
+			}
+			return len(addrs), nil
+		},
+	}
+	require.NoError(t, r.retryJoin())
+
+	// The failure is retried, and the token is then reused between
+	// attempts and given only to entries without their own
+	require.Equal(t, 2, calls)
+	require.Equal(t, []string{
+		"10.0.0.2:8500=explicit",
+		"10.0.0.1:8500=bootstrap-token", "10.0.0.2:8500=explicit",
+		"10.0.0.1:8500=bootstrap-token", "10.0.0.2:8500=explicit",
+	}, tokens)
+	require.Contains(t, buf.String(), "failed fetching join credential: secrets API unavailable")
+	require.NotContains(t, buf.String(), "bootstrap-token")
+}
+
+func TestRetryJoin_skipsSelf(t *testing.T) {
+	t.Parallel()
+
+	lookup := func(host string) ([]string, error) {
+		switch host {
+		case "me.example.com":
+			return []string{"10.0.0.1"}, nil
+		case "servers.example.com":
+			return []string{"10.0.0.1", "10.0.0.2"}, nil
+		default:
+			return nil, fmt.Errorf("no such host %s", host)
+		}
+	}
+	run := func(t *testing.T, discovered []string) []string {
+		var joined []string
+		r := &retryJoiner{
+			cluster:    "LAN",
+			addrs:      []string{"provider=test"},
+			interval:   time.Millisecond,
+			logger:     log.New(ioutil.Discard, "", 0),
+			self:       &net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 8301},
+			lookupHost: lookup,
+			providers: map[string]discover.Provider{
+				"test": &testDiscoverProvider{addrs: func(args map[string]string) ([]string, error) {
+					return discovered, nil
+				}},
+			},
+			join: func(addrs []string) (int, error) {
+				joined = addrs
+				return len(addrs), nil
+			},
+		}
+		require.NoError(t, r.retryJoin())
+		return joined
+	}
+
+	t.Run("self excluded", func(t *testing.T) {
+		joined := run(t, []string{
+			"10.0.0.1", "10.0.0.1:8301", "me.example.com", "me.example.com:8301",
+			"10.0.0.1:8302", "servers.example.com", "10.0.0.3", "unknown.example.com",
+		})
+		require.Equal(t, []string{
+			"10.0.0.1:8302", "servers.example.com", "10.0.0.3", "unknown.example.com",
+		}, joined)
+	})
+
+	t.Run("only self", func(t *testing.T) {
+		joined := run(t, []string{"10.0.0.1", "me.example.com"})
+		require.Equal(t, []string{"10.0.0.1", "me.example.com"}, joined)
+	})
+}
@@ -107,6 +107,26 @@ type CARoot struct {
 // CARoots is a list of CARoot structures.
 type CARoots []*CARoot
 
+// Active returns the active root, or nil if there isn't one, along with how
+// many roots are marked active. There should never be more than one, but if
+// there are the most recently created is returned regardless of their order,
+// and callers can use the count to report the anomaly.
+func (c CARoots) Active() (*CARoot, int) {
+	var active *CARoot
+	count := 0
+	for _, r := range c {
+		if !r.Active {
+			continue
+		}
+		count++
+		if active == nil || r.CreateIndex > active.CreateIndex ||
+			(r.CreateIndex == active.CreateIndex && r.ID > active.ID) {
+			active = r
+		}
+	}
+	return active, count
+}
+
 // CASignRequest is the request for signing a service certificate.
 type CASignRequest struct {
 	// Datacenter is the target for this request.
@@ -115,6 +135,21 @@ type CASignRequest struct {
 	// CSR is the PEM-encoded CSR.
 	CSR string
 
+	// NotBefore optionally requests a cert that only becomes valid at the
+	// given time. The server may not support it, in which case the cert is
+	// valid straight away.
+	NotBefore time.Time `json:",omitempty"`
+
+	// Usage optionally requests a cert whose extended key usage is limited
+	// to "client" or "server" authentication. The server may not support
+	// it, in which case the cert is usable as both.
+	Usage string `json:",omitempty"`
+
+	// OnBehalfOf optionally names the identity the cert is requested for
+	// when the request's token belongs to another, delegating identity. The
+	// server decides whether the token may request certs on its behalf.
+	OnBehalfOf string `json:",omitempty"`
+
 	// WriteRequest is a common struct containing ACL tokens and other
 	// write-related common elements for requests.
 	WriteRequest
@@ -137,6 +172,11 @@ type IssuedCert struct {
 	CertPEM       string `json:",omitempty"`
 	PrivateKeyPEM string `json:",omitempty"`
 
+	// PKCS12 is an optional PKCS#12 bundle of the cert, its chain and the
+	// private key, added by the agent when requested. Like PrivateKeyPEM it
+	// is never stored in the state store.
+	PKCS12 []byte `json:",omitempty"`
+
 	// Service is the name of the service for which the cert was issued.
 	// ServiceURI is the cert URI value.
 	Service    string
@@ -147,6 +187,22 @@ type IssuedCert struct {
 	ValidAfter  time.Time
 	ValidBefore time.Time
 
+	// IssuedAt and FreshnessToken are optional freshness information from
+	// the server that signed the certificate, so proxies can report when
+	// the leaf was last verified without contacting the CA. They are left
+	// empty if the server doesn't provide them.
+	IssuedAt       time.Time `json:",omitempty"`
+	FreshnessToken string    `json:",omitempty"`
+
+	// SignedBy is the node name of the server that signed the certificate,
+	// for audit trails. It's empty if the server doesn't report it.
+	SignedBy string `json:",omitempty"`
+
+	// Expired is set by the agent on a cert it's still serving after
+	// ValidBefore because it couldn't be renewed in time, which is only done
+	// within an opt-in emergency grace period. Servers never set it.
+	Expired bool `json:",omitempty"`
+
 	RaftIndex
 }
 
@@ -56,3 +56,35 @@ func TestCAConfiguration_GetCommonConfig(t *testing.T) {
 		})
 	}
 }
+
+func TestCARoots_Active(t *testing.T) {
+	root := func(id string, idx uint64, active bool) *CARoot {
+		return &CARoot{ID: id, Active: active, RaftIndex: RaftIndex{CreateIndex: idx}}
+	}
+
+	tests := []struct {
+		name      string
+		roots     CARoots
+		wantID    string
+		wantCount int
+	}{
+		{"none", nil, "", 0},
+		{"no active", CARoots{root("a", 1, false)}, "", 0},
+		{"one active", CARoots{root("a", 1, false), root("b", 2, true)}, "b", 1},
+		{"two active newest first", CARoots{root("new", 5, true), root("old", 2, true)}, "new", 2},
+		{"two active newest last", CARoots{root("old", 2, true), root("new", 5, true)}, "new", 2},
+		{"two active same index", CARoots{root("b", 3, true), root("a", 3, true)}, "b", 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			active, count := tt.roots.Active()
+			require.Equal(t, tt.wantCount, count)
+			if tt.wantID == "" {
+				require.Nil(t, active)
+				return
+			}
+			require.NotNil(t, active)
+			require.Equal(t, tt.wantID, active.ID)
+		})
+	}
+}
@@ -109,6 +109,17 @@ type LeafCert struct {
 	ValidAfter  time.Time
 	ValidBefore time.Time
 
+	// IssuedAt and FreshnessToken are optional freshness information from
+	// the server that signed the certificate, so proxies can report when
+	// the leaf was last verified without contacting the CA. They are left
+	// empty if the server doesn't provide them.
+	IssuedAt       time.Time `json:",omitempty"`
+	FreshnessToken string    `json:",omitempty"`
+
+	// SignedBy is the node name of the server that signed the certificate,
+	// for audit trails. It's empty if the server doesn't report it.
+	SignedBy string `json:",omitempty"`
+
 	CreateIndex uint64
 	ModifyIndex uint64
 }